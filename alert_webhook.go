@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// alertWebhook posts to webhook when replayed request gets response with concerning status, or is too slow.
+// Alerts are sent at most once per interval, number of suppressed alerts is reported with the next one.
+type alertWebhook struct {
+	url      string
+	target   string
+	statuses []string
+	latency  time.Duration
+	interval time.Duration
+	client   *http.Client
+
+	mu         sync.Mutex
+	lastSent   time.Time
+	suppressed int
+}
+
+// alertMessage has "text" field, so it can be posted to Slack-compatible webhooks as is
+type alertMessage struct {
+	Text       string `json:"text"`
+	Target     string `json:"target"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Status     string `json:"status"`
+	LatencyMs  int64  `json:"latency_ms"`
+	Suppressed int    `json:"suppressed"`
+}
+
+// newAlertWebhook parses statuses in "5xx,404" format: exact codes or classes of codes
+func newAlertWebhook(url, target, statuses string, latency, interval time.Duration) (*alertWebhook, error) {
+	a := &alertWebhook{
+		url:      url,
+		target:   target,
+		latency:  latency,
+		interval: interval,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+
+	for _, s := range strings.Split(statuses, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			continue
+		}
+
+		if len(s) != 3 || s[0] < '1' || s[0] > '5' || (s[1:] != "xx" && strings.Trim(s[1:], "0123456789") != "") {
+			return nil, fmt.Errorf("wrong status %q, should be code like 503 or class like 5xx", s)
+		}
+
+		a.statuses = append(a.statuses, s)
+	}
+
+	if len(a.statuses) == 0 && a.latency == 0 {
+		return nil, errors.New("requires --alert-on-status or --alert-on-latency")
+	}
+
+	return a, nil
+}
+
+func (a *alertWebhook) matchStatus(status []byte) bool {
+	if len(status) != 3 {
+		return false
+	}
+
+	for _, s := range a.statuses {
+		if s[0] == status[0] && (s[1] == 'x' || s[1:] == string(status[1:])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check sends alert if response is concerning, and alert was not sent during last interval
+func (a *alertWebhook) Check(request, response []byte, latency time.Duration) {
+	status := proto.Status(response)
+
+	var reason string
+	switch {
+	case a.matchStatus(status):
+		reason = "status " + string(status)
+	case a.latency > 0 && latency > a.latency:
+		reason = "latency " + latency.String()
+	default:
+		return
+	}
+
+	a.mu.Lock()
+	if time.Since(a.lastSent) < a.interval {
+		a.suppressed++
+		a.mu.Unlock()
+		return
+	}
+	suppressed := a.suppressed
+	a.suppressed = 0
+	a.lastSent = time.Now()
+	a.mu.Unlock()
+
+	msg := alertMessage{
+		Method:     string(proto.Method(request)),
+		Path:       string(proto.Path(request)),
+		Status:     string(status),
+		Target:     a.target,
+		LatencyMs:  int64(latency / time.Millisecond),
+		Suppressed: suppressed,
+	}
+	msg.Text = fmt.Sprintf("[GoReplay] %s %s to %s: %s", msg.Method, msg.Path, a.target, reason)
+	if suppressed > 0 {
+		msg.Text += fmt.Sprintf(" (%d more alerts suppressed)", suppressed)
+	}
+
+	// Replay should not wait for webhook
+	go a.send(&msg)
+}
+
+func (a *alertWebhook) send(msg *alertMessage) {
+	body, _ := json.Marshal(msg)
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("[ALERT] Error sending webhook:", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Println("[ALERT] Webhook returned status", resp.StatusCode)
+	}
+}
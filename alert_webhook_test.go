@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAlertWebhook(t *testing.T) {
+	alerts := make(chan alertMessage, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg alertMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		alerts <- msg
+	}))
+	defer server.Close()
+
+	a, err := newAlertWebhook(server.URL, "staging", "5xx, 404", time.Second, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := []byte("GET /users HTTP/1.1\r\n\r\n")
+
+	a.Check(req, []byte("HTTP/1.1 200 OK\r\n\r\n"), time.Millisecond)
+	a.Check(req, []byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"), time.Millisecond)
+	// Suppressed by rate limit
+	a.Check(req, []byte("HTTP/1.1 404 Not Found\r\n\r\n"), time.Millisecond)
+
+	msg := <-alerts
+	if msg.Status != "503" || msg.Path != "/users" || msg.Target != "staging" || msg.Suppressed != 0 {
+		t.Errorf("Wrong alert: %+v", msg)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	a.Check(req, []byte("HTTP/1.1 200 OK\r\n\r\n"), 2*time.Second)
+
+	msg = <-alerts
+	if msg.Status != "200" || msg.LatencyMs != 2000 || msg.Suppressed != 1 {
+		t.Errorf("Should alert on latency, and report suppressed alerts: %+v", msg)
+	}
+
+	select {
+	case msg = <-alerts:
+		t.Errorf("Unexpected alert: %+v", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestAlertWebhookStatuses(t *testing.T) {
+	for _, statuses := range []string{"5x", "5x3", "xxx", "600", "abc"} {
+		if _, err := newAlertWebhook("", "", statuses, 0, 0); err == nil {
+			t.Error("Should reject", statuses)
+		}
+	}
+
+	if _, err := newAlertWebhook("", "", "", 0, 0); err == nil {
+		t.Error("Should require status or latency")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/metrics"
+)
+
+const (
+	// Error rate is calculated over this number of last requests
+	cbWindow = 100
+	// Breaker is not opened until at least this number of requests is sent
+	cbMinRequests = 20
+)
+
+// States of circuit breaker, values are reported to metrics
+const (
+	cbClosed   = 0
+	cbOpen     = 1
+	cbHalfOpen = 2
+)
+
+// circuitBreaker stops sending requests to the target when share of failed requests reaches threshold.
+// After cooldown single request is let through, and if it succeeds sending resumes, otherwise breaker opens again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	target    string
+	threshold float64
+	cooldown  time.Duration
+
+	// Outcomes of last requests
+	window outcomeWindow
+
+	state    int
+	openedAt time.Time
+	// Set while request sent in half-open state waits for response
+	probing bool
+}
+
+func newCircuitBreaker(target string, threshold float64, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{target: target, threshold: threshold, cooldown: cooldown}
+	b.report()
+
+	return b
+}
+
+// Allow tells if request can be sent
+func (b *circuitBreaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case cbOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		Debug("[OUTPUT-HTTP] Circuit breaker is half-open, probing", b.target)
+		b.state = cbHalfOpen
+		b.probing = true
+		b.report()
+		return true
+	case cbHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+
+	return true
+}
+
+// Record takes outcome of request allowed by Allow
+func (b *circuitBreaker) Record(failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case cbHalfOpen:
+		b.probing = false
+		if failed {
+			b.open(now)
+		} else {
+			Debug("[OUTPUT-HTTP] Circuit breaker is closed", b.target)
+			b.state = cbClosed
+			b.window = outcomeWindow{}
+		}
+	case cbClosed:
+		b.window.Add(failed)
+
+		if b.window.count >= cbMinRequests && b.window.Rate() >= b.threshold {
+			b.open(now)
+		}
+	default:
+		// Requests sent before breaker opened
+		return
+	}
+
+	b.report()
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	Debug("[OUTPUT-HTTP] Circuit breaker is open, error rate:", b.window.Rate(), b.target)
+	b.state = cbOpen
+	b.openedAt = now
+}
+
+func (b *circuitBreaker) report() {
+	metrics.SetCircuitBreaker(b.target, b.state, b.window.Rate())
+}
+
+// outcomeWindow keeps outcomes of last cbWindow requests to calculate error rate
+type outcomeWindow struct {
+	// True if request failed
+	results  [cbWindow]bool
+	pos      int
+	count    int
+	failures int
+}
+
+// Add records outcome of request, replacing the oldest one if window is full
+func (w *outcomeWindow) Add(failed bool) {
+	if w.results[w.pos] && w.count == cbWindow {
+		w.failures--
+	}
+	w.results[w.pos] = failed
+	w.pos = (w.pos + 1) % cbWindow
+	if w.count < cbWindow {
+		w.count++
+	}
+	if failed {
+		w.failures++
+	}
+}
+
+// Rate returns share of failed requests in the window
+func (w *outcomeWindow) Rate() float64 {
+	if w.count == 0 {
+		return 0
+	}
+
+	return float64(w.failures) / float64(w.count)
+}
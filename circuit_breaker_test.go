@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker("staging", 0.5, time.Second)
+	now := time.Now()
+
+	// Not enough requests to judge the rate
+	for i := 0; i < cbMinRequests-1; i++ {
+		b.Record(true, now)
+	}
+	if !b.Allow(now) {
+		t.Fatal("Breaker should not open before min number of requests")
+	}
+
+	b = newCircuitBreaker("staging", 0.5, time.Second)
+	for i := 0; i < cbWindow; i++ {
+		b.Record(i%3 == 0, now)
+	}
+	if !b.Allow(now) {
+		t.Fatal("Breaker should stay closed below threshold")
+	}
+
+	for i := 0; i < cbWindow/2; i++ {
+		b.Record(true, now)
+	}
+	if b.Allow(now) {
+		t.Fatal("Breaker should open when error rate reaches threshold")
+	}
+
+	now = now.Add(time.Second)
+	if !b.Allow(now) {
+		t.Fatal("Single request should be let through after cooldown")
+	}
+	if b.Allow(now) {
+		t.Fatal("Only one request should be sent in half-open state")
+	}
+
+	b.Record(true, now)
+	if b.Allow(now.Add(time.Millisecond)) {
+		t.Fatal("Failed probe should open breaker again")
+	}
+
+	now = now.Add(time.Second)
+	b.Allow(now)
+	b.Record(false, now)
+	for i := 0; i < 10; i++ {
+		if !b.Allow(now) {
+			t.Fatal("Successful probe should close breaker")
+		}
+	}
+}
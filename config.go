@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configEntry is a single option read from config file.
+// Key is the name of command line flag, repeatable flags can have multiple values.
+type configEntry struct {
+	key    string
+	values []string
+}
+
+// LoadConfigFile reads settings from YAML or TOML file.
+// Config keys are the same as flag names, nested sections are joined with "-", so both
+//
+//	output-http-workers: 10
+//
+// and
+//
+//	output-http:
+//	  workers: 10
+//
+// set --output-http-workers. Repeatable flags, like --output-http, accept arrays.
+// Flags explicitly set in the command line override values from the file.
+func LoadConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var entries []configEntry
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		entries, err = parseYAMLConfig(data)
+	case ".toml":
+		entries, err = parseTOMLConfig(data)
+	default:
+		return errors.New("unknown config format, expected .yaml, .yml or .toml file: " + path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return applyConfig(flag.CommandLine, entries)
+}
+
+func applyConfig(fs *flag.FlagSet, entries []configEntry) error {
+	setInCLI := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setInCLI[f.Name] = true
+	})
+
+	for _, e := range entries {
+		name := strings.Replace(e.key, "_", "-", -1)
+
+		if name == "config" {
+			continue
+		}
+
+		if fs.Lookup(name) == nil {
+			return errors.New("unknown config option: " + e.key)
+		}
+
+		if setInCLI[name] {
+			continue
+		}
+
+		for _, v := range e.values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value %q for %s: %v", v, e.key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseYAMLConfig parses subset of YAML used for configs: mappings, lists and scalars.
+// Anchors, multi-line strings and flow mappings are not supported.
+func parseYAMLConfig(data []byte) (entries []configEntry, err error) {
+	type section struct {
+		indent int
+		prefix string
+	}
+
+	var stack []section
+	// Key without value, which can be followed by list items
+	var listKey string
+	listIdx := -1
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+
+		line := stripConfigComment(scanner.Text())
+		text := strings.TrimSpace(line)
+		if text == "" || text == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", lineNo)
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item without key", lineNo)
+			}
+
+			value, err := parseConfigScalar(strings.TrimSpace(text[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+
+			if listIdx == -1 {
+				entries = append(entries, configEntry{key: listKey})
+				listIdx = len(entries) - 1
+			}
+			entries[listIdx].values = append(entries[listIdx].values, value)
+			continue
+		}
+
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		prefix := ""
+		if len(stack) > 0 {
+			prefix = stack[len(stack)-1].prefix
+		}
+
+		colon := strings.Index(text, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("line %d: expected 'key: value'", lineNo)
+		}
+
+		key, err := parseConfigScalar(strings.TrimSpace(text[:colon]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		key = prefix + key
+		rest := strings.TrimSpace(text[colon+1:])
+
+		listKey = ""
+		listIdx = -1
+
+		if rest == "" {
+			stack = append(stack, section{indent, key + "-"})
+			listKey = key
+			continue
+		}
+
+		values, err := parseConfigValue(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+
+		entries = append(entries, configEntry{key, values})
+	}
+
+	return entries, scanner.Err()
+}
+
+// parseTOMLConfig parses subset of TOML used for configs: tables, key/value pairs, strings, numbers, booleans and arrays.
+func parseTOMLConfig(data []byte) (entries []configEntry, err error) {
+	prefix := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+
+		text := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[[") {
+			return nil, fmt.Errorf("line %d: arrays of tables are not supported", lineNo)
+		}
+
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("line %d: malformed table header", lineNo)
+			}
+
+			prefix = ""
+			for _, part := range strings.Split(text[1:len(text)-1], ".") {
+				name, err := parseConfigScalar(strings.TrimSpace(part))
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNo, err)
+				}
+				prefix += name + "-"
+			}
+			continue
+		}
+
+		eq := strings.Index(text, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("line %d: expected 'key = value'", lineNo)
+		}
+
+		key, err := parseConfigScalar(strings.TrimSpace(text[:eq]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		rest := strings.TrimSpace(text[eq+1:])
+
+		// Multi-line arrays
+		for strings.HasPrefix(rest, "[") && !closedConfigArray(rest) && scanner.Scan() {
+			lineNo++
+			rest += " " + strings.TrimSpace(stripConfigComment(scanner.Text()))
+		}
+
+		values, err := parseConfigValue(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+
+		entries = append(entries, configEntry{prefix + key, values})
+	}
+
+	return entries, scanner.Err()
+}
+
+// stripConfigComment removes '#' comment, ignoring '#' inside quoted strings
+func stripConfigComment(line string) string {
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+func closedConfigArray(value string) bool {
+	_, err := splitConfigArray(value)
+	return err == nil
+}
+
+// parseConfigValue parses scalar or inline array
+func parseConfigValue(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		v, err := parseConfigScalar(value)
+		return []string{v}, err
+	}
+
+	items, err := splitConfigArray(value)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{}
+	for _, item := range items {
+		v, err := parseConfigScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// splitConfigArray splits "[a, 'b', "c"]" into items, respecting quotes
+func splitConfigArray(value string) (items []string, err error) {
+	if !strings.HasSuffix(value, "]") {
+		return nil, errors.New("unclosed array")
+	}
+
+	var quote byte
+	start := 1
+
+	for i := 1; i < len(value)-1; i++ {
+		c := value[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == ']':
+			return nil, errors.New("nested arrays are not supported")
+		case c == ',':
+			items = append(items, strings.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unclosed quote")
+	}
+
+	// Trailing comma is allowed
+	if last := strings.TrimSpace(value[start : len(value)-1]); last != "" {
+		items = append(items, last)
+	}
+
+	return items, nil
+}
+
+func parseConfigScalar(value string) (string, error) {
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '"' && value[len(value)-1] == '"':
+			return strconv.Unquote(value)
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+		}
+	}
+
+	if strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'") {
+		return "", errors.New("unclosed quote: " + value)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testConfigFlagSet() (*flag.FlagSet, *MultiOption, *int, *time.Duration, *bool) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+
+	outputs := &MultiOption{}
+	fs.Var(outputs, "output-http", "")
+	workers := fs.Int("output-http-workers", 0, "")
+	timeout := fs.Duration("output-http-timeout", time.Second, "")
+	verbose := fs.Bool("verbose", false, "")
+
+	return fs, outputs, workers, timeout, verbose
+}
+
+func TestConfigYAML(t *testing.T) {
+	config := `
+# Replay to staging
+verbose: true
+output-http:
+  - "http://staging.com" # main target
+  - http://dev.com#anchor
+output-http:
+  workers: 10
+  timeout: 30s
+`
+	entries, err := parseYAMLConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, outputs, workers, timeout, verbose := testConfigFlagSet()
+	if err := applyConfig(fs, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual([]string(*outputs), []string{"http://staging.com", "http://dev.com#anchor"}) {
+		t.Error("Wrong outputs:", *outputs)
+	}
+
+	if *workers != 10 || *timeout != 30*time.Second || !*verbose {
+		t.Error("Wrong settings:", *workers, *timeout, *verbose)
+	}
+}
+
+func TestConfigTOML(t *testing.T) {
+	config := `
+verbose = true
+output-http = [
+  "http://staging.com",
+  'http://dev.com', # comment
+]
+
+[output-http]
+workers = 10
+timeout = "30s"
+`
+	entries, err := parseTOMLConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, outputs, workers, timeout, _ := testConfigFlagSet()
+
+	// Command line has priority over config
+	fs.Parse([]string{"-output-http-workers", "5", "-output-http", "http://cli.com"})
+
+	if err := applyConfig(fs, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual([]string(*outputs), []string{"http://cli.com"}) {
+		t.Error("Wrong outputs:", *outputs)
+	}
+
+	if *workers != 5 || *timeout != 30*time.Second {
+		t.Error("Wrong settings:", *workers, *timeout)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	fs, _, _, _, _ := testConfigFlagSet()
+
+	entries, _ := parseYAMLConfig([]byte("unknown-option: 1"))
+	if err := applyConfig(fs, entries); err == nil {
+		t.Error("Should fail on unknown option")
+	}
+
+	entries, _ = parseYAMLConfig([]byte("output-http-workers: many"))
+	if err := applyConfig(fs, entries); err == nil {
+		t.Error("Should fail on invalid value")
+	}
+
+	if _, err := parseTOMLConfig([]byte("output-http = [\"a\"")); err == nil {
+		t.Error("Should fail on unclosed array")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"math/rand"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+// Placeholder for column value of current data row: {{csv:column_name}}
+var csvTemplateRegexp = regexp.MustCompile(`\{\{csv:([^}]+)\}\}`)
+
+// csvDataSource holds rows of --data-file, which are used to fill templates of --http-set-header and --http-set-param.
+// First line of the file should contain column names.
+type csvDataSource struct {
+	columns map[string]int
+	rows    [][]string
+	random  bool
+	next    uint64
+}
+
+func newCSVDataSource(path string, random bool) (*csvDataSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) < 2 {
+		return nil, errors.New("file should contain header line and at least one row")
+	}
+
+	d := &csvDataSource{columns: make(map[string]int), rows: records[1:], random: random}
+	for idx, name := range records[0] {
+		d.columns[name] = idx
+	}
+
+	return d, nil
+}
+
+var csvDataSourcesMu sync.Mutex
+
+// Each emitter has own modifier, so sources are shared by file path to cycle through rows once for all of them
+var csvDataSources = make(map[string]*csvDataSource)
+
+func sharedCSVDataSource(path string, random bool) (*csvDataSource, error) {
+	csvDataSourcesMu.Lock()
+	defer csvDataSourcesMu.Unlock()
+
+	if d, ok := csvDataSources[path]; ok {
+		return d, nil
+	}
+
+	d, err := newCSVDataSource(path, random)
+	if err != nil {
+		return nil, err
+	}
+	csvDataSources[path] = d
+
+	return d, nil
+}
+
+// Row returns next row, rows are cycled in order, or picked randomly
+func (d *csvDataSource) Row() []string {
+	if d.random {
+		return d.rows[rand.Intn(len(d.rows))]
+	}
+
+	n := atomic.AddUint64(&d.next, 1) - 1
+
+	return d.rows[n%uint64(len(d.rows))]
+}
+
+// Validate checks that all placeholders in template reference existing columns
+func (d *csvDataSource) Validate(template string) error {
+	for _, m := range csvTemplateRegexp.FindAllStringSubmatch(template, -1) {
+		if _, ok := d.columns[m[1]]; !ok {
+			return errors.New("unknown column: " + m[1])
+		}
+	}
+
+	return nil
+}
+
+// Expand replaces placeholders in template with values of the row, escaped by `escape` function if it is set.
+// Missing values, for rows shorter than header, are replaced with empty string.
+func (d *csvDataSource) Expand(template string, row []string, escape func(string) string) string {
+	return csvTemplateRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := csvTemplateRegexp.FindStringSubmatch(placeholder)[1]
+
+		if idx, ok := d.columns[name]; ok && idx < len(row) {
+			if escape != nil {
+				return escape(row[idx])
+			}
+			return row[idx]
+		}
+
+		return ""
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTempCSV(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "gor_data_*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+
+	return f.Name()
+}
+
+func TestCSVDataSource(t *testing.T) {
+	name := writeTempCSV(t, "user_id,token\n1,a\n2,b\n3\n")
+	defer os.Remove(name)
+
+	d, err := newCSVDataSource(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var values []string
+	for i := 0; i < 4; i++ {
+		values = append(values, d.Expand("{{csv:user_id}}-{{csv:token}}", d.Row(), nil))
+	}
+
+	expected := []string{"1-a", "2-b", "3-", "1-a"}
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], values[i])
+		}
+	}
+
+	if err = d.Validate("{{csv:user}}"); err == nil {
+		t.Error("Should fail on unknown column")
+	}
+
+	if err = d.Validate("Bearer {{csv:token}}"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCSVDataSourceEmpty(t *testing.T) {
+	name := writeTempCSV(t, "user_id\n")
+	defer os.Remove(name)
+
+	if _, err := newCSVDataSource(name, false); err == nil {
+		t.Error("Should fail on file without rows")
+	}
+}
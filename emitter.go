@@ -2,51 +2,44 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/buger/goreplay/proto"
 )
 
 // Start initialize loop for sending data from inputs to outputs
 func Start(plugins *InOutPlugins, stop chan int) {
-	if Settings.middleware != "" {
-		middleware := NewMiddleware(Settings.middleware)
+	if len(Settings.middleware) > 0 {
+		middleware := NewMiddlewareChain(Settings.middleware)
 
 		for _, in := range plugins.Inputs {
-			middleware.ReadFrom(in)
+			middleware.ReadInputFrom(in)
 		}
 
-		// We are going only to read responses, so using same ReadFrom method
+		// We are going only to read responses, they go through the chain in reverse
 		for _, out := range plugins.Outputs {
 			if r, ok := out.(io.Reader); ok {
-				middleware.ReadFrom(r)
+				middleware.ReadResponsesFrom(r)
 			}
 		}
 
-		go func() {
-			if err := CopyMulty(middleware, plugins.Outputs...); err != nil {
-				log.Println("Error during copy: ", err)
-				close(stop)
-			}
-		}()
+		go copyOrStop(middleware, plugins.Outputs, stop)
 	} else {
 		for _, in := range plugins.Inputs {
-			go func(in io.Reader) {
-				if err := CopyMulty(in, plugins.Outputs...); err != nil {
-					log.Println("Error during copy: ", err)
-					close(stop)
-				}
-			}(in)
+			go copyOrStop(in, plugins.Outputs, stop)
 		}
 
 		for _, out := range plugins.Outputs {
 			if r, ok := out.(io.Reader); ok {
-				go func(r io.Reader) {
-					if err := CopyMulty(r, plugins.Outputs...); err != nil {
-						log.Println("Error during copy: ", err)
-						close(stop)
-					}
-				}(r)
+				go copyOrStop(r, plugins.Outputs, stop)
 			}
 		}
 	}
@@ -61,13 +54,117 @@ func Start(plugins *InOutPlugins, stop chan int) {
 	}
 }
 
+// errRequestLimit is returned by CopyMulty which forwarded the last request allowed by --exit-after-requests
+var errRequestLimit = errors.New("request limit reached")
+
+// Number of requests forwarded by all CopyMulty loops, counted if --exit-after-requests is set
+var forwardedRequests uint64
+
+// copyOrStop runs CopyMulty, and stops Gor when it fails or forwards the last allowed request
+func copyOrStop(src io.Reader, writers []io.Writer, stop chan int) {
+	err := CopyMulty(src, writers...)
+	if err == nil {
+		return
+	}
+
+	if err == errRequestLimit {
+		log.Println("Stopping gor after forwarding", atomic.LoadUint64(&forwardedRequests), "requests")
+	} else {
+		log.Println("Error during copy: ", err)
+	}
+	close(stop)
+}
+
 // CopyMulty copies from 1 reader to multiple writers
 func CopyMulty(src io.Reader, writers ...io.Writer) (err error) {
+	return copyMulty(src, NewHTTPModifier(&Settings.modifierConfig), writers...)
+}
+
+// copyMulty is CopyMulty with given request modifier, which can be nil
+func copyMulty(src io.Reader, modifier *HTTPModifier, writers ...io.Writer) (err error) {
 	buf := make([]byte, Settings.copyBufferSize)
 	wIndex := 0
-	modifier := NewHTTPModifier(&Settings.modifierConfig)
+	// Weights are validated against outputs on start, plain round robin is used for other writers
+	var weighted *weightedRoundRobin
+	if len(Settings.splitWeights) > 0 && len(Settings.splitWeights) == len(writers) {
+		weighted = newWeightedRoundRobin(Settings.splitWeights)
+	}
 	filteredRequests := make(map[string]time.Time)
 	filteredRequestsLastCleanTime := time.Now()
+	// Value of --http-dedup-header -> time request with it was seen
+	dedupKeys := make(map[string]time.Time)
+	dedupKeysLastCleanTime := time.Now()
+	formatWarned := false
+	// Requests are held until their responses, if they are filtered by response status
+	statusFilter := newResponseStatusFilter(Settings.allowResponseStatus, Settings.disallowResponseStatus)
+
+	// In --dry-run mode requests dropped by filters are counted
+	var dryRun *DryRunOutput
+	for _, w := range writers {
+		if o, ok := w.(*DryRunOutput); ok {
+			dryRun = o
+		}
+	}
+
+	// Type checks above need original writers
+	if outputBandwidth != nil {
+		writers = throttleWriters(writers, outputBandwidth)
+	}
+
+	// emit writes payload to all writers, or to one of them if output is split
+	emit := func(payload []byte, id []byte) error {
+		if Settings.prettifyHTTP {
+			payload = prettifyHTTP(payload)
+			if len(payload) == 0 {
+				return nil
+			}
+		}
+
+		// Requests over the limit are dropped until Gor stops
+		var forwarded uint64
+		if Settings.exitAfterRequests > 0 && isRequestPayload(payload) {
+			if forwarded = atomic.AddUint64(&forwardedRequests, 1); forwarded > Settings.exitAfterRequests {
+				return nil
+			}
+		}
+
+		if Settings.splitOutput && Settings.splitOutputHash {
+			idx := outputIndexByID(id, len(writers))
+			if weighted != nil {
+				idx = weighted.byID(id)
+			}
+			if _, err := writers[idx].Write(payload); err != nil {
+				return err
+			}
+		} else if Settings.splitOutput && weighted != nil {
+			if _, err := writers[weighted.next()].Write(payload); err != nil {
+				return err
+			}
+		} else if Settings.splitOutput {
+			// Simple round robin
+			if _, err := writers[wIndex].Write(payload); err != nil {
+				return err
+			}
+
+			wIndex++
+
+			if wIndex >= len(writers) {
+				wIndex = 0
+			}
+		} else {
+			for _, dst := range writers {
+				if _, err := dst.Write(payload); err != nil {
+					return err
+				}
+			}
+		}
+
+		if forwarded > 0 && forwarded == Settings.exitAfterRequests {
+			return errRequestLimit
+		}
+
+		return nil
+	}
 
 	i := 0
 
@@ -87,15 +184,29 @@ func CopyMulty(src io.Reader, writers ...io.Writer) (err error) {
 		}
 		if nr > 0 && len(buf) > nr {
 			payload := buf[:nr]
-			meta := payloadMeta(payload)
-			if len(meta) < 3 {
+			if !isGorPayload(payload) {
 				if Settings.debug {
 					Debug("[EMITTER] Found malformed record", string(payload[0:_maxN]), nr, "from:", src)
 				}
-				continue
+
+				if payload = convertPayloadFormat(payload, src, Settings.inputFormatMismatch, &formatWarned); payload == nil {
+					continue
+				}
 			}
+			if payload[0] != ReplayedResponsePayload {
+				markInputActivity(time.Now())
+			}
+
+			meta := payloadMeta(payload)
 			requestID := string(meta[1])
 
+			if Settings.sampleRate < 1 && !sampledID(meta[1], Settings.sampleRate) {
+				if dryRun != nil && isRequestPayload(payload) {
+					dryRun.Drop("sample-rate")
+				}
+				continue
+			}
+
 			if nr >= 5*1024*1024 {
 				log.Println("INFO: Large packet... We received ", len(payload), " bytes from ", src)
 			}
@@ -104,59 +215,97 @@ func CopyMulty(src io.Reader, writers ...io.Writer) (err error) {
 				Debug("[EMITTER] input:", string(payload[0:_maxN]), nr, "from:", src)
 			}
 
+			if Settings.dedupHeader != "" && isRequestPayload(payload) {
+				if key := proto.Header(payloadBody(payload), []byte(Settings.dedupHeader)); len(key) > 0 {
+					now := time.Now()
+					if seen, ok := dedupKeys[string(key)]; ok && now.Sub(seen) < Settings.dedupWindow {
+						Debug("[EMITTER] Dropped duplicate request:", requestID, Settings.dedupHeader+":", string(key))
+						filteredRequests[requestID] = now
+						if dryRun != nil {
+							dryRun.Drop("http-dedup-header")
+						}
+						continue
+					}
+					dedupKeys[string(key)] = now
+				}
+			}
+
 			if modifier != nil {
 				if isRequestPayload(payload) {
+					if !modifier.AllowDstPort(payloadPort(meta)) {
+						filteredRequests[requestID] = time.Now()
+						if dryRun != nil {
+							dryRun.Drop("http-allow-dst-port")
+						}
+						continue
+					}
+
 					headSize := bytes.IndexByte(payload, '\n') + 1
 					body := payload[headSize:]
 					originalBodyLen := len(body)
-					body = modifier.Rewrite(body)
+
+					// Modifier sees decoded body, and it is compressed back after rewrite
+					gzipped := false
+					if Settings.decompressBody {
+						body, gzipped = gunzipHTTP(body)
+					}
+
+					body, reason := modifier.RewriteWithMeta(meta, body)
 
 					// If modifier tells to skip request
 					if len(body) == 0 {
 						filteredRequests[requestID] = time.Now()
+						if dryRun != nil && reason != "" {
+							dryRun.Drop(reason)
+						}
 						continue
 					}
 
-					if originalBodyLen != len(body) {
+					if gzipped {
+						body = gzipHTTP(body)
+					}
+
+					if gzipped || originalBodyLen != len(body) {
 						payload = append(payload[:headSize], body...)
 					}
 
 					if Settings.debug {
 						Debug("[EMITTER] Rewritten input:", len(payload), "First 500 bytes:", string(payload[0:_maxN]))
 					}
-				} else {
-					if _, ok := filteredRequests[requestID]; ok {
-						delete(filteredRequests, requestID)
-						continue
-					}
 				}
 			}
 
-			if Settings.prettifyHTTP {
-				payload = prettifyHTTP(payload)
-				if len(payload) == 0 {
+			if !isRequestPayload(payload) {
+				if _, ok := filteredRequests[requestID]; ok {
+					delete(filteredRequests, requestID)
 					continue
 				}
 			}
 
-			if Settings.splitOutput {
-				// Simple round robin
-				if _, err := writers[wIndex].Write(payload); err != nil {
-					return err
+			if statusFilter != nil {
+				if isRequestPayload(payload) {
+					statusFilter.Hold(requestID, payload, time.Now())
+					continue
 				}
 
-				wIndex++
+				if payload[0] == ResponsePayload {
+					request, reason := statusFilter.Release(requestID, payload)
+					if request == nil {
+						if dryRun != nil && reason != "" {
+							dryRun.Drop(reason)
+						}
+						continue
+					}
 
-				if wIndex >= len(writers) {
-					wIndex = 0
-				}
-			} else {
-				for _, dst := range writers {
-					if _, err := dst.Write(payload); err != nil {
+					if err := emit(request, meta[1]); err != nil {
 						return err
 					}
 				}
 			}
+
+			if err := emit(payload, meta[1]); err != nil {
+				return err
+			}
 		} else if nr > 0 {
 			log.Println("WARN: Packet", nr, "bytes is too large to process. Consider increasing --copy-buffer-size")
 		}
@@ -172,9 +321,112 @@ func CopyMulty(src io.Reader, writers ...io.Writer) (err error) {
 					}
 				}
 				filteredRequestsLastCleanTime = time.Now()
+
+				if statusFilter != nil {
+					statusFilter.Expire(now, 60*time.Second)
+				}
+			}
+
+			// Forget keys of requests which are out of dedup window
+			if now.Sub(dedupKeysLastCleanTime) > Settings.dedupWindow {
+				for k, v := range dedupKeys {
+					if now.Sub(v) >= Settings.dedupWindow {
+						delete(dedupKeys, k)
+					}
+				}
+				dedupKeysLastCleanTime = time.Now()
 			}
 		}
 
 		i++
 	}
 }
+
+// outputIndexByID picks output by hash of request ID, so split does not depend on timing
+func outputIndexByID(id []byte, outputs int) int {
+	return int(hashID(id) % uint32(outputs))
+}
+
+func hashID(id []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(id)
+
+	return h.Sum32()
+}
+
+// sampledID tells if request with given ID is kept by sampling with given rate.
+// Decision depends only on ID, so request and its responses are sampled together.
+func sampledID(id []byte, rate float64) bool {
+	return float64(hashID(id)) < rate*(1<<32)
+}
+
+// weightedRoundRobin splits traffic among outputs in proportion to their weights.
+// Picks of each output are spread evenly, so with weights 9,1 every 10th payload goes to the second output,
+// instead of 9 payloads in a row to the first one.
+type weightedRoundRobin struct {
+	weights []int
+	current []int
+	total   int
+}
+
+func newWeightedRoundRobin(weights []int) *weightedRoundRobin {
+	w := &weightedRoundRobin{weights: weights, current: make([]int, len(weights))}
+	for _, weight := range weights {
+		w.total += weight
+	}
+
+	return w
+}
+
+// next returns output index using smooth weighted round robin, same as in nginx
+func (w *weightedRoundRobin) next() int {
+	best := 0
+	for i, weight := range w.weights {
+		w.current[i] += weight
+		if w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= w.total
+
+	return best
+}
+
+// byID returns output index by hash of request ID, with probability of each output proportional to its weight
+func (w *weightedRoundRobin) byID(id []byte) int {
+	n := int(hashID(id) % uint32(w.total))
+	for i, weight := range w.weights {
+		if n < weight {
+			return i
+		}
+		n -= weight
+	}
+
+	return len(w.weights) - 1
+}
+
+// parseSplitWeights parses comma separated weights of outputs, e.g. "9,1"
+func parseSplitWeights(options string, outputs int) ([]int, error) {
+	var weights []int
+	for _, o := range strings.Split(options, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(o))
+		if err != nil || weight < 0 {
+			return nil, errors.New("weight should be non-negative number: " + o)
+		}
+		weights = append(weights, weight)
+	}
+
+	if len(weights) != outputs {
+		return nil, fmt.Errorf("got %d weights for %d outputs", len(weights), outputs)
+	}
+
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	if total == 0 {
+		return nil, errors.New("at least one weight should be positive")
+	}
+
+	return weights, nil
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/buger/goreplay/proto"
 )
 
 func TestEmitter(t *testing.T) {
@@ -34,6 +38,53 @@ func TestEmitter(t *testing.T) {
 	close(quit)
 }
 
+func TestEmitterExitAfterRequests(t *testing.T) {
+	quit := make(chan int)
+
+	input := NewTestInput()
+	var forwarded int32
+	output := NewTestOutput(func(data []byte) {
+		if !strings.HasPrefix(string(payloadBody(data)), "GET") {
+			t.Error("Filtered request should not be forwarded:", string(data))
+		}
+		atomic.AddInt32(&forwarded, 1)
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+
+	Settings.modifierConfig = HTTPModifierConfig{methods: HTTPMethods{[]byte("GET")}}
+	Settings.exitAfterRequests = 5
+	atomic.StoreUint64(&forwardedRequests, 0)
+	defer func() {
+		Settings.modifierConfig = HTTPModifierConfig{}
+		Settings.exitAfterRequests = 0
+	}()
+
+	for i := 0; i < 10; i++ {
+		input.EmitPOST()
+		input.EmitGET()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Start(plugins, quit)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Gor should stop after request limit")
+	}
+
+	if n := atomic.LoadInt32(&forwarded); n != 5 {
+		t.Error("Should forward 5 requests, got:", n)
+	}
+}
+
 func TestEmitterFiltered(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
@@ -83,6 +134,40 @@ func TestEmitterFiltered(t *testing.T) {
 	Settings.modifierConfig = HTTPModifierConfig{}
 }
 
+func TestEmitterFilteredByDstPort(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+	input.skipHeader = true
+
+	var ports []uint16
+	output := NewTestOutput(func(data []byte) {
+		ports = append(ports, payloadPort(payloadMeta(data)))
+		wg.Done()
+	})
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{dstPorts: HTTPPorts{443}})
+	go copyMulty(input, modifier, output)
+
+	wg.Add(2)
+
+	for _, port := range []uint16{80, 443} {
+		id := uuid()
+		reqh := payloadHeaderWithPort(RequestPayload, id, time.Now().UnixNano(), -1, port)
+		input.EmitBytes(append(reqh, []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")...))
+
+		resh := payloadHeaderWithPort(ResponsePayload, id, time.Now().UnixNano()+1, 1, port)
+		input.EmitBytes(append(resh, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")...))
+	}
+
+	wg.Wait()
+	time.Sleep(10 * time.Millisecond)
+
+	if len(ports) != 2 || ports[0] != 443 || ports[1] != 443 {
+		t.Error("Only request and response on port 443 should pass:", ports)
+	}
+}
+
 func TestEmitterRoundRobin(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
@@ -126,6 +211,77 @@ func TestEmitterRoundRobin(t *testing.T) {
 	Settings.splitOutput = false
 }
 
+func TestEmitterSplitByHash(t *testing.T) {
+	Settings.splitOutput = true
+	Settings.splitOutputHash = true
+	defer func() {
+		Settings.splitOutput = false
+		Settings.splitOutputHash = false
+	}()
+
+	ids := make([][]byte, 100)
+	for i := range ids {
+		ids[i] = uuid()
+	}
+
+	// Returns output index of each request, and of each response
+	split := func() (requests, responses map[string]int) {
+		wg := new(sync.WaitGroup)
+		var mu sync.Mutex
+		requests, responses = make(map[string]int), make(map[string]int)
+
+		input := NewTestInput()
+		input.skipHeader = true
+
+		var outputs []io.Writer
+		for i := 0; i < 3; i++ {
+			idx := i
+			outputs = append(outputs, NewTestOutput(func(data []byte) {
+				mu.Lock()
+				if isRequestPayload(data) {
+					requests[string(payloadMeta(data)[1])] = idx
+				} else {
+					responses[string(payloadMeta(data)[1])] = idx
+				}
+				mu.Unlock()
+				wg.Done()
+			}))
+		}
+
+		go copyMulty(input, nil, outputs...)
+
+		for _, id := range ids {
+			wg.Add(2)
+			input.EmitBytes(append(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), []byte("GET / HTTP/1.1\r\n\r\n")...))
+			input.EmitBytes(append(payloadHeader(ResponsePayload, id, time.Now().UnixNano(), 1), []byte("HTTP/1.1 200 OK\r\n\r\n")...))
+		}
+
+		wg.Wait()
+
+		return
+	}
+
+	requests, responses := split()
+	again, _ := split()
+
+	used := make(map[int]bool)
+	for id, idx := range requests {
+		used[idx] = true
+
+		if again[id] != idx {
+			t.Error("Request should go to the same output in each run:", id)
+		}
+
+		if responses[id] != idx {
+			t.Error("Response should go to the same output as request:", id)
+		}
+	}
+
+	if len(used) != 3 {
+		t.Error("Requests should be split among all outputs:", used)
+	}
+}
+
 func BenchmarkEmitter(b *testing.B) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
@@ -153,3 +309,252 @@ func BenchmarkEmitter(b *testing.B) {
 	wg.Wait()
 	close(quit)
 }
+
+func TestEmitterFormatMismatch(t *testing.T) {
+	received := make(chan []byte, 10)
+
+	input := NewTestInput()
+	input.skipHeader = true
+	output := NewTestOutput(func(data []byte) {
+		received <- append([]byte(nil), data...)
+	})
+
+	go copyMulty(input, nil, output)
+
+	// Written by --output-kafka-json-format
+	input.EmitBytes([]byte(`{"Req_URL":"/api","Req_Type":"1","Req_ID":"abc","Req_Ts":"1","Req_Method":"GET","Req_Headers":{"Host":"www.w3.org"}}`))
+	input.EmitBytes([]byte("not a payload"))
+	input.EmitBytes(append(payloadHeader(RequestPayload, []byte("def"), 2, -1), "GET / HTTP/1.1\r\n\r\n"...))
+
+	expected := []string{
+		"1 abc 1\nGET /api HTTP/1.1\r\nHost: www.w3.org\r\n\r\n",
+		"1 def 2\nGET / HTTP/1.1\r\n\r\n",
+	}
+
+	for _, e := range expected {
+		select {
+		case data := <-received:
+			if string(data) != e {
+				t.Errorf("Expected %q, got %q", e, data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should emit converted and valid payloads")
+		}
+	}
+
+	select {
+	case data := <-received:
+		t.Errorf("Malformed payload should be skipped: %q", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEmitterSplitWeights(t *testing.T) {
+	w := newWeightedRoundRobin([]int{3, 1, 0})
+
+	var picks []int
+	for i := 0; i < 8; i++ {
+		picks = append(picks, w.next())
+	}
+	if fmt.Sprint(picks) != "[0 0 1 0 0 0 1 0]" {
+		t.Errorf("Outputs should be picked in proportion to weights: %v", picks)
+	}
+
+	counts := make([]int, 3)
+	for i := 0; i < 10000; i++ {
+		counts[w.byID(uuid())]++
+	}
+	if counts[0] < 7000 || counts[0] > 8000 || counts[2] != 0 {
+		t.Errorf("Hash split should follow weights: %v", counts)
+	}
+
+	if _, err := parseSplitWeights("9, 1", 2); err != nil {
+		t.Error(err)
+	}
+	for _, options := range []string{"9", "9,a", "-1,2", "0,0"} {
+		if _, err := parseSplitWeights(options, 2); err == nil {
+			t.Errorf("Weights %q should be invalid", options)
+		}
+	}
+}
+
+func TestEmitterSampleRate(t *testing.T) {
+	Settings.sampleRate = 0.3
+	defer func() { Settings.sampleRate = 1 }()
+
+	wg := new(sync.WaitGroup)
+	var mu sync.Mutex
+	requests, responses := make(map[string]bool), make(map[string]bool)
+
+	input := NewTestInput()
+	input.skipHeader = true
+	output := NewTestOutput(func(data []byte) {
+		mu.Lock()
+		if isRequestPayload(data) {
+			requests[string(payloadMeta(data)[1])] = true
+		} else {
+			responses[string(payloadMeta(data)[1])] = true
+		}
+		mu.Unlock()
+		wg.Done()
+	})
+
+	go copyMulty(input, nil, output)
+
+	for i := 0; i < 1000; i++ {
+		id := uuid()
+		if sampledID(id, Settings.sampleRate) {
+			wg.Add(2)
+		}
+		input.EmitBytes(append(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), []byte("GET / HTTP/1.1\r\n\r\n")...))
+		input.EmitBytes(append(payloadHeader(ResponsePayload, id, time.Now().UnixNano(), 1), []byte("HTTP/1.1 200 OK\r\n\r\n")...))
+	}
+
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(requests) < 250 || len(requests) > 350 {
+		t.Errorf("About 30%% of requests should be kept, got %d", len(requests))
+	}
+	for id := range requests {
+		if !responses[id] {
+			t.Errorf("Response of sampled request %s should be kept", id)
+		}
+	}
+	if len(responses) != len(requests) {
+		t.Errorf("Responses should be sampled together with requests: %d vs %d", len(responses), len(requests))
+	}
+}
+
+func TestEmitterDedupHeader(t *testing.T) {
+	Settings.dedupHeader = "Idempotency-Key"
+	Settings.dedupWindow = 50 * time.Millisecond
+	defer func() { Settings.dedupHeader = "" }()
+
+	wg := new(sync.WaitGroup)
+	var mu sync.Mutex
+	var received []string
+
+	input := NewTestInput()
+	input.skipHeader = true
+	output := NewTestOutput(func(data []byte) {
+		mu.Lock()
+		received = append(received, string(payloadMeta(data)[0])+string(proto.Header(payloadBody(data), []byte("Idempotency-Key"))))
+		mu.Unlock()
+		wg.Done()
+	})
+
+	go copyMulty(input, nil, output)
+
+	emit := func(key string) {
+		id := uuid()
+		input.EmitBytes(append(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), []byte("POST / HTTP/1.1\r\nIdempotency-Key: "+key+"\r\n\r\n")...))
+		input.EmitBytes(append(payloadHeader(ResponsePayload, id, time.Now().UnixNano(), 1), []byte("HTTP/1.1 200 OK\r\n\r\n")...))
+	}
+
+	// Retry of `a` is dropped together with its response, `b` is kept
+	wg.Add(4)
+	emit("a")
+	emit("a")
+	emit("b")
+	wg.Wait()
+
+	// Window is over, so `a` is replayed again
+	time.Sleep(60 * time.Millisecond)
+	wg.Add(2)
+	emit("a")
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if expected := "1a 2 1b 2 1a 2"; strings.Join(received, " ") != expected {
+		t.Errorf("Expected %q, got %q", expected, strings.Join(received, " "))
+	}
+}
+
+func TestEmitterDryRun(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+	input.skipHeader = true
+	output := NewTestOutput(func(data []byte) {
+		wg.Done()
+	})
+	dryRun := NewDryRunOutput()
+	var summary strings.Builder
+	dryRun.out = &summary
+
+	modifier := NewHTTPModifier(&HTTPModifierConfig{methods: HTTPMethods{[]byte("GET")}})
+	go copyMulty(input, modifier, dryRun, output)
+
+	emit := func(method string) {
+		id := uuid()
+		input.EmitBytes(append(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), []byte(method+" / HTTP/1.1\r\n\r\n")...))
+		input.EmitBytes(append(payloadHeader(ResponsePayload, id, time.Now().UnixNano(), 1), []byte("HTTP/1.1 200 OK\r\n\r\n")...))
+	}
+
+	// POST and its response are dropped
+	wg.Add(4)
+	emit("POST")
+	emit("GET")
+	emit("GET")
+	wg.Wait()
+
+	dryRun.Close()
+
+	for _, line := range []string{"requests to replay: 2", "responses: 2", "dropped by --http-allow-method: 1", "First 2 requests to replay:"} {
+		if !strings.Contains(summary.String(), line) {
+			t.Errorf("Expected %q in summary:\n%s", line, summary.String())
+		}
+	}
+}
+
+func TestEmitterResponseStatusFilter(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	var mu sync.Mutex
+	var received []string
+
+	input := NewTestInput()
+	input.skipHeader = true
+	output := NewTestOutput(func(data []byte) {
+		mu.Lock()
+		received = append(received, string(payloadBody(data)))
+		mu.Unlock()
+		wg.Done()
+	})
+
+	Settings.allowResponseStatus = HTTPStatusRegexp{}
+	Settings.allowResponseStatus.Set("^5")
+	defer func() {
+		Settings.allowResponseStatus = nil
+	}()
+
+	go copyMulty(input, nil, output)
+
+	emit := func(path, status string) {
+		id := uuid()
+		input.EmitBytes(append(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), []byte("GET "+path+" HTTP/1.1\r\n\r\n")...))
+		input.EmitBytes(append(payloadHeader(ResponsePayload, id, time.Now().UnixNano(), 1), []byte("HTTP/1.1 "+status+" Status\r\n\r\n")...))
+	}
+
+	// Only the pair with 5xx response is forwarded
+	wg.Add(2)
+	emit("/ok", "200")
+	emit("/error", "502")
+	emit("/missing", "404")
+	wg.Wait()
+
+	time.Sleep(10 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expected := []string{"GET /error HTTP/1.1\r\n\r\n", "HTTP/1.1 502 Status\r\n\r\n"}
+	if strings.Join(received, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected %q, got %q", expected, received)
+	}
+}
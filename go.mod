@@ -1,21 +1,36 @@
 module github.com/buger/goreplay
 
-go 1.12
+go 1.22
 
 require (
 	github.com/Shopify/sarama v1.11.0
+	github.com/google/gopacket v0.0.0-20190211013929-f86faeb88894
+	github.com/klauspost/compress v1.18.0
+	github.com/mattbaird/elastigo v0.0.0-20170123220020-2fe47fd29e4b
+	github.com/prometheus/client_golang v1.6.0
+	golang.org/x/net v0.0.0-20190613194153-d28f0bde5980
+	google.golang.org/protobuf v1.21.0
+)
+
+require (
 	github.com/araddon/gou v0.0.0-20190110011759-c797efecbb61 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/bitly/go-hostpool v0.0.0-20171023180738-a3a6125de932 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/eapache/go-resiliency v0.0.0-20160104191539-b86b1ec0dd42 // indirect
 	github.com/eapache/go-xerial-snappy v0.0.0-20160609142408-bb955e01b934 // indirect
 	github.com/eapache/queue v1.1.0 // indirect
+	github.com/golang/protobuf v1.4.0 // indirect
 	github.com/golang/snappy v0.0.0-20160529050041-d9eb7a3d35ec // indirect
-	github.com/google/gopacket v0.0.0-20190211013929-f86faeb88894
 	github.com/klauspost/crc32 v0.0.0-20161016154125-cb6bfca970f6 // indirect
-	github.com/lidedede/goreplay v1.0.0 // indirect
-	github.com/mattbaird/elastigo v0.0.0-20170123220020-2fe47fd29e4b
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/pierrec/lz4 v0.0.0-20161206202305-5c9560bfa9ac // indirect
 	github.com/pierrec/xxHash v0.0.0-20160112165351-5a004441f897 // indirect
-	github.com/prometheus/client_golang v1.6.0
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.9.1 // indirect
+	github.com/prometheus/procfs v0.0.11 // indirect
 	github.com/rcrowley/go-metrics v0.0.0-20161128210544-1f30fe9094a5 // indirect
+	golang.org/x/sys v0.0.0-20200420163511-1957bb5e6d1f // indirect
+	golang.org/x/text v0.3.0 // indirect
 )
@@ -18,6 +18,7 @@ import (
 	_ "runtime/debug"
 	_ "github.com/buger/goreplay/metrics"
 	"runtime/pprof"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -38,6 +39,20 @@ func loggingMiddleware(next http.Handler) http.Handler {
 
 var closeCh chan int
 
+// closeChOnce guards closeCh, which is closed both by inputs reaching end of data and by --exit-after
+var closeChOnce sync.Once
+
+// stopGor closes closeCh, so Start returns. It can be called multiple times.
+func stopGor() {
+	if closeCh == nil {
+		return
+	}
+
+	closeChOnce.Do(func() {
+		close(closeCh)
+	})
+}
+
 func main() {
 	closeCh = make(chan int)
 	// // Don't exit on panic
@@ -65,14 +80,23 @@ func main() {
 		log.Fatal(http.ListenAndServe(args[1], loggingMiddleware(http.FileServer(http.Dir(dir)))))
 	} else {
 		flag.Parse()
+
+		if Settings.configFile != "" {
+			if err := LoadConfigFile(Settings.configFile); err != nil {
+				log.Fatal("config: ", err)
+			}
+		}
+
 		plugins = InitPlugins()
 	}
 
-	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		log.Fatal(http.ListenAndServe(":8081", nil))
-		fmt.Println("metrics Okay")
-	}()
+	if Settings.metricsAddr != "" {
+		go func() {
+			http.Handle("/metrics", promhttp.Handler())
+			// Replay should not be stopped because of metrics, e.g. if port is taken by another instance
+			log.Println("Metrics server error:", http.ListenAndServe(Settings.metricsAddr, nil))
+		}()
+	}
 	metrics.IncreaseSubRequests("111","222")
 	fmt.Println("Version:", VERSION)
 
@@ -94,10 +118,29 @@ func main() {
 		}()
 	}
 
+	if Settings.statusAddr != "" {
+		go StartStatusServer(Settings.statusAddr)
+	}
+
+	if Settings.healthAddr != "" {
+		go StartHealthServer(Settings.healthAddr, &Settings.healthConfig)
+	}
+
+	if Settings.ringBuffer != "" {
+		notifyRingBufferDump()
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+
+		// Second signal stops without waiting for outputs
+		go func() {
+			<-c
+			os.Exit(1)
+		}()
+
 		finalize(plugins)
 		os.Exit(1)
 	}()
@@ -107,15 +150,28 @@ func main() {
 
 		time.AfterFunc(Settings.exitAfter, func() {
 			log.Println("Stopping gor after", Settings.exitAfter)
-			close(closeCh)
+			stopGor()
 		})
 	}
 
 	Start(plugins, closeCh)
 }
 
+// finalize closes inputs first, so outputs can send what is already queued without getting new requests
 func finalize(plugins *InOutPlugins) {
 	for _, p := range plugins.All {
+		if _, isW := p.(io.Writer); isW {
+			continue
+		}
+		if cp, ok := p.(io.Closer); ok {
+			cp.Close()
+		}
+	}
+
+	for _, p := range plugins.All {
+		if _, isW := p.(io.Writer); !isW {
+			continue
+		}
 		if cp, ok := p.(io.Closer); ok {
 			cp.Close()
 		}
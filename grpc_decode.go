@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/buger/goreplay/proto"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Requests which responses were not seen are forgotten after this limit
+const grpcMaxPendingRequests = 10000
+
+var errGRPCFrame = errors.New("grpc: malformed message frame")
+
+// grpcDecoder replaces protobuf bodies of gRPC requests and responses with their JSON representation,
+// using message types from descriptor set: protoc --include_imports --descriptor_set_out=api.pb api.proto
+//
+// Response has no method path, so it is found using request with the same ID.
+type grpcDecoder struct {
+	files *protoregistry.Files
+
+	mu sync.Mutex
+	// Request ID -> method
+	pending map[string]protoreflect.MethodDescriptor
+}
+
+func newGRPCDecoder(descriptorSet string) (*grpcDecoder, error) {
+	data, err := ioutil.ReadFile(descriptorSet)
+	if err != nil {
+		return nil, err
+	}
+
+	set := new(descriptorpb.FileDescriptorSet)
+	if err = protobuf.Unmarshal(data, set); err != nil {
+		return nil, err
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcDecoder{files: files, pending: make(map[string]protoreflect.MethodDescriptor)}, nil
+}
+
+// Decode returns payload with JSON body, or payload as is if it is not gRPC message of known method
+func (d *grpcDecoder) Decode(payload []byte) []byte {
+	meta := payloadMeta(payload)
+	if len(meta) < 2 {
+		return payload
+	}
+
+	body := payloadBody(payload)
+	headerSize := len(payload) - len(body)
+	id := string(meta[1])
+
+	var msgType protoreflect.MessageDescriptor
+
+	if isRequestPayload(payload) {
+		if !bytes.HasPrefix(proto.Header(body, []byte("Content-Type")), []byte("application/grpc")) {
+			return payload
+		}
+
+		method := d.findMethod(string(proto.Path(body)))
+		if method == nil {
+			return payload
+		}
+
+		d.mu.Lock()
+		if len(d.pending) >= grpcMaxPendingRequests {
+			d.pending = make(map[string]protoreflect.MethodDescriptor)
+		}
+		d.pending[id] = method
+		d.mu.Unlock()
+
+		msgType = method.Input()
+	} else {
+		d.mu.Lock()
+		method, ok := d.pending[id]
+		delete(d.pending, id)
+		d.mu.Unlock()
+
+		if !ok {
+			return payload
+		}
+
+		msgType = method.Output()
+	}
+
+	gzipped := string(proto.Header(body, []byte("Grpc-Encoding"))) == "gzip"
+
+	decoded, err := d.decodeMessages(msgType, proto.Body(body), gzipped)
+	if err != nil {
+		Debug("[GRPC] Can't decode", msgType.FullName(), err)
+		return payload
+	}
+
+	// Headers are copied, since they are modified in place
+	headers := append([]byte(nil), body[:proto.MIMEHeadersEndPos(body)]...)
+	headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(strconv.Itoa(len(decoded))))
+	headers = proto.SetHeader(headers, []byte("X-Grpc-Decoded"), []byte("json"))
+
+	result := make([]byte, 0, headerSize+len(headers)+len(decoded))
+	result = append(result, payload[:headerSize]...)
+	result = append(result, headers...)
+
+	return append(result, decoded...)
+}
+
+// findMethod finds method by request path: /package.Service/Method
+func (d *grpcDecoder) findMethod(path string) protoreflect.MethodDescriptor {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 {
+		return nil
+	}
+
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName(parts[0]))
+	if err != nil {
+		return nil
+	}
+
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil
+	}
+
+	return service.Methods().ByName(protoreflect.Name(parts[1]))
+}
+
+// decodeMessages converts length-prefixed messages to JSON, one message per line for streaming calls
+func (d *grpcDecoder) decodeMessages(msgType protoreflect.MessageDescriptor, body []byte, gzipped bool) ([]byte, error) {
+	var out bytes.Buffer
+
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, errGRPCFrame
+		}
+
+		compressed := body[0] == 1
+		size := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(size) {
+			return nil, errGRPCFrame
+		}
+
+		data := body[5 : 5+size]
+		body = body[5+size:]
+
+		if compressed {
+			if !gzipped {
+				return nil, errors.New("grpc: unsupported message encoding")
+			}
+
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			if data, err = ioutil.ReadAll(r); err != nil {
+				return nil, err
+			}
+		}
+
+		msg := dynamicpb.NewMessage(msgType)
+		if err := protobuf.Unmarshal(data, msg); err != nil {
+			return nil, fmt.Errorf("grpc: %s: %v", msgType.FullName(), err)
+		}
+
+		j, err := protojson.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.Write(j)
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func testGRPCDescriptorSet(t *testing.T) string {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    protobuf.String("greeter.proto"),
+		Package: protobuf.String("test"),
+		Syntax:  protobuf.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: protobuf.String("HelloRequest"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: protobuf.String("name"), JsonName: protobuf.String("name"), Number: protobuf.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				},
+			},
+			{
+				Name: protobuf.String("HelloReply"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: protobuf.String("message"), JsonName: protobuf.String("message"), Number: protobuf.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+					{Name: protobuf.String("count"), JsonName: protobuf.String("count"), Number: protobuf.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{
+			{
+				Name: protobuf.String("Greeter"),
+				Method: []*descriptorpb.MethodDescriptorProto{
+					{Name: protobuf.String("SayHello"), InputType: protobuf.String(".test.HelloRequest"), OutputType: protobuf.String(".test.HelloReply")},
+				},
+			},
+		},
+	}
+
+	data, err := protobuf.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "grpc-descriptor-set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(data)
+	f.Close()
+
+	return f.Name()
+}
+
+// grpcMessages encodes messages with length prefix, fields are set by name
+func grpcMessages(t *testing.T, d *grpcDecoder, name string, messages ...map[string]interface{}) string {
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName("test." + name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgType := desc.(protoreflect.MessageDescriptor)
+
+	var out []byte
+	for _, fields := range messages {
+		msg := dynamicpb.NewMessage(msgType)
+		for name, value := range fields {
+			msg.Set(msgType.Fields().ByName(protoreflect.Name(name)), protoreflect.ValueOf(value))
+		}
+
+		data, err := protobuf.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prefix := make([]byte, 5)
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+		out = append(out, prefix...)
+		out = append(out, data...)
+	}
+
+	return string(out)
+}
+
+// grpcJSON returns decoded body without spaces, which protojson adds randomly to keep output unstable
+func grpcJSON(payload []byte) []byte {
+	return bytes.Replace(proto.Body(payloadBody(payload)), []byte(" "), nil, -1)
+}
+
+func TestGRPCDecoder(t *testing.T) {
+	path := testGRPCDescriptorSet(t)
+	defer os.Remove(path)
+
+	d, err := newGRPCDecoder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := grpcMessages(t, d, "HelloRequest", map[string]interface{}{"name": "gor"})
+	req := "1 1 1\nPOST /test.Greeter/SayHello HTTP/1.1\r\nContent-Type: application/grpc\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+
+	decoded := d.Decode([]byte(req))
+	if string(grpcJSON(decoded)) != `{"name":"gor"}` || string(proto.Header(payloadBody(decoded), []byte("X-Grpc-Decoded"))) != "json" {
+		t.Errorf("Wrong decoded request: %q", decoded)
+	}
+	if l := proto.Header(payloadBody(decoded), []byte("Content-Length")); string(l) != strconv.Itoa(len(proto.Body(payloadBody(decoded)))) {
+		t.Errorf("Wrong Content-Length: %s", l)
+	}
+
+	body = grpcMessages(t, d, "HelloReply", map[string]interface{}{"message": "hi", "count": int32(1)}, map[string]interface{}{"message": "bye", "count": int32(2)})
+	resp := "2 1 1\nHTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\n\r\n" + body
+
+	decoded = d.Decode([]byte(resp))
+	if string(grpcJSON(decoded)) != "{\"message\":\"hi\",\"count\":1}\n{\"message\":\"bye\",\"count\":2}" {
+		t.Errorf("Wrong decoded response: %q", decoded)
+	}
+
+	// Unknown methods and non gRPC payloads are kept as is
+	for _, payload := range []string{
+		"1 2 1\nPOST /test.Greeter/Unknown HTTP/1.1\r\nContent-Type: application/grpc\r\n\r\n" + body,
+		"1 3 1\nPOST /test.Greeter/SayHello HTTP/1.1\r\nContent-Type: application/json\r\n\r\n{}",
+		"2 4 1\nHTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\n\r\n" + body,
+	} {
+		if decoded := string(d.Decode([]byte(payload))); decoded != payload {
+			t.Errorf("Payload should not be modified: %q", decoded)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthConfig holds thresholds of --health-address server
+type HealthConfig struct {
+	// Gor is unhealthy if inputs produced no data for this long
+	inputTimeout time.Duration
+	// Gor is unhealthy if share of failed requests of any output reaches it
+	maxErrorRate float64
+}
+
+// Time of the last payload read from inputs, in unix nanoseconds
+var lastInputActivity int64
+
+func markInputActivity(now time.Time) {
+	atomic.StoreInt64(&lastInputActivity, now.UnixNano())
+}
+
+// healthReporter is implemented by outputs, which track outcomes of sent requests
+type healthReporter interface {
+	healthStatus() outputHealthStatus
+}
+
+type outputHealthStatus struct {
+	Output    string  `json:"output"`
+	Requests  int     `json:"requests"`
+	ErrorRate float64 `json:"error_rate"`
+	Workers   int     `json:"workers"`
+	Queued    int     `json:"queued"`
+	Healthy   bool    `json:"healthy"`
+}
+
+type healthStatus struct {
+	Healthy bool `json:"healthy"`
+	// Seconds since inputs produced data, -1 if they did not produce anything yet
+	InputIdle float64              `json:"input_idle_seconds"`
+	Outputs   []outputHealthStatus `json:"outputs"`
+}
+
+var healthReportersMu sync.Mutex
+var healthReporters = make(map[healthReporter]struct{})
+
+func registerHealthReporter(r healthReporter) {
+	healthReportersMu.Lock()
+	healthReporters[r] = struct{}{}
+	healthReportersMu.Unlock()
+}
+
+func unregisterHealthReporter(r healthReporter) {
+	healthReportersMu.Lock()
+	delete(healthReporters, r)
+	healthReportersMu.Unlock()
+}
+
+// checkHealth tells if inputs produced data recently, and error rates of all outputs are below threshold.
+// Error rate is not checked until output sent cbMinRequests requests, so single failure doesn't make Gor unhealthy.
+func checkHealth(config *HealthConfig, now time.Time) healthStatus {
+	status := healthStatus{Healthy: true, InputIdle: -1, Outputs: []outputHealthStatus{}}
+
+	if last := atomic.LoadInt64(&lastInputActivity); last > 0 {
+		idle := now.Sub(time.Unix(0, last))
+		status.InputIdle = idle.Seconds()
+		status.Healthy = idle < config.inputTimeout
+	} else {
+		status.Healthy = false
+	}
+
+	healthReportersMu.Lock()
+	for r := range healthReporters {
+		s := r.healthStatus()
+		s.Healthy = s.Requests < cbMinRequests || s.ErrorRate < config.maxErrorRate
+		status.Healthy = status.Healthy && s.Healthy
+		status.Outputs = append(status.Outputs, s)
+	}
+	healthReportersMu.Unlock()
+
+	return status
+}
+
+func healthHandler(config *HealthConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := checkHealth(config, time.Now())
+
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// StartHealthServer starts HTTP server with /healthz endpoint for liveness and readiness probes
+func StartHealthServer(addr string, config *HealthConfig) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler(config))
+
+	log.Println("Health server listening on", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
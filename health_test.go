@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeHealthReporter outputHealthStatus
+
+func (r *fakeHealthReporter) healthStatus() outputHealthStatus {
+	return outputHealthStatus(*r)
+}
+
+func TestHealthCheck(t *testing.T) {
+	config := &HealthConfig{inputTimeout: time.Minute, maxErrorRate: 0.5}
+	now := time.Now()
+
+	atomic.StoreInt64(&lastInputActivity, 0)
+	if checkHealth(config, now).Healthy {
+		t.Error("Should be unhealthy until inputs produce data")
+	}
+
+	markInputActivity(now.Add(-2 * time.Minute))
+	if status := checkHealth(config, now); status.Healthy || status.InputIdle != 120 {
+		t.Error("Should be unhealthy if inputs are idle", status)
+	}
+
+	markInputActivity(now)
+	if !checkHealth(config, now).Healthy {
+		t.Error("Should be healthy if inputs produce data")
+	}
+
+	output := &fakeHealthReporter{Output: "fake", Requests: cbMinRequests - 1, ErrorRate: 1}
+	registerHealthReporter(output)
+	defer unregisterHealthReporter(output)
+
+	if !checkHealth(config, now).Healthy {
+		t.Error("Error rate should be ignored until enough requests are sent")
+	}
+
+	output.Requests = cbMinRequests
+	output.ErrorRate = 0.5
+
+	recorder := httptest.NewRecorder()
+	healthHandler(config)(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Error("Should be unhealthy if error rate reaches threshold", recorder.Code)
+	}
+
+	var status healthStatus
+	json.Unmarshal(recorder.Body.Bytes(), &status)
+
+	found := false
+	for _, o := range status.Outputs {
+		if o.Output == "fake" {
+			found = !o.Healthy
+		}
+	}
+	if !found {
+		t.Error("Output should be reported as unhealthy", recorder.Body.String())
+	}
+}
+
+func TestHTTPOutputHealthStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{}).(*HTTPOutput)
+	defer output.Close()
+
+	output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+
+	for i := 0; i < 100; i++ {
+		if status := output.healthStatus(); status.Requests == 1 {
+			if status.ErrorRate != 1 {
+				t.Error("5xx response should be counted as error", status)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Error("Request outcome should be recorded")
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"github.com/buger/goreplay/proto"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -20,6 +23,7 @@ import (
 	"time"
 
 	"github.com/lidedede/gor/metrics"
+	"golang.org/x/net/http2"
 )
 
 var httpMu sync.Mutex
@@ -31,6 +35,17 @@ const (
 
 var chunkedSuffix = []byte("0\r\n\r\n")
 
+// isChunked tells if message body uses chunked transfer coding, which must be the last one applied
+func isChunked(payload []byte) bool {
+	codings := bytes.Split(proto.Header(payload, []byte("Transfer-Encoding")), []byte(","))
+	return bytes.EqualFold(bytes.TrimSpace(codings[len(codings)-1]), []byte("chunked"))
+}
+
+var errRequestDeadline = errors.New("request deadline exceeded")
+
+// Headers describing HTTP/1.1 connection, rather than request
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Upgrade", "Transfer-Encoding"}
+
 var defaultPorts = map[string]string{
 	"http":  "80",
 	"https": "443",
@@ -44,6 +59,32 @@ type HTTPClientConfig struct {
 	Timeout            time.Duration
 	ResponseBufferSize int
 	CompatibilityMode  bool
+	// Hard limit for the whole request, unlike Timeout it is not extended while response is still coming
+	RequestDeadline time.Duration
+	// Socket options of connection to the target, system defaults are used if nil
+	Socket *SocketOptions
+	// If set, each connection is made to random address from the list, instead of resolving host
+	TargetIPs []net.IP
+	// If set, returns address to connect to, instead of target host. Empty value means default address.
+	PickTarget func() string
+	// Called when connection to picked target is closed, failed is set if it could not be established
+	ReleaseTarget func(addr string, failed bool)
+	// Open new connection for each request, and close it after response received
+	NoKeepAlive bool
+	// Fraction of requests, which are sent with fault of FaultType
+	FaultRate float64
+	FaultType string
+	// Point Referer and Origin of the original site to the target, when Host header is rewritten
+	RewriteReferer bool
+	// Client certificate and verification of https targets, server certificate is not verified if nil
+	TLSConfig *tls.Config
+	// Reuse keep-alive connection without probing it first. If target closed it while idle,
+	// request is sent once again over new connection.
+	SkipAliveCheck bool
+	// Talk HTTP/2 to cleartext target without upgrade, used by CompatibilityMode client
+	H2C bool
+	// Decode gzip or deflate body of responses, compressed response is returned as is if it can't be decoded
+	DecompressResponse bool
 }
 
 type HTTPClient struct {
@@ -58,6 +99,14 @@ type HTTPClient struct {
 	config         *HTTPClientConfig
 	goClient       *http.Client
 	redirectsCount int
+	deadline       time.Time
+	// Set by send if connection was closed before request was written, or, for idempotent requests,
+	// before any response byte was received. Then request can be safely resent over new connection.
+	connClosed bool
+	// Target of current connection, if it was picked by balancer
+	target string
+	// Gor payload ID of request being sent, used in error logs
+	requestID []byte
 }
 
 func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
@@ -71,7 +120,9 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 		config.Timeout = time.Second
 	}
 
-	config.ConnectionTimeout = config.Timeout
+	if config.ConnectionTimeout == 0 {
+		config.ConnectionTimeout = config.Timeout
+	}
 
 	if config.ResponseBufferSize == 0 {
 		config.ResponseBufferSize = 100 * 1024 // 100kb
@@ -89,6 +140,30 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 			// #TODO
 			// CheckRedirect: redirectPolicyFunc,
 		}
+
+		if config.H2C {
+			// HTTP/2 with prior knowledge: connection "upgraded" to TLS is plain TCP connection to the target
+			client.goClient.Transport = &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+					return client.dialContext(context.Background(), network, addr)
+				},
+			}
+		} else if config.NoKeepAlive || config.PickTarget != nil || len(config.TargetIPs) > 0 || config.TLSConfig != nil {
+			// Same settings as http.DefaultTransport, but connections are made to picked target
+			transport := &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         client.dialContext,
+				MaxIdleConns:        100,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+				DisableKeepAlives:   config.NoKeepAlive,
+				TLSClientConfig:     config.TLSConfig,
+			}
+			// Custom transport does not negotiate HTTP/2 with https targets by itself
+			http2.ConfigureTransport(transport)
+			client.goClient.Transport = transport
+		}
 	}
 
 	if u.User != nil {
@@ -97,7 +172,7 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 
 	client.proxy, _ = http.ProxyFromEnvironment(&http.Request{URL: u})
 
-	if client.isProxy() && client.proxy.User != nil {
+	if client.isProxy() && !isSOCKS5(client.proxy) && client.proxy.User != nil {
 		client.proxyAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(client.proxy.User.String()))
 	}
 
@@ -107,23 +182,30 @@ func NewHTTPClient(baseURL string, config *HTTPClientConfig) *HTTPClient {
 func (c *HTTPClient) Connect() (err error) {
 	c.Disconnect()
 
-	var toDial string
-	if !strings.Contains(c.host, ":") {
-		toDial = c.host + ":" + defaultPorts[c.scheme]
-	} else {
-		toDial = c.host
+	if c.deadlineExceeded() {
+		return errRequestDeadline
+	}
+
+	toDial := c.host
+	if _, _, err := net.SplitHostPort(c.host); err != nil {
+		toDial = net.JoinHostPort(c.hostname(), defaultPorts[c.scheme])
 	}
 
 	if c.isProxy() {
-		if c.proxy.Scheme != "http" {
+		if c.proxy.Scheme != "http" && !isSOCKS5(c.proxy) {
 			panic("Unsupported HTTP Proxy method")
 		}
 		Debug("[HTTPClient] Connecting to proxy", c.proxy.String(), "<>", toDial)
-		c.conn, err = net.DialTimeout("tcp", c.proxy.Host, c.config.ConnectionTimeout)
+		c.conn, err = net.DialTimeout("tcp", c.proxy.Host, c.connectTimeout())
 		if err != nil {
 			return
 		}
-		if c.scheme == "https" {
+		c.setConnectDeadline()
+		if isSOCKS5(c.proxy) {
+			if err = socks5Connect(c.conn, toDial, c.proxy.User); err != nil {
+				return
+			}
+		} else if c.scheme == "https" {
 			c.conn.Write([]byte("CONNECT " + toDial + " HTTP/1.1\r\n"))
 			if c.proxyAuth != "" {
 				c.conn.Write([]byte("Proxy-Authorization: " + c.proxyAuth + "\r\n"))
@@ -154,8 +236,21 @@ func (c *HTTPClient) Connect() (err error) {
 		}
 		Debug("[HTTPClient] Proxy successfully connected")
 	} else {
-		c.conn, err = net.DialTimeout("tcp", toDial, c.config.ConnectionTimeout)
+		toDial = c.targetAddr(toDial)
+		if c.config.ReleaseTarget != nil {
+			c.target = toDial
+		}
+
+		c.conn, err = net.DialTimeout("tcp", toDial, c.connectTimeout())
 		if err != nil {
+			c.releaseTarget(true)
+			return
+		}
+		c.setConnectDeadline()
+	}
+
+	if c.config.Socket != nil {
+		if err = c.config.Socket.apply(c.conn); err != nil {
 			return
 		}
 	}
@@ -163,11 +258,15 @@ func (c *HTTPClient) Connect() (err error) {
 	if c.scheme == "https" {
 		// Wrap our socket in TLS
 		Debug("[HTTPClient] Wrapping socket in TLS", c.host)
-		tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true, ServerName: c.host})
+		tlsConn := tls.Client(c.conn, c.tlsConfig())
 
+		tlsConn.SetDeadline(time.Now().Add(c.connectTimeout()))
 		if err = tlsConn.Handshake(); err != nil {
+			c.releaseTarget(true)
 			return
 		}
+		// Back to request deadline, if any
+		tlsConn.SetDeadline(c.deadline)
 
 		c.conn = tlsConn
 		Debug("[HTTPClient] Successfully wrapped in TLS")
@@ -176,12 +275,116 @@ func (c *HTTPClient) Connect() (err error) {
 	return
 }
 
+// tlsConfig returns configuration of TLS connection to the target host
+func (c *HTTPClient) tlsConfig() *tls.Config {
+	if c.config.TLSConfig == nil {
+		return &tls.Config{InsecureSkipVerify: true, ServerName: c.hostname()}
+	}
+
+	config := c.config.TLSConfig.Clone()
+	if config.ServerName == "" {
+		// Certificate is verified against host name, without port
+		config.ServerName = c.hostname()
+	}
+
+	return config
+}
+
+// hostname returns target host without port, and without brackets of IPv6 address
+func (c *HTTPClient) hostname() string {
+	u := url.URL{Host: c.host}
+	return u.Hostname()
+}
+
+// connectTimeout limits dial time by request deadline, if it comes earlier than connection timeout
+func (c *HTTPClient) connectTimeout() time.Duration {
+	timeout := c.config.ConnectionTimeout
+
+	if !c.deadline.IsZero() {
+		if left := time.Until(c.deadline); left < timeout {
+			// Zero means no timeout for net.DialTimeout
+			if left <= 0 {
+				left = time.Nanosecond
+			}
+			timeout = left
+		}
+	}
+
+	return timeout
+}
+
+// setConnectDeadline makes sure that proxy negotiation and TLS handshake do not exceed request deadline
+func (c *HTTPClient) setConnectDeadline() {
+	if !c.deadline.IsZero() {
+		c.conn.SetDeadline(c.deadline)
+	}
+}
+
+// targetAddr returns address to connect to instead of target host address, if configured
+func (c *HTTPClient) targetAddr(addr string) string {
+	if c.config.PickTarget != nil {
+		if picked := c.config.PickTarget(); picked != "" {
+			Debug("[HTTPClient] Connecting to", picked, "of", c.host)
+			return picked
+		}
+	}
+
+	if len(c.config.TargetIPs) > 0 {
+		_, port, _ := net.SplitHostPort(addr)
+		ip := c.config.TargetIPs[rand.Intn(len(c.config.TargetIPs))]
+		addr = net.JoinHostPort(ip.String(), port)
+		Debug("[HTTPClient] Connecting to", addr, "of", c.host)
+	}
+
+	return addr
+}
+
+// dialContext is used by CompatibilityMode client, to connect to the same targets as built-in client
+func (c *HTTPClient) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.config.ConnectionTimeout}
+
+	return dialer.DialContext(ctx, network, c.targetAddr(addr))
+}
+
+// resolveTargetIPs returns all IPv4 and IPv6 addresses of the target host
+func resolveTargetIPs(address string) []net.IP {
+	if !strings.HasPrefix(address, "http") {
+		address = "http://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil
+	}
+
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		log.Println("[HTTPClient] Can't resolve target, using default resolver:", err)
+		return nil
+	}
+
+	Debug("[HTTPClient] Target", u.Hostname(), "resolved to", ips)
+
+	return ips
+}
+
 func (c *HTTPClient) Disconnect() {
 	if c.conn != nil {
 		c.conn.Close()
 		c.conn = nil
 		Debug("[HTTP] Disconnected: ", c.baseURL)
 	}
+
+	c.releaseTarget(false)
+}
+
+// releaseTarget tells balancer that connection to picked target is closed
+func (c *HTTPClient) releaseTarget(failed bool) {
+	if c.target != "" && c.config.ReleaseTarget != nil {
+		c.config.ReleaseTarget(c.target, failed)
+	}
+
+	c.target = ""
 }
 
 func (c *HTTPClient) isAlive(readBytes *int) bool {
@@ -225,15 +428,59 @@ func (c *HTTPClient) SendGoClient(data []byte) ([]byte, error) {
 
 	req.URL, _ = url.ParseRequestURI(c.scheme + "://" + c.host + req.RequestURI)
 	req.RequestURI = ""
+
+	// Captured HTTP/1.1 request can be sent over HTTP/2, which forbids connection-specific headers.
+	// Transport manages connections by itself, and `Connection: close` is already kept in req.Close.
+	if c.config.H2C || c.scheme == "https" {
+		for _, h := range hopByHopHeaders {
+			req.Header.Del(h)
+		}
+	}
+
+	// Deadline covers whole request, including dial and reading of the body
+	var ctx context.Context
+	if c.config.RequestDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), c.config.RequestDeadline)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
 	startT := time.Now()
 	resp, err = c.goClient.Do(req)
 	tc := time.Since(startT)
 	if err != nil {
+		if ctx != nil && ctx.Err() == context.DeadlineExceeded {
+			return errorPayload(HTTP_TIMEOUT), errRequestDeadline
+		}
 		return nil, err
 	}
 	metrics.ObserveTotalRequestsTimeHistogram(req.RequestURI, tc.Seconds())
 	metrics.IncreaseTotalRequests(req.RequestURI, resp.Status)
-	return httputil.DumpResponse(resp, true)
+
+	payload, err := httputil.DumpResponse(resp, true)
+	if err != nil && ctx != nil && ctx.Err() == context.DeadlineExceeded {
+		return errorPayload(HTTP_TIMEOUT), errRequestDeadline
+	}
+
+	return payload, err
+}
+
+// SendWithID sends request same way as Send, but adds given payload ID to connection error logs
+func (c *HTTPClient) SendWithID(id []byte, data []byte) ([]byte, error) {
+	c.requestID = id
+	defer func() { c.requestID = nil }()
+
+	return c.Send(data)
+}
+
+func (c *HTTPClient) logConnectionError(err error) {
+	if len(c.requestID) > 0 {
+		log.Println("[HTTPClient] Connection error:", c.baseURL, "request", string(c.requestID), err)
+		return
+	}
+
+	log.Println("[HTTPClient] Connection error:", c.baseURL, err)
 }
 
 func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
@@ -251,15 +498,53 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		}
 	}()
 
+	if c.config.DecompressResponse {
+		defer func() {
+			if err == nil {
+				if decoded, ok := gunzipHTTP(response); ok {
+					response = proto.DeleteHeader(decoded, []byte("Content-Encoding"))
+				}
+			}
+		}()
+	}
+
+	if c.config.RewriteReferer && !c.config.OriginalHost {
+		data = c.rewriteReferer(data)
+	}
+
+	// Stream properties of captured HTTP/2 requests are only for filters
+	data = proto.DeleteHTTP2StreamHeaders(data)
+
 	if c.config.CompatibilityMode {
 		return c.SendGoClient(data)
 	}
 
+	if c.config.RequestDeadline > 0 {
+		c.deadline = time.Now().Add(c.config.RequestDeadline)
+	} else {
+		c.deadline = time.Time{}
+	}
+
+	if c.config.NoKeepAlive {
+		// Previous connection is closed after each response, so new one is opened below
+		data = proto.SetHeader(data, []byte("Connection"), []byte("close"))
+		defer c.Disconnect()
+	}
+
 	var readBytes int
-	if c.conn == nil || !c.isAlive(&readBytes) {
+	reused := c.conn != nil
+	if c.conn == nil || (!c.config.SkipAliveCheck && !c.isAlive(&readBytes)) {
 		Debug("[HTTPClient] Connecting:", c.baseURL)
 		if err = c.Connect(); err != nil {
-			log.Println("[HTTPClient] Connection error:", err)
+			if c.deadlineExceeded() {
+				Debug("[HTTPClient] Request deadline exceeded while connecting", c.config.RequestDeadline, c.baseURL)
+				c.Disconnect()
+				response = errorPayload(HTTP_TIMEOUT)
+				err = errRequestDeadline
+				return
+			}
+
+			c.logConnectionError(err)
 			response = errorPayload(HTTP_CONNECTION_ERROR)
 			return
 		}
@@ -267,13 +552,14 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 
 	timeout := time.Now().Add(c.config.Timeout)
 
-	c.conn.SetWriteDeadline(timeout)
+	c.conn.SetWriteDeadline(c.capDeadline(timeout))
 
 	if !c.config.OriginalHost {
 		data = proto.SetHost(data, []byte(c.baseURL), []byte(c.host))
 	}
 
-	if c.isProxy() && c.scheme == "http" {
+	// SOCKS5 proxy tunnels connection, so requests are sent as is
+	if c.isProxy() && !isSOCKS5(c.proxy) && c.scheme == "http" {
 		path := proto.Path(data)
 		if len(path) > 0 && path[0] == '/' {
 			data = proto.SetPath(data, c.proxyPath(path))
@@ -287,31 +573,187 @@ func (c *HTTPClient) Send(data []byte) (response []byte, err error) {
 		data = proto.SetHeader(data, []byte("Authorization"), []byte(c.auth))
 	}
 
+	if isChunked(data) {
+		// Targets reject requests with both headers, as length of the message is ambiguous
+		data = proto.DeleteHeader(data, []byte("Content-Length"))
+
+		if !bytes.HasSuffix(data, chunkedSuffix) {
+			Debug("[HTTPClient] Chunked request is not finished, target will wait for the rest of body:", c.baseURL)
+		}
+	}
+
+	if c.config.FaultRate > 0 && rand.Float64() < c.config.FaultRate {
+		return c.sendFault(data, readBytes, timeout)
+	}
+
 	if c.config.Debug {
 		Debug("[HTTPClient] Sending:", string(data))
 	}
-	return c.send(data, readBytes, timeout)
+
+	response, err = c.send(data, readBytes, timeout, false)
+	if !reused || !c.config.SkipAliveCheck || !c.connClosed {
+		return
+	}
+
+	// Connection was not probed, so it could be closed by target while idle
+	Debug("[HTTPClient] Connection closed by target, resending:", c.baseURL)
+	if err = c.Connect(); err != nil {
+		c.logConnectionError(err)
+		response = errorPayload(HTTP_CONNECTION_ERROR)
+		return
+	}
+
+	timeout = time.Now().Add(c.config.Timeout)
+	c.conn.SetWriteDeadline(c.capDeadline(timeout))
+
+	return c.send(data, 0, timeout, false)
+}
+
+// Headers with URL of the page, which made request. Targets check them against own host to prevent CSRF.
+var refererHeaders = [][]byte{[]byte("Referer"), []byte("Origin")}
+
+// rewriteReferer replaces host in Referer and Origin headers, which point to the site of the request,
+// so they stay consistent with rewritten Host header. Headers pointing to other sites are kept as is.
+func (c *HTTPClient) rewriteReferer(data []byte) []byte {
+	host := proto.Header(data, []byte("Host"))
+	if len(host) == 0 {
+		// Absolute URL of HTTP/1.0 and proxy requests
+		if u, err := url.Parse(string(proto.Path(data))); err == nil {
+			host = []byte(u.Host)
+		}
+	}
+
+	if len(host) == 0 {
+		return data
+	}
+
+	for _, name := range refererHeaders {
+		value := proto.Header(data, name)
+		if len(value) == 0 {
+			continue
+		}
+
+		u, err := url.Parse(string(value))
+		if err != nil || !strings.EqualFold(u.Host, string(host)) {
+			continue
+		}
+
+		u.Scheme, u.Host = c.scheme, c.host
+		data = proto.SetHeader(data, name, []byte(u.String()))
+	}
+
+	return data
+}
+
+// Faults injected by --output-http-fault-type
+const (
+	faultTruncate = "truncate"
+	faultCorrupt  = "corrupt"
+	faultReset    = "reset"
+)
+
+// sendFault sends malformed request, and returns response of the target, if any.
+// Connection can't be reused after it, so it is closed.
+func (c *HTTPClient) sendFault(data []byte, readBytes int, timeout time.Time) (response []byte, err error) {
+	defer c.Disconnect()
+
+	if c.config.Debug {
+		Debug("[HTTPClient] Sending with", c.config.FaultType, "fault:", string(data))
+	}
+
+	switch c.config.FaultType {
+	case faultTruncate:
+		return c.send(truncatePayload(data), readBytes, timeout, true)
+	case faultCorrupt:
+		return c.send(corruptHeader(data), readBytes, timeout, true)
+	}
+
+	// Drop connection in the middle of request, with RST instead of graceful close
+	if _, err = c.conn.Write(data[:len(data)/2]); err != nil {
+		Debug("[HTTPClient] Write error:", err, c.baseURL)
+	}
+	if conn, ok := c.conn.(*net.TCPConn); ok {
+		conn.SetLinger(0)
+	}
+
+	return errorPayload(HTTP_CONNECTION_ERROR), nil
+}
+
+// truncatePayload cuts half of the body, or of the headers if request has no body
+func truncatePayload(data []byte) []byte {
+	body := proto.Body(data)
+	if len(body) == 0 {
+		return data[:len(data)/2]
+	}
+
+	return data[:len(data)-(len(body)+1)/2]
+}
+
+// corruptHeader removes delimiter of random header line, or adds such line if request has no headers
+func corruptHeader(data []byte) []byte {
+	start, end := proto.MIMEHeadersStartPos(data), proto.MIMEHeadersEndPos(data)-len(proto.CLRF)
+	if end < start {
+		return data
+	}
+	headers := data[start:end]
+
+	var lines []int
+	for pos := 0; pos < len(headers); {
+		lines = append(lines, start+pos)
+
+		next := bytes.Index(headers[pos:], proto.CLRF)
+		if next == -1 {
+			break
+		}
+		pos += next + len(proto.CLRF)
+	}
+
+	corrupted := make([]byte, 0, len(data)+len("Gor-Fault\r\n"))
+	if len(lines) == 0 {
+		corrupted = append(corrupted, data[:start]...)
+		corrupted = append(corrupted, "Gor-Fault\r\n"...)
+		return append(corrupted, data[start:]...)
+	}
+
+	line := lines[rand.Intn(len(lines))]
+	delim := bytes.IndexByte(data[line:end], ':')
+	if delim == -1 {
+		return data
+	}
+	corrupted = append(corrupted, data[:line+delim]...)
+	return append(corrupted, data[line+delim+1:]...)
 }
 
-func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (response []byte, err error) {
+// send writes request and reads response. If halfClose is set, sending side of connection is closed after request,
+// so target does not wait for the rest of malformed request.
+func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time, halfClose bool) (response []byte, err error) {
 	var payload []byte
 	var n int
-	if _, err = c.conn.Write(data); err != nil {
+	c.connClosed = false
+	if err = c.write(data); err != nil {
 		Debug("[HTTPClient] Write error:", err, c.baseURL)
 		response = errorPayload(HTTP_TIMEOUT)
+		c.connClosed = !isTimeoutError(err)
 		c.Disconnect()
 		return
 	}
 
+	if halfClose {
+		if conn, ok := c.conn.(interface{ CloseWrite() error }); ok {
+			conn.CloseWrite()
+		}
+	}
+
 	var currentChunk []byte
 	timeout = time.Now().Add(c.config.Timeout)
+	isHead := bytes.Equal(proto.Method(data), []byte("HEAD"))
 	chunked := false
 	contentLength := -1
 	currentContentLength := 0
 	chunks := 0
 
 	for {
-		c.conn.SetReadDeadline(timeout)
+		c.conn.SetReadDeadline(c.capDeadline(timeout))
 
 		if readBytes < len(c.respBuf) {
 			n, err = c.conn.Read(c.respBuf[readBytes:])
@@ -322,33 +764,49 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 			if chunked || contentLength != -1 {
 				currentContentLength += n
 			} else {
+				// We want to soak up all 100 Continues received to get the real result code
+				firstEmptyLine := bytes.Index(c.respBuf[:readBytes], proto.EmptyLine)
+				informational := false
+				for firstEmptyLine != -1 {
+					status, _ := strconv.Atoi(string(proto.Status(c.respBuf[:readBytes])))
+					if status < 100 || status >= 200 {
+						break
+					}
+
+					informational = true
+					deleteLen := firstEmptyLine + len(proto.EmptyLine)
+					copy(c.respBuf, c.respBuf[deleteLen:readBytes])
+					readBytes -= deleteLen
+					firstEmptyLine = bytes.Index(c.respBuf[:readBytes], proto.EmptyLine)
+				}
+
+				if informational {
+					timeout = time.Now().Add(c.config.Timeout)
+					chunks--
+				}
+
 				// If headers are finished
-				var firstEmptyLine = bytes.Index(c.respBuf[:readBytes], proto.EmptyLine)
 				if firstEmptyLine != -1 {
-					if bytes.Equal(proto.Header(c.respBuf[:readBytes], []byte("Transfer-Encoding")), []byte("chunked")) {
+					status, _ := strconv.Atoi(string(proto.Status(c.respBuf[:readBytes])))
+
+					// Responses to HEAD requests can contain Content-Length or Transfer-Encoding, but never have body
+					if isHead || status == 204 || status == 304 {
+						contentLength = 0
+						break
+					}
+
+					if isChunked(c.respBuf[:readBytes]) {
 						chunked = true
 					} else {
-						status, _ := strconv.Atoi(string(proto.Status(c.respBuf[:readBytes])))
-						// We want to soak up all 100 Continues received to get the real result code
-						if status >= 100 && status < 200 {
-							timeout = time.Now().Add(c.config.Timeout)
-							var deleteLen = firstEmptyLine + len(proto.EmptyLine)
-							copy(c.respBuf, c.respBuf[deleteLen:readBytes])
-							readBytes -= deleteLen
-							chunks--
-							continue
-						} else if status == 204 || status == 304 {
-							contentLength = 0
-							break
-						} else {
-							l := proto.Header(c.respBuf[:readBytes], []byte("Content-Length"))
-							if len(l) > 0 {
-								contentLength, _ = strconv.Atoi(string(l))
-							}
+						l := proto.Header(c.respBuf[:readBytes], []byte("Content-Length"))
+						if len(l) > 0 {
+							contentLength, _ = strconv.Atoi(string(l))
 						}
 					}
 
 					currentContentLength += len(proto.Body(c.respBuf[:readBytes]))
+				} else if informational {
+					continue
 				}
 			}
 
@@ -422,6 +880,14 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 		timeout = time.Now().Add(c.config.Timeout / 5)
 	}
 
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && c.deadlineExceeded() {
+		Debug("[HTTPClient] Request deadline exceeded", c.config.RequestDeadline, readBytes, c.baseURL)
+		response = errorPayload(HTTP_TIMEOUT)
+		err = errRequestDeadline
+		c.Disconnect()
+		return
+	}
+
 	if err != nil && readBytes == 0 {
 		maxRead := 100
 		if readBytes < maxRead {
@@ -429,6 +895,8 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 		}
 		Debug("[HTTPClient] Response read timeout error", err, c.conn, readBytes, string(c.respBuf[:maxRead]))
 		response = errorPayload(HTTP_TIMEOUT)
+		// Target could have processed written request, so only requests without side effects are resent
+		c.connClosed = !isTimeoutError(err) && isIdempotent(data)
 		c.Disconnect()
 		return
 	}
@@ -440,6 +908,7 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 		}
 		Debug("[HTTPClient] Response read unknown error", err, c.conn, readBytes, string(c.respBuf[:maxRead]))
 		response = errorPayload(HTTP_UNKNOWN_ERROR)
+		c.connClosed = readBytes == 0 && isIdempotent(data)
 		c.Disconnect()
 		return
 	}
@@ -482,6 +951,59 @@ func (c *HTTPClient) send(data []byte, readBytes int, timeout time.Time) (respon
 	return payload, err
 }
 
+// write sends request. Chunked request is written by readChunkSize pieces, each with own write deadline, the same way
+// as response is read, so large uploads are limited by speed of target rather than by the total timeout.
+func (c *HTTPClient) write(data []byte) error {
+	if !isChunked(data) {
+		_, err := c.conn.Write(data)
+		return err
+	}
+
+	for len(data) > 0 {
+		n := readChunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+
+		if _, err := c.conn.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+
+		c.conn.SetWriteDeadline(c.capDeadline(time.Now().Add(c.config.Timeout)))
+	}
+
+	return nil
+}
+
+// isIdempotent tells if request can be sent twice without side effects, the same methods are retried by net/http
+func isIdempotent(data []byte) bool {
+	switch string(proto.Method(data)) {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+
+	return false
+}
+
+func isTimeoutError(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// capDeadline makes sure that I/O timeout do not exceed hard request deadline
+func (c *HTTPClient) capDeadline(timeout time.Time) time.Time {
+	if !c.deadline.IsZero() && c.deadline.Before(timeout) {
+		return c.deadline
+	}
+
+	return timeout
+}
+
+func (c *HTTPClient) deadlineExceeded() bool {
+	return !c.deadline.IsZero() && !time.Now().Before(c.deadline)
+}
+
 func (c *HTTPClient) Get(path string) (response []byte, err error) {
 	payload := "GET " + path + " HTTP/1.1\r\n\r\n"
 
@@ -496,6 +1018,32 @@ func (c *HTTPClient) Post(path string, body []byte) (response []byte, err error)
 	return c.Send([]byte(payload))
 }
 
+// PostChunked sends body with Transfer-Encoding: chunked, each read from body becomes separate chunk.
+// Body is not streamed: it is read into memory before request is sent, the same way as request is passed to Send.
+func (c *HTTPClient) PostChunked(path string, body io.Reader) (response []byte, err error) {
+	var payload bytes.Buffer
+	payload.WriteString("POST " + path + " HTTP/1.1\r\n")
+	payload.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+
+	w := httputil.NewChunkedWriter(&payload)
+	buf := make([]byte, readChunkSize)
+	for {
+		n, rerr := body.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return nil, rerr
+		}
+	}
+	w.Close()
+	payload.WriteString("\r\n")
+
+	return c.Send(payload.Bytes())
+}
+
 func (c *HTTPClient) proxyPath(path []byte) []byte {
 	return append([]byte(c.scheme+"://"+c.host), path...)
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+)
+
+// httpClientPool is a fixed set of keep-alive connections to the target, shared by workers of HTTP output.
+// Each request is sent over free connection, so at most `size` requests are in flight at once.
+type httpClientPool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// Free clients, the last one was used most recently
+	idle []*HTTPClient
+}
+
+func newHTTPClientPool(size int, newClient func() *HTTPClient) *httpClientPool {
+	p := &httpClientPool{idle: make([]*HTTPClient, size)}
+	p.cond = sync.NewCond(&p.mu)
+
+	for i := range p.idle {
+		p.idle[i] = newClient()
+	}
+
+	return p
+}
+
+// Get returns free client, waiting for one if all are busy.
+// Recently used clients are preferred, because their connections are most likely still open.
+func (p *httpClientPool) Get() *HTTPClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.idle) == 0 {
+		p.cond.Wait()
+	}
+
+	c := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+
+	return c
+}
+
+// Put returns client taken by Get
+func (p *httpClientPool) Put(c *HTTPClient) {
+	p.mu.Lock()
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+
+	p.cond.Signal()
+}
+
+// Close disconnects free clients
+func (p *httpClientPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range p.idle {
+		c.Disconnect()
+	}
+}
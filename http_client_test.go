@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
+	"crypto/tls"
 	"io/ioutil"
 	_ "log"
 	"net"
@@ -12,10 +14,13 @@ import (
 	_ "reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/buger/goreplay/proto"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestHTTPClientURLPort(t *testing.T) {
@@ -40,6 +45,37 @@ func TestHTTPClientURLPort(t *testing.T) {
 	}
 }
 
+func TestHTTPClientIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available:", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Listener.Close()
+	server.Listener = ln
+	server.Start()
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{})
+	if client.hostname() != "::1" {
+		t.Error("Brackets and port should be removed from hostname:", client.hostname())
+	}
+
+	resp, err := client.Send([]byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(resp, []byte("HTTP/1.1 200 OK")) {
+		t.Error("Wrong response:", string(resp))
+	}
+
+	// Default port is added to address without port
+	if client = NewHTTPClient("http://[::1]", &HTTPClientConfig{}); client.hostname() != "::1" {
+		t.Error("Wrong hostname:", client.hostname())
+	}
+}
+
 func TestHTTPClientSend(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
@@ -253,6 +289,38 @@ func TestHTTPClientHTTPSSend(t *testing.T) {
 	wg.Wait()
 }
 
+func TestHTTPClientHTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	payload := []byte("GET / HTTP/1.1\r\nConnection: keep-alive\r\n\r\n")
+
+	h2cServer := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cServer.Close()
+
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	for _, c := range []struct {
+		url    string
+		config *HTTPClientConfig
+	}{
+		{h2cServer.URL, &HTTPClientConfig{CompatibilityMode: true, H2C: true}},
+		// Client certificate settings make client use custom transport
+		{tlsServer.URL, &HTTPClientConfig{CompatibilityMode: true, TLSConfig: &tls.Config{InsecureSkipVerify: true}}},
+	} {
+		resp, err := NewHTTPClient(c.url, c.config).Send(payload)
+		if err != nil {
+			t.Fatal(c.url, err)
+		}
+		if !bytes.HasSuffix(resp, []byte("HTTP/2.0")) {
+			t.Errorf("Expected HTTP/2 request to %s, got response:\n%s", c.url, resp)
+		}
+	}
+}
+
 func TestHTTPClientServerInstantDisconnect(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
@@ -531,3 +599,524 @@ func TestHTTPClientErrors(t *testing.T) {
 		t.Error("Should throw error")
 	}
 }
+
+func TestHTTPClientRequestDeadline(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Read(make([]byte, 1024))
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"))
+
+		// Trickle body, each chunk arrives before read timeout
+		for i := 0; i < 20; i++ {
+			time.Sleep(20 * time.Millisecond)
+			if _, err := conn.Write([]byte("a")); err != nil {
+				return
+			}
+		}
+	}()
+
+	client := NewHTTPClient(ln.Addr().String(), &HTTPClientConfig{Timeout: time.Second, RequestDeadline: 100 * time.Millisecond})
+
+	start := time.Now()
+	resp, err := client.Send([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	if err != errRequestDeadline {
+		t.Error("Should abort request after deadline, got:", err)
+	}
+
+	if s := proto.Status(resp); !bytes.Equal(s, []byte("524")) {
+		t.Error("Should return status 524, instead:", string(s))
+	}
+
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Error("Request took too long:", elapsed)
+	}
+}
+
+func TestHTTPClientHEADRequest(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+
+			// Connection is kept open, and body is never sent
+			if bytes.HasPrefix(buf, []byte("HEAD")) {
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n"))
+			} else {
+				conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+			}
+		}
+	}()
+
+	client := NewHTTPClient(ln.Addr().String(), &HTTPClientConfig{Timeout: time.Second})
+
+	for _, req := range []string{"HEAD / HTTP/1.1\r\n\r\n", "POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nok"} {
+		start := time.Now()
+		resp, err := client.Send([]byte(req))
+
+		if err != nil {
+			t.Error("Should not return error:", err)
+		}
+
+		if s := proto.Status(resp); !bytes.Equal(s, []byte("200")) {
+			t.Error("Should return status 200, instead:", string(s))
+		}
+
+		if time.Since(start) > 500*time.Millisecond {
+			t.Error("Should not wait for the body:", req)
+		}
+	}
+}
+
+func TestHTTPClientRandomTarget(t *testing.T) {
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	client := NewHTTPClient("http://example.invalid:"+port, &HTTPClientConfig{Timeout: time.Second, TargetIPs: []net.IP{net.ParseIP("127.0.0.1")}})
+
+	if _, err := client.Send([]byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if host != "example.invalid:"+port {
+		t.Error("Should keep original host:", host)
+	}
+
+	if ips := resolveTargetIPs("http://localhost:80"); len(ips) == 0 {
+		t.Error("Should resolve localhost")
+	}
+}
+
+func TestHTTPClientNoKeepAlive(t *testing.T) {
+	var connections int32
+	var headers []string
+	var mu sync.Mutex
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Get("Connection"))
+		mu.Unlock()
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{NoKeepAlive: true})
+
+	for i := 0; i < 3; i++ {
+		if resp, err := client.Send([]byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")); err != nil || !bytes.Equal(proto.Status(resp), []byte("200")) {
+			t.Fatal("Request failed:", err, string(resp))
+		}
+
+		if client.conn != nil {
+			t.Error("Connection should be closed after response")
+		}
+	}
+
+	if n := atomic.LoadInt32(&connections); n != 3 {
+		t.Error("Should open connection for each request:", n)
+	}
+
+	for _, h := range headers {
+		if h != "close" {
+			t.Error("Should send Connection: close header:", headers)
+		}
+	}
+}
+
+func TestHTTPClientPickTargetCompatibilityMode(t *testing.T) {
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	client := NewHTTPClient("http://example.invalid:"+port, &HTTPClientConfig{
+		Timeout:           time.Second,
+		CompatibilityMode: true,
+		PickTarget:        func() string { return server.Listener.Addr().String() },
+	})
+
+	if _, err := client.Send([]byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if host != "example.invalid:"+port {
+		t.Error("Should keep original host:", host)
+	}
+}
+
+func TestHTTPClientRequestDeadlineConnect(t *testing.T) {
+	// Accepts connections, but never completes TLS handshake
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := NewHTTPClient("https://"+ln.Addr().String(), &HTTPClientConfig{Timeout: 5 * time.Second, RequestDeadline: 100 * time.Millisecond})
+
+	start := time.Now()
+	resp, err := client.Send([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	if err != errRequestDeadline {
+		t.Error("Should abort request after deadline, got:", err)
+	}
+
+	if s := proto.Status(resp); !bytes.Equal(s, []byte("524")) {
+		t.Error("Should return status 524, instead:", string(s))
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Handshake should be limited by deadline:", elapsed)
+	}
+}
+
+func TestHTTPClientConnectionTimeout(t *testing.T) {
+	// Accepts connections, but never completes TLS handshake
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := NewHTTPClient("https://"+ln.Addr().String(), &HTTPClientConfig{Timeout: 5 * time.Second, ConnectionTimeout: 100 * time.Millisecond})
+
+	if client.config.Timeout != 5*time.Second {
+		t.Error("Timeout should not be changed:", client.config.Timeout)
+	}
+
+	start := time.Now()
+	resp, _ := client.Send([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	if s := proto.Status(resp); !bytes.Equal(s, []byte("521")) {
+		t.Error("Should return status 521, instead:", string(s))
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Handshake should be limited by connection timeout:", elapsed)
+	}
+
+	client = NewHTTPClient("http://"+ln.Addr().String(), &HTTPClientConfig{Timeout: 2 * time.Second})
+	if client.config.ConnectionTimeout != 2*time.Second {
+		t.Error("Connection timeout should default to timeout:", client.config.ConnectionTimeout)
+	}
+}
+
+func TestHTTPClientRequestDeadlineCompatibilityMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: 5 * time.Second, RequestDeadline: 100 * time.Millisecond, CompatibilityMode: true})
+
+	start := time.Now()
+	resp, err := client.Send([]byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n"))
+
+	if err != errRequestDeadline {
+		t.Error("Should abort request after deadline, got:", err)
+	}
+
+	if s := proto.Status(resp); !bytes.Equal(s, []byte("524")) {
+		t.Error("Should return status 524, instead:", string(s))
+	}
+
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Error("Request took too long:", elapsed)
+	}
+}
+
+func TestHTTPClientFault(t *testing.T) {
+	var handled int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&handled, 1)
+
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	payload := []byte("POST /post HTTP/1.1\r\nContent-Length: 7\r\nHost: www.w3.org\r\n\r\na=1&b=2")
+
+	tests := []struct {
+		fault   string
+		status  string
+		handled int32
+	}{
+		// Handler gets only part of the body
+		{faultTruncate, "400", 1},
+		// Server rejects malformed header before handler
+		{faultCorrupt, "400", 0},
+		{faultReset, HTTP_CONNECTION_ERROR, 0},
+	}
+
+	for _, tt := range tests {
+		atomic.StoreInt32(&handled, 0)
+
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, FaultRate: 1, FaultType: tt.fault})
+
+		resp, err := client.Send(payload)
+		if err != nil || !bytes.Equal(proto.Status(resp), []byte(tt.status)) {
+			t.Errorf("%s: expected %s status, got %q %v", tt.fault, tt.status, resp, err)
+		}
+
+		if client.conn != nil {
+			t.Error(tt.fault, ": connection should be closed after fault")
+		}
+
+		if n := atomic.LoadInt32(&handled); n != tt.handled {
+			t.Error(tt.fault, ": expected", tt.handled, "handled requests, got", n)
+		}
+	}
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, FaultRate: 0.5, FaultType: faultCorrupt})
+
+	var faults int
+	for i := 0; i < 100; i++ {
+		resp, _ := client.Send(payload)
+		if !bytes.Equal(proto.Status(resp), []byte("200")) {
+			faults++
+		}
+	}
+
+	if faults == 0 || faults == 100 {
+		t.Error("Fault should be injected only into sampled requests:", faults)
+	}
+}
+
+func TestHTTPClientCorruptHeader(t *testing.T) {
+	if c := corruptHeader([]byte("GET / HTTP/1.1\r\n\r\n")); string(c) != "GET / HTTP/1.1\r\nGor-Fault\r\n\r\n" {
+		t.Errorf("Should add malformed header line: %q", c)
+	}
+
+	c := corruptHeader([]byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n"))
+	if string(c) != "GET / HTTP/1.1\r\nHost www.w3.org\r\n\r\n" {
+		t.Errorf("Should remove header delimiter: %q", c)
+	}
+}
+
+func TestHTTPClientRewriteReferer(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer server.Close()
+
+	target := strings.TrimPrefix(server.URL, "http://")
+	payload := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\nReferer: https://www.w3.org/page?a=1\r\nOrigin: https://other.org\r\n\r\n")
+
+	for _, compatibility := range []bool{false, true} {
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{RewriteReferer: true, CompatibilityMode: compatibility})
+		client.Send(payload)
+
+		h := <-headers
+		if referer := h.Get("Referer"); referer != "http://"+target+"/page?a=1" {
+			t.Error("Referer of the same site should point to target:", referer)
+		}
+
+		if origin := h.Get("Origin"); origin != "https://other.org" {
+			t.Error("Origin of other site should not be changed:", origin)
+		}
+	}
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{RewriteReferer: true, OriginalHost: true})
+	client.Send(payload)
+
+	if referer := (<-headers).Get("Referer"); referer != "https://www.w3.org/page?a=1" {
+		t.Error("Referer should not be changed if Host is kept:", referer)
+	}
+}
+
+func TestHTTPClientSkipAliveCheck(t *testing.T) {
+	var requests int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	// Idle keep-alive connections are closed by target
+	server.Config.IdleTimeout = 20 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{SkipAliveCheck: true})
+	req := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Send(req)
+		if err != nil || !bytes.Equal(proto.Status(resp), []byte("200")) {
+			t.Fatalf("Request should be resent over new connection: %v %q", err, resp)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Error("Target should receive each request once, got:", n)
+	}
+}
+
+func TestHTTPClientDecompressResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		g := gzip.NewWriter(w)
+		g.Write([]byte(`{"id":1}`))
+		g.Close()
+	}))
+	defer server.Close()
+
+	req := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n")
+
+	for _, compatibility := range []bool{false, true} {
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{DecompressResponse: true, CompatibilityMode: compatibility})
+
+		resp, err := client.Send(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(proto.Body(resp)) != `{"id":1}` || len(proto.Header(resp, []byte("Content-Encoding"))) > 0 {
+			t.Errorf("Response should be decompressed, compatibility mode %v: %q", compatibility, resp)
+		}
+	}
+}
+
+func TestHTTPClientPostChunked(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), readChunkSize*3+10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		received, _ := ioutil.ReadAll(r.Body)
+
+		if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+			t.Error("Request should be chunked:", r.TransferEncoding, r.ContentLength)
+		}
+		if !bytes.Equal(received, body) {
+			t.Error("Wrong POST body length:", len(received))
+		}
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second})
+
+	resp, err := client.PostChunked("/", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := string(proto.Status(resp)); status != "200" {
+		t.Error("Wrong status:", status)
+	}
+}
+
+func TestIsChunked(t *testing.T) {
+	tests := []struct {
+		payload string
+		chunked bool
+	}{
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n", true},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, Chunked\r\n\r\n", true},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n", false},
+		{"POST / HTTP/1.1\r\nContent-Length: 7\r\n\r\na=1&b=2", false},
+	}
+
+	for _, tt := range tests {
+		if isChunked([]byte(tt.payload)) != tt.chunked {
+			t.Errorf("Expected chunked %v: %q", tt.chunked, tt.payload)
+		}
+	}
+}
+
+func TestHTTPClientDeletesHTTP2StreamHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name := range r.Header {
+			if strings.HasPrefix(name, "X-Http2-") {
+				t.Error("HTTP/2 stream header should not be sent:", name)
+			}
+		}
+		if r.Header.Get("Accept") != "*/*" {
+			t.Error("Other headers should be kept:", r.Header)
+		}
+	}))
+	defer server.Close()
+
+	req := []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\nX-Http2-Stream-Id: 3\r\nX-Http2-Priority: weight=16; depends-on=0; exclusive=0\r\nX-Http2-Flags: END_STREAM\r\nAccept: */*\r\n\r\n")
+
+	for _, compatibility := range []bool{false, true} {
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{Timeout: time.Second, CompatibilityMode: compatibility})
+		if _, err := client.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHTTPClientSkipAliveCheckNotIdempotent(t *testing.T) {
+	var requests int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	server.Config.IdleTimeout = 20 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, &HTTPClientConfig{SkipAliveCheck: true, Timeout: time.Second})
+	req := []byte("POST / HTTP/1.1\r\nHost: www.w3.org\r\nContent-Length: 3\r\n\r\na=1")
+
+	if resp, _ := client.Send(req); !bytes.Equal(proto.Status(resp), []byte("200")) {
+		t.Fatalf("First request should succeed: %q", resp)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Written request could be processed by target, so it is not resent
+	if resp, _ := client.Send(req); bytes.Equal(proto.Status(resp), []byte("200")) {
+		t.Errorf("POST should not be resent over new connection: %q", resp)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Error("Target should receive only the first request, got:", n)
+	}
+}
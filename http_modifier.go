@@ -3,39 +3,141 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"hash/fnv"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/buger/goreplay/byteutils"
 	"github.com/buger/goreplay/proto"
 )
 
+// Placeholders of --output-http-header-dynamic, filled from captured request
+var payloadTemplateRegexp = regexp.MustCompile(`\{\{([^}]*)\}\}`)
+
+// Only this prefix of request body is matched by --http-allow-body and --http-disallow-body
+const bodyFilterMaxLen = 64 * 1024
+
+var payloadTemplateFields = map[string]bool{"uuid": true, "timestamp": true, "host": true, "path": true}
+
 type HTTPModifier struct {
 	config *HTTPModifierConfig
+
+	// Values for templates of --http-set-header and --http-set-param
+	data *csvDataSource
+
+	// Authorization header value of --http-set-basic-auth
+	basicAuth []byte
 }
 
 func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
 	// Optimization to skip modifier completely if we do not need it
 	if len(config.urlRegexp) == 0 &&
 		len(config.urlNegativeRegexp) == 0 &&
+		len(config.bodyRegexp) == 0 &&
+		len(config.bodyNegativeRegexp) == 0 &&
 		len(config.urlRewrite) == 0 &&
 		len(config.headerRewrite) == 0 &&
+		len(config.jsonRewrite) == 0 &&
 		len(config.headerFilters) == 0 &&
 		len(config.headerNegativeFilters) == 0 &&
 		len(config.headerBasicAuthFilters) == 0 &&
 		len(config.headerHashFilters) == 0 &&
 		len(config.paramHashFilters) == 0 &&
+		len(config.rateLimits) == 0 &&
 		len(config.params) == 0 &&
 		len(config.headers) == 0 &&
-		len(config.methods) == 0 {
+		len(config.dynamicHeaders) == 0 &&
+		len(config.cookies) == 0 &&
+		len(config.methods) == 0 &&
+		len(config.dstPorts) == 0 &&
+		config.basicAuth == "" {
 		return nil
 	}
 
-	return &HTTPModifier{config: config}
+	m := &HTTPModifier{config: config}
+
+	for _, header := range config.dynamicHeaders {
+		for _, p := range payloadTemplateRegexp.FindAllStringSubmatch(header.Value, -1) {
+			if !payloadTemplateFields[p[1]] {
+				log.Fatal("output-http-header-dynamic: unknown placeholder ", p[0], ", expected {{uuid}}, {{timestamp}}, {{host}} or {{path}}")
+			}
+		}
+	}
+
+	if config.basicAuth != "" {
+		if !strings.Contains(config.basicAuth, ":") {
+			log.Fatal("http-set-basic-auth: credentials should be in user:pass format")
+		}
+
+		m.basicAuth = []byte("Basic " + base64.StdEncoding.EncodeToString([]byte(config.basicAuth)))
+	}
+
+	if config.dataFile != "" {
+		data, err := sharedCSVDataSource(config.dataFile, config.dataFileRandom)
+		if err != nil {
+			log.Fatal("data-file: ", err)
+		}
+
+		for _, header := range config.headers {
+			if err = data.Validate(header.Value); err != nil {
+				log.Fatal("http-set-header: ", err)
+			}
+		}
+
+		for _, param := range config.params {
+			if err = data.Validate(string(param.Value)); err != nil {
+				log.Fatal("http-set-param: ", err)
+			}
+		}
+
+		for _, cookie := range config.cookies {
+			if err = data.Validate(cookie.Value); err != nil {
+				log.Fatal("http-set-cookie: ", err)
+			}
+		}
+
+		m.data = data
+	}
+
+	return m
+}
+
+// AllowDstPort checks destination port of captured request.
+// If ports are filtered, requests without port information are not allowed.
+func (m *HTTPModifier) AllowDstPort(port uint16) bool {
+	if len(m.config.dstPorts) == 0 {
+		return true
+	}
+
+	for _, p := range m.config.dstPorts {
+		if p == port {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
+	response, _ = m.RewriteWithReason(payload)
+	return
+}
+
+// RewriteWithReason is Rewrite, which also returns name of the option that dropped request
+func (m *HTTPModifier) RewriteWithReason(payload []byte) (response []byte, reason string) {
+	return m.RewriteWithMeta(nil, payload)
+}
+
+// RewriteWithMeta is RewriteWithReason for request with Gor header, which meta is used by dynamic headers.
+// Without meta {{uuid}} and {{timestamp}} are empty.
+func (m *HTTPModifier) RewriteWithMeta(meta [][]byte, payload []byte) (response []byte, reason string) {
 	if !proto.IsHTTPPayload(payload) {
-		return payload
+		return payload, ""
 	}
 
 	if len(m.config.methods) > 0 {
@@ -51,19 +153,64 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 
 		if !matched {
-			return
+			return nil, "http-allow-method"
 		}
 	}
 
+	// Filled before any header is set, so values are of captured request
+	var dynamicValues [][]byte
+	if len(m.config.dynamicHeaders) > 0 {
+		dynamicValues = make([][]byte, len(m.config.dynamicHeaders))
+		for i, header := range m.config.dynamicHeaders {
+			dynamicValues[i] = expandPayloadTemplate(header.Value, meta, payload)
+		}
+	}
+
+	// All templates of the request are filled from the same data row
+	var row []string
+	if m.data != nil && (len(m.config.headers) > 0 || len(m.config.params) > 0 || len(m.config.cookies) > 0) {
+		row = m.data.Row()
+	}
+
 	if len(m.config.headers) > 0 {
 		for _, header := range m.config.headers {
-			payload = proto.SetHeader(payload, []byte(header.Name), []byte(header.Value))
+			value := header.Value
+			if row != nil {
+				value = m.data.Expand(value, row, nil)
+			}
+
+			payload = proto.SetHeader(payload, []byte(header.Name), []byte(value))
+		}
+	}
+
+	if len(m.config.dynamicHeaders) > 0 {
+		for i, header := range m.config.dynamicHeaders {
+			payload = proto.SetHeader(payload, []byte(header.Name), dynamicValues[i])
+		}
+	}
+
+	if len(m.config.cookies) > 0 {
+		cookies := proto.Header(payload, []byte("Cookie"))
+		for _, cookie := range m.config.cookies {
+			value := cookie.Value
+			if row != nil {
+				value = m.data.Expand(value, row, nil)
+			}
+
+			cookies = setCookie(cookies, cookie.Name, value)
 		}
+
+		payload = proto.SetHeader(payload, []byte("Cookie"), cookies)
 	}
 
 	if len(m.config.params) > 0 {
 		for _, param := range m.config.params {
-			payload = proto.SetPathParam(payload, param.Name, param.Value)
+			value := param.Value
+			if row != nil {
+				value = []byte(m.data.Expand(string(value), row, url.QueryEscape))
+			}
+
+			payload = proto.SetPathParam(payload, param.Name, value)
 		}
 	}
 
@@ -80,7 +227,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 
 		if !matched {
-			return
+			return nil, "http-allow-url"
 		}
 	}
 
@@ -89,7 +236,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 
 		for _, f := range m.config.urlNegativeRegexp {
 			if f.regexp.Match(path) {
-				return
+				return nil, "http-disallow-url"
 			}
 		}
 	}
@@ -99,11 +246,11 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 			value := proto.Header(payload, f.name)
 
 			if len(value) == 0 {
-				return
+				return nil, "http-allow-header"
 			}
 
 			if !f.regexp.Match(value) {
-				return
+				return nil, "http-allow-header"
 			}
 		}
 	}
@@ -113,7 +260,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 			value := proto.Header(payload, f.name)
 
 			if len(value) > 0 && f.regexp.Match(value) {
-				return
+				return nil, "http-disallow-header"
 			}
 		}
 	}
@@ -128,13 +275,42 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 				if strings.Compare(valueString, trimmedBasicAuthEncoded) != 0 {
 					decodedAuth, _ := base64.StdEncoding.DecodeString(trimmedBasicAuthEncoded)
 					if !f.regexp.Match(decodedAuth) {
-						return
+						return nil, "http-basic-auth-filter"
 					}
 				}
 			}
 		}
 	}
 
+	if len(m.config.bodyRegexp) > 0 || len(m.config.bodyNegativeRegexp) > 0 {
+		body := proto.Body(payload)
+		// Regexp cost grows with input, so big bodies are matched by prefix only
+		if len(body) > bodyFilterMaxLen {
+			body = body[:bodyFilterMaxLen]
+		}
+
+		if len(m.config.bodyRegexp) > 0 {
+			matched := false
+
+			for _, f := range m.config.bodyRegexp {
+				if f.regexp.Match(body) {
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				return nil, "http-allow-body"
+			}
+		}
+
+		for _, f := range m.config.bodyNegativeRegexp {
+			if f.regexp.Match(body) {
+				return nil, "http-disallow-body"
+			}
+		}
+	}
+
 	if len(m.config.headerHashFilters) > 0 {
 		for _, f := range m.config.headerHashFilters {
 			value := proto.Header(payload, f.name)
@@ -144,7 +320,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 				hasher.Write(value)
 
 				if (hasher.Sum32() % 100) >= f.percent {
-					return
+					return nil, "http-header-limiter"
 				}
 			}
 		}
@@ -159,12 +335,28 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 				hasher.Write(value)
 
 				if (hasher.Sum32() % 100) >= f.percent {
-					return
+					return nil, "http-param-limiter"
 				}
 			}
 		}
 	}
 
+	// Checked after filters, so dropped requests don't take tokens, and before rewrites to match original path
+	if len(m.config.rateLimits) > 0 {
+		method := proto.Method(payload)
+		path := proto.Path(payload)
+
+		for _, l := range m.config.rateLimits {
+			if (l.method == nil || bytes.Equal(method, l.method)) && l.path.Match(path) {
+				if !l.bucket.Allow(time.Now()) {
+					return nil, "http-rate-limit"
+				}
+
+				break
+			}
+		}
+	}
+
 	if len(m.config.urlRewrite) > 0 {
 		path := proto.Path(payload)
 
@@ -192,5 +384,91 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 	}
 
+	if len(m.config.jsonRewrite) > 0 {
+		payload = m.rewriteJSON(payload)
+	}
+
+	// Set last, so --http-basic-auth-filter and header rewrites see original credentials
+	if m.basicAuth != nil {
+		payload = proto.SetHeader(payload, []byte("Authorization"), m.basicAuth)
+	}
+
+	return payload, ""
+}
+
+// expandPayloadTemplate replaces placeholders of --output-http-header-dynamic with values of the request
+func expandPayloadTemplate(template string, meta [][]byte, payload []byte) []byte {
+	return payloadTemplateRegexp.ReplaceAllFunc([]byte(template), func(placeholder []byte) []byte {
+		switch string(placeholder[2 : len(placeholder)-2]) {
+		case "uuid":
+			if len(meta) > 1 {
+				return meta[1]
+			}
+		case "timestamp":
+			if len(meta) > 2 {
+				return meta[2]
+			}
+		case "host":
+			return proto.Header(payload, []byte("Host"))
+		case "path":
+			return proto.Path(payload)
+		}
+
+		return nil
+	})
+}
+
+// rewriteJSON sets fields of JSON request body, body is kept as is if it is not valid JSON
+func (m *HTTPModifier) rewriteJSON(payload []byte) []byte {
+	if !bytes.HasPrefix(bytes.ToLower(proto.Header(payload, []byte("Content-Type"))), []byte("application/json")) {
+		return payload
+	}
+
+	bodyStart := proto.MIMEHeadersEndPos(payload)
+	if !json.Valid(payload[bodyStart:]) {
+		Debug("[HTTP-MODIFIER] Body is not valid JSON, skipping --http-rewrite-json")
+		return payload
+	}
+
+	for _, f := range m.config.jsonRewrite {
+		start, end, ok := jsonPathSpan(payload[bodyStart:], f.path)
+		if !ok {
+			Debug("[HTTP-MODIFIER] JSON path not found:", f.src)
+			continue
+		}
+
+		payload = byteutils.Replace(payload, bodyStart+start, bodyStart+end, f.value)
+	}
+
+	if len(proto.Header(payload, []byte("Content-Length"))) > 0 {
+		payload = proto.SetHeader(payload, []byte("Content-Length"), []byte(strconv.Itoa(len(payload)-bodyStart)))
+	}
+
 	return payload
 }
+
+// setCookie replaces value of cookie in Cookie header, or adds it if there is no such cookie.
+// Other cookies are kept as is.
+func setCookie(header []byte, name, value string) []byte {
+	var cookies [][]byte
+	found := false
+
+	for _, c := range bytes.Split(header, []byte(";")) {
+		c = bytes.TrimSpace(c)
+		if len(c) == 0 {
+			continue
+		}
+
+		if eq := bytes.IndexByte(c, '='); eq != -1 && string(bytes.TrimSpace(c[:eq])) == name {
+			c = []byte(name + "=" + value)
+			found = true
+		}
+		cookies = append(cookies, c)
+	}
+
+	if !found {
+		cookies = append(cookies, []byte(name+"="+value))
+	}
+
+	return bytes.Join(cookies, []byte("; "))
+}
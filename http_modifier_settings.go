@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"regexp"
@@ -12,17 +13,32 @@ import (
 type HTTPModifierConfig struct {
 	urlNegativeRegexp      HTTPUrlRegexp
 	urlRegexp              HTTPUrlRegexp
+	bodyRegexp             HTTPUrlRegexp
+	bodyNegativeRegexp     HTTPUrlRegexp
 	urlRewrite             UrlRewriteMap
 	headerRewrite          HeaderRewriteMap
+	jsonRewrite            HTTPJSONRewrites
 	headerFilters          HTTPHeaderFilters
 	headerNegativeFilters  HTTPHeaderFilters
 	headerBasicAuthFilters HTTPHeaderBasicAuthFilters
 	headerHashFilters      HTTPHashFilters
 	paramHashFilters       HTTPHashFilters
+	rateLimits             HTTPRateLimits
 
-	params  HTTPParams
-	headers HTTPHeaders
-	methods HTTPMethods
+	params   HTTPParams
+	headers  HTTPHeaders
+	cookies  HTTPCookies
+	methods  HTTPMethods
+	dstPorts HTTPPorts
+
+	// Headers with values of --output-http-header-dynamic templates
+	dynamicHeaders HTTPHeaders
+
+	dataFile       string
+	dataFileRandom bool
+
+	// Credentials of --http-set-basic-auth in user:pass format
+	basicAuth string
 }
 
 //
@@ -182,6 +198,34 @@ func (h *HTTPParams) Set(value string) error {
 	return nil
 }
 
+//
+// Handling of --http-set-cookie option
+//
+type HTTPCookies []HTTPCookie
+type HTTPCookie struct {
+	Name  string
+	Value string
+}
+
+func (h *HTTPCookies) String() string {
+	return fmt.Sprint(*h)
+}
+
+func (h *HTTPCookies) Set(value string) error {
+	v := strings.SplitN(value, "=", 2)
+	if len(v) != 2 || strings.TrimSpace(v[0]) == "" {
+		return errors.New("Expected `Name=Value`")
+	}
+
+	cookie := HTTPCookie{
+		strings.TrimSpace(v[0]),
+		strings.TrimSpace(v[1]),
+	}
+
+	*h = append(*h, cookie)
+	return nil
+}
+
 //
 // Handling of --http-allow-method option
 //
@@ -196,6 +240,26 @@ func (h *HTTPMethods) Set(value string) error {
 	return nil
 }
 
+//
+// Handling of --http-allow-dst-port option
+//
+type HTTPPorts []uint16
+
+func (h *HTTPPorts) String() string {
+	return fmt.Sprint(*h)
+}
+
+func (h *HTTPPorts) Set(value string) error {
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || port == 0 {
+		return errors.New("expected port number: " + value)
+	}
+
+	*h = append(*h, uint16(port))
+
+	return nil
+}
+
 //
 // Handling of --http-rewrite-url option
 //
@@ -260,7 +324,87 @@ func (r *HeaderRewriteMap) Set(value string) error {
 }
 
 //
-// Handling of --http-allow-url option
+// Handling of --http-rewrite-json option
+//
+type jsonRewrite struct {
+	src   string
+	path  []jsonPathElem
+	value []byte
+}
+
+type HTTPJSONRewrites []jsonRewrite
+
+func (r *HTTPJSONRewrites) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Set parses `path:value`. Value is used as is if it is valid JSON, like 42 or {"a":1}, otherwise it is set as string.
+func (r *HTTPJSONRewrites) Set(value string) error {
+	valArr := strings.SplitN(value, ":", 2)
+	if len(valArr) < 2 {
+		return errors.New("need both JSON path and value, colon-delimited (ex. $.user.email:test@example.com)")
+	}
+
+	src := strings.TrimSpace(valArr[0])
+	path, err := parseJSONPath(src)
+	if err != nil {
+		return err
+	}
+
+	target := []byte(strings.TrimSpace(valArr[1]))
+	if !json.Valid(target) {
+		target, _ = json.Marshal(string(target))
+	}
+
+	*r = append(*r, jsonRewrite{src: src, path: path, value: target})
+	return nil
+}
+
+//
+// Handling of --http-rate-limit option
+//
+type rateLimit struct {
+	method []byte
+	path   *regexp.Regexp
+	bucket *tokenBucket
+}
+
+type HTTPRateLimits []rateLimit
+
+func (r *HTTPRateLimits) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Set parses `[METHOD] path-regexp:rate`, e.g. `POST /orders:50`. Without method requests of any method are matched.
+func (r *HTTPRateLimits) Set(value string) error {
+	i := strings.LastIndex(value, ":")
+	if i == -1 {
+		return errors.New("need both request pattern and rate, colon-delimited (ex. POST /orders:50)")
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(value[i+1:]), 64)
+	if err != nil || rate <= 0 {
+		return errors.New("rate should be positive number of requests per second: " + value)
+	}
+
+	var method []byte
+	pattern := strings.TrimSpace(value[:i])
+	if parts := strings.SplitN(pattern, " ", 2); len(parts) == 2 {
+		method = []byte(parts[0])
+		pattern = strings.TrimSpace(parts[1])
+	}
+
+	path, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+
+	*r = append(*r, rateLimit{method: method, path: path, bucket: newTokenBucket(rate)})
+	return nil
+}
+
+//
+// Handling of --http-allow-url, --http-allow-body options
 //
 type urlRegexp struct {
 	regexp *regexp.Regexp
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"io"
 	"io/ioutil"
 	"net/http/httputil"
 	"strconv"
@@ -42,14 +45,7 @@ func prettifyHTTP(p []byte) []byte {
 	}
 
 	if bytes.Equal(tEnc, []byte("chunked")) {
-		buf := bytes.NewBuffer(content)
-		r := httputil.NewChunkedReader(buf)
-		content, _ = ioutil.ReadAll(r)
-
-		headers = proto.DeleteHeader(headers, []byte("Transfer-Encoding"))
-
-		newLen := strconv.Itoa(len(content))
-		headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(newLen))
+		headers, content = decodeChunked(headers, content)
 	}
 
 	if bytes.Equal(cEnc, []byte("gzip")) {
@@ -73,3 +69,104 @@ func prettifyHTTP(p []byte) []byte {
 
 	return newPayload
 }
+
+// decodeChunked decodes chunked body and replaces Transfer-Encoding with Content-Length header
+func decodeChunked(headers, content []byte) ([]byte, []byte) {
+	r := httputil.NewChunkedReader(bytes.NewBuffer(content))
+	content, _ = ioutil.ReadAll(r)
+
+	headers = proto.DeleteHeader(headers, []byte("Transfer-Encoding"))
+
+	newLen := strconv.Itoa(len(content))
+	headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(newLen))
+
+	return headers, content
+}
+
+// dechunkHTTP converts chunked HTTP message to the one with Content-Length
+func dechunkHTTP(p []byte) []byte {
+	if !bytes.Equal(proto.Header(p, []byte("Transfer-Encoding")), []byte("chunked")) {
+		return p
+	}
+
+	headersPos := proto.MIMEHeadersEndPos(p)
+	if headersPos < 5 || headersPos > len(p) {
+		return p
+	}
+
+	headers, content := decodeChunked(p[:headersPos], p[headersPos:])
+
+	return append(headers, content...)
+}
+
+// gunzipHTTP decompresses body of HTTP message with Content-Encoding: gzip or deflate, and sets Content-Length of decoded body.
+// Content-Encoding header is kept, so body can be compressed back by gzipHTTP.
+// Returns false and the message as is, if it is not compressed, or if body is truncated, corrupted or decodes to more than --copy-buffer-size.
+func gunzipHTTP(p []byte) ([]byte, bool) {
+	encoding := bytes.ToLower(proto.Header(p, []byte("Content-Encoding")))
+	if !bytes.Equal(encoding, []byte("gzip")) && !bytes.Equal(encoding, []byte("deflate")) {
+		return p, false
+	}
+
+	headersPos := proto.MIMEHeadersEndPos(p)
+	if headersPos < 5 || headersPos > len(p) {
+		return p, false
+	}
+
+	headers, content := p[:headersPos], p[headersPos:]
+	if bytes.Equal(proto.Header(headers, []byte("Transfer-Encoding")), []byte("chunked")) {
+		headers, content = decodeChunked(append([]byte(nil), headers...), content)
+	}
+
+	var r io.Reader
+	if bytes.Equal(encoding, []byte("gzip")) {
+		g, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			Debug("[Prettifier] GZIP encoding error:", err)
+			return p, false
+		}
+		r = g
+	} else if z, err := zlib.NewReader(bytes.NewReader(content)); err == nil {
+		r = z
+	} else {
+		// Deflate should be zlib stream, but some servers send raw deflate data
+		r = flate.NewReader(bytes.NewReader(content))
+	}
+
+	// Small body can be decoded to a huge one
+	content, err := ioutil.ReadAll(io.LimitReader(r, Settings.copyBufferSize+1))
+	if err != nil {
+		Debug("[Prettifier] "+string(encoding)+" encoding error:", err)
+		return p, false
+	}
+	if int64(len(content)) > Settings.copyBufferSize {
+		Debug("[Prettifier] Decoded body is over --copy-buffer-size")
+		return p, false
+	}
+
+	headers = proto.SetHeader(append([]byte(nil), headers...), []byte("Content-Length"), []byte(strconv.Itoa(len(content))))
+
+	return append(headers, content...), true
+}
+
+// gzipHTTP compresses body of HTTP message decoded by gunzipHTTP with encoding of Content-Encoding header, which is kept
+func gzipHTTP(p []byte) []byte {
+	headersPos := proto.MIMEHeadersEndPos(p)
+	if headersPos < 5 || headersPos > len(p) {
+		return p
+	}
+
+	var content bytes.Buffer
+	var w io.WriteCloser
+	if bytes.EqualFold(proto.Header(p, []byte("Content-Encoding")), []byte("deflate")) {
+		w = zlib.NewWriter(&content)
+	} else {
+		w = gzip.NewWriter(&content)
+	}
+	w.Write(p[headersPos:])
+	w.Close()
+
+	headers := proto.SetHeader(append([]byte(nil), p[:headersPos]...), []byte("Content-Length"), []byte(strconv.Itoa(content.Len())))
+
+	return append(headers, content.Bytes()...)
+}
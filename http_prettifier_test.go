@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"strconv"
 	"testing"
+
+	"github.com/buger/goreplay/proto"
 )
 
 func TestHTTPPrettifierGzip(t *testing.T) {
@@ -34,3 +38,107 @@ func TestHTTPPrettifierChunked(t *testing.T) {
 		t.Error("Payload not match:", string(newPayload))
 	}
 }
+
+func TestHTTPDechunk(t *testing.T) {
+	payload := []byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nContent-Type: text/plain\r\n\r\n4\r\nWiki\r\n5\r\npedia\r\n0\r\n\r\n")
+
+	newPayload := dechunkHTTP(payload)
+
+	if string(newPayload) != "HTTP/1.1 200 OK\r\nContent-Length: 9\r\nContent-Type: text/plain\r\n\r\nWikipedia" {
+		t.Error("Payload not match:", string(newPayload))
+	}
+
+	payload = []byte("HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nWiki")
+
+	if newPayload = dechunkHTTP(payload); !bytes.Equal(newPayload, payload) {
+		t.Error("Payload without chunks should not change:", string(newPayload))
+	}
+}
+
+func TestHTTPGunzip(t *testing.T) {
+	b := bytes.NewBufferString("")
+	w := gzip.NewWriter(b)
+	w.Write([]byte(`{"email":"user@example.com"}`))
+	w.Close()
+
+	payload := []byte("POST / HTTP/1.1\r\nContent-Encoding: gzip\r\nContent-Length: " + strconv.Itoa(b.Len()) + "\r\n\r\n")
+	payload = append(payload, b.Bytes()...)
+
+	decoded, ok := gunzipHTTP(payload)
+	if !ok || string(decoded) != "POST / HTTP/1.1\r\nContent-Encoding: gzip\r\nContent-Length: 28\r\n\r\n{\"email\":\"user@example.com\"}" {
+		t.Fatal("Body should be decoded:", string(decoded))
+	}
+
+	encoded := gzipHTTP(decoded)
+	if again, _ := gunzipHTTP(encoded); !bytes.Equal(again, decoded) {
+		t.Error("Body should be compressed back:", string(encoded))
+	}
+	if l := string(proto.Header(encoded, []byte("Content-Length"))); l != strconv.Itoa(len(proto.Body(encoded))) {
+		t.Error("Wrong Content-Length of compressed body:", l)
+	}
+
+	// Truncated body
+	truncated := payload[:len(payload)-5]
+	if p, ok := gunzipHTTP(truncated); ok || !bytes.Equal(p, truncated) {
+		t.Error("Corrupted body should be left as is")
+	}
+
+	plain := []byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\n{}")
+	if p, ok := gunzipHTTP(plain); ok || !bytes.Equal(p, plain) {
+		t.Error("Body without gzip encoding should be left as is")
+	}
+}
+
+func TestHTTPGunzipEncodings(t *testing.T) {
+	var gzipped, zlibbed, deflated bytes.Buffer
+	g := gzip.NewWriter(&gzipped)
+	g.Write([]byte("Wikipedia"))
+	g.Close()
+	z := zlib.NewWriter(&zlibbed)
+	z.Write([]byte("Wikipedia"))
+	z.Close()
+	f, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	f.Write([]byte("Wikipedia"))
+	f.Close()
+
+	chunked := strconv.FormatInt(int64(gzipped.Len()), 16) + "\r\n" + gzipped.String() + "\r\n0\r\n\r\n"
+
+	testCases := []struct {
+		name     string
+		payload  string
+		expected string
+	}{
+		{"gzip", "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: " + strconv.Itoa(gzipped.Len()) + "\r\n\r\n" + gzipped.String(), "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: 9\r\n\r\nWikipedia"},
+		{"chunked gzip", "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n" + chunked, "HTTP/1.1 200 OK\r\nContent-Length: 9\r\nContent-Encoding: gzip\r\n\r\nWikipedia"},
+		{"zlib deflate", "HTTP/1.1 200 OK\r\nContent-Encoding: deflate\r\n\r\n" + zlibbed.String(), "HTTP/1.1 200 OK\r\nContent-Length: 9\r\nContent-Encoding: deflate\r\n\r\nWikipedia"},
+		{"raw deflate", "HTTP/1.1 200 OK\r\nContent-Encoding: Deflate\r\n\r\n" + deflated.String(), "HTTP/1.1 200 OK\r\nContent-Length: 9\r\nContent-Encoding: Deflate\r\n\r\nWikipedia"},
+		{"truncated", "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n\r\n" + gzipped.String()[:gzipped.Len()-4], ""},
+		{"not compressed", "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nWiki", ""},
+	}
+
+	for _, tc := range testCases {
+		expected := tc.expected
+		if expected == "" {
+			expected = tc.payload
+		}
+
+		p, ok := gunzipHTTP([]byte(tc.payload))
+		if string(p) != expected || ok != (tc.expected != "") {
+			t.Errorf("%s: payload not match: %q", tc.name, p)
+		}
+	}
+
+	// Deflate body is compressed back with deflate
+	decoded, _ := gunzipHTTP([]byte("POST / HTTP/1.1\r\nContent-Encoding: deflate\r\n\r\n" + zlibbed.String()))
+	if again, ok := gunzipHTTP(gzipHTTP(decoded)); !ok || !bytes.Equal(again, decoded) {
+		t.Errorf("Body should be compressed back: %q", again)
+	}
+
+	// Body decoded to more than copy buffer
+	defer func(size int64) { Settings.copyBufferSize = size }(Settings.copyBufferSize)
+	Settings.copyBufferSize = 4
+	payload := "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n\r\n" + gzipped.String()
+	if p, ok := gunzipHTTP([]byte(payload)); ok || string(p) != payload {
+		t.Errorf("Body over copy buffer size should be left as is: %q", p)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Positions of fields in AWS ALB access log entry
+// https://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-access-logs.html
+const (
+	albFieldTime      = 1
+	albFieldClient    = 3
+	albFieldRequest   = 12
+	albFieldUserAgent = 13
+	albFieldTraceID   = 17
+	albFieldDomain    = 18
+)
+
+// ALBLogInput reads AWS Application Load Balancer access logs and converts entries to replayable requests.
+// Logs do not contain request bodies and most of the headers, so it mostly suits GET traffic.
+type ALBLogInput struct {
+	data chan []byte
+	path string
+	quit chan bool
+}
+
+// NewALBLogInput constructor for ALBLogInput. Accepts directory, file or glob pattern.
+// Files with .gz extension are decompressed automatically.
+func NewALBLogInput(path string) (i *ALBLogInput) {
+	i = new(ALBLogInput)
+	i.data = make(chan []byte, 1000)
+	i.path = path
+	i.quit = make(chan bool)
+
+	files, err := albLogFiles(path)
+	if err != nil {
+		log.Fatal("input-alb-log: ", err)
+	}
+
+	go i.emit(files)
+
+	return
+}
+
+func albLogFiles(path string) ([]string, error) {
+	if stat, err := os.Stat(path); err == nil && stat.IsDir() {
+		path = filepath.Join(path, "*")
+	}
+
+	matches, err := filepath.Glob(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, m := range matches {
+		if stat, err := os.Stat(m); err == nil && !stat.IsDir() {
+			files = append(files, m)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("no files match pattern: " + path)
+	}
+
+	// ALB log file names contain timestamp, so it gives chronological order
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func (i *ALBLogInput) emit(files []string) {
+	defer close(i.data)
+
+	for _, f := range files {
+		if !i.emitFile(f) {
+			return
+		}
+	}
+
+	log.Printf("ALBLogInput: end of logs '%s'\n", i.path)
+}
+
+func (i *ALBLogInput) emitFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println("ALBLogInput:", err)
+		return true
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gzReader, err := gzip.NewReader(file)
+		if err != nil {
+			log.Println("ALBLogInput:", path, err)
+			return true
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		payload, err := parseALBLogEntry(scanner.Text())
+		if err != nil {
+			Debug("[INPUT-ALB-LOG] Skipping entry:", err, scanner.Text())
+			continue
+		}
+
+		select {
+		case i.data <- payload:
+		case <-i.quit:
+			return false
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Println("ALBLogInput:", path, err)
+	}
+
+	return true
+}
+
+// splitALBLogEntry splits log line by spaces, keeping quoted fields together
+func splitALBLogEntry(line string) (fields []string) {
+	var field bytes.Buffer
+	inQuotes := false
+	quoted := false
+
+	for idx := 0; idx < len(line); idx++ {
+		c := line[idx]
+
+		switch {
+		case c == '\\' && inQuotes && idx+1 < len(line):
+			idx++
+			field.WriteByte(line[idx])
+		case c == '"':
+			inQuotes = !inQuotes
+			quoted = true
+		case c == ' ' && !inQuotes:
+			if field.Len() > 0 || quoted {
+				fields = append(fields, field.String())
+			}
+			field.Reset()
+			quoted = false
+		default:
+			field.WriteByte(c)
+		}
+	}
+
+	if field.Len() > 0 || quoted {
+		fields = append(fields, field.String())
+	}
+
+	return
+}
+
+// parseALBLogEntry converts single ALB log entry to request payload with Gor header
+func parseALBLogEntry(line string) ([]byte, error) {
+	fields := splitALBLogEntry(line)
+	if len(fields) <= albFieldRequest {
+		return nil, errors.New("not enough fields")
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, fields[albFieldTime])
+	if err != nil {
+		return nil, err
+	}
+
+	request := strings.SplitN(fields[albFieldRequest], " ", 3)
+	if len(request) != 3 || request[0] == "-" {
+		return nil, errors.New("malformed request field")
+	}
+
+	u, err := url.Parse(request[1])
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if h, port, err := net.SplitHostPort(host); err == nil && port == defaultPorts[u.Scheme] {
+		host = h
+	}
+	if len(fields) > albFieldDomain && fields[albFieldDomain] != "-" {
+		host = fields[albFieldDomain]
+	}
+
+	var buf bytes.Buffer
+	buf.Write(payloadHeader(RequestPayload, uuid(), ts.UnixNano(), -1))
+	buf.WriteString(request[0] + " " + u.RequestURI() + " " + request[2] + "\r\n")
+	buf.WriteString("Host: " + host + "\r\n")
+
+	if len(fields) > albFieldUserAgent && fields[albFieldUserAgent] != "-" {
+		buf.WriteString("User-Agent: " + fields[albFieldUserAgent] + "\r\n")
+	}
+
+	if client, _, err := net.SplitHostPort(fields[albFieldClient]); err == nil {
+		buf.WriteString("X-Forwarded-For: " + client + "\r\n")
+	}
+
+	if len(fields) > albFieldTraceID && fields[albFieldTraceID] != "-" {
+		buf.WriteString("X-Amzn-Trace-Id: " + fields[albFieldTraceID] + "\r\n")
+	}
+
+	buf.WriteString("\r\n")
+
+	return buf.Bytes(), nil
+}
+
+func (i *ALBLogInput) Read(data []byte) (int, error) {
+	buf, ok := <-i.data
+	if !ok {
+		return 0, io.EOF
+	}
+
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *ALBLogInput) String() string {
+	return "ALB log input: " + i.path
+}
+
+// Close stops reading log files
+func (i *ALBLogInput) Close() error {
+	close(i.quit)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+const albLogEntry = `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/path?a=1 HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-"`
+
+func TestParseALBLogEntry(t *testing.T) {
+	payload, err := parseALBLogEntry(albLogEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := payloadMeta(payload)
+	if string(meta[2]) != "1530570180186641000" {
+		t.Error("Wrong timestamp:", string(meta[2]))
+	}
+
+	body := payloadBody(payload)
+
+	if string(proto.Method(body)) != "GET" {
+		t.Error("Wrong method:", string(proto.Method(body)))
+	}
+
+	if string(proto.Path(body)) != "/path?a=1" {
+		t.Error("Wrong path:", string(proto.Path(body)))
+	}
+
+	if string(proto.Header(body, []byte("Host"))) != "www.example.com" {
+		t.Error("Wrong host:", string(proto.Header(body, []byte("Host"))))
+	}
+
+	if string(proto.Header(body, []byte("User-Agent"))) != "curl/7.46.0" {
+		t.Error("Wrong user agent:", string(proto.Header(body, []byte("User-Agent"))))
+	}
+
+	if string(proto.Header(body, []byte("X-Forwarded-For"))) != "192.168.131.39" {
+		t.Error("Wrong client IP:", string(proto.Header(body, []byte("X-Forwarded-For"))))
+	}
+}
+
+func TestParseALBLogEntryMalformed(t *testing.T) {
+	malformed := `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 - -1 -1 -1 400 - 0 0 "- - - " "-" - -`
+
+	if _, err := parseALBLogEntry(malformed); err == nil {
+		t.Error("Should not parse entry without request")
+	}
+}
+
+func TestALBLogInput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "alb")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "1.log"), []byte(albLogEntry+"\n"+albLogEntry+"\n"), 0644)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(albLogEntry + "\n"))
+	w.Close()
+	ioutil.WriteFile(filepath.Join(dir, "2.log.gz"), gz.Bytes(), 0644)
+
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	input := NewALBLogInput(dir)
+	output := NewTestOutput(func(data []byte) {
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+
+	wg.Add(3)
+	go Start(plugins, quit)
+
+	wg.Wait()
+	close(quit)
+}
@@ -4,15 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"io"
 	"log"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 type fileInputReader struct {
@@ -20,41 +25,71 @@ type fileInputReader struct {
 	data      []byte
 	file      *os.File
 	timestamp int64
+	// Releases decompressor resources, set for compressed files
+	closeDecoder func()
+	// Only payloads captured within this range are read, 0 means no limit
+	timeFrom int64
+	timeTo   int64
+	framing  payloadFraming
 }
 
-func (f *fileInputReader) parseNext() error {
-	payloadSeparatorAsBytes := []byte(payloadSeparator)
-	var buffer bytes.Buffer
+// timeWindowMargin is how far past --input-file-time-to reading goes on: payloads are written
+// in order they complete, so capture time of the next payloads can be a bit earlier
+const timeWindowMargin = int64(time.Minute)
 
+// parseNext reads the next payload within time window, reader is finished well after the window
+func (f *fileInputReader) parseNext() error {
 	for {
-		line, err := f.reader.ReadBytes('\n')
-
-		if err != nil {
-			if err != io.EOF {
-				log.Println(err)
-				return err
-			}
+		if err := f.parseRecord(); err != nil {
+			return err
+		}
 
-			if err == io.EOF {
-				f.file.Close()
+		if f.timeTo > 0 && f.timestamp > f.timeTo {
+			if f.timestamp > f.timeTo+timeWindowMargin {
+				f.Close()
 				f.file = nil
-				return err
+				return io.EOF
 			}
+			continue
 		}
 
-		if bytes.Equal(payloadSeparatorAsBytes[1:], line) {
-			asBytes := buffer.Bytes()
-			meta := payloadMeta(asBytes)
+		if f.timestamp >= f.timeFrom {
+			return nil
+		}
+	}
+}
 
-			f.timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
-			f.data = asBytes[:len(asBytes)-1]
+// setTimeWindow limits payloads to given range of capture time, current payload is skipped if it is out of range
+func (f *fileInputReader) setTimeWindow(from, to int64) {
+	f.timeFrom, f.timeTo = from, to
 
-			return nil
+	if f.file == nil {
+		return
+	}
+
+	if f.timestamp < from || (to > 0 && f.timestamp > to) {
+		f.parseNext()
+	}
+}
+
+func (f *fileInputReader) parseRecord() error {
+	data, err := f.framing.Read(f.reader)
+
+	if err != nil {
+		if err != io.EOF {
+			log.Println(err)
+			return err
 		}
 
-		buffer.Write(line)
+		f.Close()
+		f.file = nil
+		return err
 	}
 
+	meta := payloadMeta(data)
+	f.timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
+	f.data = data
+
 	return nil
 }
 
@@ -64,6 +99,11 @@ func (f *fileInputReader) ReadPayload() []byte {
 	return f.data
 }
 func (f *fileInputReader) Close() error {
+	if f.closeDecoder != nil {
+		f.closeDecoder()
+		f.closeDecoder = nil
+	}
+
 	if f.file != nil {
 		f.file.Close()
 	}
@@ -71,7 +111,7 @@ func (f *fileInputReader) Close() error {
 	return nil
 }
 
-func NewFileInputReader(path string) *fileInputReader {
+func NewFileInputReader(path string, framing payloadFraming) *fileInputReader {
 	file, err := os.Open(path)
 
 	if err != nil {
@@ -79,78 +119,451 @@ func NewFileInputReader(path string) *fileInputReader {
 		return nil
 	}
 
-	r := &fileInputReader{file: file}
-	if strings.HasSuffix(path, ".gz") {
-		gzReader, err := gzip.NewReader(file)
-		if err != nil {
-			log.Println(err)
-			return nil
-		}
-		r.reader = bufio.NewReader(gzReader)
-	} else {
-		r.reader = bufio.NewReader(file)
+	r := &fileInputReader{file: file, framing: framing}
+
+	reader, closeDecoder, err := newFileReader(path, file)
+	if err != nil {
+		log.Println(err)
+		file.Close()
+		return nil
 	}
+	r.reader = bufio.NewReader(reader)
+	r.closeDecoder = closeDecoder
 
 	r.parseNext()
 
 	return r
 }
 
+// newFileReader picks decompression by file extension, the same way as FileOutput: ".gz" for gzip, ".zst" for zstd.
+// Concatenated gzip members and zstd frames are read as one stream.
+func newFileReader(path string, file io.Reader) (io.Reader, func(), error) {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		r, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, func() { r.Close() }, nil
+	case strings.HasSuffix(path, ".zst"):
+		r, err := zstd.NewReader(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, r.Close, nil
+	}
+
+	return file, nil, nil
+}
+
+func isCompressedFile(path string) bool {
+	return strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".zst")
+}
+
+// fileInputSource is a group of files matching single path pattern
+type fileInputSource struct {
+	path     string
+	weight   int
+	readers  []*fileInputReader
+	lastTime int64
+	// Number of started passes over the files
+	loops int
+	// Time when current pass started, and timestamp of its first payload
+	loopStart      int64
+	firstTimestamp int64
+	// Range of capture time of replayed payloads, 0 means no limit
+	timeFrom int64
+	timeTo   int64
+	framing  payloadFraming
+}
+
+func (s *fileInputSource) init() (err error) {
+	var matches []string
+
+	if matches, err = filepath.Glob(s.path); err != nil {
+		log.Println("Wrong file pattern", s.path, err)
+		return
+	}
+
+	if len(matches) == 0 {
+		log.Println("No files match pattern: ", s.path)
+		return errors.New("No matching files")
+	}
+
+	s.readers = make([]*fileInputReader, len(matches))
+
+	for idx, p := range matches {
+		s.readers[idx] = NewFileInputReader(p, s.framing)
+		if s.readers[idx] != nil && (s.timeFrom > 0 || s.timeTo > 0) {
+			s.readers[idx].setTimeWindow(s.timeFrom, s.timeTo)
+		}
+	}
+
+	s.lastTime = -1
+	s.loops++
+
+	if r := s.nextReader(); r != nil {
+		s.loopStart = time.Now().UnixNano()
+		s.firstTimestamp = r.timestamp
+	}
+
+	return nil
+}
+
+// duration returns time between first and last payload of initialized source
+func (s *fileInputSource) duration() int64 {
+	var first, last int64 = -1, -1
+
+	for _, r := range s.readers {
+		if r != nil && r.file != nil && (first == -1 || r.timestamp < first) {
+			first = r.timestamp
+		}
+	}
+
+	matches, _ := filepath.Glob(s.path)
+	for _, p := range matches {
+		if ts, err := lastPayloadTimestamp(p, s.framing); err == nil && ts > last {
+			last = ts
+		}
+	}
+
+	if s.timeTo > 0 && last > s.timeTo {
+		last = s.timeTo
+	}
+
+	if first == -1 || last == -1 {
+		return 0
+	}
+
+	return last - first
+}
+
+// lastPayloadTimestamp finds the last payload by reading only end of the file.
+// Compressed and length-prefixed files can't be read from the end, so they are read completely.
+func lastPayloadTimestamp(path string, framing payloadFraming) (int64, error) {
+	if isCompressedFile(path) || framing.lengthPrefixed || framing.jsonLines {
+		r := NewFileInputReader(path, framing)
+		if r == nil || r.file == nil {
+			return -1, errors.New("no payloads in " + path)
+		}
+		defer r.Close()
+
+		last := r.timestamp
+		for r.parseNext() == nil {
+			last = r.timestamp
+		}
+
+		return last, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return -1, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return -1, err
+	}
+
+	separator := framing.sep()
+
+	// Read bigger part of the file, until it contains whole last payload
+	for window := int64(64 * 1024); ; window *= 2 {
+		offset := stat.Size() - window
+		if offset < 0 {
+			offset = 0
+		}
+
+		data := make([]byte, stat.Size()-offset)
+		if _, err = file.ReadAt(data, offset); err != nil && err != io.EOF {
+			return -1, err
+		}
+
+		// Payload without separator is not complete, and is not emitted
+		end := bytes.LastIndex(data, separator)
+		start := bytes.LastIndex(data[:end+1], separator)
+
+		if offset > 0 && (end == -1 || start == -1) {
+			continue
+		}
+
+		if end == -1 {
+			return -1, errors.New("no payloads in " + path)
+		}
+
+		// The only payload starts at the beginning of the file
+		payload := data[:end]
+		if start != -1 {
+			payload = data[start+len(separator) : end]
+		}
+
+		meta := payloadMeta(payload)
+
+		if len(meta) < 3 {
+			return -1, errors.New("malformed payload in " + path)
+		}
+
+		return strconv.ParseInt(string(meta[2]), 10, 64)
+	}
+}
+
+// refreshedTimestamp maps timestamp of payload to the time it is replayed in current pass
+func (s *fileInputSource) refreshedTimestamp(ts int64, speedFactor float64) int64 {
+	return s.loopStart + int64(float64(ts-s.firstTimestamp)/speedFactor)
+}
+
+// Find reader with smallest timestamp e.g next payload in row
+func (s *fileInputSource) nextReader() (next *fileInputReader) {
+	for _, r := range s.readers {
+		if r == nil || r.file == nil {
+			continue
+		}
+
+		if next == nil || r.timestamp < next.timestamp {
+			next = r
+			continue
+		}
+	}
+
+	return
+}
+
+// FileInputConfig holds options of file input
+type FileInputConfig struct {
+	loop bool
+	// Shift timestamps, so each pass looks like fresh traffic
+	refreshTimestamps bool
+	// Adjust replay speed, so whole number of loops fits into exitAfter
+	fitLoops  bool
+	exitAfter time.Duration
+	// Replay speed relative to recorded one, 0 means original speed
+	replaySpeed float64
+	// Replay only payloads captured within this range, see parseCaptureTime for format
+	timeFrom string
+	timeTo   string
+	// How payloads are delimited, see newPayloadFraming
+	framing   string
+	separator string
+	// "gor" for payloads written by FileOutput, or "json" for JSON Lines with requests, see readJSONRequest
+	format string
+}
+
 // FileInput can read requests generated by FileOutput
 type FileInput struct {
 	mu          sync.Mutex
 	data        chan []byte
 	exit        chan bool
 	path        string
-	readers     []*fileInputReader
+	sources     []*fileInputSource
 	speedFactor float64
-	loop        bool
+	config      *FileInputConfig
+	// Stop after given number of loops, 0 means infinite
+	maxLoops int
 }
 
 // NewFileInput constructor for FileInput. Accepts file path as argument.
-func NewFileInput(path string, loop bool) (i *FileInput) {
+func NewFileInput(path string, config *FileInputConfig) (i *FileInput) {
+	return NewWeightedFileInput([]string{path}, []int{1}, config)
+}
+
+// NewWeightedFileInput constructor for FileInput which mixes multiple files.
+// Each next payload is taken from the file chosen randomly, with probability proportional to its weight.
+func NewWeightedFileInput(paths []string, weights []int, config *FileInputConfig) (i *FileInput) {
 	i = new(FileInput)
 	i.data = make(chan []byte, 1000)
 	i.exit = make(chan bool, 1)
-	i.path = path
+	i.path = strings.Join(paths, ", ")
 	i.speedFactor = 1
-	i.loop = loop
+	if config.replaySpeed > 0 {
+		i.speedFactor = config.replaySpeed
+	}
+	i.config = config
+
+	var timeFrom, timeTo int64
+	var err error
+	if config.timeFrom != "" {
+		if timeFrom, err = parseCaptureTime(config.timeFrom); err != nil {
+			log.Fatal("input-file-time-from: ", err)
+		}
+	}
+	if config.timeTo != "" {
+		if timeTo, err = parseCaptureTime(config.timeTo); err != nil {
+			log.Fatal("input-file-time-to: ", err)
+		}
+		if timeTo < timeFrom {
+			log.Fatal("input-file-time-to: should not be before --input-file-time-from")
+		}
+	}
+
+	framing, err := newPayloadFraming(config.framing, config.separator)
+	if err != nil {
+		log.Fatal("input-file-framing: ", err)
+	}
+
+	switch config.format {
+	case "", "gor":
+	case "json":
+		if framing.lengthPrefixed || framing.separator != nil {
+			log.Fatal("input-file-format: json can't be combined with --input-file-framing or --input-file-separator")
+		}
+		framing.jsonLines = true
+	default:
+		log.Fatal("input-file-format: should be gor or json")
+	}
+
+	for idx, path := range paths {
+		i.sources = append(i.sources, &fileInputSource{path: path, weight: weights[idx], timeFrom: timeFrom, timeTo: timeTo, framing: framing})
+	}
 
 	if err := i.init(); err != nil {
 		return
 	}
 
+	if config.loop && config.fitLoops && config.exitAfter > 0 {
+		i.fitLoops(config.exitAfter)
+	}
+
 	go i.emit()
 
 	return
 }
 
-type NextFileNotFound struct{}
+// Fields of --input-file-format json records, they are the same as default columns of --input-sql
+var jsonRequestFields = sqlFieldMapping{method: "method", url: "url", headers: "headers", body: "body"}
 
-func (_ *NextFileNotFound) Error() string {
-	return "There is no new files"
+// readJSONRequest reads the next JSON Lines record, like {"method":"POST","url":"/api","headers":{"Host":"example.com"},"body":"..."},
+// and converts it to request payload. Records have no ID and capture time, so payload gets new ID and current time.
+// Malformed lines are logged and skipped.
+func readJSONRequest(r *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := r.ReadBytes('\n')
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			payload, perr := parseJSONRequest(line)
+			if perr == nil {
+				return payload, nil
+			}
+			log.Println("[INPUT-FILE] Skipping malformed JSON record:", perr)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
 }
 
-func (i *FileInput) init() (err error) {
-	defer i.mu.Unlock()
-	i.mu.Lock()
+func parseJSONRequest(line []byte) ([]byte, error) {
+	var record struct {
+		Method  string          `json:"method"`
+		URL     string          `json:"url"`
+		Headers json.RawMessage `json:"headers"`
+		Body    string          `json:"body"`
+	}
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, err
+	}
 
-	var matches []string
+	index := map[string]int{"method": 0, "url": 1, "headers": 2, "body": 3}
+	row := [][]byte{[]byte(record.Method), []byte(record.URL), record.Headers, []byte(record.Body)}
+
+	return buildSQLRequest(index, row, jsonRequestFields)
+}
+
+// parseCaptureTime parses time in RFC 3339 format, "2006-01-02 15:04:05" format in local time zone,
+// or Unix time in nanoseconds as in payload header. Returns Unix time in nanoseconds.
+func parseCaptureTime(value string) (int64, error) {
+	if ns, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ns, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UnixNano(), nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	if err != nil {
+		return 0, errors.New("expected time like 2006-01-02T15:04:05Z, '2006-01-02 15:04:05' or Unix time in nanoseconds: " + value)
+	}
+
+	return t.UnixNano(), nil
+}
+
+// parseFileWeights validates --input-file-weight values, there should be one for each input file
+func parseFileWeights(paths []string, options []string) (weights []int, err error) {
+	if len(options) != len(paths) {
+		return nil, errors.New("number of weights should match number of input files")
+	}
+
+	for idx, o := range options {
+		// Files are mixed into single input, so it can't have limiter per file
+		if _, limit := extractLimitOptions(paths[idx]); limit != "" {
+			return nil, errors.New("limiter can't be used with weighted files: " + paths[idx])
+		}
 
-	if matches, err = filepath.Glob(i.path); err != nil {
-		log.Println("Wrong file pattern", i.path, err)
+		weight, err := strconv.Atoi(o)
+		if err != nil || weight <= 0 {
+			return nil, errors.New("weight should be positive number: " + o)
+		}
+
+		weights = append(weights, weight)
+	}
+
+	return weights, nil
+}
+
+// fitLoops adjusts replay speed, so whole number of loops fits into given duration,
+// and last loop is not cut off in the middle. Input stops after the last loop.
+func (i *FileInput) fitLoops(total time.Duration) {
+	var length int64
+	for _, s := range i.sources {
+		if d := s.duration(); d > length {
+			length = d
+		}
+	}
+
+	// Capture is longer than duration, no looping needed
+	if length <= 0 || length > int64(total) {
 		return
 	}
 
-	if len(matches) == 0 {
-		log.Println("No files match pattern: ", i.path)
-		return errors.New("No matching files")
+	i.maxLoops = int(math.Round(float64(total) / float64(length)))
+	i.speedFactor = float64(int64(i.maxLoops)*length) / float64(total)
+
+	log.Printf("FileInput: replaying %d loops of %s at %.2fx speed to fit into %s\n", i.maxLoops, time.Duration(length), i.speedFactor, total)
+}
+
+// setPayloadTimestamp replaces timestamp in payload header, keeping other fields as is
+func setPayloadTimestamp(payload []byte, ts int64) []byte {
+	headerSize := bytes.IndexByte(payload, '\n')
+	if headerSize < 0 {
+		return payload
+	}
+
+	meta := bytes.Split(payload[:headerSize], []byte{' '})
+	if len(meta) < 3 {
+		return payload
 	}
+	meta[2] = []byte(strconv.FormatInt(ts, 10))
 
-	i.readers = make([]*fileInputReader, len(matches))
+	return append(bytes.Join(meta, []byte{' '}), payload[headerSize:]...)
+}
 
-	for idx, p := range matches {
-		i.readers[idx] = NewFileInputReader(p)
+type NextFileNotFound struct{}
+
+func (_ *NextFileNotFound) Error() string {
+	return "There is no new files"
+}
+
+func (i *FileInput) init() (err error) {
+	defer i.mu.Unlock()
+	i.mu.Lock()
+
+	for _, s := range i.sources {
+		if err = s.init(); err != nil {
+			return
+		}
 	}
 
 	return nil
@@ -167,25 +580,50 @@ func (i *FileInput) String() string {
 	return "File input: " + i.path
 }
 
-// Find reader with smallest timestamp e.g next payload in row
-func (i *FileInput) nextReader() (next *fileInputReader) {
-	for _, r := range i.readers {
-		if r == nil || r.file == nil {
-			continue
+// Choose source of the next payload randomly by weight, skipping finished sources
+func (i *FileInput) nextSource() *fileInputSource {
+	var active []*fileInputSource
+	total := 0
+
+	for _, s := range i.sources {
+		if s.nextReader() == nil {
+			if !i.config.loop || (i.maxLoops > 0 && s.loops >= i.maxLoops) {
+				continue
+			}
+
+			i.mu.Lock()
+			err := s.init()
+			i.mu.Unlock()
+
+			if err != nil || s.nextReader() == nil {
+				continue
+			}
 		}
 
-		if next == nil || r.timestamp < next.timestamp {
-			next = r
-			continue
+		active = append(active, s)
+		total += s.weight
+	}
+
+	if len(active) < 2 {
+		if len(active) == 0 {
+			return nil
 		}
+
+		return active[0]
 	}
 
-	return
+	n := rand.Intn(total)
+	for _, s := range active {
+		if n < s.weight {
+			return s
+		}
+		n -= s.weight
+	}
+
+	return nil
 }
 
 func (i *FileInput) emit() {
-	var lastTime int64 = -1
-
 	for {
 		select {
 		case <-i.exit:
@@ -193,21 +631,17 @@ func (i *FileInput) emit() {
 		default:
 		}
 
-		reader := i.nextReader()
+		source := i.nextSource()
 
-		if reader == nil {
-			if i.loop {
-				i.init()
-				lastTime = -1
-				continue
-			} else {
-				break
-			}
+		if source == nil {
+			break
 		}
 
-		if lastTime != -1 {
-			diff := reader.timestamp - lastTime
-			lastTime = reader.timestamp
+		reader := source.nextReader()
+
+		if source.lastTime != -1 {
+			diff := reader.timestamp - source.lastTime
+			source.lastTime = reader.timestamp
 
 			if i.speedFactor != 1 {
 				diff = int64(float64(diff) / i.speedFactor)
@@ -215,10 +649,16 @@ func (i *FileInput) emit() {
 
 			time.Sleep(time.Duration(diff))
 		} else {
-			lastTime = reader.timestamp
+			source.lastTime = reader.timestamp
 		}
 
-		i.data <- reader.ReadPayload()
+		ts := reader.timestamp
+		payload := reader.ReadPayload()
+		if i.config.refreshTimestamps {
+			payload = setPayloadTimestamp(payload, source.refreshedTimestamp(ts, i.speedFactor))
+		}
+
+		i.data <- payload
 	}
 
 	log.Printf("FileInput: end of file '%s'\n", i.path)
@@ -226,8 +666,10 @@ func (i *FileInput) emit() {
 	// For now having fixed timeout is temporary solution
 	// Further should be modified, so outputs can report if their queue empty or not
 	time.Sleep(time.Second)
-	if closeCh != nil {
-		close(closeCh)
+
+	// With fitted loops gor is stopped by --exit-after
+	if i.maxLoops == 0 {
+		stopGor()
 	}
 }
 
@@ -237,8 +679,10 @@ func (i *FileInput) Close() error {
 
 	i.exit <- true
 
-	for _, r := range i.readers {
-		r.Close()
+	for _, s := range i.sources {
+		for _, r := range s.readers {
+			r.Close()
+		}
 	}
 
 	return nil
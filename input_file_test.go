@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
@@ -9,6 +10,9 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -114,7 +118,7 @@ func TestInputFileMultipleFilesWithRequestsOnly(t *testing.T) {
 	file2.Write([]byte(payloadSeparator))
 	file2.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 
 	for i := '1'; i <= '4'; i++ {
@@ -141,7 +145,7 @@ func TestInputFileRequestsWithLatency(t *testing.T) {
 	file.Write([]byte("1 3 250000000\nrequest3"))
 	file.Write([]byte(payloadSeparator))
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 
 	start := time.Now().UnixNano()
@@ -187,7 +191,7 @@ func TestInputFileMultipleFilesWithRequestsAndResponses(t *testing.T) {
 	file2.Write([]byte(payloadSeparator))
 	file2.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 
 	for i := '1'; i <= '4'; i++ {
@@ -216,7 +220,7 @@ func TestInputFileLoop(t *testing.T) {
 	file.Write([]byte(payloadSeparator))
 	file.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), true)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d", rnd), &FileInputConfig{loop: true})
 	buf := make([]byte, 1000)
 
 	// Even if we have just 2 requests in file, it should indifinitly loop
@@ -228,6 +232,195 @@ func TestInputFileLoop(t *testing.T) {
 	os.Remove(file.Name())
 }
 
+func TestInputFileLoopFit(t *testing.T) {
+	rnd := rand.Int63()
+
+	// 3 requests over 100ms
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	for _, ts := range []int64{0, 50, 100} {
+		file.Write([]byte(fmt.Sprintf("1 1 %d\ntest", ts*int64(time.Millisecond))))
+		file.Write([]byte(payloadSeparator))
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	// Speed is adjusted only if asked explicitly
+	input := NewFileInput(file.Name(), &FileInputConfig{loop: true, exitAfter: 250 * time.Millisecond})
+	if input.maxLoops != 0 || input.speedFactor != 1 {
+		t.Error("Should not fit loops by default:", input.maxLoops, input.speedFactor)
+	}
+	input.Close()
+
+	input = NewFileInput(file.Name(), &FileInputConfig{loop: true, fitLoops: true, exitAfter: 250 * time.Millisecond, refreshTimestamps: true})
+	defer input.Close()
+
+	if input.maxLoops != 3 || input.speedFactor != 1.2 {
+		t.Error("Should fit 3 loops:", input.maxLoops, input.speedFactor)
+	}
+
+	payloads := make(chan []byte, 100)
+	go func() {
+		for {
+			buf := make([]byte, 1000)
+			n, _ := input.Read(buf)
+			payloads <- buf[:n]
+		}
+	}()
+
+	count := 0
+	for {
+		select {
+		case p := <-payloads:
+			count++
+
+			// Refreshed timestamp should match replay time, even if speed is changed
+			ts, _ := strconv.ParseInt(string(payloadMeta(p)[2]), 10, 64)
+			if diff := time.Now().UnixNano() - ts; diff < 0 || diff > int64(20*time.Millisecond) {
+				t.Error("Timestamp should be refreshed:", string(p), time.Duration(diff))
+			}
+			continue
+		case <-time.After(500 * time.Millisecond):
+		}
+		break
+	}
+
+	if count != 9 {
+		t.Error("Should replay 3 full loops, got:", count)
+	}
+}
+
+func TestInputFileReplaySpeed(t *testing.T) {
+	rnd := rand.Int63()
+
+	// 3 requests over 200ms
+	file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d", rnd), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	for _, ts := range []int64{0, 100, 200} {
+		file.Write([]byte(fmt.Sprintf("1 1 %d\ntest", ts*int64(time.Millisecond))))
+		file.Write([]byte(payloadSeparator))
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	input := NewFileInput(file.Name(), &FileInputConfig{loop: true, replaySpeed: 2})
+	defer input.Close()
+
+	buf := make([]byte, 1000)
+	start := time.Now()
+	var emitted []time.Duration
+	for i := 0; i < 6; i++ {
+		input.Read(buf)
+		emitted = append(emitted, time.Since(start))
+	}
+
+	// Second loop starts right after the first one, without waiting for time between passes
+	expected := []time.Duration{0, 50, 100, 100, 150, 200}
+	for i, e := range expected {
+		if d := emitted[i] - e*time.Millisecond; d < 0 || d > 30*time.Millisecond {
+			t.Errorf("Payload %d should be emitted after %dms, got %s", i, e, emitted[i])
+		}
+	}
+}
+
+func TestLastPayloadTimestamp(t *testing.T) {
+	file, _ := ioutil.TempFile("", "last_payload")
+	defer os.Remove(file.Name())
+
+	// Last payload is bigger than initial read window
+	body := bytes.Repeat([]byte("a"), 100*1024)
+	for _, ts := range []int64{1, 2, 3} {
+		file.Write([]byte(fmt.Sprintf("1 %d %d\n", ts, ts)))
+		file.Write(body)
+		file.Write([]byte(payloadSeparator))
+	}
+	// Incomplete payload is not emitted
+	file.Write([]byte("1 4 4\n"))
+	file.Close()
+
+	if ts, err := lastPayloadTimestamp(file.Name(), payloadFraming{}); ts != 3 || err != nil {
+		t.Error("Wrong timestamp of last payload:", ts, err)
+	}
+
+	ioutil.WriteFile(file.Name(), []byte("1 1 5\ntest"+payloadSeparator), 0600)
+	if ts, err := lastPayloadTimestamp(file.Name(), payloadFraming{}); ts != 5 || err != nil {
+		t.Error("Wrong timestamp of single payload:", ts, err)
+	}
+}
+
+func TestInputFileWeighted(t *testing.T) {
+	rnd := rand.Int63()
+
+	var paths, options []string
+	for _, body := range []string{"browse", "checkout"} {
+		file, _ := os.OpenFile(fmt.Sprintf("/tmp/%d_%s", rnd, body), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+		file.Write([]byte("1 1 1\n" + body))
+		file.Write([]byte(payloadSeparator))
+		file.Close()
+		defer os.Remove(file.Name())
+
+		paths = append(paths, file.Name())
+		options = append(options, strconv.Itoa(len(options)*2+1))
+	}
+
+	weights, err := parseFileWeights(paths, options)
+	if err != nil || weights[0] != 1 || weights[1] != 3 {
+		t.Fatal("Should parse weights", weights, err)
+	}
+
+	input := NewWeightedFileInput(paths, weights, &FileInputConfig{loop: true})
+	buf := make([]byte, 1000)
+
+	checkout := 0
+	for i := 0; i < 1000; i++ {
+		n, _ := input.Read(buf)
+		if string(buf[6:n]) == "checkout" {
+			checkout++
+		}
+	}
+	input.Close()
+
+	if checkout < 650 || checkout > 850 {
+		t.Error("Files should be mixed according to weights, got:", checkout)
+	}
+
+	if _, err := parseFileWeights(paths, []string{"70"}); err == nil {
+		t.Error("Each file should have weight")
+	}
+
+	if _, err := parseFileWeights([]string{"browse.gor|10", "checkout.gor"}, []string{"70", "30"}); err == nil {
+		t.Error("Limiter should not be allowed for weighted files")
+	}
+}
+
+func TestInputFileLimiterWithMultipleFiles(t *testing.T) {
+	defer func(p *InOutPlugins) { plugins = p }(plugins)
+	plugins = new(InOutPlugins)
+
+	Settings.inputFile = MultiOption{"/dev/null|100", "/dev/null|10%"}
+	defer func() { Settings.inputFile = nil }()
+
+	registered := InitPlugins()
+
+	if len(registered.Inputs) != 2 {
+		t.Fatal("Each file should be separate input", len(registered.Inputs))
+	}
+
+	for _, input := range registered.Inputs {
+		if l, ok := input.(*Limiter); !ok {
+			t.Errorf("Input should be wrapped in limiter: %T", input)
+		} else if _, ok := l.plugin.(*FileInput); !ok {
+			t.Errorf("Limiter should wrap file input: %T", l.plugin)
+		}
+	}
+
+	if l := registered.Inputs[0].(*Limiter); l.limit != 100 || l.isPercent {
+		t.Error("Wrong limit of first file", l.limit, l.isPercent)
+	}
+
+	if l := registered.Inputs[1].(*Limiter); l.limit != 10 || !l.isPercent {
+		t.Error("Wrong limit of second file", l.limit, l.isPercent)
+	}
+}
+
 func TestInputFileCompressed(t *testing.T) {
 	rnd := rand.Int63()
 
@@ -245,7 +438,7 @@ func TestInputFileCompressed(t *testing.T) {
 	name2 := output2.file.Name()
 	output2.Close()
 
-	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), false)
+	input := NewFileInput(fmt.Sprintf("/tmp/%d*", rnd), &FileInputConfig{})
 	buf := make([]byte, 1000)
 	for i := 0; i < 2000; i++ {
 		input.Read(buf)
@@ -255,6 +448,120 @@ func TestInputFileCompressed(t *testing.T) {
 	os.Remove(name2)
 }
 
+func TestFileInputReaderCompressed(t *testing.T) {
+	for _, ext := range []string{".gz", ".zst"} {
+		name := fmt.Sprintf("/tmp/%d%s", rand.Int63(), ext)
+		file, _ := os.Create(name)
+
+		// Each chunk is separate compressed stream, like files concatenated after rotation
+		for chunk := 0; chunk < 2; chunk++ {
+			w := newFileWriter(name, file, 0)
+			for i := 0; i < 3; i++ {
+				w.Write([]byte(fmt.Sprintf("1 %d %d\nGET / HTTP/1.1\r\n\r\n%s", i, chunk*3+i, payloadSeparator)))
+			}
+			w.(io.Closer).Close()
+		}
+		file.Close()
+
+		r := NewFileInputReader(name, payloadFraming{})
+		if r == nil {
+			t.Fatal("Should open", name)
+		}
+
+		count := 0
+		for r.file != nil {
+			if ts := r.timestamp; ts != int64(count) {
+				t.Error(ext, "Wrong payload order", ts, count)
+			}
+			r.ReadPayload()
+			count++
+		}
+
+		if count != 6 {
+			t.Error(ext, "Should read payloads of all chunks", count)
+		}
+
+		if ts, err := lastPayloadTimestamp(name, payloadFraming{}); err != nil || ts != 5 {
+			t.Error(ext, "Wrong last timestamp", ts, err)
+		}
+
+		os.Remove(name)
+	}
+}
+
+func TestFileInputTimeWindow(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.gor", rand.Int63())
+	defer os.Remove(name)
+
+	file, _ := os.Create(name)
+	for ts := 1; ts <= 10; ts++ {
+		file.Write([]byte(fmt.Sprintf("1 %d %d\nGET / HTTP/1.1\r\n\r\n%s", ts, ts, payloadSeparator)))
+	}
+	file.Close()
+
+	input := NewFileInput(name, &FileInputConfig{timeFrom: "3", timeTo: "6"})
+
+	var received []string
+	for {
+		select {
+		case payload := <-input.data:
+			received = append(received, string(payloadMeta(payload)[2]))
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+
+	if strings.Join(received, ",") != "3,4,5,6" {
+		t.Error("Only payloads within time window should be read:", received)
+	}
+}
+
+func TestFileInputTimeWindowOutOfOrder(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.gor", rand.Int63())
+	defer os.Remove(name)
+
+	// Payloads are not ordered by capture time, reading stops only well past the window
+	file, _ := os.Create(name)
+	for _, ts := range []int64{1, 3, 7, 4, 8, 6, 6 + timeWindowMargin + 1, 5} {
+		file.Write([]byte(fmt.Sprintf("1 %d %d\nGET / HTTP/1.1\r\n\r\n%s", ts, ts, payloadSeparator)))
+	}
+	file.Close()
+
+	input := NewFileInput(name, &FileInputConfig{timeFrom: "3", timeTo: "6"})
+
+	var received []string
+	for {
+		select {
+		case payload := <-input.data:
+			received = append(received, string(payloadMeta(payload)[2]))
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+
+	if strings.Join(received, ",") != "3,4,6" {
+		t.Error("Payloads out of time window should be skipped:", received)
+	}
+}
+
+func TestParseCaptureTime(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"1500000000000000000":       1500000000000000000,
+		"2017-07-14T02:40:00Z":      1500000000000000000,
+		"2017-07-14T04:40:00+02:00": 1500000000000000000,
+	} {
+		if ts, err := parseCaptureTime(value); err != nil || ts != expected {
+			t.Error("Wrong time of", value, ts, err)
+		}
+	}
+
+	if _, err := parseCaptureTime("14:00"); err == nil {
+		t.Error("Should fail on unknown format")
+	}
+}
+
 type CaptureFile struct {
 	data [][]byte
 	file *os.File
@@ -346,7 +653,7 @@ func ReadFromCaptureFile(captureFile *os.File, count int, callback writeCallback
 	quit := make(chan int)
 	wg := new(sync.WaitGroup)
 
-	input := NewFileInput(captureFile.Name(), false)
+	input := NewFileInput(captureFile.Name(), &FileInputConfig{})
 	output := NewTestOutput(func(data []byte) {
 		callback(data)
 		wg.Done()
@@ -384,3 +691,99 @@ func Duplicate(data []byte) (duplicate []byte) {
 
 	return
 }
+
+func TestFileFramingRoundTrip(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor")
+	defer os.RemoveAll(dir)
+
+	// Binary body which contains default separator
+	payloads := [][]byte{
+		[]byte("1 a 1\nPOST / HTTP/1.1\r\nContent-Length: 16\r\n\r\n\x00\x01" + payloadSeparator + "\xff"),
+		[]byte("1 b 2\nGET / HTTP/1.1\r\n\r\n"),
+	}
+
+	for _, c := range []struct{ framing, separator string }{
+		{"length", ""},
+		{"separator", `\n--gor--\n`},
+	} {
+		name := filepath.Join(dir, c.framing+".gor")
+		output := NewFileOutput(name, &FileOutputConfig{flushInterval: time.Minute, append: true, framing: c.framing, separator: c.separator})
+		for _, p := range payloads {
+			output.Write(p)
+		}
+		output.Close()
+
+		framing, err := newPayloadFraming(c.framing, c.separator)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewFileInputReader(name, framing)
+		for _, p := range payloads {
+			if data := r.ReadPayload(); !bytes.Equal(data, p) {
+				t.Errorf("%s: expected payload %q, got %q", c.framing, p, data)
+			}
+		}
+
+		if ts, err := lastPayloadTimestamp(name, framing); err != nil || ts != 2 {
+			t.Errorf("%s: expected last timestamp 2, got %d %v", c.framing, ts, err)
+		}
+	}
+
+	// Payload in default framing read as length framed
+	framing := payloadFraming{lengthPrefixed: true}
+	reader := bufio.NewReader(bytes.NewReader([]byte("1 a 1\n")))
+	if _, err := framing.Read(reader); err != errPayloadTooLarge {
+		t.Error("Should reject length over copy buffer size:", err)
+	}
+	if _, _, err := framing.Split([]byte("1 a 1\n"), false); err != errPayloadTooLarge {
+		t.Error("Should reject length over copy buffer size:", err)
+	}
+
+	for _, c := range []struct{ framing, separator string }{
+		{"csv", ""},
+		{"length", "--"},
+		{"separator", `\q`},
+	} {
+		if _, err := newPayloadFraming(c.framing, c.separator); err == nil {
+			t.Errorf("Expected error for framing %q with separator %q", c.framing, c.separator)
+		}
+	}
+}
+
+func TestInputFileJSONFormat(t *testing.T) {
+	file, _ := ioutil.TempFile("", "gor_json")
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"method":"POST","url":"http://example.com/api?a=1","headers":{"Content-Type":"application/json"},"body":"{\"id\":1}"}` + "\n")
+	file.WriteString("not json\n\n")
+	file.WriteString(`{"method":"GET","url":"/ping","headers":{"Host":"example.org","Accept":["text/plain","*/*"]}}`)
+	file.Close()
+
+	input := NewFileInput(file.Name(), &FileInputConfig{format: "json"})
+	defer input.Close()
+
+	buf := make([]byte, 1000)
+	var payloads [][]byte
+	for i := 0; i < 2; i++ {
+		n, _ := input.Read(buf)
+		payloads = append(payloads, append([]byte{}, buf[:n]...))
+	}
+
+	for _, p := range payloads {
+		meta := payloadMeta(p)
+		if !isRequestPayload(p) || len(meta) < 3 || len(meta[1]) == 0 {
+			t.Errorf("Payload should have request header: %q", p)
+		}
+	}
+
+	expected := []string{
+		"POST /api?a=1 HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/json\r\nContent-Length: 8\r\n\r\n{\"id\":1}",
+		"GET /ping HTTP/1.1\r\nAccept: text/plain\r\nAccept: */*\r\nHost: example.org\r\n\r\n",
+	}
+	for i, p := range payloads {
+		if body := string(payloadBody(p)); body != expected[i] {
+			t.Errorf("Expected request %q, got %q", expected[i], body)
+		}
+	}
+}
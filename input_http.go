@@ -1,6 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -8,18 +15,29 @@ import (
 	"time"
 )
 
+// Payloads POSTed to this path enter the pipeline as is, other requests are emitted as captured requests
+const httpInputPayloadsPath = "/gor/payloads"
+
+// HTTPInputConfig struct for holding http input configuration
+type HTTPInputConfig struct {
+	// Payloads are in JSON format of Kafka output, instead of Gor format
+	useJSON bool
+}
+
 // HTTPInput used for sending requests to Gor via http
 type HTTPInput struct {
 	data     chan []byte
 	address  string
+	config   *HTTPInputConfig
 	listener net.Listener
 }
 
 // NewHTTPInput constructor for HTTPInput. Accepts address with port which he will listen on.
-func NewHTTPInput(address string) (i *HTTPInput) {
+func NewHTTPInput(address string, config *HTTPInputConfig) (i *HTTPInput) {
 	i = new(HTTPInput)
 	i.data = make(chan []byte, 10000)
 	i.address = address
+	i.config = config
 
 	i.listen(address)
 
@@ -28,29 +46,110 @@ func NewHTTPInput(address string) (i *HTTPInput) {
 
 func (i *HTTPInput) Read(data []byte) (int, error) {
 	buf := <-i.data
+	copy(data, buf)
 
-	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1)
-
-	copy(data[0:len(header)], header)
-	copy(data[len(header):], buf)
-
-	return len(buf) + len(header), nil
+	return len(buf), nil
 }
 
 func (i *HTTPInput) handler(w http.ResponseWriter, r *http.Request) {
+	// Request is emitted as single payload, so it can't be bigger than copy buffer
+	r.Body = http.MaxBytesReader(w, r.Body, Settings.copyBufferSize)
+
+	if r.URL.Path == httpInputPayloadsPath && r.Method == http.MethodPost {
+		i.payloadsHandler(w, r)
+		return
+	}
+
 	r.URL.Scheme = "http"
 	r.URL.Host = i.listener.Addr().String()
 
-	buf, _ := httputil.DumpRequestOut(r, true)
+	buf, err := httputil.DumpRequestOut(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
 	http.Error(w, http.StatusText(200), 200)
 
+	header := payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1)
+
 	select {
-	case i.data <- buf:
+	case i.data <- append(header, buf...):
 	default:
 		Debug("[INPUT-HTTP] Dropping requests because output can't process them fast enough")
 	}
 }
 
+// payloadsHandler queues payloads from request body. Body can contain several payloads delimited like in files,
+// or several JSON messages. Client gets 503 if queue is full, so it can retry with the rest of payloads.
+func (i *HTTPInput) payloadsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
+
+	payloads, err := i.decodePayloads(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for n, payload := range payloads {
+		select {
+		case i.data <- payload:
+		default:
+			http.Error(w, fmt.Sprintf("queue is full, %d of %d payloads accepted", n, len(payloads)), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "%d payloads accepted\n", len(payloads))
+}
+
+// bodyErrorStatus is 413 if request body is over the limit, and 400 for other errors
+func bodyErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+func (i *HTTPInput) decodePayloads(body []byte) (payloads [][]byte, err error) {
+	if i.config.useJSON {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		for {
+			var kafkaMessage KafkaMessage
+			if err = decoder.Decode(&kafkaMessage); err == io.EOF {
+				return payloads, nil
+			} else if err != nil {
+				return nil, err
+			}
+
+			payload, _ := kafkaMessage.Dump()
+			payloads = append(payloads, payload)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	scanner.Split(payloadScanner)
+
+	for scanner.Scan() {
+		// Scanner reuses its buffer
+		payload := append([]byte(nil), scanner.Bytes()...)
+		if !isGorPayload(payload) {
+			return nil, fmt.Errorf("payload %d is not in Gor format", len(payloads)+1)
+		}
+
+		payloads = append(payloads, payload)
+	}
+
+	return payloads, nil
+}
+
 func (i *HTTPInput) listen(address string) {
 	var err error
 
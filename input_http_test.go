@@ -16,7 +16,7 @@ func TestHTTPInput(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
 
-	input := NewHTTPInput("127.0.0.1:0")
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
 	output := NewTestOutput(func(data []byte) {
 		wg.Done()
 	})
@@ -50,7 +50,7 @@ func TestInputHTTPLargePayload(t *testing.T) {
 		log.Fatal("dd error:", err)
 	}
 
-	input := NewHTTPInput("127.0.0.1:0")
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
 	output := NewTestOutput(func(data []byte) {
 		if len(proto.Body(payloadBody(data))) != 4000000 {
 			t.Error("Should receive full file")
@@ -75,3 +75,62 @@ func TestInputHTTPLargePayload(t *testing.T) {
 	wg.Wait()
 	close(quit)
 }
+
+func TestHTTPInputPayloads(t *testing.T) {
+	for _, useJSON := range []bool{false, true} {
+		input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{useJSON: useJSON})
+		url := "http://" + input.listener.Addr().String() + httpInputPayloadsPath
+
+		body := "1 a1 1\nGET /first HTTP/1.1\r\n\r\n" + payloadSeparator + "2 a1 2 1\nHTTP/1.1 200 OK\r\n\r\n" + payloadSeparator
+		if useJSON {
+			body = `{"Req_URL":"/first","Req_Type":"1","Req_ID":"a1","Req_Ts":"1","Req_Method":"GET"}
+{"Req_URL":"/second","Req_Type":"1","Req_ID":"a2","Req_Ts":"2","Req_Method":"GET"}`
+		}
+
+		resp, err := http.Post(url, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted {
+			t.Error("Payloads should be accepted:", resp.Status)
+		}
+
+		buf := make([]byte, 1000)
+		n, _ := input.Read(buf)
+		if meta := payloadMeta(buf[:n]); string(meta[1]) != "a1" || string(proto.Path(payloadBody(buf[:n]))) != "/first" {
+			t.Errorf("Wrong payload: %q", buf[:n])
+		}
+
+		if n, _ = input.Read(buf); !isGorPayload(buf[:n]) {
+			t.Errorf("Wrong payload: %q", buf[:n])
+		}
+
+		resp, _ = http.Post(url, "text/plain", strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Error("Malformed payload should be rejected:", resp.Status)
+		}
+	}
+}
+
+func TestHTTPInputBodyLimit(t *testing.T) {
+	defer func(size int64) { Settings.copyBufferSize = size }(Settings.copyBufferSize)
+	Settings.copyBufferSize = 10
+
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
+	address := "http://" + input.listener.Addr().String()
+
+	for _, path := range []string{"/", httpInputPayloadsPath} {
+		resp, err := http.Post(address+path, "text/plain", strings.NewReader(strings.Repeat("a", 100)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Error(path, "Body over copy buffer size should be rejected:", resp.Status)
+		}
+	}
+}
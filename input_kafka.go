@@ -27,6 +27,10 @@ func NewKafkaInput(address string, config *KafkaConfig) *KafkaInput {
 	if mock, ok := config.consumer.(*mocks.Consumer); ok && mock != nil {
 		con = config.consumer
 	} else {
+		if err := config.auth.apply(c); err != nil {
+			log.Fatalln("Failed to configure Sarama(Kafka) consumer:", err)
+		}
+
 		var err error
 		//con, err = sarama.NewConsumer([]string{config.host}, c)
 		con, err = sarama.NewConsumer(strings.Split(config.host, ","), c)
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMQTTBroker forwards published messages to subscribers, supporting `+` and `#` wildcards
+type fakeMQTTBroker struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	subs map[*mqttConn][]string
+}
+
+func newFakeMQTTBroker(t *testing.T) *fakeMQTTBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeMQTTBroker{ln: ln, subs: make(map[*mqttConn][]string)}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.handle(&mqttConn{conn: conn, reader: bufio.NewReader(conn), done: make(chan bool)})
+		}
+	}()
+
+	return b
+}
+
+func mqttTopicMatch(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(t) || (f[i] != "+" && f[i] != t[i]) {
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
+
+func (b *fakeMQTTBroker) handle(c *mqttConn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.subs, c)
+		b.mu.Unlock()
+		c.conn.Close()
+	}()
+
+	for {
+		header, body, err := c.readPacket()
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case mqttConnect:
+			c.writePacket(mqttConnack<<4, []byte{0, 0})
+		case mqttSubscribe:
+			var topics []string
+			for data := body[2:]; len(data) > 2; {
+				l := int(binary.BigEndian.Uint16(data))
+				topics = append(topics, string(data[2:2+l]))
+				data = data[3+l:]
+			}
+
+			b.mu.Lock()
+			b.subs[c] = append(b.subs[c], topics...)
+			b.mu.Unlock()
+
+			c.writePacket(mqttSuback<<4, append(body[0:2], make([]byte, len(topics))...))
+		case mqttPublish:
+			topic := string(body[2 : 2+binary.BigEndian.Uint16(body)])
+
+			b.mu.Lock()
+			for sub, filters := range b.subs {
+				for _, f := range filters {
+					if mqttTopicMatch(f, topic) {
+						sub.writePacket(header, body)
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+		case mqttPingreq:
+			c.writePacket(mqttPingresp<<4, nil)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+func (b *fakeMQTTBroker) subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+func TestMQTTInputOutput(t *testing.T) {
+	broker := newFakeMQTTBroker(t)
+	defer broker.ln.Close()
+
+	address := "tcp://" + broker.ln.Addr().String()
+
+	input := NewMQTTInput(address, &MQTTInputConfig{topics: MultiOption{"devices/+/data", "gor"}})
+	defer input.Close()
+
+	for i := 0; broker.subscribers() == 0; i++ {
+		if i > 100 {
+			t.Fatal("Input should subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Gor payloads are passed as is
+	output := NewMQTTOutput(address, &MQTTOutputConfig{topic: "gor"})
+	defer output.Close()
+
+	request := append(payloadHeader(RequestPayload, uuid(), 1, -1), []byte("GET / HTTP/1.1\r\n\r\n")...)
+	output.Write(request)
+
+	buf := make([]byte, 1000)
+	n, _ := input.Read(buf)
+	if string(buf[:n]) != string(request) {
+		t.Errorf("Expected %q, got %q", request, buf[:n])
+	}
+
+	// Raw messages are wrapped into request payload
+	raw := NewMQTTOutput(address, &MQTTOutputConfig{topic: "devices/1/data", raw: true})
+	defer raw.Close()
+
+	raw.Write(append(payloadHeader(ResponsePayload, uuid(), 1, 1), []byte("skipped")...))
+	raw.Write(append(payloadHeader(RequestPayload, uuid(), 1, -1), []byte(`{"temp":21}`)...))
+
+	n, _ = input.Read(buf)
+	if !isRequestPayload(buf[:n]) || string(payloadBody(buf[:n])) != `{"temp":21}` {
+		t.Errorf("Wrong message: %q", buf[:n])
+	}
+
+	// Not matching topic
+	other := NewMQTTOutput(address, &MQTTOutputConfig{topic: "devices/1/status", raw: true})
+	defer other.Close()
+	other.Write(append(payloadHeader(RequestPayload, uuid(), 1, -1), []byte("online")...))
+
+	select {
+	case data := <-input.data:
+		t.Errorf("Should not receive message: %q", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMQTTInputReconnect(t *testing.T) {
+	broker := newFakeMQTTBroker(t)
+	defer broker.ln.Close()
+
+	input := NewMQTTInput("tcp://"+broker.ln.Addr().String(), &MQTTInputConfig{topics: MultiOption{"#"}})
+	defer input.Close()
+
+	for i := 0; broker.subscribers() == 0; i++ {
+		if i > 100 {
+			t.Fatal("Input should subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Drop connection on broker side
+	broker.mu.Lock()
+	for c := range broker.subs {
+		c.conn.Close()
+		delete(broker.subs, c)
+	}
+	broker.mu.Unlock()
+
+	for i := 0; broker.subscribers() == 0; i++ {
+		if i > 300 {
+			t.Fatal("Input should resubscribe after reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTTMaxPacketSize(t *testing.T) {
+	// PUBLISH packet with remaining length of 2MB, without body
+	packet := []byte{mqttPublish << 4, 0x80, 0x80, 0x80, 0x01}
+
+	c := &mqttConn{reader: bufio.NewReader(bytes.NewReader(packet)), maxPacketSize: 1024 * 1024}
+	if _, _, err := c.readPacket(); err == nil || !strings.Contains(err.Error(), "exceeds maximum") {
+		t.Error("Should reject packet bigger than limit:", err)
+	}
+
+	c = &mqttConn{reader: bufio.NewReader(bytes.NewReader([]byte{mqttPingresp << 4, 0})), maxPacketSize: 1024 * 1024}
+	if header, _, err := c.readPacket(); err != nil || header>>4 != mqttPingresp {
+		t.Error("Should read packet within limit:", header, err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// NATSInput subscribes to NATS subject and emits received payloads.
+// Message can contain several payloads delimited by payloadSeparator, like files of file output.
+type NATSInput struct {
+	config *NATSConfig
+	data   chan []byte
+	quit   chan bool
+
+	mu   sync.Mutex
+	conn *natsConn
+}
+
+// NewNATSInput constructor for NATSInput, server URL is taken from config, like in Kafka input
+func NewNATSInput(address string, config *NATSConfig) *NATSInput {
+	if config.subject == "" {
+		log.Fatal("input-nats-subject: subject is required")
+	}
+
+	i := &NATSInput{
+		config: config,
+		data:   make(chan []byte, 1000),
+		quit:   make(chan bool),
+	}
+
+	go i.consume()
+
+	return i
+}
+
+// consume keeps subscription, and reconnects with exponential backoff if connection is lost
+func (i *NATSInput) consume() {
+	backoff := time.Second
+
+	for {
+		conn, err := natsDial(i.config.url)
+		if err == nil {
+			err = conn.Subscribe(i.config.subject)
+		}
+
+		if err == nil {
+			backoff = time.Second
+
+			i.mu.Lock()
+			i.conn = conn
+			i.mu.Unlock()
+
+			for {
+				var message []byte
+				if message, err = conn.ReadMessage(); err != nil {
+					break
+				}
+
+				if !i.emit(message) {
+					return
+				}
+			}
+
+			conn.Close()
+		}
+
+		select {
+		case <-i.quit:
+			return
+		default:
+		}
+
+		log.Println("[INPUT-NATS] Connection error, reconnecting in", backoff, ":", err)
+
+		select {
+		case <-i.quit:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// emit splits message into payloads, returns false if input is closed
+func (i *NATSInput) emit(message []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(message))
+	scanner.Buffer(nil, len(message)+1)
+	scanner.Split(payloadScanner)
+
+	for scanner.Scan() {
+		// Scanner reuses its buffer
+		payload := append([]byte(nil), scanner.Bytes()...)
+
+		if i.config.useJSON {
+			var kafkaMessage KafkaMessage
+			if err := json.Unmarshal(payload, &kafkaMessage); err != nil {
+				log.Println("[INPUT-NATS] Failed to decode message:", err)
+				continue
+			}
+			payload, _ = kafkaMessage.Dump()
+		}
+
+		select {
+		case i.data <- payload:
+		case <-i.quit:
+			return false
+		}
+	}
+
+	return true
+}
+
+func (i *NATSInput) Read(data []byte) (int, error) {
+	select {
+	case buf := <-i.data:
+		copy(data, buf)
+		return len(buf), nil
+	case <-i.quit:
+		return 0, io.EOF
+	}
+}
+
+func (i *NATSInput) String() string {
+	return "NATS input: " + i.config.url + "/" + i.config.subject
+}
+
+// Close unsubscribes and disconnects from the server
+func (i *NATSInput) Close() error {
+	close(i.quit)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.conn != nil {
+		i.conn.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATSServer delivers published messages to subscribers of the same subject
+type fakeNATSServer struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	subs map[net.Conn]string
+}
+
+func newFakeNATSServer(t *testing.T) *fakeNATSServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeNATSServer{ln: ln, subs: make(map[net.Conn]string)}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeNATSServer) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	// Clients should answer pings
+	conn.Write([]byte("INFO {\"server_id\":\"fake\"}\r\nPING\r\n"))
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+
+		switch args[0] {
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "SUB":
+			s.mu.Lock()
+			s.subs[conn] = args[1]
+			s.mu.Unlock()
+		case "PUB":
+			size, _ := strconv.Atoi(args[2])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			for sub, subject := range s.subs {
+				if subject == args[1] {
+					sub.Write([]byte("MSG " + subject + " 1 " + args[2] + "\r\n"))
+					sub.Write(data)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *fakeNATSServer) subscribers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.subs)
+}
+
+func TestNATSInputOutput(t *testing.T) {
+	for _, useJSON := range []bool{false, true} {
+		server := newFakeNATSServer(t)
+		address := server.ln.Addr().String()
+
+		input := NewNATSInput("", &NATSConfig{url: address, subject: "gor", useJSON: useJSON})
+		for i := 0; server.subscribers() == 0; i++ {
+			if i == 100 {
+				t.Fatal("Input is not subscribed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		output := NewNATSOutput("", &NATSConfig{url: "nats://" + address, subject: "gor", useJSON: useJSON})
+		output.Write([]byte("1 1 1\nGET /1 HTTP/1.1\r\n\r\n"))
+		output.Write([]byte("1 2 2\nGET /2 HTTP/1.1\r\n\r\n"))
+
+		buf := make([]byte, 1024)
+		for _, expected := range []string{"1 1 1\nGET /1 HTTP/1.1\r\n\r\n", "1 2 2\nGET /2 HTTP/1.1\r\n\r\n"} {
+			n, _ := input.Read(buf)
+			if string(buf[:n]) != expected {
+				t.Errorf("JSON %v: expected %q, got %q", useJSON, expected, buf[:n])
+			}
+		}
+
+		output.(*NATSOutput).Close()
+		input.Close()
+		server.ln.Close()
+	}
+}
+
+func TestNATSInputMultiplePayloads(t *testing.T) {
+	server := newFakeNATSServer(t)
+	defer server.ln.Close()
+
+	input := NewNATSInput("", &NATSConfig{url: server.ln.Addr().String(), subject: "gor"})
+	defer input.Close()
+	for server.subscribers() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := natsDial(server.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Publish("gor", []byte("1 1 1\nGET /1 HTTP/1.1\r\n\r\n"+payloadSeparator+"1 2 2\nGET /2 HTTP/1.1\r\n\r\n"+payloadSeparator))
+
+	buf := make([]byte, 1024)
+	for _, expected := range []string{"1 1 1\nGET /1 HTTP/1.1\r\n\r\n", "1 2 2\nGET /2 HTTP/1.1\r\n\r\n"} {
+		n, _ := input.Read(buf)
+		if string(buf[:n]) != expected {
+			t.Errorf("Expected %q, got %q", expected, buf[:n])
+		}
+	}
+}
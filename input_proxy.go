@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// ProxyInputConfig holds options of proxy input
+type ProxyInputConfig struct {
+	backend       string
+	trackResponse bool
+}
+
+// ProxyInput is inline reverse proxy: clients get responses of real backend, while proxied requests
+// are emitted to outputs, so they can be shadow-replayed without SPAN port or packet capture.
+//
+// Payloads are dropped if outputs can't keep up, so replay never slows down proxied traffic.
+type ProxyInput struct {
+	data     chan []byte
+	address  string
+	backend  *url.URL
+	config   *ProxyInputConfig
+	proxy    *httputil.ReverseProxy
+	listener net.Listener
+}
+
+type proxyRequestKey struct{}
+
+// proxyRequest links proxied response with its request
+type proxyRequest struct {
+	id    []byte
+	start time.Time
+	// Response is emitted only if request was
+	emitted bool
+}
+
+// NewProxyInput constructor for ProxyInput. Accepts address to listen on, requests are forwarded to `config.backend`.
+func NewProxyInput(address string, config *ProxyInputConfig) (i *ProxyInput) {
+	i = new(ProxyInput)
+	i.data = make(chan []byte, 10000)
+	i.address = address
+	i.config = config
+
+	backend, err := url.Parse(config.backend)
+	if err != nil || backend.Host == "" {
+		log.Fatal("input-proxy-backend: should be url of backend, e.g. http://localhost:8081, got ", config.backend)
+	}
+	i.backend = backend
+
+	i.proxy = httputil.NewSingleHostReverseProxy(backend)
+	if config.trackResponse {
+		i.proxy.ModifyResponse = i.emitResponse
+	}
+
+	i.listen(address)
+
+	return
+}
+
+func (i *ProxyInput) Read(data []byte) (int, error) {
+	buf := <-i.data
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (i *ProxyInput) handler(w http.ResponseWriter, r *http.Request) {
+	req := &proxyRequest{id: uuid(), start: time.Now()}
+
+	body, captured, err := captureBody(r.Body)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if captured != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(captured))
+		dump, _ := httputil.DumpRequest(r, true)
+
+		i.emit(append(payloadHeader(RequestPayload, req.id, req.start.UnixNano(), -1), dump...))
+		req.emitted = true
+	} else {
+		Debug("[INPUT-PROXY] Request body is over --copy-buffer-size, request is proxied but not emitted")
+	}
+	r.Body = body
+
+	i.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyRequestKey{}, req)))
+}
+
+func (i *ProxyInput) emitResponse(resp *http.Response) error {
+	req, ok := resp.Request.Context().Value(proxyRequestKey{}).(*proxyRequest)
+	if !ok || !req.emitted {
+		return nil
+	}
+
+	body, captured, err := captureBody(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if captured == nil {
+		Debug("[INPUT-PROXY] Response body is over --copy-buffer-size, response is proxied but not emitted")
+		resp.Body = body
+		return nil
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(captured))
+	dump, _ := httputil.DumpResponse(resp, true)
+	resp.Body = body
+
+	latency := time.Since(req.start).Nanoseconds()
+	i.emit(append(payloadHeader(ResponsePayload, req.id, req.start.UnixNano(), latency), dump...))
+
+	return nil
+}
+
+// captureBody reads body up to --copy-buffer-size, as bigger payload can't be emitted anyway.
+// Returns body to pass on, and its captured content, which is nil if body is bigger than the limit.
+func captureBody(body io.ReadCloser) (io.ReadCloser, []byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, Settings.copyBufferSize+1))
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+
+	if int64(len(data)) > Settings.copyBufferSize {
+		// The rest of body is passed on without buffering
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}, nil, nil
+	}
+
+	body.Close()
+	return ioutil.NopCloser(bytes.NewReader(data)), data, nil
+}
+
+func (i *ProxyInput) emit(payload []byte) {
+	select {
+	case i.data <- payload:
+	default:
+		Debug("[INPUT-PROXY] Dropping requests because output can't process them fast enough")
+	}
+}
+
+func (i *ProxyInput) listen(address string) {
+	var err error
+
+	i.listener, err = net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("Proxy input listener failure:", err)
+	}
+
+	go func() {
+		err = http.Serve(i.listener, http.HandlerFunc(i.handler))
+		if err != nil {
+			log.Fatal("Proxy input serve failure:", err)
+		}
+	}()
+}
+
+func (i *ProxyInput) String() string {
+	return "Proxy input: " + i.address + " -> " + i.backend.String()
+}
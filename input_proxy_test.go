@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestProxyInput(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("backend:"), body...))
+	}))
+	defer backend.Close()
+
+	input := NewProxyInput("127.0.0.1:0", &ProxyInputConfig{backend: backend.URL, trackResponse: true})
+
+	var mu sync.Mutex
+	payloads := make(map[byte][]byte)
+	output := NewTestOutput(func(data []byte) {
+		mu.Lock()
+		payloads[data[0]] = append([]byte(nil), data...)
+		mu.Unlock()
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+
+	go Start(plugins, quit)
+	defer close(quit)
+
+	wg.Add(2)
+	resp, err := http.Post("http://"+input.listener.Addr().String()+"/upload", "text/plain", strings.NewReader("a=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "backend:a=1" {
+		t.Error("Client should get response of backend:", string(body))
+	}
+
+	wg.Wait()
+
+	req, res := payloads[RequestPayload], payloads[ResponsePayload]
+
+	if !bytes.Equal(proto.Path(payloadBody(req)), []byte("/upload")) || !bytes.Equal(proto.Body(payloadBody(req)), []byte("a=1")) {
+		t.Errorf("Wrong request payload: %q", req)
+	}
+
+	if !bytes.Equal(proto.Body(payloadBody(res)), []byte("backend:a=1")) {
+		t.Errorf("Wrong response payload: %q", res)
+	}
+
+	if !bytes.Equal(payloadMeta(req)[1], payloadMeta(res)[1]) {
+		t.Error("Request and response should have the same ID")
+	}
+}
+
+func TestProxyInputLargeBody(t *testing.T) {
+	defer func(size int64) { Settings.copyBufferSize = size }(Settings.copyBufferSize)
+	Settings.copyBufferSize = 5
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("backend:"), body...))
+	}))
+	defer backend.Close()
+
+	input := NewProxyInput("127.0.0.1:0", &ProxyInputConfig{backend: backend.URL, trackResponse: true})
+
+	resp, err := http.Post("http://"+input.listener.Addr().String()+"/upload", "text/plain", strings.NewReader("a=1234567890"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// Request is proxied as is, but it is not emitted
+	if string(body) != "backend:a=1234567890" {
+		t.Error("Client should get response of backend:", string(body))
+	}
+
+	select {
+	case payload := <-input.data:
+		t.Errorf("Payload over copy buffer size should not be emitted: %q", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/buger/goreplay/metrics"
 	"github.com/buger/goreplay/proto"
 	raw "github.com/buger/goreplay/raw_socket_listener"
 )
@@ -22,6 +23,7 @@ type RAWInput struct {
 	bpfFilter     string
 	timestampType string
 	bufferSize    int64
+	recordPort    bool
 }
 
 // Available engines for intercepting traffic
@@ -29,10 +31,11 @@ const (
 	EngineRawSocket = 1 << iota
 	EnginePcap
 	EnginePcapFile
+	EngineEBPF
 )
 
 // NewRAWInput constructor for RAWInput. Accepts address with port as argument.
-func NewRAWInput(address string, engine int, trackResponse bool, expire time.Duration, realIPHeader string, bpfFilter string, timestampType string, bufferSize int64) (i *RAWInput) {
+func NewRAWInput(address string, engine int, trackResponse bool, expire time.Duration, realIPHeader string, bpfFilter string, timestampType string, bufferSize int64, recordPort bool) (i *RAWInput) {
 	i = new(RAWInput)
 	i.data = make(chan *raw.TCPMessage)
 	i.address = address
@@ -44,6 +47,7 @@ func NewRAWInput(address string, engine int, trackResponse bool, expire time.Dur
 	i.trackResponse = trackResponse
 	i.timestampType = timestampType
 	i.bufferSize = bufferSize
+	i.recordPort = recordPort
 
 	i.listen(address)
 	i.listener.IsReady()
@@ -58,12 +62,17 @@ func (i *RAWInput) Read(data []byte) (int, error) {
 	var header []byte
 
 	if msg.IsIncoming {
-		header = payloadHeader(RequestPayload, msg.UUID(), msg.Start.UnixNano(), -1)
-		if len(i.realIPHeader) > 0 {
+		header = i.header(RequestPayload, msg, -1)
+		// UDP datagrams can be of any protocol
+		if len(i.realIPHeader) > 0 && proto.IsHTTPPayload(buf) {
 			buf = proto.SetHeader(buf, i.realIPHeader, []byte(msg.IP().String()))
 		}
 	} else {
-		header = payloadHeader(ResponsePayload, msg.UUID(), msg.Start.UnixNano(), msg.End.UnixNano()-msg.AssocMessage.End.UnixNano())
+		if Settings.trackResponseDechunk {
+			buf = dechunkHTTP(buf)
+		}
+
+		header = i.header(ResponsePayload, msg, msg.End.UnixNano()-msg.AssocMessage.End.UnixNano())
 	}
 
 	copy(data[0:len(header)], header)
@@ -72,6 +81,15 @@ func (i *RAWInput) Read(data []byte) (int, error) {
 	return len(buf) + len(header), nil
 }
 
+// Port of the captured service is added only if asked, since it changes header format
+func (i *RAWInput) header(payloadType byte, msg *raw.TCPMessage, latency int64) []byte {
+	if i.recordPort {
+		return payloadHeaderWithPort(payloadType, msg.UUID(), msg.Start.UnixNano(), latency, msg.ServicePort())
+	}
+
+	return payloadHeader(payloadType, msg.UUID(), msg.Start.UnixNano(), latency)
+}
+
 func (i *RAWInput) listen(address string) {
 	Debug("Listening for traffic on: " + address)
 
@@ -81,7 +99,20 @@ func (i *RAWInput) listen(address string) {
 		log.Fatal("input-raw: error while parsing address", err)
 	}
 
-	i.listener = raw.NewListener(host, port, i.engine, i.trackResponse, i.expire, i.bpfFilter, i.timestampType, i.bufferSize, Settings.inputRAWOverrideSnapLen, Settings.inputRAWImmediateMode)
+	i.listener = raw.NewListener(host, port, raw.ListenerConfig{
+		Engine:         i.engine,
+		TrackResponse:  i.trackResponse,
+		Expire:         i.expire,
+		BPFFilter:      i.bpfFilter,
+		TimestampType:  i.timestampType,
+		BufferSize:     i.bufferSize,
+		SnapLen:        Settings.inputRAWSnapLen,
+		ImmediateMode:  Settings.inputRAWImmediateMode,
+		TLSKeyLog:      Settings.inputRAWTLSKeyLog,
+		Workers:        Settings.inputRAWWorkers,
+		Protocol:       Settings.inputRAWProtocol,
+		ProtocolDetect: Settings.inputRAWProtocolDetect,
+	})
 
 	ch := i.listener.Receiver()
 
@@ -99,6 +130,41 @@ func (i *RAWInput) listen(address string) {
 			i.data <- m
 		}
 	}()
+
+	go i.reportStats()
+}
+
+// reportStats updates capture metrics, and warns when pcap starts dropping packets
+func (i *RAWInput) reportStats() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var dropped int
+
+	for {
+		select {
+		case <-i.quit:
+			return
+		case <-ticker.C:
+		}
+
+		s := i.listener.Stats()
+
+		metrics.SetCaptureStats(i.address, metrics.CaptureStats{
+			PacketsReceived:  s.PacketsReceived,
+			PacketsDropped:   s.PacketsDropped,
+			PacketsIfDropped: s.PacketsIfDropped,
+			PacketsQueued:    s.PacketsQueued,
+			MessagesEmitted:  s.MessagesEmitted,
+			MessagesExpired:  s.MessagesExpired,
+			StreamsNonHTTP:   s.StreamsNonHTTP,
+		})
+
+		if s.PacketsDropped > dropped {
+			log.Println("[INPUT-RAW] Packets dropped by capture:", s.PacketsDropped-dropped, "Consider increasing --input-raw-buffer-size")
+		}
+		dropped = s.PacketsDropped
+	}
 }
 
 func (i *RAWInput) String() string {
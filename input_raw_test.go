@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"log"
@@ -44,7 +45,7 @@ func TestRAWInputIPv4(t *testing.T) {
 
 	var respCounter, reqCounter int64
 
-	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "X-Real-IP", "", "", 0)
+	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "X-Real-IP", "", "", 0, false)
 	defer input.Close()
 
 	output := NewTestOutput(func(data []byte) {
@@ -108,7 +109,7 @@ func TestRAWInputNoKeepAlive(t *testing.T) {
 
 	originAddr := listener.Addr().String()
 
-	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", "", "", 0)
+	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", "", "", 0, false)
 	defer input.Close()
 
 	output := NewTestOutput(func(data []byte) {
@@ -156,7 +157,7 @@ func TestRAWInputIPv6(t *testing.T) {
 
 	var respCounter, reqCounter int64
 
-	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", "", "", 0)
+	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", "", "", 0, false)
 	defer input.Close()
 
 	output := NewTestOutput(func(data []byte) {
@@ -209,7 +210,7 @@ func TestInputRAW100Expect(t *testing.T) {
 
 	originAddr := strings.Replace(origin.Listener.Addr().String(), "[::]", "127.0.0.1", -1)
 
-	input := NewRAWInput(originAddr, EnginePcap, true, time.Second, "", "", "", 0)
+	input := NewRAWInput(originAddr, EnginePcap, true, time.Second, "", "", "", 0, false)
 	defer input.Close()
 
 	// We will use it to get content of raw HTTP request
@@ -274,7 +275,7 @@ func TestInputRAWChunkedEncoding(t *testing.T) {
 	}))
 
 	originAddr := strings.Replace(origin.Listener.Addr().String(), "[::]", "127.0.0.1", -1)
-	input := NewRAWInput(originAddr, EnginePcap, true, time.Second, "", "", "", 0)
+	input := NewRAWInput(originAddr, EnginePcap, true, time.Second, "", "", "", 0, false)
 	defer input.Close()
 
 	replay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -340,7 +341,7 @@ func TestInputRAWLargePayload(t *testing.T) {
 	}))
 	originAddr := strings.Replace(origin.Listener.Addr().String(), "[::]", "127.0.0.1", -1)
 
-	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", "", "", 0)
+	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", "", "", 0, false)
 	defer input.Close()
 
 	replay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -378,6 +379,93 @@ func TestInputRAWLargePayload(t *testing.T) {
 	close(quit)
 }
 
+func h2cFrame(typ, flags byte, streamID uint32, payload []byte) []byte {
+	frame := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[5:], streamID)
+
+	return append(frame, payload...)
+}
+
+// HPACK literals without indexing, for short names and values
+func h2cHeaders(headers ...string) (block []byte) {
+	for i := 0; i < len(headers); i += 2 {
+		block = append(block, 0, byte(len(headers[i])))
+		block = append(block, headers[i]...)
+		block = append(block, byte(len(headers[i+1])))
+		block = append(block, headers[i+1]...)
+	}
+
+	return
+}
+
+func TestRAWInputHTTP2(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	input := NewRAWInput(listener.Addr().String(), EnginePcap, false, testRawExpire, "", "", "", 0, false)
+	defer input.Close()
+
+	var payloads [][]byte
+	output := NewTestOutput(func(data []byte) {
+		payloads = append(payloads, payloadBody(data))
+		wg.Done()
+	})
+
+	config := &HTTPModifierConfig{}
+	config.methods.Set("POST")
+	config.headerFilters.Set("X-Http2-Priority:weight=256")
+	modifier := NewHTTPModifier(config)
+
+	go copyMulty(input, modifier, output)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	wg.Add(1)
+
+	var data []byte
+	data = append(data, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"...)
+	data = append(data, h2cFrame(0x4, 0, 0, nil)...)
+	// Filtered out by method
+	data = append(data, h2cFrame(0x1, 0x5, 1, h2cHeaders(":method", "GET", ":path", "/", ":authority", "www.w3.org"))...)
+	// Filtered out by priority: default weight is 16
+	data = append(data, h2cFrame(0x1, 0x4, 3, h2cHeaders(":method", "POST", ":path", "/low", ":authority", "www.w3.org"))...)
+	data = append(data, h2cFrame(0x0, 0x1, 3, []byte("a=1"))...)
+	// Has PRIORITY flag, weight 256
+	data = append(data, h2cFrame(0x1, 0x24, 5, append([]byte{0, 0, 0, 0, 255}, h2cHeaders(":method", "POST", ":path", "/high", ":authority", "www.w3.org")...))...)
+	data = append(data, h2cFrame(0x0, 0x1, 5, []byte("b=2"))...)
+
+	conn.Write(data)
+
+	wg.Wait()
+	time.Sleep(100 * time.Millisecond)
+
+	if len(payloads) != 1 {
+		t.Fatal("Only one request should pass filters, got", len(payloads))
+	}
+
+	expected := "POST /high HTTP/1.1\r\nHost: www.w3.org\r\nX-Http2-Stream-Id: 5\r\nX-Http2-Priority: weight=256; depends-on=0; exclusive=0\r\nX-Http2-Flags: END_HEADERS,PRIORITY\r\nContent-Length: 3\r\n\r\nb=2"
+	if string(payloads[0]) != expected {
+		t.Errorf("Expected %q, got %q", expected, payloads[0])
+	}
+}
+
 func BenchmarkRAWInput(b *testing.B) {
 	var respCounter, reqCounter, replayCounter int64
 
@@ -393,7 +481,7 @@ func BenchmarkRAWInput(b *testing.B) {
 	defer origin.Close()
 	upstreamAddr := strings.Replace(upstream.Listener.Addr().String(), "[::]", "127.0.0.1", -1)
 
-	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", "", "", 0)
+	input := NewRAWInput(originAddr, EnginePcap, true, testRawExpire, "", "", "", 0, false)
 	defer input.Close()
 
 	output := NewTestOutput(func(data []byte) {
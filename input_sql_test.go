@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePgServer accepts single connection, authenticates it with md5 and answers any query with given rows
+func fakePgServer(t *testing.T, password string, columns []string, rows [][]string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(conn net.Conn, typ byte, data []byte) {
+		msg := []byte{typ, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(msg[1:], uint32(len(data)+4))
+		conn.Write(append(msg, data...))
+	}
+
+	read := func(r *bufio.Reader, typed bool) (byte, []byte) {
+		var typ byte
+		if typed {
+			typ, _ = r.ReadByte()
+		}
+		header := make([]byte, 4)
+		io.ReadFull(r, header)
+		data := make([]byte, binary.BigEndian.Uint32(header)-4)
+		io.ReadFull(r, data)
+		return typ, data
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		_, startup := read(r, false)
+		user := strings.Split(string(startup[4:]), "\x00")[1]
+
+		salt := []byte{1, 2, 3, 4}
+		write(conn, 'R', []byte{0, 0, 0, pgAuthMD5, 1, 2, 3, 4})
+
+		if _, pass := read(r, true); string(pass) != pgMD5Password(user, password, salt)+"\x00" {
+			write(conn, 'E', []byte("SFATAL\x00Mpassword authentication failed\x00\x00"))
+			return
+		}
+
+		write(conn, 'R', []byte{0, 0, 0, pgAuthOK})
+		write(conn, 'Z', []byte{'I'})
+
+		if typ, _ := read(r, true); typ != 'Q' {
+			return
+		}
+
+		var desc bytes.Buffer
+		binary.Write(&desc, binary.BigEndian, uint16(len(columns)))
+		for _, c := range columns {
+			desc.WriteString(c + "\x00")
+			desc.Write(make([]byte, 18))
+		}
+		write(conn, 'T', desc.Bytes())
+
+		for _, row := range rows {
+			var data bytes.Buffer
+			binary.Write(&data, binary.BigEndian, uint16(len(row)))
+			for _, v := range row {
+				if v == "NULL" {
+					binary.Write(&data, binary.BigEndian, int32(-1))
+					continue
+				}
+				binary.Write(&data, binary.BigEndian, int32(len(v)))
+				data.WriteString(v)
+			}
+			write(conn, 'D', data.Bytes())
+		}
+
+		write(conn, 'C', []byte("SELECT 2\x00"))
+		write(conn, 'Z', []byte{'I'})
+		read(r, true)
+	}()
+
+	return listener
+}
+
+func TestSQLInput(t *testing.T) {
+	listener := fakePgServer(t, "secret",
+		[]string{"http_method", "path", "hdrs", "payload"},
+		[][]string{
+			{"post", "/api", `{"Content-Type": "application/json"}`, `{"a":1}`},
+			{"GET", "http://example.com/?q=1", "NULL", "NULL"},
+		})
+	defer listener.Close()
+
+	input := NewSQLInput("postgres://gor:secret@"+listener.Addr().String()+"/db?sslmode=disable&query="+url.PathEscape("SELECT * FROM requests"),
+		&SQLInputConfig{mapping: "method=http_method,url=path,headers=hdrs,body=payload"})
+
+	if strings.Contains(input.String(), "secret") {
+		t.Error("Password should not be exposed:", input.String())
+	}
+
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	var requests []string
+	output := NewTestOutput(func(data []byte) {
+		requests = append(requests, string(payloadBody(data)))
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+
+	wg.Add(2)
+	go Start(plugins, quit)
+
+	wg.Wait()
+	close(quit)
+
+	expected := []string{
+		"POST /api HTTP/1.1\r\nContent-Type: application/json\r\nContent-Length: 7\r\n\r\n{\"a\":1}",
+		"GET /?q=1 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	}
+
+	if len(requests) != len(expected) {
+		t.Fatal("Wrong number of requests:", requests)
+	}
+
+	for idx := range expected {
+		if requests[idx] != expected[idx] {
+			t.Errorf("Expected %q, got %q", expected[idx], requests[idx])
+		}
+	}
+}
+
+func TestSQLFieldMapping(t *testing.T) {
+	m, err := parseSQLFieldMapping("url=path, timestamp = created_at")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.url != "path" || m.timestamp != "created_at" || m.method != "method" {
+		t.Error("Wrong mapping:", m)
+	}
+
+	if _, err = parseSQLFieldMapping("uri=path"); err == nil {
+		t.Error("Should fail on unknown field")
+	}
+
+	ts, err := parseSQLTimestamp("2020-03-01 10:00:00.5+00")
+	if err != nil || ts != 1583056800500000000 {
+		t.Error("Wrong timestamp:", ts, err)
+	}
+
+	for _, value := range []string{"1583056800", "1583056800000", "1583056800000000", "1583056800000000000"} {
+		if ts, _ = parseSQLTimestamp(value); ts != 1583056800000000000 {
+			t.Error("Wrong unix timestamp:", value, ts)
+		}
+	}
+}
+
+func TestSQLInputExtractQuery(t *testing.T) {
+	dsn, _ := url.Parse("postgres://localhost/db?sslmode=disable&query=SELECT a+1 AS b, '%25' FROM t&connect_timeout=5")
+
+	query, err := extractSQLQuery(dsn)
+	if err != nil || query != "SELECT a+1 AS b, '%' FROM t" {
+		t.Errorf("Wrong query: %q %v", query, err)
+	}
+
+	if dsn.RawQuery != "sslmode=disable&connect_timeout=5" {
+		t.Error("Query should be removed from parameters:", dsn.RawQuery)
+	}
+}
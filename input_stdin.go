@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// StdinInput reads payloads in Gor file format from stdin, e.g. piped from another process
+type StdinInput struct {
+	scanner *bufio.Scanner
+	done    sync.Once
+}
+
+// NewStdinInput constructor for StdinInput
+func NewStdinInput() *StdinInput {
+	return newReaderInput(os.Stdin)
+}
+
+func newReaderInput(r io.Reader) *StdinInput {
+	// Stdin usually gets what file output writes, so it is framed the same way as input file
+	framing, err := newPayloadFraming(Settings.inputFileConfig.framing, Settings.inputFileConfig.separator)
+	if err != nil {
+		log.Fatal("input-file-framing: ", err)
+	}
+
+	i := &StdinInput{scanner: bufio.NewScanner(r)}
+	i.scanner.Buffer(make([]byte, 64*1024), int(Settings.copyBufferSize))
+	i.scanner.Split(framing.Split)
+
+	return i
+}
+
+func (i *StdinInput) Read(data []byte) (int, error) {
+	for i.scanner.Scan() {
+		// Skip leftovers after the last separator
+		if len(i.scanner.Bytes()) == 0 {
+			continue
+		}
+
+		return copy(data, i.scanner.Bytes()), nil
+	}
+
+	if err := i.scanner.Err(); err != nil {
+		log.Println("StdinInput:", err)
+	}
+
+	i.done.Do(func() {
+		log.Println("StdinInput: end of input")
+
+		// The same as FileInput: give outputs time to send queued requests, then stop
+		go func() {
+			time.Sleep(time.Second)
+			stopGor()
+		}()
+	})
+
+	return 0, io.EOF
+}
+
+func (i *StdinInput) String() string {
+	return "Stdin input"
+}
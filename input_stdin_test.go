@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStdinInput(t *testing.T) {
+	req := "1 1 1\nGET / HTTP/1.1\r\n\r\n"
+	resp := "2 1 1 1\nHTTP/1.1 200 OK\r\n\r\n"
+	input := newReaderInput(strings.NewReader(req + payloadSeparator + resp + payloadSeparator))
+
+	buf := make([]byte, 1000)
+	for _, expected := range []string{req, resp} {
+		n, err := input.Read(buf)
+		if err != nil || string(buf[:n]) != expected {
+			t.Errorf("Expected %q, got %q %v", expected, buf[:n], err)
+		}
+	}
+
+	if _, err := input.Read(buf); err != io.EOF {
+		t.Error("Should return EOF when input is closed, got", err)
+	}
+}
+
+func TestStdinInputStopsOnce(t *testing.T) {
+	closeCh = make(chan int)
+	defer func() {
+		closeCh = nil
+		closeChOnce = sync.Once{}
+	}()
+
+	// Both inputs and --exit-after stop Gor
+	for i := 0; i < 2; i++ {
+		input := newReaderInput(strings.NewReader(""))
+		if _, err := input.Read(make([]byte, 100)); err != io.EOF {
+			t.Fatal("Expected EOF, got", err)
+		}
+	}
+	stopGor()
+
+	select {
+	case <-closeCh:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Gor should be stopped")
+	}
+
+	// Inputs stop Gor with delay, so wait for them to not panic
+	time.Sleep(1500 * time.Millisecond)
+}
@@ -9,20 +9,30 @@ import (
 	"log"
 	"net"
 	"os"
+	"sync"
+	"time"
 )
 
 // TCPInput used for internal communication
 type TCPInput struct {
+	mu       sync.Mutex
 	data     chan []byte
 	listener net.Listener
 	address  string
 	config   *TCPInputConfig
+	conns    map[net.Conn]struct{}
+	quit     chan bool
+	stop     sync.Once
 }
 
 type TCPInputConfig struct {
 	secure          bool
 	certificatePath string
 	keyPath         string
+	idleTimeout     time.Duration
+	keepAlive       time.Duration
+	// "tcp" by default, or "unix" for Unix domain socket
+	network string
 }
 
 // NewTCPInput constructor for TCPInput, accepts address with port
@@ -31,6 +41,8 @@ func NewTCPInput(address string, config *TCPInputConfig) (i *TCPInput) {
 	i.data = make(chan []byte, 1000)
 	i.address = address
 	i.config = config
+	i.conns = make(map[net.Conn]struct{})
+	i.quit = make(chan bool)
 
 	i.listen(address)
 
@@ -45,25 +57,25 @@ func (i *TCPInput) Read(data []byte) (int, error) {
 }
 
 func (i *TCPInput) listen(address string) {
+	network := i.config.network
+	if network == "" {
+		network = "tcp"
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal("Can't start:", err)
+	}
+	i.listener = listener
+
+	var tlsConfig *tls.Config
 	if i.config.secure {
 		cer, err := tls.LoadX509KeyPair(i.config.certificatePath, i.config.keyPath)
 		if err != nil {
 			log.Fatal("Error while loading --input-file certificate:", err)
 		}
 
-		config := &tls.Config{Certificates: []tls.Certificate{cer}}
-		listener, err := tls.Listen("tcp", address, config)
-		if err != nil {
-			log.Fatal("Can't start --input-tcp with secure connection:", err)
-		}
-		i.listener = listener
-	} else {
-		listener, err := net.Listen("tcp", address)
-		if err != nil {
-			log.Fatal("Can't start:", err)
-		}
-
-		i.listener = listener
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cer}}
 	}
 
 	go func() {
@@ -71,37 +83,90 @@ func (i *TCPInput) listen(address string) {
 			conn, err := i.listener.Accept()
 
 			if err != nil {
+				select {
+				case <-i.quit:
+					return
+				default:
+				}
+
 				log.Println("Error while Accept()", err)
 				continue
 			}
 
+			// Keepalive has to be set on the raw TCP socket, before it gets wrapped in TLS
+			// Listener enables keepalive with default period, so it should be explicitly disabled
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				if i.config.keepAlive > 0 {
+					tcpConn.SetKeepAlive(true)
+					tcpConn.SetKeepAlivePeriod(i.config.keepAlive)
+				} else {
+					tcpConn.SetKeepAlive(false)
+				}
+			}
+
+			if tlsConfig != nil {
+				conn = tls.Server(conn, tlsConfig)
+			}
+
 			go i.handleConnection(conn)
 		}
 	}()
 }
 
+func (i *TCPInput) trackConnection(conn net.Conn, active bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if active {
+		i.conns[conn] = struct{}{}
+	} else {
+		delete(i.conns, conn)
+	}
+}
+
+// handleConnection reads payloads from a single sender connection.
+// Each connection owns its reassembly buffer, so when a sender reconnects
+// half-received payload from the old connection is dropped instead of being glued to the new one.
 func (i *TCPInput) handleConnection(conn net.Conn) {
-	defer conn.Close()
+	i.trackConnection(conn, true)
+	defer func() {
+		i.trackConnection(conn, false)
+		conn.Close()
+	}()
 
 	payloadSeparatorAsBytes := []byte(payloadSeparator)
 	reader := bufio.NewReader(conn)
 	var buffer bytes.Buffer
 
 	for {
+		if i.config.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(i.config.idleTimeout))
+		}
+
 		line, err := reader.ReadBytes('\n')
 
 		if err != nil {
-			if err != io.EOF {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				Debug("[INPUT-TCP] Closing idle connection:", conn.RemoteAddr())
+			} else if err != io.EOF {
 				fmt.Fprintln(os.Stderr, "Unexpected error in input tcp connection:", err)
 			}
-			break
 
+			if buffer.Len() > 0 || len(line) > 0 {
+				Debug("[INPUT-TCP] Dropping incomplete payload from", conn.RemoteAddr(), "bytes:", buffer.Len()+len(line))
+			}
+			break
 		}
 
 		if bytes.Equal(payloadSeparatorAsBytes[1:], line) {
 			asBytes := buffer.Bytes()
 			buffer.Reset()
 
+			// Separator without payload, e.g. sender re-sent it after reconnect
+			if len(asBytes) == 0 {
+				continue
+			}
+
 			newBuf := make([]byte, len(asBytes)-1)
 			copy(newBuf, asBytes)
 
@@ -113,5 +178,26 @@ func (i *TCPInput) handleConnection(conn net.Conn) {
 }
 
 func (i *TCPInput) String() string {
+	if i.config.network == "unix" {
+		return "Unix input: " + i.address
+	}
+
 	return "TCP input: " + i.address
 }
+
+// Close stops accepting new connections and closes all active ones
+func (i *TCPInput) Close() error {
+	i.stop.Do(func() {
+		close(i.quit)
+		i.listener.Close()
+
+		i.mu.Lock()
+		defer i.mu.Unlock()
+
+		for conn := range i.conns {
+			conn.Close()
+		}
+	})
+
+	return nil
+}
@@ -59,6 +59,76 @@ func TestTCPInput(t *testing.T) {
 	close(quit)
 }
 
+func TestTCPInputReconnect(t *testing.T) {
+	received := make(chan []byte, 10)
+	quit := make(chan int)
+
+	input := NewTCPInput("127.0.0.1:0", &TCPInputConfig{idleTimeout: time.Second})
+	defer input.Close()
+
+	output := NewTestOutput(func(data []byte) {
+		received <- data
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+
+	go Start(plugins, quit)
+	defer close(quit)
+
+	// Sender drops connection in the middle of payload
+	conn, err := net.Dial("tcp", input.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("1 1 1\nGET /partial HTTP/1.1\r\n"))
+	conn.Close()
+
+	conn, err = net.Dial("tcp", input.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := []byte("1 2 1\nGET / HTTP/1.1\r\n\r\n")
+	conn.Write(msg)
+	conn.Write([]byte(payloadSeparator))
+
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, msg) {
+			t.Errorf("Payload from previous connection leaked: %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Payload not received")
+	}
+}
+
+func TestTCPInputDoubleClose(t *testing.T) {
+	input := NewTCPInput("127.0.0.1:0", &TCPInputConfig{})
+
+	input.Close()
+	input.Close()
+}
+
+func TestTCPInputIdleTimeout(t *testing.T) {
+	input := NewTCPInput("127.0.0.1:0", &TCPInputConfig{idleTimeout: 50 * time.Millisecond})
+	defer input.Close()
+
+	conn, err := net.Dial("tcp", input.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Idle connection should be closed by input, got:", err)
+	}
+}
+
 func genCertificate(template *x509.Certificate) ([]byte, []byte) {
 	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
 
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+)
+
+// NewUnixInput constructor for TCPInput listening on Unix domain socket, with the same options as TCP input.
+// Socket file left by previous run is removed, listener removes it on Close.
+func NewUnixInput(path string, config *TCPInputConfig) *TCPInput {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	// Options are shared with TCP inputs, so they are copied. Local socket is not encrypted.
+	unixConfig := *config
+	unixConfig.network = "unix"
+	unixConfig.secure = false
+
+	return NewTCPInput(path, &unixConfig)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUnixInputOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gor-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "gor.sock")
+	// Socket file left by crashed instance
+	stale := NewUnixInput(path, &TCPInputConfig{})
+	stale.listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	config := &TCPInputConfig{idleTimeout: time.Minute, secure: true}
+	input := NewUnixInput(path, config)
+	defer input.Close()
+
+	// Options of TCP input are used, but shared config is not changed
+	if input.config.idleTimeout != time.Minute || input.config.network != "unix" || input.config.secure || config.network != "" {
+		t.Errorf("Wrong config of Unix input: %+v", input.config)
+	}
+	output := NewTestOutput(func(data []byte) {
+		wg.Done()
+	})
+
+	source := NewTestInput()
+	unixOutput := NewUnixOutput(path, &TCPOutputConfig{workers: 2})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+	go Start(plugins, quit)
+	go CopyMulty(source, unixOutput)
+
+	if input.String() != "Unix input: "+path {
+		t.Error("Wrong input name", input.String())
+	}
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		source.EmitGET()
+	}
+
+	wg.Wait()
+	close(quit)
+}
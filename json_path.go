@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// jsonPathElem is object key, or array index if index is not negative
+type jsonPathElem struct {
+	key   string
+	index int
+}
+
+// parseJSONPath parses simple JSONPath: $.user.email or $.items[0].id, leading $ is optional
+func parseJSONPath(path string) ([]jsonPathElem, error) {
+	s := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if s == "" {
+		return nil, errors.New("empty JSON path")
+	}
+
+	var elems []jsonPathElem
+	for _, part := range strings.Split(s, ".") {
+		key := part
+		if i := strings.IndexByte(part, '['); i != -1 {
+			key = part[:i]
+		}
+		if key != "" {
+			elems = append(elems, jsonPathElem{key: key, index: -1})
+		}
+
+		for rest := part[len(key):]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end == -1 {
+				return nil, errors.New("wrong JSON path: " + path)
+			}
+
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, errors.New("wrong array index in JSON path: " + path)
+			}
+			elems = append(elems, jsonPathElem{index: index})
+
+			rest = rest[end+1:]
+		}
+
+		if key == "" && !strings.HasPrefix(part, "[") {
+			return nil, errors.New("wrong JSON path: " + path)
+		}
+	}
+
+	return elems, nil
+}
+
+// jsonPathSpan finds value by path in valid JSON document, and returns its position.
+// Document is scanned without decoding, so the rest of it is kept byte for byte.
+func jsonPathSpan(data []byte, path []jsonPathElem) (start, end int, ok bool) {
+	i := jsonSkipSpace(data, 0)
+
+	for _, elem := range path {
+		if elem.index >= 0 {
+			if i >= len(data) || data[i] != '[' {
+				return 0, 0, false
+			}
+			i = jsonSkipSpace(data, i+1)
+
+			for n := 0; ; n++ {
+				if data[i] == ']' {
+					return 0, 0, false
+				}
+				if n == elem.index {
+					break
+				}
+				if i = jsonNextElem(data, jsonSkipValue(data, i)); i == -1 {
+					return 0, 0, false
+				}
+			}
+
+			continue
+		}
+
+		if i >= len(data) || data[i] != '{' {
+			return 0, 0, false
+		}
+		i = jsonSkipSpace(data, i+1)
+
+		for {
+			if data[i] == '}' {
+				return 0, 0, false
+			}
+
+			keyEnd := jsonSkipValue(data, i)
+			var key string
+			if json.Unmarshal(data[i:keyEnd], &key) != nil {
+				return 0, 0, false
+			}
+
+			// Skip colon
+			i = jsonSkipSpace(data, jsonSkipSpace(data, keyEnd)+1)
+			if key == elem.key {
+				break
+			}
+
+			if i = jsonNextElem(data, jsonSkipValue(data, i)); i == -1 {
+				return 0, 0, false
+			}
+		}
+	}
+
+	return i, jsonSkipValue(data, i), true
+}
+
+func jsonSkipSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\r' || data[i] == '\n') {
+		i++
+	}
+
+	return i
+}
+
+// jsonNextElem moves past comma to the next element of object or array, returns -1 if there are no more elements
+func jsonNextElem(data []byte, i int) int {
+	i = jsonSkipSpace(data, i)
+	if i >= len(data) || data[i] != ',' {
+		return -1
+	}
+
+	return jsonSkipSpace(data, i+1)
+}
+
+// jsonSkipValue returns position after value which starts at i
+func jsonSkipValue(data []byte, i int) int {
+	switch data[i] {
+	case '"':
+		for i++; i < len(data); i++ {
+			switch data[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1
+			}
+		}
+	case '{', '[':
+		depth := 0
+		for i < len(data) {
+			switch data[i] {
+			case '"':
+				i = jsonSkipValue(data, i)
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+	default:
+		for i < len(data) && !strings.ContainsRune(",}] \t\r\n", rune(data[i])) {
+			i++
+		}
+	}
+
+	return i
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/buger/goreplay/proto"
 
@@ -17,6 +21,55 @@ type KafkaConfig struct {
 	producer sarama.AsyncProducer
 	consumer sarama.Consumer
 	useJSON  bool
+	// Output writes kafkaRecord with request and its response, instead of KafkaMessage
+	jsonSchema bool
+	// Set on start if responses are tracked, so output waits for them
+	trackResponses bool
+	// Requests are sent without response after this time, kafkaPendingTimeout by default
+	pendingTimeout time.Duration
+	// Message key of output: `uuid` for request ID, or header name
+	key string
+	// Shared by input and output, set on start
+	auth *KafkaAuthConfig
+}
+
+// KafkaAuthConfig holds SASL and TLS options of Kafka connection
+type KafkaAuthConfig struct {
+	saslUsername  string
+	saslPassword  string
+	saslMechanism string
+	useTLS        bool
+	tlsCA         string
+}
+
+// apply sets authentication options of sarama client config
+func (a *KafkaAuthConfig) apply(c *sarama.Config) error {
+	if a == nil {
+		return nil
+	}
+
+	if a.saslUsername != "" {
+		// Sarama supports only SASL/PLAIN
+		if a.saslMechanism != "" && !strings.EqualFold(a.saslMechanism, "PLAIN") {
+			return errors.New("unsupported SASL mechanism " + a.saslMechanism + ", only PLAIN is supported")
+		}
+
+		c.Net.SASL.Enable = true
+		c.Net.SASL.User = a.saslUsername
+		c.Net.SASL.Password = a.saslPassword
+	}
+
+	if a.useTLS || a.tlsCA != "" {
+		tlsConfig, err := loadClientTLSConfig("", "", a.tlsCA, true)
+		if err != nil {
+			return err
+		}
+
+		c.Net.TLS.Enable = true
+		c.Net.TLS.Config = tlsConfig
+	}
+
+	return nil
 }
 
 // KafkaMessage should contains catched request information that should be
@@ -31,6 +84,86 @@ type KafkaMessage struct {
 	ReqHeaders map[string]string `json:"Req_Headers,omitempty"`
 }
 
+// newKafkaMessage converts payload in Gor format to message of JSON format
+func newKafkaMessage(data []byte) *KafkaMessage {
+	headers := make(map[string]string)
+	proto.ParseHeaders([][]byte{data}, func(header []byte, value []byte) bool {
+		headers[string(header)] = string(value)
+		return true
+	})
+
+	meta := payloadMeta(data)
+	req := payloadBody(data)
+
+	return &KafkaMessage{
+		ReqURL:     string(proto.Path(req)),
+		ReqType:    string(meta[0]),
+		ReqID:      string(meta[1]),
+		ReqTs:      string(meta[2]),
+		ReqMethod:  string(proto.Method(req)),
+		ReqBody:    string(proto.Body(req)),
+		ReqHeaders: headers,
+	}
+}
+
+// kafkaRecord is JSON message of --output-kafka-json-schema, request parsed together with its response
+type kafkaRecord struct {
+	UUID      string            `json:"uuid"`
+	Timestamp int64             `json:"timestamp"`
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"`
+	Body      string            `json:"body"`
+
+	// Set if response is tracked
+	Status       int     `json:"status,omitempty"`
+	ResponseBody string  `json:"response_body,omitempty"`
+	LatencyMs    float64 `json:"latency_ms,omitempty"`
+
+	// Message key of the request
+	key string
+	// When request was written to output
+	seen time.Time
+}
+
+// newKafkaRecord parses request payload in Gor format
+func newKafkaRecord(data []byte) *kafkaRecord {
+	meta := payloadMeta(data)
+	req := payloadBody(data)
+
+	headers := make(map[string]string)
+	proto.ParseHeaders([][]byte{req}, func(header []byte, value []byte) bool {
+		headers[string(header)] = string(value)
+		return true
+	})
+
+	timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+
+	return &kafkaRecord{
+		UUID:      string(meta[1]),
+		Timestamp: timestamp,
+		Method:    string(proto.Method(req)),
+		URL:       string(proto.Path(req)),
+		Headers:   headers,
+		Body:      string(proto.Body(req)),
+	}
+}
+
+// setResponse adds status, body and latency of response payload in Gor format
+func (r *kafkaRecord) setResponse(data []byte) {
+	meta := payloadMeta(data)
+	resp := payloadBody(data)
+
+	r.Status, _ = strconv.Atoi(string(proto.Status(resp)))
+	r.ResponseBody = string(proto.Body(resp))
+
+	// Latency of original and replayed responses is in nanoseconds
+	if len(meta) > 3 {
+		latency, _ := strconv.ParseInt(string(meta[3]), 10, 64)
+		r.LatencyMs = float64(latency) / float64(time.Millisecond)
+	}
+}
+
 // Dump returns the given request in its HTTP/1.x wire
 // representation.
 func (m KafkaMessage) Dump() ([]byte, error) {
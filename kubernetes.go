@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+type k8sEndpointSlice struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+type k8sEndpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []k8sEndpointSlice `json:"items"`
+}
+
+type k8sWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// k8sEndpoints keeps list of ready pod addresses of Kubernetes Service,
+// by watching its EndpointSlices using Kubernetes API
+type k8sEndpoints struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment for atomic operations on 32bit machines
+	next uint64
+
+	apiURL    string
+	token     string
+	client    *http.Client
+	namespace string
+	service   string
+	port      string
+
+	mu     sync.RWMutex
+	slices map[string][]string
+	addrs  []string
+}
+
+// newK8sServiceEndpoints starts endpoints discovery for service in `namespace/service[:port]` format,
+// using service account of the pod. Port can be name or number, it is required only if service has multiple ports.
+func newK8sServiceEndpoints(service string) (*k8sEndpoints, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running inside Kubernetes cluster")
+	}
+
+	token, err := ioutil.ReadFile(k8sServiceAccountDir + "token")
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := ioutil.ReadFile(k8sServiceAccountDir + "ca.crt")
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	e, err := newK8sEndpoints("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), client, service)
+	if err != nil {
+		return nil, err
+	}
+
+	// First list is done synchronously, so connections are not made before endpoints are known
+	resourceVersion, err := e.list()
+	if err != nil {
+		return nil, err
+	}
+
+	go e.run(resourceVersion)
+
+	return e, nil
+}
+
+func newK8sEndpoints(apiURL, token string, client *http.Client, service string) (*k8sEndpoints, error) {
+	e := &k8sEndpoints{apiURL: apiURL, token: token, client: client, slices: make(map[string][]string)}
+
+	if idx := strings.LastIndex(service, ":"); idx != -1 {
+		service, e.port = service[:idx], service[idx+1:]
+	}
+
+	parts := strings.Split(service, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New("expected namespace/service[:port]")
+	}
+	e.namespace, e.service = parts[0], parts[1]
+
+	return e, nil
+}
+
+// Pick returns next pod address in round-robin order, or empty string if there are no ready pods
+func (e *k8sEndpoints) Pick() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if len(e.addrs) == 0 {
+		return ""
+	}
+
+	return e.addrs[atomic.AddUint64(&e.next, 1)%uint64(len(e.addrs))]
+}
+
+func (e *k8sEndpoints) slicesURL(query url.Values) string {
+	query.Set("labelSelector", "kubernetes.io/service-name="+e.service)
+
+	return fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s", e.apiURL, e.namespace, query.Encode())
+}
+
+func (e *k8sEndpoints) request(query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", e.slicesURL(query), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes API: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
+
+// list fetches all EndpointSlices of the service, and returns resource version to start watch from
+func (e *k8sEndpoints) list() (string, error) {
+	resp, err := e.request(url.Values{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var list k8sEndpointSliceList
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+
+	slices := make(map[string][]string)
+	for _, slice := range list.Items {
+		if slices[slice.Metadata.Name], err = e.sliceAddrs(slice); err != nil {
+			return "", err
+		}
+	}
+
+	e.mu.Lock()
+	e.slices = slices
+	e.updateLocked()
+	e.mu.Unlock()
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies changes of EndpointSlices until stream ends
+func (e *k8sEndpoints) watch(resourceVersion string) error {
+	resp, err := e.request(url.Values{"watch": {"true"}, "resourceVersion": {resourceVersion}, "allowWatchBookmarks": {"false"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+
+	for {
+		var event k8sWatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+
+		if event.Type == "ERROR" {
+			// Usually means that resource version is too old, and list should be fetched again
+			return errors.New("kubernetes API: watch error: " + string(event.Object))
+		}
+
+		var slice k8sEndpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return err
+		}
+
+		addrs, err := e.sliceAddrs(slice)
+		if err != nil && event.Type != "DELETED" {
+			return err
+		}
+
+		e.mu.Lock()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			e.slices[slice.Metadata.Name] = addrs
+		case "DELETED":
+			delete(e.slices, slice.Metadata.Name)
+		}
+		e.updateLocked()
+		e.mu.Unlock()
+	}
+}
+
+// run keeps watching for changes, list is fetched again each time watch breaks
+func (e *k8sEndpoints) run(resourceVersion string) {
+	for {
+		err := e.watch(resourceVersion)
+		Debug("[K8S] Endpoints watch of", e.namespace+"/"+e.service, "stopped:", err)
+		time.Sleep(time.Second)
+
+		for {
+			if resourceVersion, err = e.list(); err == nil {
+				break
+			}
+
+			log.Println("[K8S] Can't list endpoints:", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// sliceAddrs returns addresses of ready endpoints, with port matching configured one.
+// If port is not configured, service should have single port, otherwise it is ambiguous.
+func (e *k8sEndpoints) sliceAddrs(slice k8sEndpointSlice) (addrs []string, err error) {
+	if e.port == "" && len(slice.Ports) > 1 {
+		return nil, errors.New("service " + e.namespace + "/" + e.service + " has multiple ports, specify port name or number: namespace/service:port")
+	}
+
+	port := 0
+	for _, p := range slice.Ports {
+		if e.port == "" || e.port == p.Name || e.port == strconv.Itoa(p.Port) {
+			port = p.Port
+			break
+		}
+	}
+
+	if port == 0 {
+		return nil, nil
+	}
+
+	for _, endpoint := range slice.Endpoints {
+		// Ready condition can be omitted, which should be interpreted as ready
+		if ready := endpoint.Conditions.Ready; ready != nil && !*ready {
+			continue
+		}
+
+		for _, addr := range endpoint.Addresses {
+			addrs = append(addrs, net.JoinHostPort(addr, strconv.Itoa(port)))
+		}
+	}
+
+	return
+}
+
+func (e *k8sEndpoints) updateLocked() {
+	var addrs []string
+	for _, slice := range e.slices {
+		addrs = append(addrs, slice...)
+	}
+	sort.Strings(addrs)
+
+	if len(addrs) != len(e.addrs) {
+		log.Printf("[K8S] Service %s/%s has %d ready endpoints\n", e.namespace, e.service, len(addrs))
+	}
+
+	e.addrs = addrs
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testK8sSliceList = `{"metadata": {"resourceVersion": "10"}, "items": [{
+	"metadata": {"name": "api-1"},
+	"ports": [{"name": "grpc", "port": 9090}, {"name": "http", "port": 8080}],
+	"endpoints": [
+		{"addresses": ["10.0.0.1"], "conditions": {"ready": true}},
+		{"addresses": ["10.0.0.2"], "conditions": {"ready": false}},
+		{"addresses": ["fd00::3"]}
+	]
+}]}`
+
+func TestK8sEndpoints(t *testing.T) {
+	watchStarted := make(chan bool)
+	done := make(chan bool)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/staging/endpointslices" || r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=api" {
+			t.Error("Wrong request:", r.URL.String())
+		}
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Error("Token should be passed")
+		}
+
+		if r.URL.Query().Get("watch") != "true" {
+			w.Write([]byte(testK8sSliceList))
+			return
+		}
+
+		if r.URL.Query().Get("resourceVersion") != "10" {
+			t.Error("Watch should start from list version")
+		}
+
+		w.Write([]byte(`{"type": "ADDED", "object": {"metadata": {"name": "api-2"}, "ports": [{"name": "http", "port": 8080}], "endpoints": [{"addresses": ["10.0.0.4"]}]}}` + "\n"))
+		w.Write([]byte(`{"type": "DELETED", "object": {"metadata": {"name": "api-1"}}}` + "\n"))
+		w.(http.Flusher).Flush()
+
+		close(watchStarted)
+		<-done
+	}))
+	// Watch handler should be released before server is closed, otherwise Close blocks forever
+	defer server.Close()
+	defer close(done)
+
+	e, err := newK8sEndpoints(server.URL, "token", http.DefaultClient, "staging/api:http")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rv, err := e.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	picked := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		picked[e.Pick()] = true
+	}
+
+	if len(picked) != 2 || !picked["10.0.0.1:8080"] || !picked["[fd00::3]:8080"] {
+		t.Error("Should pick only ready endpoints with http port:", picked)
+	}
+
+	go e.watch(rv)
+
+	select {
+	case <-watchStarted:
+	case <-time.After(time.Second):
+		t.Fatal("Watch was not started")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if addr := e.Pick(); addr != "10.0.0.4:8080" {
+		t.Error("Endpoints should be updated by watch:", addr)
+	}
+
+	if _, err = newK8sEndpoints(server.URL, "", http.DefaultClient, "api"); err == nil {
+		t.Error("Should require namespace")
+	}
+}
+
+func TestK8sEndpointsAmbiguousPort(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testK8sSliceList))
+	}))
+	defer server.Close()
+
+	e, _ := newK8sEndpoints(server.URL, "", http.DefaultClient, "staging/api")
+
+	if _, err := e.list(); err == nil {
+		t.Error("Should require port for service with multiple ports")
+	}
+
+	e, _ = newK8sEndpoints(server.URL, "", http.DefaultClient, "staging/api:9090")
+
+	if _, err := e.list(); err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := e.Pick(); addr != "10.0.0.1:9090" && addr != "[fd00::3]:9090" {
+		t.Error("Should select port by number:", addr)
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -98,3 +100,95 @@ func (l *Limiter) Read(data []byte) (n int, err error) {
 func (l *Limiter) String() string {
 	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v)", l.plugin, l.limit, l.isPercent)
 }
+
+// tokenBucket allows `rate` events per second on average, with bursts up to one second of rate
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: math.Max(rate, 1)}
+}
+
+// Allow takes one token if available
+func (b *tokenBucket) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.last.IsZero() {
+		b.last = now
+	} else if now.After(b.last) {
+		b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*b.rate, math.Max(b.rate, 1))
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Shared by all CopyMulty loops if --throttle-bandwidth is set
+var outputBandwidth *bandwidthLimiter
+
+// bandwidthLimiter allows `rate` bytes per second on average, with bursts up to one second of rate.
+// Payloads bigger than the burst are not split: they are written, and following writes wait until the debt is paid.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+// Reserve takes n bytes from the budget, and returns how long writer should sleep before writing them
+func (b *bandwidthLimiter) Reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.last.IsZero() {
+		b.last = now
+	} else if now.After(b.last) {
+		b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+		b.last = now
+	}
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttledWriter sleeps before writes which are over bandwidth budget
+type throttledWriter struct {
+	io.Writer
+	limiter *bandwidthLimiter
+}
+
+func (w throttledWriter) Write(data []byte) (int, error) {
+	if wait := w.limiter.Reserve(len(data), time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	return w.Writer.Write(data)
+}
+
+// throttleWriters wraps writers so bytes written to all of them share the limiter budget
+func throttleWriters(writers []io.Writer, limiter *bandwidthLimiter) []io.Writer {
+	throttled := make([]io.Writer, len(writers))
+	for i, w := range writers {
+		throttled[i] = throttledWriter{w, limiter}
+	}
+
+	return throttled
+}
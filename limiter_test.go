@@ -3,9 +3,11 @@
 package main
 
 import (
+	"bytes"
 	"io"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestOutputLimiter(t *testing.T) {
@@ -112,3 +114,63 @@ func TestPercentLimiter2(t *testing.T) {
 
 	close(quit)
 }
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2)
+	now := time.Now()
+
+	if !b.Allow(now) || !b.Allow(now) || b.Allow(now) {
+		t.Error("Should allow burst of 2 requests")
+	}
+
+	if !b.Allow(now.Add(500*time.Millisecond)) || b.Allow(now.Add(500*time.Millisecond)) {
+		t.Error("Should allow 1 request after half of second")
+	}
+
+	if !b.Allow(now.Add(time.Hour)) || !b.Allow(now.Add(time.Hour)) || b.Allow(now.Add(time.Hour)) {
+		t.Error("Tokens should not exceed burst")
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	b := newBandwidthLimiter(1000)
+	now := time.Now()
+
+	if b.Reserve(600, now) != 0 || b.Reserve(400, now) != 0 {
+		t.Error("Should allow burst of 1000 bytes")
+	}
+
+	if wait := b.Reserve(500, now); wait != 500*time.Millisecond {
+		t.Error("Should wait until 500 bytes are available", wait)
+	}
+
+	// Debt of 500 bytes is paid after half of second
+	if wait := b.Reserve(2000, now.Add(time.Second)); wait != 1500*time.Millisecond {
+		t.Error("Payload bigger than burst should be written after its bytes are accumulated", wait)
+	}
+
+	if wait := b.Reserve(1000, now.Add(time.Hour)); wait != 0 {
+		t.Error("Tokens should not exceed burst", wait)
+	}
+
+	if wait := b.Reserve(1, now.Add(time.Hour)); wait == 0 {
+		t.Error("Tokens should not exceed burst")
+	}
+}
+
+func TestThrottleWriters(t *testing.T) {
+	var first, second bytes.Buffer
+	writers := throttleWriters([]io.Writer{&first, &second}, newBandwidthLimiter(1000))
+
+	start := time.Now()
+	writers[0].Write(make([]byte, 1000))
+	writers[1].Write(make([]byte, 100))
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error("Writers should share bandwidth budget", elapsed)
+	}
+
+	if first.Len() != 1000 || second.Len() != 100 {
+		t.Error("Payloads should be written", first.Len(), second.Len())
+	}
+}
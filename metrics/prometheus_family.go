@@ -10,6 +10,13 @@ var (
 		},
 		[]string{"location", "code"},
 	)
+	responseStatusClassCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goreplay_response_status_class",
+			Help: "responses of HTTP output by status class: 1xx-5xx, or error if response has no status",
+		},
+		[]string{"target", "class"},
+	)
 	subRequestsCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "test_sub_requests",
@@ -20,14 +27,62 @@ var (
 	circuitBreakerRateGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "goreplay_circuit_breaker_rate",
-			Help: "rate of circuit breaker",
+			Help: "circuit breaker of HTTP output: error_rate of last requests, and state: 0 closed, 1 open, 2 half-open",
 		},
-		[]string{"location", "code"},
+		[]string{"target", "kind"},
+	)
+
+	capturePacketsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "goreplay_raw_capture_packets",
+			Help: "packets of raw input: received, dropped and if_dropped reported by pcap, queued waiting for reassembly",
+		},
+		[]string{"address", "state"},
+	)
+	captureMessagesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "goreplay_raw_capture_messages",
+			Help: "messages of raw input: emitted, or expired incomplete",
+		},
+		[]string{"address", "state"},
+	)
+	captureStreamsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "goreplay_raw_capture_streams",
+			Help: "connections of raw input: non_http ones recognized by --input-raw-protocol-detect",
+		},
+		[]string{"address", "state"},
+	)
+
+	httpActiveWorkersGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "goreplay_http_active_workers",
+			Help: "workers of HTTP output",
+		},
+		[]string{"target"},
+	)
+	httpQueueLengthGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "goreplay_http_queue_length",
+			Help: "requests waiting in queue of HTTP output",
+		},
+		[]string{"target"},
+	)
+	tcpBufferLengthGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "goreplay_tcp_buffer_length",
+			Help: "payloads waiting in buffers of TCP output",
+		},
+		[]string{"target"},
 	)
 
 	buckets = []float64{0, 100, 200}
 
-	totalRequestsTimeHistogram = prometheus.NewHistogramVec(
+	totalRequestsTimeHistogram = newRequestsTimeHistogram(buckets)
+)
+
+func newRequestsTimeHistogram(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "goreplay_total_requests_time",
 			Help:    "income requests time",
@@ -35,25 +90,83 @@ var (
 		},
 		[]string{"location"},
 	)
-
-)
+}
 
 func init() {
 	prometheus.MustRegister(totalRequestsCounter)
+	prometheus.MustRegister(responseStatusClassCounter)
 	prometheus.MustRegister(subRequestsCounter)
 	prometheus.MustRegister(circuitBreakerRateGauge)
 	prometheus.MustRegister(totalRequestsTimeHistogram)
+	prometheus.MustRegister(capturePacketsGauge)
+	prometheus.MustRegister(captureMessagesGauge)
+	prometheus.MustRegister(captureStreamsGauge)
+	prometheus.MustRegister(httpActiveWorkersGauge)
+	prometheus.MustRegister(httpQueueLengthGauge)
+	prometheus.MustRegister(tcpBufferLengthGauge)
 }
 
 func IncreaseTotalRequests(location,code string) {
 	totalRequestsCounter.With(prometheus.Labels{"location": location, "code": code}).Add(1)
 }
 
+// IncreaseResponseStatusClass counts response of HTTP output by class of its status
+func IncreaseResponseStatusClass(target, class string) {
+	responseStatusClassCounter.WithLabelValues(target, class).Inc()
+}
+
 func IncreaseSubRequests() {
 	subRequestsCounter.With(prometheus.Labels{}).Add(1)
 }
 
 
+// SetLatencyBuckets replaces buckets of requests time histogram, in seconds.
+// Should be called before any request is observed.
+func SetLatencyBuckets(b []float64) {
+	prometheus.Unregister(totalRequestsTimeHistogram)
+	buckets = b
+	totalRequestsTimeHistogram = newRequestsTimeHistogram(buckets)
+	prometheus.MustRegister(totalRequestsTimeHistogram)
+}
+
 func ObserveTotalRequestsTimeHistogram(location string, d float64) {
 	totalRequestsTimeHistogram.With(prometheus.Labels{"location": location}).Observe(d)
 }
+
+// SetCircuitBreaker reports state and error rate of circuit breaker of HTTP output
+func SetCircuitBreaker(target string, state int, errorRate float64) {
+	circuitBreakerRateGauge.WithLabelValues(target, "state").Set(float64(state))
+	circuitBreakerRateGauge.WithLabelValues(target, "error_rate").Set(errorRate)
+}
+
+// SetHTTPOutputStats reports number of workers and queued requests of HTTP output
+func SetHTTPOutputStats(target string, workers, queued int) {
+	httpActiveWorkersGauge.WithLabelValues(target).Set(float64(workers))
+	httpQueueLengthGauge.WithLabelValues(target).Set(float64(queued))
+}
+
+// SetTCPOutputBuffer reports number of payloads buffered by TCP output
+func SetTCPOutputBuffer(target string, buffered int) {
+	tcpBufferLengthGauge.WithLabelValues(target).Set(float64(buffered))
+}
+
+// CaptureStats holds counters of raw input listener
+type CaptureStats struct {
+	PacketsReceived  int
+	PacketsDropped   int
+	PacketsIfDropped int
+	PacketsQueued    int
+	MessagesEmitted  uint64
+	MessagesExpired  uint64
+	StreamsNonHTTP   uint64
+}
+
+func SetCaptureStats(address string, s CaptureStats) {
+	capturePacketsGauge.WithLabelValues(address, "received").Set(float64(s.PacketsReceived))
+	capturePacketsGauge.WithLabelValues(address, "dropped").Set(float64(s.PacketsDropped))
+	capturePacketsGauge.WithLabelValues(address, "if_dropped").Set(float64(s.PacketsIfDropped))
+	capturePacketsGauge.WithLabelValues(address, "queued").Set(float64(s.PacketsQueued))
+	captureMessagesGauge.WithLabelValues(address, "emitted").Set(float64(s.MessagesEmitted))
+	captureMessagesGauge.WithLabelValues(address, "expired").Set(float64(s.MessagesExpired))
+	captureStreamsGauge.WithLabelValues(address, "non_http").Set(float64(s.StreamsNonHTTP))
+}
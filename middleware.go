@@ -2,16 +2,28 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 )
 
+// Version of middleware protocol with acknowledgements, sent to middleware as "v2" line on start.
+// Protocol without acknowledgements is version 1, and has no handshake.
+const middlewareProtocolVersion byte = '2'
+
+// Replies of middleware to payload with sequence number, when --middleware-ack is set
+const (
+	middlewareAck    = "+"
+	middlewareReject = "-"
+)
+
 type Middleware struct {
 	command string
 
@@ -19,6 +31,15 @@ type Middleware struct {
 
 	mu sync.Mutex
 
+	// Each payload is numbered, and should be acknowledged, rejected or replaced by middleware
+	ack bool
+	seq uint64
+	// Payloads waiting for reply of middleware, by sequence number
+	pending   map[uint64][]byte
+	pendingMu sync.Mutex
+	// Limits number of pending payloads, so slow middleware slows down input instead of piling up data
+	window chan struct{}
+
 	Stdin  io.Writer
 	Stdout io.Reader
 }
@@ -28,6 +49,12 @@ func NewMiddleware(command string) *Middleware {
 	m.command = command
 	m.data = make(chan []byte, 1000)
 
+	if Settings.middlewareAck {
+		m.ack = true
+		m.pending = make(map[uint64][]byte)
+		m.window = make(chan struct{}, cap(m.data))
+	}
+
 	commands := strings.Split(command, " ")
 	cmd := exec.Command(commands[0], commands[1:]...)
 
@@ -38,16 +65,16 @@ func NewMiddleware(command string) *Middleware {
 
 	go m.read(m.Stdout)
 
-	go func() {
-		err := cmd.Start()
-
-		if err != nil {
-			log.Fatal(err)
-		}
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
 
-		err = cmd.Wait()
+	if m.ack {
+		m.Stdin.Write([]byte{'v', middlewareProtocolVersion, '\n'})
+	}
 
-		if err != nil {
+	go func() {
+		if err := cmd.Wait(); err != nil {
 			log.Fatal(err)
 		}
 	}()
@@ -89,9 +116,25 @@ func (m *Middleware) copy(to io.Writer, from io.Reader) {
 		hex.Encode(dst, payload)
 		dst[nr*2] = '\n'
 
-		m.mu.Lock()
-		to.Write(dst[0 : nr*2+1])
-		m.mu.Unlock()
+		if m.ack {
+			// Blocks until middleware replies to one of pending payloads
+			m.window <- struct{}{}
+
+			m.mu.Lock()
+			m.seq++
+
+			m.pendingMu.Lock()
+			m.pending[m.seq] = append([]byte(nil), payload...)
+			m.pendingMu.Unlock()
+
+			to.Write([]byte(strconv.FormatUint(m.seq, 10) + " "))
+			to.Write(dst[0 : nr*2+1])
+			m.mu.Unlock()
+		} else {
+			m.mu.Lock()
+			to.Write(dst[0 : nr*2+1])
+			m.mu.Unlock()
+		}
 
 		if Settings.debug {
 			Debug("[MIDDLEWARE-MASTER] Sending:", string(buf[0:nr]), "From:", from)
@@ -113,11 +156,18 @@ func (m *Middleware) read(from io.Reader) {
 			}
 		}
 
-		buf := make([]byte, len(line)/2)
-		if _, err := hex.Decode(buf, line[:len(line)-1]); err != nil {
-			fmt.Fprintln(os.Stderr, "Failed to decode input payload", err, len(line))
+		line = line[:len(line)-1]
+
+		// Reply to numbered payload, lines without sequence number are new payloads
+		if m.ack {
+			if i := bytes.IndexByte(line, ' '); i != -1 {
+				m.reply(line[:i], line[i+1:])
+				continue
+			}
 		}
 
+		buf := decodeMiddlewarePayload(line)
+
 		if Settings.debug {
 			Debug("[MIDDLEWARE-MASTER] Received:", string(buf))
 		}
@@ -128,6 +178,49 @@ func (m *Middleware) read(from io.Reader) {
 	return
 }
 
+// reply handles acknowledgement, rejection or replacement of pending payload
+func (m *Middleware) reply(seq, reply []byte) {
+	id, _ := strconv.ParseUint(string(seq), 10, 64)
+
+	m.pendingMu.Lock()
+	payload, ok := m.pending[id]
+	delete(m.pending, id)
+	m.pendingMu.Unlock()
+
+	if !ok {
+		Debug("[MIDDLEWARE-MASTER] Reply to unknown payload:", string(seq))
+		return
+	}
+
+	<-m.window
+
+	switch string(reply) {
+	case middlewareAck:
+	case middlewareReject:
+		if Settings.debug {
+			Debug("[MIDDLEWARE-MASTER] Rejected:", string(payload))
+		}
+		return
+	default:
+		payload = decodeMiddlewarePayload(reply)
+	}
+
+	if Settings.debug {
+		Debug("[MIDDLEWARE-MASTER] Received:", string(payload))
+	}
+
+	m.data <- payload
+}
+
+func decodeMiddlewarePayload(line []byte) []byte {
+	buf := make([]byte, len(line)/2)
+	if _, err := hex.Decode(buf, line); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to decode input payload", err, len(line))
+	}
+
+	return buf
+}
+
 func (m *Middleware) Read(data []byte) (int, error) {
 	buf := <-m.data
 	copy(data, buf)
@@ -138,3 +231,103 @@ func (m *Middleware) Read(data []byte) (int, error) {
 func (m *Middleware) String() string {
 	return fmt.Sprintf("Modifying traffic using '%s' command", m.command)
 }
+
+// MiddlewareChain pipes payloads through several middlewares, each reading output of the previous one.
+// Requests and original responses go from the first middleware to the last one, and replayed responses
+// go back from the last one to the first. Payloads leaving the chain are read from it by CopyMulty.
+type MiddlewareChain struct {
+	middlewares []*Middleware
+
+	data chan []byte
+}
+
+// middlewarePipe passes payloads between neighbour middlewares of the chain
+type middlewarePipe chan []byte
+
+func (p middlewarePipe) Read(data []byte) (int, error) {
+	buf := <-p
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (p middlewarePipe) String() string {
+	return "middleware chain"
+}
+
+// NewMiddlewareChain starts middleware for each command. Single middleware works the same way as without chain.
+func NewMiddlewareChain(commands []string) *MiddlewareChain {
+	c := new(MiddlewareChain)
+	c.data = make(chan []byte, 1000)
+
+	for _, command := range commands {
+		c.middlewares = append(c.middlewares, NewMiddleware(command))
+	}
+
+	last := len(c.middlewares) - 1
+	forward := make([]middlewarePipe, len(c.middlewares))
+	backward := make([]middlewarePipe, len(c.middlewares))
+
+	for i, m := range c.middlewares {
+		if i > 0 {
+			forward[i] = make(middlewarePipe, cap(c.data))
+			m.ReadFrom(forward[i])
+		}
+
+		if i < last {
+			backward[i] = make(middlewarePipe, cap(c.data))
+			m.ReadFrom(backward[i])
+		}
+	}
+
+	for i, m := range c.middlewares {
+		next, previous := c.data, c.data
+		if i < last {
+			next = forward[i+1]
+		}
+		if i > 0 {
+			previous = backward[i-1]
+		}
+
+		go c.route(m, next, previous)
+	}
+
+	return c
+}
+
+// route passes replayed responses of middleware to the previous one, and other payloads to the next one
+func (c *MiddlewareChain) route(m *Middleware, next, previous chan []byte) {
+	for payload := range m.data {
+		if len(payload) > 0 && payload[0] == ReplayedResponsePayload {
+			previous <- payload
+		} else {
+			next <- payload
+		}
+	}
+}
+
+// ReadInputFrom passes payloads of input to the first middleware
+func (c *MiddlewareChain) ReadInputFrom(plugin io.Reader) {
+	c.middlewares[0].ReadFrom(plugin)
+}
+
+// ReadResponsesFrom passes replayed responses of output to the last middleware
+func (c *MiddlewareChain) ReadResponsesFrom(plugin io.Reader) {
+	c.middlewares[len(c.middlewares)-1].ReadFrom(plugin)
+}
+
+func (c *MiddlewareChain) Read(data []byte) (int, error) {
+	buf := <-c.data
+	copy(data, buf)
+
+	return len(buf), nil
+}
+
+func (c *MiddlewareChain) String() string {
+	commands := make([]string, len(c.middlewares))
+	for i, m := range c.middlewares {
+		commands[i] = m.command
+	}
+
+	return fmt.Sprintf("Modifying traffic using '%s' commands", strings.Join(commands, "' | '"))
+}
@@ -5,8 +5,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"sync"
 	"testing"
@@ -114,11 +116,11 @@ func TestEchoMiddleware(t *testing.T) {
 
 	quit := make(chan int)
 
-	Settings.middleware = "./examples/middleware/echo.sh"
+	Settings.middleware = MultiOption{"./examples/middleware/echo.sh"}
 
 	// Catch traffic from one service
 	fromAddr := strings.Replace(from.Listener.Addr().String(), "[::]", "127.0.0.1", -1)
-	input := NewRAWInput(fromAddr, EnginePcap, true, testRawExpire, "", "", "", 0)
+	input := NewRAWInput(fromAddr, EnginePcap, true, testRawExpire, "", "", "", 0, false)
 	defer input.Close()
 
 	// And redirect to another
@@ -151,7 +153,7 @@ func TestEchoMiddleware(t *testing.T) {
 	close(quit)
 	time.Sleep(200 * time.Millisecond)
 
-	Settings.middleware = ""
+	Settings.middleware = nil
 }
 
 func TestTokenMiddleware(t *testing.T) {
@@ -178,11 +180,11 @@ func TestTokenMiddleware(t *testing.T) {
 
 	quit := make(chan int)
 
-	Settings.middleware = "go run ./examples/middleware/token_modifier.go"
+	Settings.middleware = MultiOption{"go run ./examples/middleware/token_modifier.go"}
 
 	fromAddr := strings.Replace(from.Listener.Addr().String(), "[::]", "127.0.0.1", -1)
 	// Catch traffic from one service
-	input := NewRAWInput(fromAddr, EnginePcap, true, testRawExpire, "", "", "", 0)
+	input := NewRAWInput(fromAddr, EnginePcap, true, testRawExpire, "", "", "", 0, false)
 	defer input.Close()
 
 	// And redirect to another
@@ -221,5 +223,131 @@ func TestTokenMiddleware(t *testing.T) {
 	wg.Wait()
 	close(quit)
 	time.Sleep(100 * time.Millisecond)
-	Settings.middleware = ""
+	Settings.middleware = nil
+}
+
+func TestMiddlewareAck(t *testing.T) {
+	replaced := []byte("1 ffffffffffffffffffffffffffffffffffffffff 1\nGET /replaced HTTP/1.1\r\n\r\n")
+
+	// Keeps first payload, drops second and replaces third
+	script, err := ioutil.TempFile("", "middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(script.Name())
+
+	script.WriteString(`#!/bin/sh
+read version
+[ "$version" = "v2" ] || exit 1
+while read seq payload; do
+  case $seq in
+    1) echo "$seq +" ;;
+    2) echo "$seq -" ;;
+    *) echo "$seq ` + hex.EncodeToString(replaced) + `" ;;
+  esac
+done
+`)
+	script.Close()
+	os.Chmod(script.Name(), 0755)
+
+	Settings.middlewareAck = true
+	defer func() { Settings.middlewareAck = false }()
+
+	input := NewTestInput()
+	m := NewMiddleware(script.Name())
+	m.ReadFrom(input)
+
+	input.EmitBytes([]byte("GET /kept HTTP/1.1\r\n\r\n"))
+	input.EmitBytes([]byte("GET /dropped HTTP/1.1\r\n\r\n"))
+	input.EmitBytes([]byte("GET /original HTTP/1.1\r\n\r\n"))
+
+	received := make(chan []byte)
+	go func() {
+		for {
+			buf := make([]byte, 1024)
+			n, _ := m.Read(buf)
+			received <- buf[:n]
+		}
+	}()
+
+	for _, path := range []string{"/kept", "/replaced"} {
+		select {
+		case payload := <-received:
+			if p := proto.Path(payloadBody(payload)); string(p) != path {
+				t.Error("Expected", path, "got:", string(p))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Middleware did not reply")
+		}
+	}
+
+	select {
+	case payload := <-received:
+		t.Error("Rejected payload should be dropped:", string(payload))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if len(m.window) != 0 {
+		t.Error("All payloads should be acknowledged:", len(m.window))
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	request := []byte("1 ffffffffffffffffffffffffffffffffffffffff 1\nGET /first HTTP/1.1\r\n\r\n")
+	chained := []byte("1 ffffffffffffffffffffffffffffffffffffffff 1\nGET /second HTTP/1.1\r\n\r\n")
+	response := []byte("3 ffffffffffffffffffffffffffffffffffffffff 1 1\nHTTP/1.1 200 OK\r\n\r\n")
+	chainedResponse := []byte("3 ffffffffffffffffffffffffffffffffffffffff 1 1\nHTTP/1.1 201 Created\r\n\r\n")
+
+	// Payload gets to the end of chain only if it passed both middlewares
+	script, err := ioutil.TempFile("", "middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(script.Name())
+
+	script.WriteString(`#!/bin/sh
+while read line; do
+  case $line in
+    ` + hex.EncodeToString(request) + `) echo ` + hex.EncodeToString(chained) + ` ;;
+    31*) echo ` + hex.EncodeToString(request) + ` ;;
+    ` + hex.EncodeToString(response) + `) echo ` + hex.EncodeToString(chainedResponse) + ` ;;
+    33*) echo ` + hex.EncodeToString(response) + ` ;;
+    *) echo $line ;;
+  esac
+done
+`)
+	script.Close()
+	os.Chmod(script.Name(), 0755)
+
+	input := NewTestInput()
+	responses := NewTestInput()
+	responses.skipHeader = true
+
+	chain := NewMiddlewareChain([]string{script.Name(), script.Name()})
+	chain.ReadInputFrom(input)
+	chain.ReadResponsesFrom(responses)
+
+	received := make(chan []byte)
+	go func() {
+		for {
+			buf := make([]byte, 1024)
+			n, _ := chain.Read(buf)
+			received <- buf[:n]
+		}
+	}()
+
+	input.EmitGET()
+	responses.EmitBytes([]byte("3 ffffffffffffffffffffffffffffffffffffffff 1 1\nHTTP/1.1 500 Internal Server Error\r\n\r\n"))
+
+	expected := map[string]bool{string(chained): true, string(chainedResponse): true}
+	for range expected {
+		select {
+		case payload := <-received:
+			if !expected[string(payload)] {
+				t.Error("Payload should pass all middlewares:", string(payload))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Middleware chain did not reply")
+		}
+	}
 }
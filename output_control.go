@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// PausableOutput is a wrapper for output plugin, which allows to pause and resume it in runtime.
+// While paused, writes are dropped or buffered up to `bufferSize` payloads.
+type PausableOutput struct {
+	plugin     io.Writer
+	name       string
+	bufferSize int
+
+	mu      sync.Mutex
+	paused  bool
+	buffer  [][]byte
+	dropped int
+}
+
+// pausableReadOutput is used for outputs which also return responses, so they still can be used as readers
+type pausableReadOutput struct {
+	*PausableOutput
+	io.Reader
+}
+
+// NewPausableOutput constructor for PausableOutput
+func NewPausableOutput(plugin io.Writer, name string, bufferSize int) io.Writer {
+	o := &PausableOutput{plugin: plugin, name: name, bufferSize: bufferSize}
+	registerPausableOutput(o)
+
+	if r, ok := plugin.(io.Reader); ok {
+		return &pausableReadOutput{o, r}
+	}
+
+	return o
+}
+
+func (o *PausableOutput) Write(data []byte) (int, error) {
+	o.mu.Lock()
+
+	if o.paused {
+		if len(o.buffer) < o.bufferSize {
+			// Emitter re-uses its buffer
+			o.buffer = append(o.buffer, append([]byte(nil), data...))
+		} else {
+			o.dropped++
+		}
+		o.mu.Unlock()
+
+		return len(data), nil
+	}
+
+	o.mu.Unlock()
+
+	return o.plugin.Write(data)
+}
+
+// Pause stops sending data to the output
+func (o *PausableOutput) Pause() {
+	o.mu.Lock()
+	o.paused = true
+	o.mu.Unlock()
+
+	log.Println("Output paused:", o.plugin)
+}
+
+// Resume sends buffered data and continues normal operation.
+// Lock is held until buffer is flushed, so new writes wait and can't overtake buffered ones.
+func (o *PausableOutput) Resume() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	log.Println("Output resumed:", o.plugin, "buffered:", len(o.buffer), "dropped:", o.dropped)
+
+	for _, data := range o.buffer {
+		if _, err := o.plugin.Write(data); err != nil {
+			log.Println("Error while flushing paused output:", err)
+			break
+		}
+	}
+
+	o.buffer = nil
+	o.dropped = 0
+	o.paused = false
+}
+
+type pausableOutputStatus struct {
+	Name     string `json:"name"`
+	Output   string `json:"output"`
+	Paused   bool   `json:"paused"`
+	Buffered int    `json:"buffered"`
+	Dropped  int    `json:"dropped"`
+}
+
+func (o *PausableOutput) status() pausableOutputStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return pausableOutputStatus{
+		Name:     o.name,
+		Output:   fmt.Sprint(o.plugin),
+		Paused:   o.paused,
+		Buffered: len(o.buffer),
+		Dropped:  o.dropped,
+	}
+}
+
+func (o *PausableOutput) String() string {
+	return fmt.Sprint(o.plugin)
+}
+
+var pausableOutputsMu sync.Mutex
+var pausableOutputs []*PausableOutput
+
+func registerPausableOutput(o *PausableOutput) {
+	pausableOutputsMu.Lock()
+	pausableOutputs = append(pausableOutputs, o)
+	pausableOutputsMu.Unlock()
+}
+
+func findPausableOutput(name string) *PausableOutput {
+	pausableOutputsMu.Lock()
+	defer pausableOutputsMu.Unlock()
+
+	for _, o := range pausableOutputs {
+		if o.name == name {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// outputsHandler serves admin API for outputs:
+//
+//	GET  /outputs               - list of outputs with their state
+//	POST /outputs/{name}/pause  - pause output
+//	POST /outputs/{name}/resume - resume output
+func outputsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/outputs"), "/")
+
+	if path == "" {
+		pausableOutputsMu.Lock()
+		var statuses []pausableOutputStatus
+		for _, o := range pausableOutputs {
+			statuses = append(statuses, o.status())
+		}
+		pausableOutputsMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	o := findPausableOutput(parts[0])
+	if o == nil {
+		http.Error(w, "Output not found: "+parts[0], http.StatusNotFound)
+		return
+	}
+
+	switch parts[1] {
+	case "pause":
+		o.Pause()
+	case "resume":
+		o.Resume()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o.status())
+}
+
+// StartStatusServer starts admin HTTP server on given address
+func StartStatusServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/outputs", outputsHandler)
+	mux.HandleFunc("/outputs/", outputsHandler)
+	mux.HandleFunc("/ring-buffer", ringBufferHandler)
+	mux.HandleFunc("/ring-buffer/", ringBufferHandler)
+
+	log.Println("Status server listening on", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
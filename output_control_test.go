@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPausableOutput(t *testing.T) {
+	var written [][]byte
+	out := NewTestOutput(func(data []byte) {
+		written = append(written, data)
+	})
+
+	o := NewPausableOutput(out, "test-pause", 1).(*PausableOutput)
+
+	server := httptest.NewServer(http.HandlerFunc(outputsHandler))
+	defer server.Close()
+
+	if resp, _ := http.Post(server.URL+"/outputs/test-pause/pause", "", nil); resp.StatusCode != 200 {
+		t.Fatal("Should pause output", resp.StatusCode)
+	}
+
+	o.Write([]byte("1"))
+	o.Write([]byte("2"))
+
+	if len(written) != 0 {
+		t.Error("Paused output should not write")
+	}
+
+	if resp, _ := http.Post(server.URL+"/outputs/test-pause/resume", "", nil); resp.StatusCode != 200 {
+		t.Fatal("Should resume output", resp.StatusCode)
+	}
+
+	o.Write([]byte("3"))
+
+	if len(written) != 2 || string(written[0]) != "1" || string(written[1]) != "3" {
+		t.Errorf("Buffered payload should be sent after resume, and rest dropped: %q", written)
+	}
+
+	if resp, _ := http.Post(server.URL+"/outputs/unknown/pause", "", nil); resp.StatusCode != 404 {
+		t.Error("Should return 404 for unknown output", resp.StatusCode)
+	}
+}
+
+func TestPausableOutputResumeOrder(t *testing.T) {
+	var written []string
+	var writing int32
+
+	out := NewTestOutput(func(data []byte) {
+		if atomic.AddInt32(&writing, 1) > 1 {
+			t.Error("Output should not be written concurrently")
+		}
+		time.Sleep(time.Millisecond)
+		written = append(written, string(data))
+		atomic.AddInt32(&writing, -1)
+	})
+
+	o := NewPausableOutput(out, "test-resume-order", 10).(*PausableOutput)
+	o.Pause()
+
+	for i := 0; i < 10; i++ {
+		o.Write([]byte(strconv.Itoa(i)))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		o.Resume()
+		wg.Done()
+	}()
+
+	// Wait until flush is started
+	for atomic.LoadInt32(&writing) == 0 {
+		time.Sleep(100 * time.Microsecond)
+	}
+	o.Write([]byte("new"))
+	wg.Wait()
+
+	if len(written) != 11 || written[10] != "new" {
+		t.Errorf("Buffered payloads should be sent before new ones: %q", written)
+	}
+}
+
+func TestExtractOutputName(t *testing.T) {
+	tests := []struct {
+		options, name, path string
+	}{
+		{"http://example.com|10", "", "http://example.com|10"},
+		{"name=staging,http://staging.example.com|10%", "staging", "http://staging.example.com|10%"},
+		{"name=staging", "staging", ""},
+	}
+
+	for _, tc := range tests {
+		if name, path := extractOutputName(tc.options); name != tc.name || path != tc.path {
+			t.Errorf("%q: expected %q and %q, got %q and %q", tc.options, tc.name, tc.path, name, path)
+		}
+	}
+}
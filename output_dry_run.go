@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Number of replayed requests printed in summary of dry run
+const dryRunSamples = 5
+
+// DryRunOutput replaces all outputs in --dry-run mode. It counts requests which would be replayed,
+// and requests dropped by filters, and prints summary when Gor stops.
+type DryRunOutput struct {
+	mu        sync.Mutex
+	out       io.Writer
+	requests  int
+	responses int
+	// Option name -> number of requests dropped by it
+	dropped map[string]int
+	samples [][]byte
+}
+
+// NewDryRunOutput constructor for DryRunOutput
+func NewDryRunOutput() *DryRunOutput {
+	return &DryRunOutput{out: os.Stdout, dropped: make(map[string]int)}
+}
+
+func (o *DryRunOutput) Write(data []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !isRequestPayload(data) {
+		o.responses++
+		return len(data), nil
+	}
+
+	o.requests++
+	if len(o.samples) < dryRunSamples {
+		o.samples = append(o.samples, append([]byte(nil), data...))
+	}
+
+	return len(data), nil
+}
+
+// Drop counts request dropped by given option
+func (o *DryRunOutput) Drop(reason string) {
+	o.mu.Lock()
+	o.dropped[reason]++
+	o.mu.Unlock()
+}
+
+// Summary returns counters and samples of replayed requests
+func (o *DryRunOutput) Summary() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var s strings.Builder
+	fmt.Fprintln(&s, "Dry run summary:")
+	fmt.Fprintln(&s, "  requests to replay:", o.requests)
+	fmt.Fprintln(&s, "  responses:", o.responses)
+
+	var reasons []string
+	for reason := range o.dropped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	for _, reason := range reasons {
+		fmt.Fprintf(&s, "  dropped by --%s: %d\n", reason, o.dropped[reason])
+	}
+
+	if len(o.samples) > 0 {
+		fmt.Fprintf(&s, "First %d requests to replay:\n", len(o.samples))
+		for _, sample := range o.samples {
+			fmt.Fprintln(&s, string(sample))
+			fmt.Fprintln(&s, "---")
+		}
+	}
+
+	return s.String()
+}
+
+// Close prints summary
+func (o *DryRunOutput) Close() error {
+	_, err := io.WriteString(o.out, o.Summary())
+	return err
+}
+
+func (o *DryRunOutput) String() string {
+	return "Dry run output"
+}
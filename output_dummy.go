@@ -1,22 +1,59 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Formats of --output-stdout-format
+const (
+	stdoutFormatRaw  = "raw"
+	stdoutFormatJSON = "json"
+	stdoutFormatCurl = "curl"
 )
 
 // DummyOutput used for debugging, prints all incoming requests
 type DummyOutput struct {
+	format string
+}
+
+// stdoutMessage is payload printed with `json` format
+type stdoutMessage struct {
+	Type      string            `json:"type"`
+	UUID      string            `json:"uuid"`
+	Timestamp int64             `json:"timestamp"`
+	Method    string            `json:"method,omitempty"`
+	URL       string            `json:"url,omitempty"`
+	Status    string            `json:"status,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      string            `json:"body,omitempty"`
 }
 
-// NewDummyOutput constructor for DummyOutput
-func NewDummyOutput() (di *DummyOutput) {
+// NewDummyOutput constructor for DummyOutput, format is one of stdoutFormat* constants
+func NewDummyOutput(format string) (di *DummyOutput) {
 	di = new(DummyOutput)
+	di.format = format
 
 	return
 }
 
 func (i *DummyOutput) Write(data []byte) (int, error) {
-	fmt.Println(string(data))
+	switch i.format {
+	case stdoutFormatJSON:
+		fmt.Println(string(stdoutJSON(data)))
+	case stdoutFormatCurl:
+		// Responses can't be reproduced
+		if isRequestPayload(data) {
+			fmt.Println(stdoutCurl(data))
+		}
+	default:
+		fmt.Println(string(data))
+	}
 
 	return len(data), nil
 }
@@ -24,3 +61,67 @@ func (i *DummyOutput) Write(data []byte) (int, error) {
 func (i *DummyOutput) String() string {
 	return "Dummy Output"
 }
+
+func stdoutJSON(data []byte) []byte {
+	meta := payloadMeta(data)
+	body := payloadBody(data)
+
+	msg := stdoutMessage{Type: string(meta[0])}
+	if len(meta) > 1 {
+		msg.UUID = string(meta[1])
+	}
+	if len(meta) > 2 {
+		msg.Timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
+	}
+
+	// IsHTTPPayload recognizes only requests
+	if !proto.IsHTTPPayload(body) && !bytes.HasPrefix(body, []byte("HTTP/")) {
+		msg.Body = string(body)
+	} else {
+		if isRequestPayload(data) {
+			msg.Method = string(proto.Method(body))
+			msg.URL = string(proto.Path(body))
+		} else {
+			msg.Status = string(proto.Status(body))
+		}
+
+		msg.Headers = make(map[string]string)
+		proto.ParseHeaders([][]byte{body}, func(header []byte, value []byte) bool {
+			msg.Headers[string(header)] = string(value)
+			return true
+		})
+		msg.Body = string(proto.Body(body))
+	}
+
+	j, _ := json.Marshal(&msg)
+	return j
+}
+
+// stdoutCurl returns curl command sending the same request, Host header is used as URL host
+func stdoutCurl(data []byte) string {
+	req := payloadBody(data)
+	if !proto.IsHTTPPayload(req) {
+		return "# not HTTP request: " + string(data[:len(data)-len(req)-1])
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("curl -X " + string(proto.Method(req)) + " " + shellQuote("http://"+string(proto.Header(req, []byte("Host")))+string(proto.Path(req))))
+
+	proto.ParseHeaders([][]byte{req}, func(header []byte, value []byte) bool {
+		// Set by curl itself
+		if name := string(header); !strings.EqualFold(name, "Host") && !strings.EqualFold(name, "Content-Length") {
+			cmd.WriteString(" -H " + shellQuote(name+": "+string(value)))
+		}
+		return true
+	})
+
+	if body := proto.Body(req); len(body) > 0 {
+		cmd.WriteString(" --data-binary " + shellQuote(string(body)))
+	}
+
+	return cmd.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
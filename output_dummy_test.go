@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStdoutJSON(t *testing.T) {
+	var msg stdoutMessage
+
+	json.Unmarshal(stdoutJSON([]byte("1 abc 1500000000000000000\nPOST /orders?id=1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2\r\n\r\n{}")), &msg)
+	if msg.Type != "1" || msg.UUID != "abc" || msg.Timestamp != 1500000000000000000 || msg.Method != "POST" || msg.URL != "/orders?id=1" ||
+		msg.Headers["Host"] != "example.com" || msg.Body != "{}" {
+		t.Errorf("Wrong request: %+v", msg)
+	}
+
+	msg = stdoutMessage{}
+	json.Unmarshal(stdoutJSON([]byte("2 abc 1500000000000000000 100\nHTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")), &msg)
+	if msg.Status != "404" || msg.Method != "" || msg.Headers["Content-Length"] != "0" {
+		t.Errorf("Wrong response: %+v", msg)
+	}
+}
+
+func TestStdoutCurl(t *testing.T) {
+	cmd := stdoutCurl([]byte("1 abc 1\nPOST /orders HTTP/1.1\r\nHost: example.com\r\nContent-Length: 8\r\nX-Name: it's\r\n\r\n{\"a\":1}"))
+	if cmd != `curl -X POST 'http://example.com/orders' -H 'X-Name: it'\''s' --data-binary '{"a":1}'` {
+		t.Errorf("Wrong command: %s", cmd)
+	}
+
+	if cmd = stdoutCurl([]byte("1 abc 1\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); cmd != `curl -X GET 'http://example.com/'` {
+		t.Errorf("Wrong command: %s", cmd)
+	}
+}
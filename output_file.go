@@ -15,6 +15,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 var dateFileNameFuncs = map[string]func(*FileOutput) string{
@@ -36,6 +38,26 @@ type FileOutputConfig struct {
 	outputFileMaxSize int64
 	queueLimit        int
 	append            bool
+	symlink           string
+	// Write requests as script of load testing tool, instead of raw payloads
+	format string
+	// Level of gzip (1-9) or zstd (1-22) compression, 0 means default level
+	compressionLevel int
+	// Descriptor set used to write gRPC messages as JSON
+	grpcDescriptorSet string
+	// Sync file to disk on each flush, so data survives crash of the system
+	fsync bool
+	// How payloads are delimited, see newPayloadFraming
+	framing   string
+	separator string
+	// Completed files are uploaded to S3 location in bucket/prefix format, and optionally removed
+	s3         string
+	s3Endpoint string
+	s3Delete   bool
+	// Older files matching path template are removed after rotation, when there are more
+	// than maxFiles files, or they were modified more than maxAge ago
+	maxFiles int
+	maxAge   time.Duration
 }
 
 // FileOutput output plugin
@@ -53,6 +75,16 @@ type FileOutput struct {
 	closed         bool
 	totalFileSize  int64
 
+	// Set if requests are written as script, timestamp of previous request is used to reproduce delays
+	script        scriptFormat
+	lastTimestamp int64
+
+	grpc *grpcDecoder
+
+	framing payloadFraming
+
+	s3 *s3Uploader
+
 	config *FileOutputConfig
 }
 
@@ -61,6 +93,42 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 	o := new(FileOutput)
 	o.pathTemplate = pathTemplate
 	o.config = config
+
+	if config.format != "" && config.format != "gor" {
+		var ok bool
+		if o.script, ok = newScriptFormat(config.format); !ok {
+			log.Fatal("output-file-format: unknown format ", config.format)
+		}
+	}
+
+	var err error
+	if o.framing, err = newPayloadFraming(config.framing, config.separator); err != nil {
+		log.Fatal("output-file-framing: ", err)
+	}
+
+	if err := validateCompressionLevel(pathTemplate, config.compressionLevel); err != nil {
+		log.Fatal("output-file-compression-level: ", err)
+	}
+
+	if config.grpcDescriptorSet != "" {
+		if o.grpc, err = newGRPCDecoder(config.grpcDescriptorSet); err != nil {
+			log.Fatal("output-file-grpc-descriptor-set: ", err)
+		}
+	}
+
+	if config.maxFiles < 0 {
+		log.Fatal("output-file-max-files: should not be negative")
+	}
+	if config.maxAge < 0 {
+		log.Fatal("output-file-max-age: should not be negative")
+	}
+
+	if config.s3 != "" {
+		if o.s3, err = newS3Uploader(config.s3, config.s3Endpoint, config.s3Delete); err != nil {
+			log.Fatal("output-file-s3: ", err)
+		}
+	}
+
 	o.updateName()
 
 	if strings.Contains(pathTemplate, "%r") {
@@ -134,6 +202,53 @@ func (s sortByFileIndex) Less(i, j int) bool {
 	return s[i] < s[j]
 }
 
+// filesPattern returns glob matching all files of this output: with any date, request ID and file index
+func (o *FileOutput) filesPattern() string {
+	// %NS goes first, so it is not broken by replacing %S
+	pattern := strings.Replace(o.pathTemplate, "%NS", "*", -1)
+	for name := range dateFileNameFuncs {
+		pattern = strings.Replace(pattern, name, "*", -1)
+	}
+
+	ext := filepath.Ext(pattern)
+	return strings.TrimSuffix(pattern, ext) + "*" + ext
+}
+
+// removeOldFiles applies --output-file-max-files and --output-file-max-age to files of this output.
+// File which is currently written is never removed.
+func (o *FileOutput) removeOldFiles() {
+	matches, err := filepath.Glob(o.filesPattern())
+	if err != nil {
+		return
+	}
+	sort.Sort(sortByFileIndex(matches))
+
+	// Current file is counted, and others are checked from the newest one
+	kept := 1
+	for i := len(matches) - 1; i >= 0; i-- {
+		name := filepath.Clean(matches[i])
+		if name == o.currentName {
+			continue
+		}
+
+		// Symlink to the latest file and directories are not files of output
+		stat, err := os.Lstat(name)
+		if err != nil || !stat.Mode().IsRegular() {
+			continue
+		}
+
+		if (o.config.maxFiles > 0 && kept >= o.config.maxFiles) || (o.config.maxAge > 0 && time.Since(stat.ModTime()) > o.config.maxAge) {
+			Debug("[OUTPUT-FILE] Removing old file", name)
+			if err := os.Remove(name); err != nil {
+				log.Println("Error removing old file:", err)
+			}
+			continue
+		}
+
+		kept++
+	}
+}
+
 func (o *FileOutput) filename() string {
 	o.RLock()
 	defer o.RUnlock()
@@ -188,6 +303,15 @@ func (o *FileOutput) updateName() {
 }
 
 func (o *FileOutput) Write(data []byte) (n int, err error) {
+	// Scripts replay only requests
+	if o.script != nil && !isRequestPayload(data) {
+		return len(data), nil
+	}
+
+	if o.grpc != nil {
+		data = o.grpc.Decode(data)
+	}
+
 	if o.requestPerFile {
 		o.Lock()
 		meta := payloadMeta(data)
@@ -204,25 +328,37 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 		o.closeLocked()
 
 		o.file, err = os.OpenFile(o.currentName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
-		o.file.Sync()
-
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer = gzip.NewWriter(o.file)
-		} else {
-			o.writer = bufio.NewWriter(o.file)
-		}
 
 		if err != nil {
 			log.Fatal(o, "Cannot open file %q. Error: %s", o.currentName, err)
 		}
 
+		o.writer = newFileWriter(o.currentName, o.file, o.config.compressionLevel)
+
+		if o.config.symlink != "" {
+			if err := updateSymlink(o.config.symlink, o.currentName); err != nil {
+				log.Println("Error updating symlink to the latest file:", err)
+			}
+		}
+
 		o.queueLength = 0
-	}
 
-	o.writer.Write(data)
-	o.writer.Write([]byte(payloadSeparator))
+		if o.config.maxFiles > 0 || o.config.maxAge > 0 {
+			o.removeOldFiles()
+		}
+
+		if o.script != nil {
+			o.lastTimestamp = 0
+			o.writer.Write(o.script.Header())
+		}
+	}
 
-	o.totalFileSize += int64(len(data) + len(payloadSeparator))
+	if o.script != nil {
+		o.totalFileSize += int64(o.writeScript(data))
+	} else {
+		n, _ := o.framing.Write(o.writer, data)
+		o.totalFileSize += int64(n)
+	}
 	o.queueLength++
 
 	if Settings.outputFileConfig.outputFileMaxSize > 0 && o.totalFileSize >= Settings.outputFileConfig.outputFileMaxSize {
@@ -232,6 +368,80 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 	return len(data), nil
 }
 
+// newFileWriter picks compression by file extension: ".gz" for gzip, ".zst" for zstd
+func newFileWriter(name string, file io.Writer, level int) io.Writer {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		w, _ := gzip.NewWriterLevel(file, level)
+		return w
+	case strings.HasSuffix(name, ".zst"):
+		opts := []zstd.EOption{}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		w, _ := zstd.NewWriter(file, opts...)
+		return w
+	}
+
+	return bufio.NewWriter(file)
+}
+
+func validateCompressionLevel(path string, level int) error {
+	if level == 0 {
+		return nil
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return fmt.Errorf("gzip level should be between %d and %d, got %d", gzip.BestSpeed, gzip.BestCompression, level)
+		}
+	case strings.HasSuffix(path, ".zst"):
+		if level < 1 || level > 22 {
+			return fmt.Errorf("zstd level should be between 1 and 22, got %d", level)
+		}
+	}
+
+	return nil
+}
+
+// writeScript writes request as script step, delayed by time passed since previous request
+func (o *FileOutput) writeScript(data []byte) int {
+	timestamp, _ := strconv.ParseInt(string(payloadMeta(data)[2]), 10, 64)
+
+	var delay time.Duration
+	if o.lastTimestamp != 0 && timestamp > o.lastTimestamp {
+		delay = time.Duration(timestamp - o.lastTimestamp)
+	}
+	o.lastTimestamp = timestamp
+
+	step := o.script.Request(parseScriptRequest(payloadBody(data)), delay)
+	o.writer.Write(step)
+
+	return len(step)
+}
+
+// updateSymlink points link to the target file. New link is created under temporary name
+// and renamed over the old one, so link always points to some file.
+func updateSymlink(link, target string) error {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+
+	if err = os.Symlink(target, tmp); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, link)
+}
+
 func (o *FileOutput) flush() {
 	// Don't exit on panic
 	defer func() {
@@ -244,10 +454,19 @@ func (o *FileOutput) flush() {
 	defer o.Unlock()
 
 	if o.file != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer.(*gzip.Writer).Flush()
-		} else {
-			o.writer.(*bufio.Writer).Flush()
+		switch w := o.writer.(type) {
+		case *gzip.Writer:
+			w.Flush()
+		case *zstd.Encoder:
+			w.Flush()
+		case *bufio.Writer:
+			w.Flush()
+		}
+
+		if o.config.fsync {
+			if err := o.file.Sync(); err != nil {
+				log.Println("Error syncing file", err)
+			}
 		}
 
 		if stat, err := o.file.Stat(); err == nil {
@@ -264,12 +483,27 @@ func (o *FileOutput) String() string {
 
 func (o *FileOutput) closeLocked() error {
 	if o.file != nil {
-		if strings.HasSuffix(o.currentName, ".gz") {
-			o.writer.(*gzip.Writer).Close()
-		} else {
-			o.writer.(*bufio.Writer).Flush()
+		if o.script != nil {
+			o.writer.Write(o.script.Footer())
+		}
+
+		switch w := o.writer.(type) {
+		case *gzip.Writer:
+			w.Close()
+		case *zstd.Encoder:
+			w.Close()
+		case *bufio.Writer:
+			w.Flush()
+		}
+		if o.config.fsync {
+			o.file.Sync()
 		}
 		o.file.Close()
+
+		// Called on rotation to the next file, and on close, so file is complete
+		if o.s3 != nil {
+			o.s3.Upload(o.file.Name())
+		}
 	}
 
 	o.closed = true
@@ -280,8 +514,11 @@ func (o *FileOutput) closeLocked() error {
 func (o *FileOutput) Close() error {
 	o.Lock()
 	defer o.Unlock()
-	return o.closeLocked()
-	return nil
+	err := o.closeLocked()
+	if o.s3 != nil {
+		o.s3.Close()
+	}
+	return err
 }
 
 // IsClosed returns if the output file is closed or not.
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed upload is retried with delay, doubled after each attempt up to this limit
+const s3MaxRetryDelay = time.Minute
+
+// s3Uploader uploads completed files of FileOutput to S3 bucket in background.
+// Failed uploads are retried, and file is kept on disk until it is uploaded.
+type s3Uploader struct {
+	bucket string
+	prefix string
+	// Unique name of this run, used as a folder for its files, so restarted output does not overwrite
+	// files uploaded before, when numbering of local files starts again
+	runID string
+	// Custom S3-compatible endpoint, requests to it are path-style
+	endpoint string
+	region   string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	deleteLocal bool
+	retryDelay  time.Duration
+	client      *http.Client
+
+	mu      sync.Mutex
+	stopped bool
+	queue   chan string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newS3Uploader accepts location in "bucket/prefix" format. Credentials and region are taken from
+// standard AWS environment variables.
+func newS3Uploader(location, endpoint string, deleteLocal bool) (*s3Uploader, error) {
+	location = strings.TrimPrefix(location, "s3://")
+	bucket := location
+	prefix := ""
+	if i := strings.Index(location, "/"); i != -1 {
+		bucket, prefix = location[:i], location[i+1:]
+	}
+
+	if bucket == "" {
+		return nil, errors.New("bucket is required, expected bucket/prefix")
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	u := &s3Uploader{
+		bucket:       bucket,
+		prefix:       prefix,
+		runID:        s3RunID(time.Now()),
+		endpoint:     strings.TrimSuffix(endpoint, "/"),
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		deleteLocal:  deleteLocal,
+		retryDelay:   time.Second,
+		client:       &http.Client{Timeout: 10 * time.Minute},
+		queue:        make(chan string, 1000),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if u.accessKey == "" || u.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables are required")
+	}
+
+	if endpoint != "" {
+		if e, err := url.Parse(endpoint); err != nil || e.Scheme == "" || e.Host == "" {
+			return nil, errors.New("endpoint should be URL like http://minio:9000: " + endpoint)
+		}
+	}
+
+	if u.region == "" {
+		u.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if u.region == "" {
+		u.region = "us-east-1"
+	}
+
+	go u.run()
+
+	return u, nil
+}
+
+// s3RunID is made of host name, start time and random suffix, e.g. "web1-20200501T140000Z-1f2e3d4c"
+func s3RunID(now time.Time) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "gor"
+	}
+
+	return host + "-" + now.UTC().Format("20060102T150405Z") + "-" + string(uuid()[:8])
+}
+
+// Upload queues completed file for upload
+func (u *s3Uploader) Upload(path string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.stopped {
+		log.Println("[S3] Not uploaded, output is closed:", path)
+		return
+	}
+
+	select {
+	case u.queue <- path:
+	default:
+		log.Println("[S3] Upload queue is full, file is kept on disk:", path)
+	}
+}
+
+func (u *s3Uploader) run() {
+	defer close(u.done)
+
+	for path := range u.queue {
+		delay := u.retryDelay
+
+		for {
+			// After Close file gets the last attempt
+			last := u.isStopped()
+
+			err := u.upload(path)
+			if err == nil {
+				break
+			}
+			log.Println("[S3] Failed to upload", path+":", err)
+
+			// Removed by --output-file-max-files or --output-file-max-age before it was uploaded
+			if os.IsNotExist(err) {
+				break
+			}
+
+			if last {
+				log.Println("[S3] File is kept on disk:", path)
+				break
+			}
+
+			select {
+			case <-time.After(delay):
+			case <-u.stop:
+			}
+
+			if delay *= 2; delay > s3MaxRetryDelay {
+				delay = s3MaxRetryDelay
+			}
+		}
+	}
+}
+
+func (u *s3Uploader) isStopped() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.stopped
+}
+
+// Close waits until queued files are uploaded. Each of them gets one more attempt, without retries.
+func (u *s3Uploader) Close() {
+	u.mu.Lock()
+	if u.stopped {
+		u.mu.Unlock()
+		return
+	}
+	u.stopped = true
+	close(u.queue)
+	close(u.stop)
+	u.mu.Unlock()
+
+	<-u.done
+}
+
+func (u *s3Uploader) objectURL(key string) *url.URL {
+	path := "/" + key
+	host := u.bucket + ".s3." + u.region + ".amazonaws.com"
+	scheme := "https"
+
+	if u.endpoint != "" {
+		e, _ := url.Parse(u.endpoint)
+		scheme, host = e.Scheme, e.Host
+		path = "/" + u.bucket + path
+	}
+
+	return &url.URL{Scheme: scheme, Host: host, Path: path, RawPath: s3EscapePath(path)}
+}
+
+func (u *s3Uploader) upload(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	key := u.prefix + u.runID + "/" + filepath.Base(path)
+	req, _ := http.NewRequest("PUT", u.objectURL(key).String(), f)
+	req.ContentLength = stat.Size()
+	if stat.Size() == 0 {
+		req.Body = http.NoBody
+	}
+	u.sign(req, time.Now().UTC())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+
+	Debug("[S3] Uploaded", path, "to", u.bucket+"/"+key)
+
+	if u.deleteLocal {
+		if err := os.Remove(path); err != nil {
+			log.Println("[S3] Failed to remove uploaded file:", err)
+		}
+	}
+
+	return nil
+}
+
+// sign adds AWS Signature Version 4 to request. Body is not signed, it is protected by TLS.
+func (u *s3Uploader) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := "host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+
+	if u.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", u.sessionToken)
+		headers += "x-amz-security-token:" + u.sessionToken + "\n"
+		signedHeaders += ";x-amz-security-token"
+	}
+
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers, signedHeaders, payloadHash}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + u.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + u.secretKey)
+	for _, part := range []string{date, u.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, []byte(part))
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+u.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3EscapePath encodes every byte except unreserved characters and slashes, as required by signature
+func s3EscapePath(path string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~/", c) != -1 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
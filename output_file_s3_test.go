@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileOutputS3Upload(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	uploaded := make(map[string]string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// The first upload fails, and is retried
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Method != "PUT" || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			t.Errorf("Wrong request: %s %v", r.Method, r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		uploaded[r.URL.Path] = string(body)
+	}))
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	dir, _ := ioutil.TempDir("", "gor")
+	defer os.RemoveAll(dir)
+
+	output := NewFileOutput(filepath.Join(dir, "requests.gor"), &FileOutputConfig{flushInterval: time.Minute, queueLimit: 1, s3: "bucket/captures", s3Endpoint: server.URL, s3Delete: true})
+	output.s3.retryDelay = 10 * time.Millisecond
+
+	// The second payload goes to the next file, and the first one is uploaded
+	output.Write([]byte("1 1 1\nGET /1 HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("1 2 2\nGET /2 HTTP/1.1\r\n\r\n"))
+
+	// Files queued on close get only one attempt, so wait for retry
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		done := len(uploaded) == 1
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	output.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	folder := "/bucket/captures/" + output.s3.runID + "/"
+	expected := map[string]string{
+		folder + "requests_0.gor": "1 1 1\nGET /1 HTTP/1.1\r\n\r\n" + payloadSeparator,
+		folder + "requests_1.gor": "1 2 2\nGET /2 HTTP/1.1\r\n\r\n" + payloadSeparator,
+	}
+	for path, body := range expected {
+		if uploaded[path] != body {
+			t.Errorf("Expected %s to be uploaded with %q, got %q", path, body, uploaded[path])
+		}
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Error("Uploaded files should be removed:", files)
+	}
+}
+
+func TestS3EscapePath(t *testing.T) {
+	if p := s3EscapePath("/bucket/gor logs/a+b_1.gor"); p != "/bucket/gor%20logs/a%2Bb_1.gor" {
+		t.Error("Wrong path:", p)
+	}
+}
+
+func TestS3RunID(t *testing.T) {
+	now := time.Date(2020, 5, 1, 14, 0, 0, 0, time.UTC)
+
+	first, second := s3RunID(now), s3RunID(now)
+	if first == second {
+		t.Error("Runs started at the same time should get different IDs:", first)
+	}
+	if !strings.Contains(first, "-20200501T140000Z-") {
+		t.Error("Run ID should contain start time:", first)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// scriptFormat converts captured requests into script of load testing tool, written by file output instead of raw payloads.
+// Each file gets header and footer, so every file chunk is complete script.
+type scriptFormat interface {
+	Header() []byte
+	// Request returns script step, which waits for delay and sends request
+	Request(req *scriptRequest, delay time.Duration) []byte
+	Footer() []byte
+}
+
+type scriptRequest struct {
+	method  string
+	host    string
+	path    string
+	headers [][2]string
+	body    []byte
+}
+
+// Headers which are set by the tool itself, based on URL and body
+var scriptSkipHeaders = map[string]bool{
+	"host":              true,
+	"content-length":    true,
+	"transfer-encoding": true,
+	"connection":        true,
+}
+
+func parseScriptRequest(payload []byte) *scriptRequest {
+	req := &scriptRequest{
+		method: string(proto.Method(payload)),
+		host:   string(proto.Header(payload, []byte("Host"))),
+		path:   string(proto.Path(payload)),
+		body:   proto.Body(payload),
+	}
+
+	proto.ParseHeaders([][]byte{payload}, func(header, value []byte) bool {
+		if !scriptSkipHeaders[strings.ToLower(string(header))] {
+			req.headers = append(req.headers, [2]string{string(header), string(value)})
+		}
+		return true
+	})
+
+	return req
+}
+
+func newScriptFormat(name string) (scriptFormat, bool) {
+	switch name {
+	case "k6":
+		return k6Script{}, true
+	case "jmeter":
+		return jmeterScript{}, true
+	}
+
+	return nil, false
+}
+
+// k6Script writes k6 scenario, target can be changed with BASE_URL environment variable:
+//
+//	k6 run -e BASE_URL=https://staging.com script.js
+type k6Script struct{}
+
+func (k6Script) Header() []byte {
+	return []byte(`import http from 'k6/http';
+import { sleep } from 'k6';
+
+const baseURL = __ENV.BASE_URL;
+
+function url(host, path) {
+  return (baseURL || 'http://' + host) + path;
+}
+
+export default function () {
+`)
+}
+
+func (k6Script) Request(req *scriptRequest, delay time.Duration) []byte {
+	var buf bytes.Buffer
+
+	if delay > 0 {
+		fmt.Fprintf(&buf, "  sleep(%.3f);\n", delay.Seconds())
+	}
+
+	body := "null"
+	if len(req.body) > 0 {
+		body = jsString(string(req.body))
+	}
+
+	headers := make([]string, len(req.headers))
+	for i, h := range req.headers {
+		headers[i] = jsString(h[0]) + ": " + jsString(h[1])
+	}
+
+	fmt.Fprintf(&buf, "  http.request(%s, url(%s, %s), %s, { headers: { %s } });\n",
+		jsString(req.method), jsString(req.host), jsString(req.path), body, strings.Join(headers, ", "))
+
+	return buf.Bytes()
+}
+
+func (k6Script) Footer() []byte {
+	return []byte("}\n")
+}
+
+// JSON string is valid JavaScript string literal
+func jsString(s string) string {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// jmeterScript writes JMeter test plan, with one thread group sending captured requests in order.
+// Target can be changed with properties: jmeter -n -t plan.jmx -Jhost=staging.com -Jport=8080 -Jprotocol=https
+type jmeterScript struct{}
+
+func (jmeterScript) Header() []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<jmeterTestPlan version="1.2" properties="5.0" jmeter="5.4">
+  <hashTree>
+    <TestPlan guiclass="TestPlanGui" testclass="TestPlan" testname="GoReplay capture" enabled="true">
+      <elementProp name="TestPlan.user_defined_variables" elementType="Arguments">
+        <collectionProp name="Arguments.arguments"/>
+      </elementProp>
+    </TestPlan>
+    <hashTree>
+      <ThreadGroup guiclass="ThreadGroupGui" testclass="ThreadGroup" testname="Captured requests" enabled="true">
+        <stringProp name="ThreadGroup.on_sample_error">continue</stringProp>
+        <elementProp name="ThreadGroup.main_controller" elementType="LoopController" guiclass="LoopControlPanel" testclass="LoopController">
+          <boolProp name="LoopController.continue_forever">false</boolProp>
+          <stringProp name="LoopController.loops">1</stringProp>
+        </elementProp>
+        <stringProp name="ThreadGroup.num_threads">1</stringProp>
+        <stringProp name="ThreadGroup.ramp_time">1</stringProp>
+      </ThreadGroup>
+      <hashTree>
+`)
+}
+
+func (jmeterScript) Request(req *scriptRequest, delay time.Duration) []byte {
+	var buf bytes.Buffer
+
+	host, port := jmeterHostPort(req.host)
+
+	fmt.Fprintf(&buf, `        <HTTPSamplerProxy guiclass="HttpTestSampleGui" testclass="HTTPSamplerProxy" testname="%s" enabled="true">
+          <boolProp name="HTTPSampler.postBodyRaw">true</boolProp>
+          <elementProp name="HTTPsampler.Arguments" elementType="Arguments">
+            <collectionProp name="Arguments.arguments">
+              <elementProp name="" elementType="HTTPArgument">
+                <boolProp name="HTTPArgument.always_encode">false</boolProp>
+                <stringProp name="Argument.value">%s</stringProp>
+                <stringProp name="Argument.metadata">=</stringProp>
+              </elementProp>
+            </collectionProp>
+          </elementProp>
+          <stringProp name="HTTPSampler.domain">${__P(host,%s)}</stringProp>
+          <stringProp name="HTTPSampler.port">${__P(port,%s)}</stringProp>
+          <stringProp name="HTTPSampler.protocol">${__P(protocol,http)}</stringProp>
+          <stringProp name="HTTPSampler.path">%s</stringProp>
+          <stringProp name="HTTPSampler.method">%s</stringProp>
+          <boolProp name="HTTPSampler.follow_redirects">false</boolProp>
+          <boolProp name="HTTPSampler.use_keepalive">true</boolProp>
+        </HTTPSamplerProxy>
+        <hashTree>
+          <HeaderManager guiclass="HeaderPanel" testclass="HeaderManager" testname="Headers" enabled="true">
+            <collectionProp name="HeaderManager.headers">
+`, xmlString(req.method+" "+req.path), xmlString(string(req.body)), xmlString(host), xmlString(port), xmlString(req.path), xmlString(req.method))
+
+	for _, h := range req.headers {
+		fmt.Fprintf(&buf, `              <elementProp name="" elementType="Header">
+                <stringProp name="Header.name">%s</stringProp>
+                <stringProp name="Header.value">%s</stringProp>
+              </elementProp>
+`, xmlString(h[0]), xmlString(h[1]))
+	}
+
+	buf.WriteString(`            </collectionProp>
+          </HeaderManager>
+          <hashTree/>
+`)
+
+	if delay > 0 {
+		fmt.Fprintf(&buf, `          <ConstantTimer guiclass="ConstantTimerGui" testclass="ConstantTimer" testname="Recorded delay" enabled="true">
+            <stringProp name="ConstantTimer.delay">%d</stringProp>
+          </ConstantTimer>
+          <hashTree/>
+`, delay/time.Millisecond)
+	}
+
+	buf.WriteString("        </hashTree>\n")
+
+	return buf.Bytes()
+}
+
+func (jmeterScript) Footer() []byte {
+	return []byte(`      </hashTree>
+    </hashTree>
+  </hashTree>
+</jmeterTestPlan>
+`)
+}
+
+// jmeterHostPort splits Host header, port is empty if header has no port
+func jmeterHostPort(host string) (string, string) {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		return h, port
+	}
+
+	return host, ""
+}
+
+func xmlString(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestFileOutput(t *testing.T) {
@@ -40,7 +46,7 @@ func TestFileOutput(t *testing.T) {
 	quit = make(chan int)
 
 	var counter int64
-	input2 := NewFileInput("/tmp/test_requests.gor", false)
+	input2 := NewFileInput("/tmp/test_requests.gor", &FileInputConfig{})
 	output2 := NewTestOutput(func(data []byte) {
 		atomic.AddInt64(&counter, 1)
 		wg.Done()
@@ -161,6 +167,50 @@ func TestFileOutputCompression(t *testing.T) {
 	os.Remove(name)
 }
 
+func TestFileOutputCompressionZstd(t *testing.T) {
+	output := NewFileOutput("/tmp/log-compression-test.zst", &FileOutputConfig{append: true, flushInterval: time.Minute, compressionLevel: 19})
+
+	for i := 0; i < 1000; i++ {
+		output.Write([]byte("1 1 1\r\ntest"))
+	}
+
+	name := output.file.Name()
+	output.Close()
+
+	s, _ := os.Stat(name)
+	if s.Size() == 12*1000 {
+		t.Error("Should be compressed file:", s.Size())
+	}
+
+	file, _ := os.Open(name)
+	defer file.Close()
+
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+
+	data, _ := ioutil.ReadAll(decoder)
+	if !bytes.Equal(data, bytes.Repeat([]byte("1 1 1\r\ntest"+payloadSeparator), 1000)) {
+		t.Error("Should decompress written payloads")
+	}
+
+	os.Remove(name)
+}
+
+func TestFileOutputCompressionLevel(t *testing.T) {
+	for path, level := range map[string]int{"log.gz": 10, "log.zst": 23} {
+		if validateCompressionLevel(path, level) == nil {
+			t.Error("Should reject level", level, "for", path)
+		}
+	}
+
+	if err := validateCompressionLevel("log.gz", 9); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestParseDataUnit(t *testing.T) {
 	var d = map[string]int64{
 		"42mb":                 42 << 20,
@@ -354,3 +404,133 @@ func TestFileOutputAppendSizeLimitOverflow(t *testing.T) {
 	os.Remove(name1)
 	os.Remove(name3)
 }
+
+func TestFileOutputSymlinkLatest(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_symlink")
+	defer os.RemoveAll(dir)
+
+	link := filepath.Join(dir, "latest.gor")
+	output := NewFileOutput(filepath.Join(dir, "requests.gor"), &FileOutputConfig{queueLimit: 1, flushInterval: time.Minute, symlink: link})
+
+	output.Write([]byte("1 1 1\r\ntest"))
+	name1 := output.file.Name()
+
+	if target, _ := os.Readlink(link); target != name1 {
+		t.Error("Symlink should point to the first file:", target, name1)
+	}
+
+	output.updateName()
+	output.Write([]byte("1 1 1\r\ntest"))
+	name2 := output.file.Name()
+
+	if name1 == name2 {
+		t.Fatal("File should be rotated")
+	}
+
+	if target, _ := os.Readlink(link); target != name2 {
+		t.Error("Symlink should point to the latest file:", target, name2)
+	}
+
+	output.Close()
+}
+
+func TestFileOutputFsync(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_fsync")
+	defer os.RemoveAll(dir)
+
+	output := NewFileOutput(filepath.Join(dir, "requests.gor"), &FileOutputConfig{queueLimit: 256, flushInterval: time.Minute, fsync: true})
+
+	output.Write([]byte("1 1 1\r\ntest"))
+	output.flush()
+
+	if data, _ := ioutil.ReadFile(output.file.Name()); len(data) == 0 {
+		t.Error("Payload should be written to the file on flush")
+	}
+
+	output.Close()
+}
+
+func TestFileOutputMaxFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_retention")
+	defer os.RemoveAll(dir)
+
+	output := NewFileOutput(filepath.Join(dir, "requests.gor"), &FileOutputConfig{queueLimit: 1, flushInterval: time.Minute, maxFiles: 2, maxAge: time.Hour})
+
+	// The first file is too old, and is removed after rotation
+	output.Write([]byte("1 1 1\r\ntest"))
+	output.flush()
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(output.file.Name(), old, old)
+	output.Write([]byte("1 2 2\r\ntest"))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if expected := []string{filepath.Join(dir, "requests_1.gor")}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected files %v, got %v", expected, files)
+	}
+
+	// Only 2 of the newest files are kept
+	output.Write([]byte("1 3 3\r\ntest"))
+	output.Write([]byte("1 4 4\r\ntest"))
+	output.Close()
+
+	files, _ = filepath.Glob(filepath.Join(dir, "*"))
+	if expected := []string{filepath.Join(dir, "requests_2.gor"), filepath.Join(dir, "requests_3.gor")}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected files %v, got %v", expected, files)
+	}
+}
+
+func TestFileOutputScriptFormat(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gor_script")
+	defer os.RemoveAll(dir)
+
+	requests := [][]byte{
+		append(payloadHeader(RequestPayload, []byte("1"), 1e9, -1), "GET /?q=1 HTTP/1.1\r\nHost: www.w3.org:8080\r\nAccept: */*\r\n\r\n"...),
+		append(payloadHeader(ResponsePayload, []byte("1"), 1e9+1e6, 1e6), "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"...),
+		append(payloadHeader(RequestPayload, []byte("2"), 2.5e9, -1), "POST /upload HTTP/1.1\r\nHost: www.w3.org:8080\r\nContent-Length: 12\r\nX-Name: \"a\" & <b>\r\n\r\n{\"a\": \"b\"}\r\n"...),
+	}
+
+	output := NewFileOutput(filepath.Join(dir, "script.js"), &FileOutputConfig{flushInterval: time.Minute, append: true, format: "k6"})
+	for _, r := range requests {
+		output.Write(r)
+	}
+	output.Close()
+
+	script, _ := ioutil.ReadFile(filepath.Join(dir, "script.js"))
+	expected := k6Script{}.Header()
+	expected = append(expected, `  http.request("GET", url("www.w3.org:8080", "/?q=1"), null, { headers: { "Accept": "*/*" } });
+  sleep(1.500);
+  http.request("POST", url("www.w3.org:8080", "/upload"), "{\"a\": \"b\"}\r\n", { headers: { "X-Name": "\"a\" & <b>" } });
+}
+`...)
+
+	if string(script) != string(expected) {
+		t.Errorf("Wrong k6 script:\n%s", script)
+	}
+
+	output = NewFileOutput(filepath.Join(dir, "plan.jmx"), &FileOutputConfig{flushInterval: time.Minute, append: true, format: "jmeter"})
+	for _, r := range requests {
+		output.Write(r)
+	}
+	output.Close()
+
+	plan, _ := ioutil.ReadFile(filepath.Join(dir, "plan.jmx"))
+
+	var doc struct {
+		Samplers []struct {
+			Props []string `xml:"stringProp"`
+			Body  []string `xml:"elementProp>collectionProp>elementProp>stringProp"`
+		} `xml:"hashTree>hashTree>hashTree>HTTPSamplerProxy"`
+		Timers []string `xml:"hashTree>hashTree>hashTree>hashTree>ConstantTimer>stringProp"`
+	}
+	if err := xml.Unmarshal(plan, &doc); err != nil {
+		t.Fatal("Test plan should be valid XML:", err, string(plan))
+	}
+
+	if len(doc.Samplers) != 2 || doc.Samplers[1].Body[0] != "{\"a\": \"b\"}\r\n" || !reflect.DeepEqual(doc.Samplers[1].Props, []string{"${__P(host,www.w3.org)}", "${__P(port,8080)}", "${__P(protocol,http)}", "/upload", "POST"}) {
+		t.Errorf("Wrong samplers: %q", doc.Samplers)
+	}
+
+	if !reflect.DeepEqual(doc.Timers, []string{"1500"}) {
+		t.Error("Should delay second request:", doc.Timers)
+	}
+}
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -32,15 +42,91 @@ type HTTPOutputConfig struct {
 
 	elasticSearch string
 
-	Timeout      time.Duration
-	OriginalHost bool
-	BufferSize   int
+	Timeout           time.Duration
+	ConnectionTimeout time.Duration
+	RequestDeadline   time.Duration
+	OriginalHost      bool
+	BufferSize        int
 
 	CompatibilityMode bool
+	// Compatibility mode client talks HTTP/2 to cleartext target, without upgrade
+	h2c bool
+
+	RewriteReferer bool
 
 	Debug bool
 
 	TrackResponses bool
+	// Responses are decoded before they are passed to other outputs and compared
+	DecompressResponse bool
+
+	// Pause of each worker after sending a request, models pacing of a real user
+	thinkTime       time.Duration
+	thinkTimeJitter time.Duration
+
+	// Send requests with the same intervals as they were captured, sped up by replaySpeed
+	replayTiming bool
+	replaySpeed  float64
+
+	// How long dynamically scaled worker waits for requests before stopping
+	maxIdleTime time.Duration
+	// How often idle worker checks if it should stop, at most one worker stops per tick
+	idleTick time.Duration
+
+	// OpenTelemetry collector for spans of replayed requests
+	otlpEndpoint    string
+	otlpServiceName string
+
+	Socket SocketOptions
+
+	// Dial random IP of the target host for each new connection
+	randomTarget bool
+
+	NoKeepAlive bool
+
+	// Workers share this number of keep-alive connections, instead of having own connection each
+	connPoolSize int
+
+	// Requests with the same value of this header are sent by the same worker
+	stickyHeader string
+	// Spread requests without sticky header across workers, instead of sending them to stickyFallbackWorker
+	stickyRoundRobin     bool
+	stickyFallbackWorker int
+
+	// Kubernetes service in namespace/service[:port] format, which pods receive requests directly
+	k8sService string
+
+	// Spread connections among all --output-http targets, instead of sending each request to every target
+	lb        bool
+	lbTargets []string
+
+	// Fraction of requests sent with injected fault, for resilience testing
+	faultRate float64
+	faultType string
+
+	// Requests failed with connection error or one of retry codes are sent again
+	retryCount int
+	retryCodes string
+	retryDelay time.Duration
+
+	// Sending is paused for cbCooldown when share of failed requests reaches cbThreshold
+	cbThreshold float64
+	cbCooldown  time.Duration
+
+	// Client certificate for https targets requiring mutual TLS, and verification of target certificate
+	tlsCert   string
+	tlsKey    string
+	tlsCA     string
+	tlsVerify bool
+
+	// Webhook which is notified about failed or slow replayed requests
+	alertWebhook   string
+	alertOnStatus  string
+	alertOnLatency time.Duration
+	alertInterval  time.Duration
+
+	// Shared by outputs, if responses of two targets are compared
+	comparator *responseComparator
 }
 
 // HTTPOutput plugin manage pool of workers which send request to replayed server
@@ -51,6 +137,11 @@ type HTTPOutput struct {
 	// alignment. atomic.* functions crash on 32bit machines if operand is not
 	// aligned at 64bit. See https://github.com/golang/go/issues/599
 	activeWorkers int64
+	lastScaleUp   int64
+	lastRetire    int64
+	stickyNext    uint64
+	// Requests which are queued or being sent
+	pending int64
 
 	address string
 	limit   int
@@ -65,6 +156,48 @@ type HTTPOutput struct {
 	queueStats *GorStat
 
 	elasticSearch *ESPlugin
+
+	tracer *OTLPTracer
+
+	alerter *alertWebhook
+
+	// Index of the target in comparator
+	compareIndex int
+
+	retryCodes map[string]bool
+
+	breaker *circuitBreaker
+
+	// Outcomes of last requests, reported to health check
+	outcomesMu sync.Mutex
+	outcomes   outcomeWindow
+
+	tlsConfig *tls.Config
+
+	// Resolved addresses of the target, if connections should be spread randomly
+	targetIPs []net.IP
+
+	// Pods of Kubernetes service, if requests are sent to them directly
+	k8sEndpoints *k8sEndpoints
+
+	// Targets of --output-http-lb
+	balancer *httpBalancer
+
+	// Connections shared by workers, if --output-http-conn-pool-size is set
+	pool *httpClientPool
+
+	// Queues of fixed workers, used instead of shared queue when sticky routing enabled
+	stickyQueues []chan []byte
+
+	// Requests waiting for their replay time, if --output-http-replay-timing is set
+	timedQueue chan []byte
+	// Capture timestamp of the first request and time it was queued, replay timing is relative to them
+	firstTimestamp int64
+	firstQueued    time.Time
+
+	// Closed to stop workers
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewHTTPOutput constructor for HTTPOutput
@@ -75,6 +208,18 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) io.Writer {
 	o.address = address
 	o.config = config
 
+	if o.config.maxIdleTime == 0 {
+		o.config.maxIdleTime = 2 * time.Second
+	}
+
+	if o.config.idleTick == 0 {
+		o.config.idleTick = 100 * time.Millisecond
+	}
+
+	if o.config.maxIdleTime < 0 || o.config.idleTick < 0 || o.config.idleTick > o.config.maxIdleTime {
+		log.Fatal("output-http-worker-idle-tick: should be positive and not greater than --output-http-worker-idle-timeout")
+	}
+
 	if o.config.stats {
 		o.queueStats = NewGorStat("output_http", o.config.statsMs)
 	}
@@ -82,12 +227,58 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) io.Writer {
 	o.queue = make(chan []byte, o.config.queueLen)
 	o.responses = make(chan response, o.config.queueLen)
 	o.needWorker = make(chan int, 1)
+	o.stop = make(chan struct{})
 
 	// Initial workers count
-	if o.config.workersMax == 0 {
-		o.needWorker <- initialDynamicWorkers
+	workers := o.config.workersMax
+	if workers == 0 {
+		workers = initialDynamicWorkers
+	}
+
+	if o.config.stickyHeader != "" {
+		// Sticky routing requires fixed set of workers, so dynamic scaling is disabled
+		o.config.workersMin = workers
+		o.config.workersMax = workers
+
+		if o.config.stickyFallbackWorker < 0 || o.config.stickyFallbackWorker >= workers {
+			log.Fatal("output-http-sticky-fallback-worker: should be in range [0, ", workers-1, "]")
+		}
 	} else {
-		o.needWorker <- o.config.workersMax
+		o.needWorker <- workers
+	}
+
+	if o.config.faultRate != 0 {
+		if o.config.faultRate < 0 || o.config.faultRate > 1 {
+			log.Fatal("output-http-fault-rate: should be in range [0, 1]")
+		}
+
+		switch o.config.faultType {
+		case faultTruncate, faultCorrupt, faultReset:
+		default:
+			log.Fatal("output-http-fault-type: should be truncate, corrupt or reset")
+		}
+
+		if o.config.CompatibilityMode {
+			log.Fatal("output-http-fault-rate: faults can't be injected in compatibility mode")
+		}
+	}
+
+	if o.config.h2c {
+		if !o.config.CompatibilityMode {
+			log.Fatal("output-http-h2c: requires --output-http-compatibility-mode")
+		}
+		if strings.HasPrefix(o.address, "https://") {
+			log.Fatal("output-http-h2c: only cleartext targets are supported, https targets negotiate HTTP/2 by themselves")
+		}
+	}
+
+	if o.config.connPoolSize != 0 {
+		if o.config.connPoolSize < 0 {
+			log.Fatal("output-http-conn-pool-size: should not be negative")
+		}
+		if o.config.CompatibilityMode || o.config.NoKeepAlive || o.config.stickyHeader != "" {
+			log.Fatal("output-http-conn-pool-size: can't be used with compatibility mode, --output-http-no-keepalive or --output-http-sticky-header")
+		}
 	}
 
 	if o.config.elasticSearch != "" {
@@ -95,7 +286,105 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) io.Writer {
 		o.elasticSearch.Init(o.config.elasticSearch)
 	}
 
-	go o.workerMaster()
+	if o.config.otlpEndpoint != "" {
+		o.tracer = NewOTLPTracer(o.config.otlpEndpoint, o.config.otlpServiceName, o.address)
+	}
+
+	if o.config.replayTiming && o.config.replaySpeed <= 0 {
+		log.Fatal("output-http-replay-timing-speed: should be positive")
+	}
+
+	if o.config.replayTiming {
+		o.timedQueue = make(chan []byte, o.config.queueLen)
+		go o.replayTimer()
+	}
+
+	if o.config.retryCount < 0 {
+		log.Fatal("output-http-retry-count: should not be negative")
+	}
+
+	if o.config.retryCodes != "" {
+		o.retryCodes = make(map[string]bool)
+		for _, code := range strings.Split(o.config.retryCodes, ",") {
+			code = strings.TrimSpace(code)
+			if n, err := strconv.Atoi(code); err != nil || n < 100 || n > 599 {
+				log.Fatal("output-http-retry-codes: wrong status code ", code)
+			}
+			o.retryCodes[code] = true
+		}
+	}
+
+	if o.config.cbThreshold != 0 {
+		if o.config.cbThreshold < 0 || o.config.cbThreshold > 1 {
+			log.Fatal("output-http-cb-threshold: should be in range [0, 1]")
+		}
+		if o.config.cbCooldown <= 0 {
+			log.Fatal("output-http-cb-cooldown: should be positive")
+		}
+		o.breaker = newCircuitBreaker(o.address, o.config.cbThreshold, o.config.cbCooldown)
+	}
+
+	if o.config.tlsCert != "" || o.config.tlsKey != "" || o.config.tlsCA != "" || o.config.tlsVerify {
+		var err error
+		if o.tlsConfig, err = loadClientTLSConfig(o.config.tlsCert, o.config.tlsKey, o.config.tlsCA, o.config.tlsVerify); err != nil {
+			log.Fatal("output-http-tls: ", err)
+		}
+	}
+
+	if o.config.alertWebhook != "" {
+		var err error
+		if o.alerter, err = newAlertWebhook(o.config.alertWebhook, o.address, o.config.alertOnStatus, o.config.alertOnLatency, o.config.alertInterval); err != nil {
+			log.Fatal("alert-webhook: ", err)
+		}
+	}
+
+	if o.config.comparator != nil {
+		var err error
+		if o.compareIndex, err = o.config.comparator.register(o.address); err != nil {
+			log.Fatal("output-http-compare: ", err)
+		}
+	}
+
+	if o.config.randomTarget {
+		o.targetIPs = resolveTargetIPs(o.address)
+	}
+
+	if o.config.k8sService != "" {
+		var err error
+		if o.k8sEndpoints, err = newK8sServiceEndpoints(o.config.k8sService); err != nil {
+			log.Fatal("output-http-k8s-service: ", err)
+		}
+	}
+
+	if o.config.lb {
+		if len(o.config.lbTargets) < 2 {
+			log.Fatal("output-http-lb: at least 2 --output-http targets are required")
+		}
+		if o.config.CompatibilityMode || o.config.k8sService != "" || o.config.randomTarget {
+			log.Fatal("output-http-lb: can't be used with compatibility mode, --output-http-k8s-service or --output-http-random-target")
+		}
+
+		var err error
+		if o.balancer, err = newHTTPBalancer(o.config.lbTargets); err != nil {
+			log.Fatal("output-http-lb: ", err)
+		}
+	}
+
+	if o.config.connPoolSize > 0 {
+		o.pool = newHTTPClientPool(o.config.connPoolSize, o.newClient)
+	}
+
+	if o.config.stickyHeader != "" {
+		o.stickyQueues = make([]chan []byte, workers)
+		for i := range o.stickyQueues {
+			o.stickyQueues[i] = make(chan []byte, o.config.queueLen/workers+1)
+			go o.startStickyWorker(o.stickyQueues[i])
+		}
+	} else {
+		go o.workerMaster()
+	}
+
+	registerHealthReporter(o)
 
 	return o
 }
@@ -109,45 +398,203 @@ func (o *HTTPOutput) workerMaster() {
 	}
 }
 
-func (o *HTTPOutput) startWorker() {
-	client := NewHTTPClient(o.address, &HTTPClientConfig{
+func (o *HTTPOutput) newClient() *HTTPClient {
+	var pickTarget func() string
+	var releaseTarget func(string, bool)
+	if o.k8sEndpoints != nil {
+		pickTarget = o.k8sEndpoints.Pick
+	}
+	if o.balancer != nil {
+		pickTarget = o.balancer.Pick
+		releaseTarget = o.balancer.Release
+	}
+
+	return NewHTTPClient(o.address, &HTTPClientConfig{
 		FollowRedirects:    o.config.redirectLimit,
 		Debug:              o.config.Debug,
 		OriginalHost:       o.config.OriginalHost,
+		ConnectionTimeout:  o.config.ConnectionTimeout,
 		Timeout:            o.config.Timeout,
+		RequestDeadline:    o.config.RequestDeadline,
 		ResponseBufferSize: o.config.BufferSize,
 		CompatibilityMode:  o.config.CompatibilityMode,
+		Socket:             &o.config.Socket,
+		TargetIPs:          o.targetIPs,
+		NoKeepAlive:        o.config.NoKeepAlive,
+		PickTarget:         pickTarget,
+		ReleaseTarget:      releaseTarget,
+		FaultRate:          o.config.faultRate,
+		FaultType:          o.config.faultType,
+		RewriteReferer:     o.config.RewriteReferer,
+		TLSConfig:          o.tlsConfig,
+		SkipAliveCheck:     o.config.connPoolSize > 0,
+		H2C:                o.config.h2c,
+		DecompressResponse: o.config.DecompressResponse,
 	})
+}
+
+// loadClientTLSConfig loads client certificate and CA bundle. Target certificate is verified against CA bundle if it is set,
+// or against system roots if `verify` is set.
+func loadClientTLSConfig(cert, key, ca string, verify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: !verify && ca == ""}
+
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("both --output-http-tls-cert and --output-http-tls-key are required")
+		}
 
-	deathCount := 0
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + ca)
+		}
+	}
+
+	return config, nil
+}
+
+func (o *HTTPOutput) startWorker() {
+	// Pooled connections are taken for each request instead
+	var client *HTTPClient
+	if o.pool == nil {
+		client = o.newClient()
+	}
+
+	idleSince := time.Now()
 
 	atomic.AddInt64(&o.activeWorkers, 1)
+	o.reportMetrics()
 
 	for {
 		select {
 		case data := <-o.queue:
-			o.sendRequest(client, data)
-			deathCount = 0
-		case <-time.After(time.Millisecond * 100):
-			// When dynamic scaling enabled workers die after 2s of inactivity
+			o.reportMetrics()
+			if o.pool != nil {
+				pooled := o.pool.Get()
+				o.sendRequest(pooled, data)
+				o.pool.Put(pooled)
+			} else {
+				o.sendRequest(client, data)
+			}
+			atomic.AddInt64(&o.pending, -1)
+			o.think()
+			idleSince = time.Now()
+		case <-o.stop:
+			if client != nil {
+				client.Disconnect()
+			}
+			atomic.AddInt64(&o.activeWorkers, -1)
+			o.reportMetrics()
+			return
+		case <-time.After(o.config.idleTick):
+			// When dynamic scaling enabled workers die after period of inactivity
 			if o.config.workersMin == o.config.workersMax {
 				continue
 			}
 
-			deathCount++
-			if deathCount > 20 {
-				workersCount := int(atomic.LoadInt64(&o.activeWorkers))
-
-				// At least 1 startWorker should be alive
-				if workersCount != 1 && workersCount > o.config.workersMin {
-					atomic.AddInt64(&o.activeWorkers, -1)
-					return
+			if time.Since(idleSince) >= o.config.maxIdleTime && o.retire() {
+				if client != nil {
+					client.Disconnect()
 				}
+				o.reportMetrics()
+				return
 			}
 		}
 	}
 }
 
+// startStickyWorker sends requests from its own queue, so requests of the same session are sent over the same connection
+func (o *HTTPOutput) startStickyWorker(queue chan []byte) {
+	client := o.newClient()
+
+	atomic.AddInt64(&o.activeWorkers, 1)
+	o.reportMetrics()
+
+	for {
+		select {
+		case data := <-queue:
+			o.reportMetrics()
+			o.sendRequest(client, data)
+			atomic.AddInt64(&o.pending, -1)
+			o.think()
+		case <-o.stop:
+			client.Disconnect()
+			atomic.AddInt64(&o.activeWorkers, -1)
+			o.reportMetrics()
+			return
+		}
+	}
+}
+
+// stickyIndex picks worker for request by hash of sticky header value.
+// Requests without the header are not hashed, otherwise they all would end up in one worker.
+func (o *HTTPOutput) stickyIndex(data []byte) int {
+	value := proto.Header(payloadBody(data), []byte(o.config.stickyHeader))
+
+	if len(value) == 0 {
+		if o.config.stickyRoundRobin {
+			return int(atomic.AddUint64(&o.stickyNext, 1) % uint64(len(o.stickyQueues)))
+		}
+
+		return o.config.stickyFallbackWorker
+	}
+
+	hasher := fnv.New32a()
+	hasher.Write(value)
+
+	return int(hasher.Sum32() % uint32(len(o.stickyQueues)))
+}
+
+// retire decides if idle worker can stop. Workers retire one per tick, and only after
+// max idle time passed since last scale up, so short lulls in bursty traffic do not cause workers churn.
+func (o *HTTPOutput) retire() bool {
+	now := time.Now().UnixNano()
+
+	if now-atomic.LoadInt64(&o.lastScaleUp) < int64(o.config.maxIdleTime) {
+		return false
+	}
+
+	lastRetire := atomic.LoadInt64(&o.lastRetire)
+	if now-lastRetire < int64(o.config.idleTick) || !atomic.CompareAndSwapInt64(&o.lastRetire, lastRetire, now) {
+		return false
+	}
+
+	workersCount := int(atomic.LoadInt64(&o.activeWorkers))
+
+	// At least 1 startWorker should be alive
+	if workersCount != 1 && workersCount > o.config.workersMin {
+		atomic.AddInt64(&o.activeWorkers, -1)
+		return true
+	}
+
+	return false
+}
+
+// think pauses worker for configured think time, plus random jitter in range [-jitter, +jitter]
+func (o *HTTPOutput) think() {
+	pause := o.config.thinkTime
+
+	if o.config.thinkTimeJitter > 0 {
+		pause += time.Duration(rand.Int63n(int64(2*o.config.thinkTimeJitter))) - o.config.thinkTimeJitter
+	}
+
+	if pause > 0 {
+		time.Sleep(pause)
+	}
+}
+
 func (o *HTTPOutput) Write(data []byte) (n int, err error) {
 	if !isRequestPayload(data) {
 		return len(data), nil
@@ -156,11 +603,39 @@ func (o *HTTPOutput) Write(data []byte) (n int, err error) {
 	buf := make([]byte, len(data))
 	copy(buf, data)
 
+	atomic.AddInt64(&o.pending, 1)
+
+	// Requests wait for replay time in own queue, so emitter and other outputs are not blocked meanwhile
+	if o.timedQueue != nil {
+		o.timedQueue <- buf
+		return len(data), nil
+	}
+
+	o.dispatch(buf)
+
+	return len(data), nil
+}
+
+// dispatch queues request to workers, and scales up workers if queue grows
+func (o *HTTPOutput) dispatch(buf []byte) {
+	if o.stickyQueues != nil {
+		queue := o.stickyQueues[o.stickyIndex(buf)]
+		queue <- buf
+
+		if o.config.stats {
+			o.queueStats.Write(len(queue))
+		}
+		o.reportMetrics()
+
+		return
+	}
+
 	o.queue <- buf
 
 	if o.config.stats {
 		o.queueStats.Write(len(o.queue))
 	}
+	o.reportMetrics()
 
 	if o.config.workersMax != o.config.workersMin {
 		workersCount := int(atomic.LoadInt64(&o.activeWorkers))
@@ -172,12 +647,73 @@ func (o *HTTPOutput) Write(data []byte) (n int, err error) {
 				extraWorkersReq = maxWorkersAvailable
 			}
 			if extraWorkersReq > 0 {
+				atomic.StoreInt64(&o.lastScaleUp, time.Now().UnixNano())
 				o.needWorker <- extraWorkersReq
 			}
 		}
 	}
+}
 
-	return len(data), nil
+// reportMetrics updates Prometheus gauges of workers and queue length
+func (o *HTTPOutput) reportMetrics() {
+	queued := len(o.queue) + len(o.timedQueue)
+	for _, q := range o.stickyQueues {
+		queued += len(q)
+	}
+
+	metrics.SetHTTPOutputStats(o.address, int(atomic.LoadInt64(&o.activeWorkers)), queued)
+}
+
+// replayTimer passes requests of timed queue to workers once their replay time comes.
+// Requests are delayed before they are queued to workers, so bursts of captured traffic still scale up workers.
+func (o *HTTPOutput) replayTimer() {
+	for {
+		select {
+		case data := <-o.timedQueue:
+			if !o.waitReplayTime(data) {
+				return
+			}
+			o.dispatch(data)
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+// waitReplayTime delays request until the same time passed since the first request, as passed during capture.
+// Returns false if output was closed while waiting.
+func (o *HTTPOutput) waitReplayTime(data []byte) bool {
+	meta := payloadMeta(data)
+	if len(meta) < 3 {
+		return true
+	}
+
+	timestamp, err := strconv.ParseInt(string(meta[2]), 10, 64)
+	if err != nil {
+		return true
+	}
+
+	if o.firstQueued.IsZero() {
+		o.firstTimestamp = timestamp
+		o.firstQueued = time.Now()
+	}
+	offset := time.Duration(float64(timestamp-o.firstTimestamp) / o.config.replaySpeed)
+	delay := time.Until(o.firstQueued.Add(offset))
+
+	// Requests captured out of order, or which are late already, are sent immediately
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-o.stop:
+		return false
+	}
 }
 
 func (o *HTTPOutput) Read(data []byte) (int, error) {
@@ -211,15 +747,56 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, request []byte) {
 		return
 	}
 
-	start := time.Now()
-	resp, err := client.Send(body)
-	stop := time.Now()
+	if o.breaker != nil && !o.breaker.Allow(time.Now()) {
+		Debug("[OUTPUT-HTTP] Circuit breaker is open, request dropped:", string(uuid), o.address)
+		return
+	}
+
+	var span *traceSpan
+	if o.tracer != nil {
+		span, body = o.tracer.StartSpan(body)
+	}
+
+	var resp []byte
+	var err error
+	var start, stop time.Time
+
+	for attempt := 0; ; attempt++ {
+		start = time.Now()
+		resp, err = client.SendWithID(uuid, body)
+		stop = time.Now()
+
+		if attempt >= o.config.retryCount || !o.shouldRetry(resp, err) {
+			break
+		}
+
+		Debug("[OUTPUT-HTTP] Retrying request", string(uuid), "to", o.address+", attempt:", attempt+1, "error:", err, "status:", string(proto.Status(resp)))
+		time.Sleep(o.config.retryDelay)
+	}
+
+	if span != nil {
+		o.tracer.EndSpan(span, resp, err)
+	}
+
+	// Error payloads of the client have 5xx status as well
+	status := proto.Status(resp)
+
+	failed := err != nil || len(status) > 0 && status[0] == '5'
+	if o.breaker != nil {
+		o.breaker.Record(failed, stop)
+	}
+
+	o.outcomesMu.Lock()
+	o.outcomes.Add(failed)
+	o.outcomesMu.Unlock()
+
 	tc := time.Since(start)
-	metrics.ObserveTotalRequestsTimeHistogram(req.RequestURI, tc.Seconds())
-	metrics.IncreaseTotalRequests(req.RequestURI, string(resp.StatusCode))
+	path := string(proto.Path(body))
+	metrics.ObserveTotalRequestsTimeHistogram(path, tc.Seconds())
+	metrics.IncreaseTotalRequests(path, string(status))
+	metrics.IncreaseResponseStatusClass(o.address, statusClass(status))
 	if err != nil {
-		log.Println("Error when sending ", err, time.Now())
-		Debug("Request error:", err)
+		log.Println("[OUTPUT-HTTP] Error when sending request", string(uuid), "to", o.address+":", err)
 	}
 
 	if o.config.TrackResponses {
@@ -229,8 +806,82 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, request []byte) {
 	if o.elasticSearch != nil {
 		o.elasticSearch.ResponseAnalyze(request, resp, start, stop)
 	}
+
+	if o.alerter != nil {
+		o.alerter.Check(body, resp, stop.Sub(start))
+	}
+
+	if o.config.comparator != nil {
+		o.config.comparator.Add(o.compareIndex, uuid, body, resp)
+	}
+}
+
+// statusClass returns class of response status like "5xx", or "error" if response has no valid status
+func statusClass(status []byte) string {
+	if len(status) != 3 || status[0] < '1' || status[0] > '5' {
+		return "error"
+	}
+
+	return string(status[0]) + "xx"
+}
+
+// shouldRetry returns true for connection errors, and responses with one of retry codes
+func (o *HTTPOutput) shouldRetry(resp []byte, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	return o.retryCodes[string(proto.Status(resp))]
 }
 
 func (o *HTTPOutput) String() string {
 	return "HTTP output: " + o.address
 }
+
+// healthStatus reports error rate of last requests, workers and queued requests
+func (o *HTTPOutput) healthStatus() outputHealthStatus {
+	o.outcomesMu.Lock()
+	requests, errorRate := o.outcomes.count, o.outcomes.Rate()
+	o.outcomesMu.Unlock()
+
+	return outputHealthStatus{
+		Output:    o.String(),
+		Requests:  requests,
+		ErrorRate: errorRate,
+		Workers:   int(atomic.LoadInt64(&o.activeWorkers)),
+		Queued:    o.QueueLen(),
+	}
+}
+
+// QueueLen returns number of requests which are queued or being sent
+func (o *HTTPOutput) QueueLen() int {
+	return int(atomic.LoadInt64(&o.pending))
+}
+
+// Close waits up to --shutdown-timeout until queued requests are sent, then stops workers
+func (o *HTTPOutput) Close() error {
+	o.closeOnce.Do(func() {
+		deadline := time.Now().Add(Settings.shutdownTimeout)
+		for o.QueueLen() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if n := o.QueueLen(); n > 0 {
+			log.Println(o, "-", n, "requests were not sent before shutdown")
+		}
+
+		close(o.stop)
+
+		if o.pool != nil {
+			o.pool.Close()
+		}
+
+		if o.balancer != nil {
+			o.balancer.Close()
+		}
+
+		unregisterHealthReporter(o)
+	})
+
+	return nil
+}
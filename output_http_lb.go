@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed targets of --output-http-lb are probed with this interval
+const lbProbeInterval = time.Second
+
+type lbTarget struct {
+	addr    string
+	conns   int
+	healthy bool
+}
+
+// httpBalancer spreads connections of HTTP output among several targets, picking healthy target with
+// the least open connections. Target is taken out of rotation when connection to it fails, and
+// is added back when probe connection succeeds.
+type httpBalancer struct {
+	mu      sync.Mutex
+	targets []*lbTarget
+	// Rotates targets with equal number of connections
+	next int
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// newHTTPBalancer accepts addresses of --output-http, which should have the same scheme
+func newHTTPBalancer(addresses []string) (*httpBalancer, error) {
+	b := &httpBalancer{stop: make(chan struct{})}
+	scheme := ""
+
+	for _, address := range addresses {
+		if !strings.HasPrefix(address, "http") {
+			address = "http://" + address
+		}
+
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+
+		if scheme != "" && u.Scheme != scheme {
+			return nil, errors.New("all targets should have the same scheme")
+		}
+		scheme = u.Scheme
+
+		port := u.Port()
+		if port == "" {
+			port = defaultPorts[u.Scheme]
+		}
+
+		b.targets = append(b.targets, &lbTarget{addr: net.JoinHostPort(u.Hostname(), port), healthy: true})
+	}
+
+	go b.probe()
+
+	return b, nil
+}
+
+// Pick returns address of target for new connection. If all targets are down, they all are tried.
+func (b *httpBalancer) Pick() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var picked *lbTarget
+	for _, healthyOnly := range []bool{true, false} {
+		for i := range b.targets {
+			t := b.targets[(b.next+i)%len(b.targets)]
+			if healthyOnly && !t.healthy {
+				continue
+			}
+			if picked == nil || t.conns < picked.conns {
+				picked = t
+			}
+		}
+
+		if picked != nil {
+			break
+		}
+	}
+
+	b.next = (b.next + 1) % len(b.targets)
+	picked.conns++
+
+	return picked.addr
+}
+
+// Release is called when connection to target is closed, or could not be established
+func (b *httpBalancer) Release(addr string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, t := range b.targets {
+		if t.addr != addr {
+			continue
+		}
+
+		t.conns--
+
+		if failed && t.healthy {
+			t.healthy = false
+			log.Println("[OUTPUT-HTTP] Target", addr, "is down, taken out of rotation")
+		}
+	}
+}
+
+// probe connects to failed targets, and adds them back to rotation if connection succeeds
+func (b *httpBalancer) probe() {
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(lbProbeInterval):
+		}
+
+		var down []string
+		b.mu.Lock()
+		for _, t := range b.targets {
+			if !t.healthy {
+				down = append(down, t.addr)
+			}
+		}
+		b.mu.Unlock()
+
+		for _, addr := range down {
+			conn, err := net.DialTimeout("tcp", addr, lbProbeInterval)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+
+			b.mu.Lock()
+			for _, t := range b.targets {
+				if t.addr == addr {
+					t.healthy = true
+				}
+			}
+			b.mu.Unlock()
+
+			log.Println("[OUTPUT-HTTP] Target", addr, "is up, added back to rotation")
+		}
+	}
+}
+
+// Close stops probes
+func (b *httpBalancer) Close() {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPBalancerLeastConnections(t *testing.T) {
+	b, err := newHTTPBalancer([]string{"10.0.0.1", "http://10.0.0.2:8080", "10.0.0.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	first, second, third := b.Pick(), b.Pick(), b.Pick()
+	if first != "10.0.0.1:80" || second != "10.0.0.2:8080" || third != "10.0.0.3:80" {
+		t.Error("Targets should be picked in turn:", first, second, third)
+	}
+
+	b.Release(second, false)
+	if addr := b.Pick(); addr != second {
+		t.Error("Target with the fewest connections should be picked:", addr)
+	}
+
+	b.Release(first, true)
+	for i := 0; i < 4; i++ {
+		if addr := b.Pick(); addr == first {
+			t.Error("Failed target should be out of rotation")
+		}
+	}
+
+	if _, err := newHTTPBalancer([]string{"http://10.0.0.1", "https://10.0.0.2"}); err == nil {
+		t.Error("Targets with different schemes should be rejected")
+	}
+}
+
+func TestHTTPBalancerProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	b, err := newHTTPBalancer([]string{addr, "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	b.Release(b.Pick(), true)
+	if picked := b.Pick(); picked == addr {
+		t.Fatal("Failed target should be out of rotation")
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("Can't listen on the same port again:", err)
+	}
+	defer ln.Close()
+
+	time.Sleep(lbProbeInterval + 200*time.Millisecond)
+	if picked := b.Pick(); picked != addr {
+		t.Error("Target should be added back after successful probe:", picked)
+	}
+}
+
+func TestHTTPOutputLB(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&received, 1)
+		wg.Done()
+	}))
+	defer server.Close()
+
+	// Nothing listens there
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	input := NewTestInput()
+	output := NewHTTPOutput(down.URL, &HTTPOutputConfig{workersMax: 1, lb: true, lbTargets: []string{down.URL, server.URL}, retryCount: 1})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+
+	go Start(plugins, quit)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		input.EmitGET()
+	}
+
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&received); n != 10 {
+		t.Error("All requests should be sent to the healthy target:", n)
+	}
+
+	close(quit)
+}
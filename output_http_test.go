@@ -1,14 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	_ "net/http/httputil"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/buger/goreplay/proto"
 )
 
 func TestHTTPOutput(t *testing.T) {
@@ -135,6 +146,40 @@ func TestOutputHTTPSSL(t *testing.T) {
 	close(quit)
 }
 
+func TestHTTPOutputThinkTime(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Done()
+	}))
+	defer server.Close()
+
+	input := NewTestInput()
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMin: 1, workersMax: 1, thinkTime: 100 * time.Millisecond})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+
+	go Start(plugins, quit)
+
+	start := time.Now()
+	wg.Add(3)
+
+	input.EmitGET()
+	input.EmitGET()
+	input.EmitGET()
+
+	wg.Wait()
+	close(quit)
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Error("Single worker should pause between requests, elapsed:", elapsed)
+	}
+}
+
 func BenchmarkHTTPOutput(b *testing.B) {
 	wg := new(sync.WaitGroup)
 	quit := make(chan int)
@@ -164,3 +209,352 @@ func BenchmarkHTTPOutput(b *testing.B) {
 
 	close(quit)
 }
+
+func TestHTTPOutputStatusClass(t *testing.T) {
+	for status, class := range map[string]string{"200": "2xx", "304": "3xx", "404": "4xx", "524": "5xx", "": "error", "OK": "error"} {
+		if c := statusClass([]byte(status)); c != class {
+			t.Errorf("Expected %s for %q, got %s", class, status, c)
+		}
+	}
+}
+
+func TestHTTPOutputMaxIdleTime(t *testing.T) {
+	output := NewHTTPOutput("127.0.0.1:0", &HTTPOutputConfig{workersMax: 5, maxIdleTime: 300 * time.Millisecond}).(*HTTPOutput)
+
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt64(&output.activeWorkers); n != 5 {
+		t.Error("Workers should not stop before max idle time:", n)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if n := atomic.LoadInt64(&output.activeWorkers); n == 5 || n == 1 {
+		t.Error("Workers should stop one by one:", n)
+	}
+
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt64(&output.activeWorkers); n != 1 {
+		t.Error("Idle workers should stop:", n)
+	}
+}
+
+func TestHTTPOutputWorkerIdleTick(t *testing.T) {
+	output := NewHTTPOutput("127.0.0.1:0", &HTTPOutputConfig{workersMax: 5, maxIdleTime: 100 * time.Millisecond, idleTick: 10 * time.Millisecond}).(*HTTPOutput)
+
+	// With default tick of 100ms the last worker would stop after 500ms
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt64(&output.activeWorkers); n != 1 {
+		t.Error("Idle workers should stop each tick:", n)
+	}
+}
+
+func TestHTTPOutputSticky(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	quit := make(chan int)
+
+	var mu sync.Mutex
+	connections := make(map[string]map[string]bool)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		session := r.Header.Get("X-Session")
+		if connections[session] == nil {
+			connections[session] = make(map[string]bool)
+		}
+		connections[session][r.RemoteAddr] = true
+		mu.Unlock()
+
+		wg.Done()
+	}))
+	defer server.Close()
+
+	input := NewTestInput()
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMax: 4, queueLen: 100, stickyHeader: "X-Session", stickyRoundRobin: true})
+
+	plugins := &InOutPlugins{
+		Inputs:  []io.Reader{input},
+		Outputs: []io.Writer{output},
+	}
+
+	go Start(plugins, quit)
+
+	for i := 0; i < 30; i++ {
+		wg.Add(2)
+		input.EmitBytes([]byte("GET / HTTP/1.1\r\nX-Session: " + string('a'+byte(i%3)) + "\r\n\r\n"))
+		input.EmitGET()
+	}
+
+	wg.Wait()
+	close(quit)
+
+	for session, conns := range connections {
+		if session != "" && len(conns) != 1 {
+			t.Errorf("Session %q should use single connection, got %d", session, len(conns))
+		}
+	}
+
+	if len(connections[""]) != 4 {
+		t.Error("Requests without session should be spread across all workers:", len(connections[""]))
+	}
+}
+
+func TestHTTPOutputStickyFallbackWorker(t *testing.T) {
+	o := &HTTPOutput{config: &HTTPOutputConfig{stickyHeader: "X-Session", stickyFallbackWorker: 2}, stickyQueues: make([]chan []byte, 4)}
+
+	for i := 0; i < 10; i++ {
+		if idx := o.stickyIndex(getTestBytes()); idx != 2 {
+			t.Error("Requests without session should go to fallback worker, got:", idx)
+		}
+	}
+}
+
+func TestHTTPOutputRetry(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Each request fails twice
+		if atomic.AddInt32(&attempts, 1)%3 != 0 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		retries  int
+		attempts int32
+		status   string
+	}{
+		{3, 3, "200"},
+		{1, 2, "503"},
+	} {
+		atomic.StoreInt32(&attempts, 0)
+
+		output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMax: 1, TrackResponses: true, retryCount: tc.retries, retryCodes: "502, 503", retryDelay: time.Millisecond}).(*HTTPOutput)
+		output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+
+		data := make([]byte, 1024)
+		n, _ := output.Read(data)
+
+		if status := string(proto.Status(payloadBody(data[:n]))); status != tc.status {
+			t.Error("Wrong tracked status", status, "expected", tc.status)
+		}
+
+		if got := atomic.LoadInt32(&attempts); got != tc.attempts {
+			t.Error("Wrong number of attempts", got, "expected", tc.attempts)
+		}
+	}
+}
+
+func TestHTTPOutputReplayTiming(t *testing.T) {
+	var mu sync.Mutex
+	var received []time.Time
+
+	wg := new(sync.WaitGroup)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, time.Now())
+		mu.Unlock()
+		wg.Done()
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMin: 1, workersMax: 10, queueLen: 10, replayTiming: true, replaySpeed: 4})
+
+	// Captured with 200ms interval, replayed 4 times as fast
+	captured := time.Now().UnixNano()
+	start := time.Now()
+	wg.Add(3)
+	for i := int64(0); i < 3; i++ {
+		output.Write(append(payloadHeader(RequestPayload, uuid(), captured+i*int64(200*time.Millisecond), -1), []byte("GET / HTTP/1.1\r\n\r\n")...))
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Error("Write should not wait for replay time, elapsed:", elapsed)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if elapsed := received[2].Sub(start); elapsed < 100*time.Millisecond || elapsed >= 400*time.Millisecond {
+		t.Error("Requests should be sent with captured intervals, scaled by speed, elapsed:", elapsed)
+	}
+}
+
+func TestHTTPOutputMutualTLS(t *testing.T) {
+	serverCert, serverKey := genCertificate(&x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}})
+	clientCert, clientKey := genCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "gor"}})
+
+	writeTemp := func(data []byte) string {
+		f, _ := ioutil.TempFile("", "tls")
+		f.Write(data)
+		f.Close()
+		return f.Name()
+	}
+	certFile, keyFile, caFile := writeTemp(clientCert), writeTemp(clientKey), writeTemp(serverCert)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	defer os.Remove(caFile)
+
+	pair, _ := tls.X509KeyPair(serverCert, serverKey)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{pair}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	send := func(config *tls.Config) []byte {
+		client := NewHTTPClient(server.URL, &HTTPClientConfig{TLSConfig: config})
+		resp, _ := client.Send([]byte("GET / HTTP/1.1\r\n\r\n"))
+		return resp
+	}
+
+	config, err := loadClientTLSConfig(certFile, keyFile, caFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := send(config); !bytes.HasSuffix(resp, []byte("\r\n\r\ngor")) {
+		t.Errorf("Should authenticate with client certificate: %q", resp)
+	}
+
+	// Server requires client certificate
+	if resp := send(nil); bytes.HasPrefix(resp, []byte("HTTP/1.1 200")) {
+		t.Errorf("Should fail without client certificate: %q", resp)
+	}
+
+	// Server certificate is not signed by system roots
+	config, _ = loadClientTLSConfig(certFile, keyFile, "", true)
+	if resp := send(config); bytes.HasPrefix(resp, []byte("HTTP/1.1 200")) {
+		t.Errorf("Should fail verification of server certificate: %q", resp)
+	}
+
+	if _, err := loadClientTLSConfig(certFile, "", "", false); err == nil {
+		t.Error("Certificate without key should not be accepted")
+	}
+}
+
+func TestHTTPOutputCloseDrainsQueue(t *testing.T) {
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(&received, 1)
+	}))
+	defer server.Close()
+
+	Settings.shutdownTimeout = 5 * time.Second
+	defer func() { Settings.shutdownTimeout = 0 }()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMin: 1, workersMax: 1}).(*HTTPOutput)
+
+	for i := 0; i < 5; i++ {
+		output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+	if output.QueueLen() == 0 {
+		t.Error("Requests should be queued")
+	}
+
+	output.Close()
+
+	if n := atomic.LoadInt64(&received); n != 5 || output.QueueLen() != 0 {
+		t.Error("Close should wait until queued requests are sent, received:", n)
+	}
+}
+
+func TestHTTPOutputConnPool(t *testing.T) {
+	var mu sync.Mutex
+	connections := make(map[string]bool)
+	var inFlight, maxInFlight int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		mu.Lock()
+		connections[r.RemoteAddr] = true
+		if n > maxInFlight {
+			maxInFlight = n
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{workersMin: 8, workersMax: 8, queueLen: 100, connPoolSize: 2}).(*HTTPOutput)
+
+	for i := 0; i < 40; i++ {
+		output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+	}
+
+	Settings.shutdownTimeout = 5 * time.Second
+	defer func() { Settings.shutdownTimeout = 0 }()
+	output.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(connections) != 2 {
+		t.Error("Workers should share 2 connections, got:", len(connections))
+	}
+	if maxInFlight > 2 {
+		t.Error("At most 2 requests should be sent at once, got:", maxInFlight)
+	}
+}
+
+// logLines passes log lines to channel, lines are dropped if nobody reads them
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	select {
+	case l <- string(p):
+	default:
+	}
+
+	return len(p), nil
+}
+
+func TestHTTPOutputErrorLog(t *testing.T) {
+	// Connection to closed listener is refused
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := "http://" + listener.Addr().String()
+	listener.Close()
+
+	lines := make(logLines, 100)
+	log.SetOutput(lines)
+	defer log.SetOutput(os.Stderr)
+
+	output := NewHTTPOutput(address, &HTTPOutputConfig{}).(*HTTPOutput)
+	defer output.Close()
+
+	output.Write([]byte("1 2fa4e9 1\nGET / HTTP/1.1\r\n\r\n"))
+
+	connectionErrorLogged := false
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, "Connection error") {
+				if !strings.Contains(line, "2fa4e9") {
+					t.Error("Connection error should identify request:", line)
+				}
+				connectionErrorLogged = true
+			}
+
+			if !strings.Contains(line, "Error when sending") {
+				continue
+			}
+
+			if !connectionErrorLogged {
+				t.Error("Connection error should be logged")
+			}
+
+			if !strings.Contains(line, "2fa4e9") || !strings.Contains(line, address) {
+				t.Error("Error should identify request and target:", line)
+			}
+			return
+		case <-timeout:
+			t.Fatal("Error should be logged")
+		}
+	}
+}
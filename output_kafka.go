@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buger/goreplay/proto"
@@ -17,13 +18,32 @@ import (
 type KafkaOutput struct {
 	config   *KafkaConfig
 	producer sarama.AsyncProducer
+
+	mu sync.Mutex
+	// Request ID -> header key, so responses go to the same partition as requests
+	keys map[string]string
+	// Request ID -> request of --output-kafka-json-schema, waiting for its response
+	pending map[string]*kafkaRecord
+
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // KafkaOutputFrequency in milliseconds
 const KafkaOutputFrequency = 500
 
+// Header keys of requests which responses were not seen are forgotten after this limit
+const kafkaMaxPendingKeys = 10000
+
+// Requests of --output-kafka-json-schema which responses were not seen are sent without them after this time
+const kafkaPendingTimeout = 10 * time.Second
+
 // NewKafkaOutput creates instance of kafka producer client.
 func NewKafkaOutput(address string, config *KafkaConfig) io.Writer {
+	if config.jsonSchema && config.useJSON {
+		log.Fatal("output-kafka-json-schema: can't be used with --output-kafka-json-format")
+	}
+
 	c := sarama.NewConfig()
 
 	var producer sarama.AsyncProducer
@@ -35,6 +55,10 @@ func NewKafkaOutput(address string, config *KafkaConfig) io.Writer {
 		c.Producer.Compression = sarama.CompressionSnappy
 		c.Producer.Flush.Frequency = KafkaOutputFrequency * time.Millisecond
 
+		if err := config.auth.apply(c); err != nil {
+			log.Fatalln("Failed to configure Sarama(Kafka) producer:", err)
+		}
+
 		brokerList := strings.Split(config.host, ",")
 
 		var err error
@@ -47,6 +71,17 @@ func NewKafkaOutput(address string, config *KafkaConfig) io.Writer {
 	o := &KafkaOutput{
 		config:   config,
 		producer: producer,
+		keys:     make(map[string]string),
+		pending:  make(map[string]*kafkaRecord),
+		stop:     make(chan struct{}),
+	}
+
+	if config.pendingTimeout == 0 {
+		config.pendingTimeout = kafkaPendingTimeout
+	}
+
+	if config.jsonSchema {
+		go o.expirePending()
 	}
 
 	if Settings.verbose {
@@ -65,37 +100,171 @@ func (o *KafkaOutput) ErrorHandler() {
 }
 
 func (o *KafkaOutput) Write(data []byte) (n int, err error) {
+	if o.config.jsonSchema {
+		o.writeRecord(data)
+		return len(data), nil
+	}
+
 	var message sarama.StringEncoder
 
 	if !o.config.useJSON {
 		message = sarama.StringEncoder(data)
 	} else {
-		headers := make(map[string]string)
-		proto.ParseHeaders([][]byte{data}, func(header []byte, value []byte) bool {
-			headers[string(header)] = string(value)
-			return true
-		})
-
-		meta := payloadMeta(data)
-		req := payloadBody(data)
-
-		kafkaMessage := KafkaMessage{
-			ReqURL:     string(proto.Path(req)),
-			ReqType:    string(meta[0]),
-			ReqID:      string(meta[1]),
-			ReqTs:      string(meta[2]),
-			ReqMethod:  string(proto.Method(req)),
-			ReqBody:    string(proto.Body(req)),
-			ReqHeaders: headers,
-		}
-		jsonMessage, _ := json.Marshal(&kafkaMessage)
+		jsonMessage, _ := json.Marshal(newKafkaMessage(data))
 		message = sarama.StringEncoder(jsonMessage)
 	}
 
-	o.producer.Input() <- &sarama.ProducerMessage{
+	msg := &sarama.ProducerMessage{
 		Topic: o.config.topic,
 		Value: message,
 	}
 
+	// Messages without key are spread across partitions
+	if key := o.messageKey(data); key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+
+	o.producer.Input() <- msg
+
 	return len(message), nil
 }
+
+// messageKey returns request ID, or value of header. Responses have no request headers,
+// so header value of request is remembered until its response.
+func (o *KafkaOutput) messageKey(data []byte) string {
+	if o.config.key == "" {
+		return ""
+	}
+
+	meta := payloadMeta(data)
+	if len(meta) < 2 {
+		return ""
+	}
+	id := string(meta[1])
+
+	if o.config.key == "uuid" {
+		return id
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !isRequestPayload(data) {
+		key := o.keys[id]
+		delete(o.keys, id)
+		return key
+	}
+
+	key := string(proto.Header(payloadBody(data), []byte(o.config.key)))
+	if key != "" {
+		if len(o.keys) >= kafkaMaxPendingKeys {
+			o.keys = make(map[string]string)
+		}
+		o.keys[id] = key
+	}
+
+	return key
+}
+
+// writeRecord sends request as kafkaRecord. If responses are tracked, request is sent together with
+// its original response, replayed responses are skipped. Requests without response are sent when
+// they expire, or when output is closed.
+func (o *KafkaOutput) writeRecord(data []byte) {
+	if len(payloadMeta(data)) < 3 || data[0] == ReplayedResponsePayload {
+		return
+	}
+
+	// Called for responses too, to forget header key of the request
+	key := o.messageKey(data)
+	id := string(payloadMeta(data)[1])
+
+	if isRequestPayload(data) {
+		record := newKafkaRecord(data)
+		record.key = key
+
+		if !o.config.trackResponses {
+			o.sendRecord(record)
+			return
+		}
+
+		record.seen = time.Now()
+
+		o.mu.Lock()
+		o.pending[id] = record
+		o.mu.Unlock()
+
+		return
+	}
+
+	o.mu.Lock()
+	record := o.pending[id]
+	delete(o.pending, id)
+	o.mu.Unlock()
+
+	// Request was already sent, or was not seen
+	if record == nil {
+		return
+	}
+
+	record.setResponse(data)
+	o.sendRecord(record)
+}
+
+// expirePending periodically sends requests which responses were not seen in time
+func (o *KafkaOutput) expirePending() {
+	ticker := time.NewTicker(o.config.pendingTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			o.sendPending(o.config.pendingTimeout)
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+// sendPending sends without response requests which wait for it at least maxAge
+func (o *KafkaOutput) sendPending(maxAge time.Duration) {
+	var expired []*kafkaRecord
+
+	o.mu.Lock()
+	for id, record := range o.pending {
+		if time.Since(record.seen) >= maxAge {
+			expired = append(expired, record)
+			delete(o.pending, id)
+		}
+	}
+	o.mu.Unlock()
+
+	for _, record := range expired {
+		o.sendRecord(record)
+	}
+}
+
+// Close sends pending requests and waits until producer flushes buffered messages
+func (o *KafkaOutput) Close() (err error) {
+	o.closeOnce.Do(func() {
+		close(o.stop)
+		o.sendPending(0)
+		err = o.producer.Close()
+	})
+
+	return err
+}
+
+func (o *KafkaOutput) sendRecord(record *kafkaRecord) {
+	message, _ := json.Marshal(record)
+
+	msg := &sarama.ProducerMessage{
+		Topic: o.config.topic,
+		Value: sarama.ByteEncoder(message),
+	}
+
+	if record.key != "" {
+		msg.Key = sarama.StringEncoder(record.key)
+	}
+
+	o.producer.Input() <- msg
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/Shopify/sarama/mocks"
@@ -52,3 +55,156 @@ func TestOutputKafkaJSON(t *testing.T) {
 		t.Error("Message not properly encoded: ", string(data))
 	}
 }
+
+func TestKafkaAuthConfig(t *testing.T) {
+	c := sarama.NewConfig()
+	auth := &KafkaAuthConfig{saslUsername: "gor", saslPassword: "secret", saslMechanism: "plain", useTLS: true}
+
+	if err := auth.apply(c); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Net.SASL.Enable || c.Net.SASL.User != "gor" || c.Net.SASL.Password != "secret" {
+		t.Error("SASL should be enabled")
+	}
+	if !c.Net.TLS.Enable || c.Net.TLS.Config.InsecureSkipVerify {
+		t.Error("TLS should be enabled with verification")
+	}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	auth.saslMechanism = "SCRAM-SHA-256"
+	if err := auth.apply(sarama.NewConfig()); err == nil {
+		t.Error("Should not accept unsupported mechanism")
+	}
+
+	c = sarama.NewConfig()
+	if err := (*KafkaAuthConfig)(nil).apply(c); err != nil || c.Net.SASL.Enable || c.Net.TLS.Enable {
+		t.Error("Should keep config without authentication")
+	}
+}
+
+func TestOutputKafkaKey(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+
+	keys := func(key string, payloads ...string) (result []string) {
+		producer := mocks.NewAsyncProducer(t, config)
+		output := NewKafkaOutput("", &KafkaConfig{producer: producer, topic: "test", key: key})
+
+		for _, p := range payloads {
+			producer.ExpectInputAndSucceed()
+			output.Write([]byte(p))
+
+			msg := <-producer.Successes()
+			if msg.Key == nil {
+				result = append(result, "")
+				continue
+			}
+			k, _ := msg.Key.Encode()
+			result = append(result, string(k))
+		}
+		return
+	}
+
+	req := "1 abc 1\nGET / HTTP/1.1\r\nX-Session: s1\r\n\r\n"
+	resp := "2 abc 1 1\nHTTP/1.1 200 OK\r\n\r\n"
+	other := "1 def 1\nGET / HTTP/1.1\r\n\r\n"
+
+	if k := keys("", req, resp); k[0] != "" || k[1] != "" {
+		t.Error("Messages should have no key by default", k)
+	}
+	if k := keys("uuid", req, resp); k[0] != "abc" || k[1] != "abc" {
+		t.Error("Request ID should be used as key", k)
+	}
+	if k := keys("X-Session", req, resp, other); k[0] != "s1" || k[1] != "s1" || k[2] != "" {
+		t.Error("Response should get header of its request", k)
+	}
+}
+
+func TestOutputKafkaJSONSchema(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndSucceed()
+
+	output := NewKafkaOutput("", &KafkaConfig{
+		producer:       producer,
+		topic:          "test",
+		jsonSchema:     true,
+		trackResponses: true,
+		key:            "X-Session",
+	})
+
+	// Request is sent with its original response, replayed one is skipped
+	output.Write([]byte("1 2 3\nPOST /users HTTP/1.1\r\nX-Session: a\r\nContent-Length: 2\r\n\r\n{}"))
+	output.Write([]byte("3 2 3 1000000\nHTTP/1.1 500 Internal Server Error\r\n\r\n"))
+	output.Write([]byte("2 2 3 1500000\nHTTP/1.1 201 Created\r\nContent-Length: 4\r\n\r\nok:1"))
+
+	resp := <-producer.Successes()
+	data, _ := resp.Value.Encode()
+	key, _ := resp.Key.Encode()
+
+	expected := `{"uuid":"2","timestamp":3,"method":"POST","url":"/users","headers":{"Content-Length":"2","X-Session":"a"},"body":"{}","status":201,"response_body":"ok:1","latency_ms":1.5}`
+	if string(data) != expected {
+		t.Error("Message not properly encoded: ", string(data))
+	}
+	if string(key) != "a" {
+		t.Error("Message should have key of request:", string(key))
+	}
+
+	// Without tracked responses request is sent right away
+	output.(*KafkaOutput).config.trackResponses = false
+	output.Write([]byte("1 4 5\nGET / HTTP/1.1\r\n\r\n"))
+
+	resp = <-producer.Successes()
+	data, _ = resp.Value.Encode()
+
+	if string(data) != `{"uuid":"4","timestamp":5,"method":"GET","url":"/","headers":{},"body":""}` {
+		t.Error("Message not properly encoded: ", string(data))
+	}
+
+	producer.Close()
+}
+
+func TestOutputKafkaJSONSchemaPending(t *testing.T) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndSucceed()
+
+	output := NewKafkaOutput("", &KafkaConfig{
+		producer:       producer,
+		topic:          "test",
+		jsonSchema:     true,
+		trackResponses: true,
+		pendingTimeout: 50 * time.Millisecond,
+	})
+
+	// Request without response is sent when it expires
+	output.Write([]byte("1 a 1\nGET /a HTTP/1.1\r\n\r\n"))
+
+	select {
+	case resp := <-producer.Successes():
+		if data, _ := resp.Value.Encode(); !strings.Contains(string(data), `"url":"/a"`) || strings.Contains(string(data), "status") {
+			t.Error("Expired request should be sent without response:", string(data))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expired request should be sent")
+	}
+
+	output.(io.Closer).Close()
+
+	// Pending requests are sent on close
+	producer = mocks.NewAsyncProducer(t, config)
+	producer.ExpectInputAndSucceed()
+	output = NewKafkaOutput("", &KafkaConfig{producer: producer, topic: "test", jsonSchema: true, trackResponses: true})
+	output.Write([]byte("1 b 1\nGET /b HTTP/1.1\r\n\r\n"))
+	output.(io.Closer).Close()
+
+	resp := <-producer.Successes()
+	if data, _ := resp.Value.Encode(); !strings.Contains(string(data), `"url":"/b"`) {
+		t.Error("Pending request should be sent on close:", string(data))
+	}
+}
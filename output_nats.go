@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+)
+
+// NATSOutput publishes payloads to NATS subject, in Gor format or in JSON format of Kafka output
+type NATSOutput struct {
+	config *NATSConfig
+
+	mu   sync.Mutex
+	conn *natsConn
+}
+
+// NewNATSOutput constructor for NATSOutput, server URL is taken from config, like in Kafka output
+func NewNATSOutput(address string, config *NATSConfig) io.Writer {
+	if config.subject == "" {
+		log.Fatal("output-nats-subject: subject is required")
+	}
+
+	return &NATSOutput{config: config}
+}
+
+func (o *NATSOutput) connect() (err error) {
+	if o.conn != nil {
+		return nil
+	}
+
+	if o.conn, err = natsDial(o.config.url); err != nil {
+		return
+	}
+
+	// Answer server pings, and detect closed connection
+	go func(conn *natsConn) {
+		for {
+			if _, err := conn.ReadMessage(); err != nil {
+				conn.Close()
+
+				o.mu.Lock()
+				if o.conn == conn {
+					o.conn = nil
+				}
+				o.mu.Unlock()
+
+				return
+			}
+		}
+	}(o.conn)
+
+	return nil
+}
+
+func (o *NATSOutput) Write(data []byte) (n int, err error) {
+	message := data
+	if o.config.useJSON {
+		message, _ = json.Marshal(newKafkaMessage(data))
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Retry once with new connection, if server closed the old one
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = o.connect(); err != nil {
+			break
+		}
+
+		if err = o.conn.Publish(o.config.subject, message); err == nil {
+			return len(data), nil
+		}
+
+		o.conn.Close()
+		o.conn = nil
+	}
+
+	// Do not stop replay because of server errors
+	log.Println("[OUTPUT-NATS] Failed to publish message:", err)
+
+	return len(data), nil
+}
+
+func (o *NATSOutput) String() string {
+	return "NATS output: " + o.config.url + "/" + o.config.subject
+}
+
+// Close disconnects from the server
+func (o *NATSOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reconnection delay of Redis output doubles after each failed attempt, up to the limit
+const (
+	redisReconnectBase = time.Second
+	redisReconnectMax  = 30 * time.Second
+)
+
+// RedisConfig holds options of Redis Streams output
+type RedisConfig struct {
+	// host:port or redis://:password@host:port/db URL
+	host    string
+	stream  string
+	useJSON bool
+	// Approximate limit of stream length, 0 means unlimited
+	maxLen int
+}
+
+// RedisOutput adds each payload to Redis stream with XADD, as `payload` field of the entry.
+// Payloads are in Gor format, or in JSON format of Kafka output.
+type RedisOutput struct {
+	config    *RedisConfig
+	queue     chan []byte
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// redisError is error reply of the server, it is not fixed by reconnection
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// NewRedisOutput constructor for RedisOutput, server address is taken from config, like in Kafka output
+func NewRedisOutput(address string, config *RedisConfig) io.Writer {
+	if config.stream == "" {
+		log.Fatal("output-redis-stream: stream is required")
+	}
+
+	o := &RedisOutput{
+		config: config,
+		queue:  make(chan []byte, 1000),
+		stop:   make(chan struct{}),
+	}
+
+	go o.worker()
+
+	return o
+}
+
+func (o *RedisOutput) Write(data []byte) (n int, err error) {
+	var message []byte
+
+	if o.config.useJSON {
+		message, _ = json.Marshal(newKafkaMessage(data))
+	} else {
+		// Input buffer is reused, and entry is sent by worker
+		message = append([]byte(nil), data...)
+	}
+
+	select {
+	case o.queue <- message:
+	case <-o.stop:
+	}
+
+	return len(data), nil
+}
+
+func (o *RedisOutput) worker() {
+	var conn *redisConn
+	retries := 0
+
+	for {
+		var message []byte
+		select {
+		case message = <-o.queue:
+		case <-o.stop:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+
+		// The same entry is sent again after reconnection
+		for {
+			if conn == nil {
+				var err error
+				if conn, err = redisDial(o.config.host); err != nil {
+					retries++
+					delay := reconnectDelay(redisReconnectBase, redisReconnectMax, retries)
+					log.Println("[OUTPUT-REDIS] Can't connect to", o.config.host+":", err, "reconnecting in", delay)
+
+					select {
+					case <-time.After(delay):
+						continue
+					case <-o.stop:
+						return
+					}
+				}
+				retries = 0
+			}
+
+			err := conn.Do(o.xaddArgs(message)...)
+			if err == nil {
+				break
+			}
+
+			if _, ok := err.(redisError); ok {
+				log.Println("[OUTPUT-REDIS] XADD failed:", err)
+				break
+			}
+
+			log.Println("[OUTPUT-REDIS] Connection closed, reconnecting:", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (o *RedisOutput) xaddArgs(message []byte) []string {
+	args := []string{"XADD", o.config.stream}
+	if o.config.maxLen > 0 {
+		args = append(args, "MAXLEN", "~", strconv.Itoa(o.config.maxLen))
+	}
+
+	return append(args, "*", "payload", string(message))
+}
+
+// Close stops worker, queued entries are dropped. It is safe to call it more than once.
+func (o *RedisOutput) Close() error {
+	o.closeOnce.Do(func() {
+		close(o.stop)
+	})
+	return nil
+}
+
+func (o *RedisOutput) String() string {
+	return "Redis output: " + o.config.host + "/" + o.config.stream
+}
+
+// redisConn is connection to Redis server, which sends commands one by one and waits for their replies
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisDial connects to host:port or redis:// URL, authenticating and selecting database if URL has them
+func redisDial(address string) (*redisConn, error) {
+	host := address
+	var password, db string
+
+	if strings.HasPrefix(address, "redis://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		host = u.Host
+		if u.User != nil {
+			password, _ = u.User.Password()
+		}
+		db = strings.TrimPrefix(u.Path, "/")
+	}
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "6379")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if password != "" {
+		if err := c.Do("AUTH", password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if db != "" {
+		if err := c.Do("SELECT", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Do sends command and reads its reply, which content is not used
+func (c *redisConn) Do(args ...string) error {
+	var buf []byte
+	buf = append(buf, fmt.Sprintf("*%d\r\n", len(args))...)
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(arg))...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(buf); err != nil {
+		return err
+	}
+
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() error {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	if len(line) == 0 {
+		return errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '-':
+		return redisError(line[1:])
+	case '+', ':':
+		return nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		if size < 0 {
+			return nil
+		}
+		_, err = io.CopyN(ioutil.Discard, c.reader, int64(size)+2)
+		return err
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			if err := c.readReply(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return errors.New("unexpected reply: " + line)
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
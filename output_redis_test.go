@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readRedisCommand reads command sent by client as array of bulk strings
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	args := make([]string, count)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func TestRedisOutput(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	wg := new(sync.WaitGroup)
+	var mu sync.Mutex
+	var commands []string
+
+	go func() {
+		for connections := 0; ; connections++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn, first bool) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readRedisCommand(r)
+					if err != nil {
+						return
+					}
+
+					// The first connection is dropped without reply, so entry is sent again
+					if first {
+						return
+					}
+
+					mu.Lock()
+					commands = append(commands, strings.Join(args, " "))
+					mu.Unlock()
+
+					switch args[0] {
+					case "AUTH", "SELECT":
+						conn.Write([]byte("+OK\r\n"))
+					default:
+						conn.Write([]byte("$15\r\n1526919030474-0\r\n"))
+						wg.Done()
+					}
+				}
+			}(conn, connections == 0)
+		}
+	}()
+
+	output := NewRedisOutput("", &RedisConfig{host: "redis://:secret@" + listener.Addr().String() + "/2", stream: "gor", maxLen: 1000})
+
+	wg.Add(2)
+	output.Write([]byte("1 1 1\nGET / HTTP/1.1\r\n\r\n"))
+	output.Write([]byte("2 1 1\nHTTP/1.1 200 OK\r\n\r\n"))
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Entries were not added")
+	}
+	output.(*RedisOutput).Close()
+	// Plugins can be closed more than once on shutdown
+	output.(*RedisOutput).Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expected := []string{
+		"AUTH secret",
+		"SELECT 2",
+		"XADD gor MAXLEN ~ 1000 * payload 1 1 1\nGET / HTTP/1.1\r\n\r\n",
+		"XADD gor MAXLEN ~ 1000 * payload 2 1 1\nHTTP/1.1 200 OK\r\n\r\n",
+	}
+	if strings.Join(commands, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected commands %q, got %q", expected, commands)
+	}
+}
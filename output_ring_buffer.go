@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type ringBufferEntry struct {
+	data []byte
+	time time.Time
+}
+
+// RingBufferOutput is a "flight recorder" wrapper for output plugin: it keeps the most recent payloads in memory,
+// limited by total size and age, and writes them to the output only when dump is triggered.
+type RingBufferOutput struct {
+	plugin  io.Writer
+	size    int64
+	maxAge  time.Duration
+	entries []ringBufferEntry
+	used    int64
+	evicted int
+
+	mu sync.Mutex
+	// Serializes dumps, so payloads of two dumps are not mixed
+	dumpMu sync.Mutex
+}
+
+// NewRingBufferOutput constructor for RingBufferOutput, `maxAge` of 0 means that payloads are limited only by size
+func NewRingBufferOutput(plugin io.Writer, size int64, maxAge time.Duration) *RingBufferOutput {
+	o := &RingBufferOutput{plugin: plugin, size: size, maxAge: maxAge}
+	registerRingBuffer(o)
+
+	return o
+}
+
+func (o *RingBufferOutput) Write(data []byte) (int, error) {
+	// Payload which does not fit into the whole buffer is never kept
+	if int64(len(data)) > o.size {
+		return len(data), nil
+	}
+
+	now := time.Now()
+
+	o.mu.Lock()
+	// Emitter re-uses its buffer
+	o.entries = append(o.entries, ringBufferEntry{append([]byte(nil), data...), now})
+	o.used += int64(len(data))
+	o.evict(now)
+	o.mu.Unlock()
+
+	return len(data), nil
+}
+
+// evict removes the oldest payloads exceeding size or age limits
+func (o *RingBufferOutput) evict(now time.Time) {
+	n := 0
+	for n < len(o.entries) {
+		e := o.entries[n]
+		if o.used <= o.size && (o.maxAge == 0 || now.Sub(e.time) <= o.maxAge) {
+			break
+		}
+		o.used -= int64(len(e.data))
+		n++
+	}
+
+	if n > 0 {
+		// Do not keep references to evicted payloads
+		for i := 0; i < n; i++ {
+			o.entries[i] = ringBufferEntry{}
+		}
+		o.entries = o.entries[n:]
+		o.evicted += n
+	}
+}
+
+// Dump writes buffered payloads to the output, and starts recording from scratch.
+// New payloads are recorded while dump is in progress.
+func (o *RingBufferOutput) Dump() (count int, err error) {
+	o.dumpMu.Lock()
+	defer o.dumpMu.Unlock()
+
+	o.mu.Lock()
+	o.evict(time.Now())
+	entries := o.entries
+	o.entries = nil
+	o.used = 0
+	o.mu.Unlock()
+
+	for _, e := range entries {
+		if _, err = o.plugin.Write(e.data); err != nil {
+			break
+		}
+		count++
+	}
+
+	log.Println("Ring buffer dumped to", o.plugin, "payloads:", count)
+
+	return
+}
+
+type ringBufferStatus struct {
+	Output   string `json:"output"`
+	Buffered int    `json:"buffered"`
+	Bytes    int64  `json:"bytes"`
+	Evicted  int    `json:"evicted"`
+	Dumped   int    `json:"dumped,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (o *RingBufferOutput) status() ringBufferStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return ringBufferStatus{
+		Output:   fmt.Sprint(o.plugin),
+		Buffered: len(o.entries),
+		Bytes:    o.used,
+		Evicted:  o.evicted,
+	}
+}
+
+func (o *RingBufferOutput) String() string {
+	return fmt.Sprint(o.plugin)
+}
+
+// Close closes wrapped output, buffered payloads which were not dumped are dropped
+func (o *RingBufferOutput) Close() error {
+	if c, ok := o.plugin.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+var ringBuffersMu sync.Mutex
+var ringBuffers []*RingBufferOutput
+
+func registerRingBuffer(o *RingBufferOutput) {
+	ringBuffersMu.Lock()
+	ringBuffers = append(ringBuffers, o)
+	ringBuffersMu.Unlock()
+}
+
+// dumpRingBuffers triggers dump of all ring buffers
+func dumpRingBuffers() (statuses []ringBufferStatus) {
+	ringBuffersMu.Lock()
+	buffers := append([]*RingBufferOutput(nil), ringBuffers...)
+	ringBuffersMu.Unlock()
+
+	for _, o := range buffers {
+		count, err := o.Dump()
+		s := o.status()
+		s.Dumped = count
+		if err != nil {
+			log.Println("Error while dumping ring buffer:", err)
+			s.Error = err.Error()
+		}
+		statuses = append(statuses, s)
+	}
+
+	return
+}
+
+// ringBufferHandler serves admin API for ring buffers:
+//
+//	GET  /ring-buffer      - state of ring buffers
+//	POST /ring-buffer/dump - write buffered payloads to outputs
+func ringBufferHandler(w http.ResponseWriter, r *http.Request) {
+	var statuses []ringBufferStatus
+
+	switch r.URL.Path {
+	case "/ring-buffer":
+		ringBuffersMu.Lock()
+		for _, o := range ringBuffers {
+			statuses = append(statuses, o.status())
+		}
+		ringBuffersMu.Unlock()
+	case "/ring-buffer/dump":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		statuses = dumpRingBuffers()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
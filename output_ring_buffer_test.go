@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRingBufferOutput(t *testing.T) {
+	var written []string
+	out := NewTestOutput(func(data []byte) {
+		written = append(written, string(data))
+	})
+
+	o := NewRingBufferOutput(out, 10, 0)
+
+	data := []byte("00")
+	for i := 0; i < 10; i++ {
+		data[0], data[1] = '0', byte('0'+i)
+		o.Write(data)
+	}
+
+	// Does not fit into the buffer
+	o.Write([]byte("too long payload"))
+
+	if len(written) != 0 {
+		t.Fatal("Should not write before dump")
+	}
+
+	if count, err := o.Dump(); err != nil || count != 5 {
+		t.Fatal("Should dump 5 payloads", count, err)
+	}
+
+	expected := []string{"05", "06", "07", "08", "09"}
+	for i := range expected {
+		if i >= len(written) || written[i] != expected[i] {
+			t.Fatalf("Should keep the most recent payloads %q, got %q", expected, written)
+		}
+	}
+
+	if count, _ := o.Dump(); count != 0 {
+		t.Error("Buffer should be empty after dump", count)
+	}
+}
+
+func TestRingBufferOutputDuration(t *testing.T) {
+	var written []string
+	out := NewTestOutput(func(data []byte) {
+		written = append(written, string(data))
+	})
+
+	o := NewRingBufferOutput(out, 1024, 20*time.Millisecond)
+
+	o.Write([]byte("old"))
+	time.Sleep(30 * time.Millisecond)
+	o.Write([]byte("new"))
+
+	o.Dump()
+
+	if len(written) != 1 || written[0] != "new" {
+		t.Errorf("Should drop payloads older than duration: %q", written)
+	}
+}
+
+func TestRingBufferHandler(t *testing.T) {
+	dumped := 0
+	out := NewTestOutput(func(data []byte) {
+		dumped++
+	})
+
+	// Only this buffer should be dumped
+	ringBuffersMu.Lock()
+	ringBuffers = nil
+	ringBuffersMu.Unlock()
+
+	o := NewRingBufferOutput(out, 1024, 0)
+
+	for i := 0; i < 3; i++ {
+		o.Write([]byte(strconv.Itoa(i)))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(ringBufferHandler))
+	defer server.Close()
+
+	if resp, _ := http.Get(server.URL + "/ring-buffer/dump"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Dump should require POST", resp.StatusCode)
+	}
+
+	resp, err := http.Post(server.URL+"/ring-buffer/dump", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var statuses []ringBufferStatus
+	json.NewDecoder(resp.Body).Decode(&statuses)
+	resp.Body.Close()
+
+	if dumped != 3 || len(statuses) != 1 || statuses[0].Dumped != 3 || statuses[0].Buffered != 0 {
+		t.Errorf("Should dump buffered payloads: %d %+v", dumped, statuses)
+	}
+}
@@ -6,58 +6,115 @@ import (
 	"hash/fnv"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/buger/goreplay/metrics"
+	"github.com/buger/goreplay/proto"
 )
 
 // TCPOutput used for sending raw tcp payloads
 // Currently used for internal communication between listener and replay server
 // Can be used for transfering binary payloads like protocol buffers
 type TCPOutput struct {
+	// Keep this as first element of struct because it guarantees 64bit
+	// alignment for atomic operations on 32bit machines
+	stickyNext uint64
+
 	address  string
 	limit    int
 	buf      []chan []byte
 	bufStats *GorStat
 	config   *TCPOutputConfig
+
+	// Buffers of requests routed by session header, so their responses follow them
+	sessionsMu        sync.Mutex
+	sessions          map[string]tcpSession
+	sessionsLastClean time.Time
+}
+
+// tcpSession is buffer of request routed by session header, remembered until its response
+type tcpSession struct {
+	index int
+	seen  time.Time
 }
 
+// Requests which responses were not seen are forgotten after this time
+const tcpSessionTimeout = 10 * time.Second
+
 type TCPOutputConfig struct {
 	secure bool
 	sticky bool
+	// Requests with the same value of this header are sent over the same connection, in capture order
+	stickyHeader string
+	socket       SocketOptions
+	// Delay before the first reconnection attempt, it doubles after each failed attempt up to reconnectMax
+	reconnectBase time.Duration
+	reconnectMax  time.Duration
+	// "tcp" by default, or "unix" for Unix domain socket
+	network string
+	// Number of workers holding keep-alive connections, and of sticky buffers, one per worker
+	workers int
+	// Set on start if responses can be forwarded, so buffers of requests are remembered for them
+	trackResponses bool
 }
 
+const defaultTCPOutputWorkers = 10
+
 // NewTCPOutput constructor for TCPOutput
-// Initialize 10 workers which hold keep-alive connection
+// Initialize workers which hold keep-alive connection, 10 by default
 func NewTCPOutput(address string, config *TCPOutputConfig) io.Writer {
 	o := new(TCPOutput)
 
 	o.address = address
 	o.config = config
 
+	if o.config.network == "" {
+		o.config.network = "tcp"
+	}
+
+	if o.config.reconnectBase <= 0 {
+		o.config.reconnectBase = time.Second
+	}
+
+	if o.config.reconnectMax < o.config.reconnectBase {
+		o.config.reconnectMax = o.config.reconnectBase
+	}
+
 	if Settings.outputTCPStats {
 		o.bufStats = NewGorStat("output_tcp", 5000)
 	}
 
+	if o.config.stickyHeader != "" {
+		o.config.sticky = true
+		o.sessions = make(map[string]tcpSession)
+	}
+
 	if o.config.sticky {
-		// create 10 buffers and send the buffer index to the worker
-		o.buf = make([]chan []byte, 10)
-		for i := 0; i < 10; i++ {
+		// create buffer per worker and send the buffer index to the worker
+		o.buf = make([]chan []byte, o.workers())
+		for i := range o.buf {
 			o.buf[i] = make(chan []byte, 100)
-			go o.worker(i)
+			go o.worker(i, nil)
 		}
 	} else {
 		// create 1 buffer and send its index (0) to all workers
 		o.buf = make([]chan []byte, 1)
 		o.buf[0] = make(chan []byte, 1000)
-		for i := 0; i < 10; i++ {
-			go o.worker(0)
+		for i := 0; i < o.workers(); i++ {
+			go o.worker(0, nil)
 		}
 	}
 
 	return o
 }
 
-func (o *TCPOutput) worker(bufferIndex int) {
+// worker sends payloads of the buffer. Payload which failed to be sent is passed to the next worker as unsent,
+// and is sent first after reconnection, so payloads keep their order.
+func (o *TCPOutput) worker(bufferIndex int, unsent []byte) {
 	retries := 1
 	conn, err := o.connect(o.address)
 	for {
@@ -65,8 +122,9 @@ func (o *TCPOutput) worker(bufferIndex int) {
 			break
 		}
 
-		log.Println("Can't connect to aggregator instance, reconnecting in 1 second. Retries:", retries)
-		time.Sleep(1 * time.Second)
+		delay := o.reconnectDelay(retries)
+		log.Println("Can't connect to aggregator instance, reconnecting in", delay, "Retries:", retries)
+		time.Sleep(delay)
 
 		conn, err = o.connect(o.address)
 		retries++
@@ -79,27 +137,109 @@ func (o *TCPOutput) worker(bufferIndex int) {
 	defer conn.Close()
 
 	for {
-		data := <-o.buf[bufferIndex]
+		data := unsent
+		if data == nil {
+			data = <-o.buf[bufferIndex]
+		}
+		unsent = nil
+
+		o.reportMetrics()
 		conn.Write(data)
 		_, err := conn.Write([]byte(payloadSeparator))
 
 		if err != nil {
 			log.Println("INFO: TCP output connection closed, reconnecting")
-			o.buf[bufferIndex] <- data
-			go o.worker(bufferIndex)
+			go o.worker(bufferIndex, data)
 			break
 		}
 	}
 }
 
+func (o *TCPOutput) workers() int {
+	if o.config.workers > 0 {
+		return o.config.workers
+	}
+
+	return defaultTCPOutputWorkers
+}
+
+func (o *TCPOutput) reconnectDelay(retries int) time.Duration {
+	return reconnectDelay(o.config.reconnectBase, o.config.reconnectMax, retries)
+}
+
+// reconnectDelay grows exponentially with number of retries, and is randomized between half and full value,
+// so workers do not reconnect in lockstep when server restarts
+func reconnectDelay(base, max time.Duration, retries int) time.Duration {
+	delay := max
+	if retries < 32 {
+		if d := base << uint(retries-1); d > 0 && d < delay {
+			delay = d
+		}
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
 func (o *TCPOutput) getBufferIndex(data []byte) int {
 	if !o.config.sticky {
 		return 0
 	}
 
+	// Payloads without ID are spread evenly, instead of hashing empty value into the same buffer
+	meta := payloadMeta(data)
+	if len(meta) < 2 || len(meta[1]) == 0 {
+		return int(atomic.AddUint64(&o.stickyNext, 1) % uint64(o.workers()))
+	}
+
+	if o.config.stickyHeader != "" {
+		if index, ok := o.sessionIndex(data, meta[1]); ok {
+			return index
+		}
+	}
+
+	return o.bufferHash(meta[1])
+}
+
+// sessionIndex picks buffer of request by its session header, and buffer of response by its request
+func (o *TCPOutput) sessionIndex(data, id []byte) (int, bool) {
+	o.sessionsMu.Lock()
+	defer o.sessionsMu.Unlock()
+
+	if !isRequestPayload(data) {
+		s, ok := o.sessions[string(id)]
+		delete(o.sessions, string(id))
+		return s.index, ok
+	}
+
+	session := proto.Header(payloadBody(data), []byte(o.config.stickyHeader))
+	if len(session) == 0 {
+		return 0, false
+	}
+
+	index := o.bufferHash(session)
+	if !o.config.trackResponses {
+		return index, true
+	}
+
+	now := time.Now()
+	if now.Sub(o.sessionsLastClean) > tcpSessionTimeout {
+		for k, s := range o.sessions {
+			if now.Sub(s.seen) > tcpSessionTimeout {
+				delete(o.sessions, k)
+			}
+		}
+		o.sessionsLastClean = now
+	}
+
+	o.sessions[string(id)] = tcpSession{index, now}
+
+	return index, true
+}
+
+func (o *TCPOutput) bufferHash(key []byte) int {
 	hasher := fnv.New32a()
-	hasher.Write(payloadMeta(data)[1])
-	return int(hasher.Sum32()) % 10
+	hasher.Write(key)
+	return int(hasher.Sum32() % uint32(o.workers()))
 }
 
 func (o *TCPOutput) Write(data []byte) (n int, err error) {
@@ -117,20 +257,50 @@ func (o *TCPOutput) Write(data []byte) (n int, err error) {
 	if Settings.outputTCPStats {
 		o.bufStats.Write(len(o.buf[bufferIndex]))
 	}
+	o.reportMetrics()
 
 	return len(data), nil
 }
 
+// reportMetrics updates Prometheus gauge of buffered payloads
+func (o *TCPOutput) reportMetrics() {
+	buffered := 0
+	for _, b := range o.buf {
+		buffered += len(b)
+	}
+
+	metrics.SetTCPOutputBuffer(o.address, buffered)
+}
+
 func (o *TCPOutput) connect(address string) (conn net.Conn, err error) {
+	if conn, err = net.Dial(o.config.network, address); err != nil {
+		return
+	}
+
+	if err = o.config.socket.apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	if o.config.secure {
-		conn, err = tls.Dial("tcp", address, &tls.Config{})
-	} else {
-		conn, err = net.Dial("tcp", address)
+		host, _, _ := net.SplitHostPort(address)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
 	}
 
 	return
 }
 
 func (o *TCPOutput) String() string {
+	if o.config.network == "unix" {
+		return fmt.Sprintf("Unix output %s, limit: %d", o.address, o.limit)
+	}
+
 	return fmt.Sprintf("TCP output %s, limit: %d", o.address, o.limit)
 }
@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -132,3 +133,106 @@ func getTestBytes() []byte {
 	reqb := append(reqh, []byte("GET / HTTP/1.1\r\nHost: www.w3.org\r\nUser-Agent: Go 1.1 package http\r\nAccept-Encoding: gzip\r\n\r\n")...)
 	return reqb
 }
+
+func TestBufferDistributionWorkers(t *testing.T) {
+	buffer := make([]int, 64)
+	tcpOutput := TCPOutput{config: &TCPOutputConfig{sticky: true, workers: len(buffer)}}
+
+	for i := 0; i < 100000; i++ {
+		buffer[tcpOutput.getBufferIndex(getTestBytes())]++
+	}
+
+	for i := range buffer {
+		if buffer[i] == 0 {
+			t.Fatal("Payloads should be spread over all buffers:", buffer)
+		}
+	}
+
+	tcpOutput = TCPOutput{config: &TCPOutputConfig{sticky: true, workers: 3}}
+	for i := 0; i < 1000; i++ {
+		if index := tcpOutput.getBufferIndex(getTestBytes()); index >= 3 {
+			t.Fatal("Index should be less than number of workers:", index)
+		}
+	}
+}
+
+func TestBufferDistributionWithoutID(t *testing.T) {
+	buffer := make([]int, 10)
+	tcpOutput := TCPOutput{config: &TCPOutputConfig{sticky: true}}
+
+	for i := 0; i < 1000; i++ {
+		buffer[tcpOutput.getBufferIndex([]byte("1  1\nGET / HTTP/1.1\r\n\r\n"))]++
+	}
+
+	for i := range buffer {
+		if buffer[i] != 100 {
+			t.Error("Payloads without ID should be spread evenly:", buffer)
+			break
+		}
+	}
+}
+
+func TestTCPOutputReconnectDelay(t *testing.T) {
+	tcpOutput := TCPOutput{config: &TCPOutputConfig{reconnectBase: time.Second, reconnectMax: 30 * time.Second}}
+
+	for i, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second} {
+		retries := i + 1
+
+		for j := 0; j < 100; j++ {
+			if d := tcpOutput.reconnectDelay(retries); d < max/2 || d > max {
+				t.Fatal("Delay of retry", retries, "should be between", max/2, "and", max, "got", d)
+			}
+		}
+	}
+
+	if d := tcpOutput.reconnectDelay(100); d > 30*time.Second {
+		t.Error("Delay should be capped", d)
+	}
+}
+
+func TestTCPOutputStickyHeader(t *testing.T) {
+	tcpOutput := TCPOutput{config: &TCPOutputConfig{sticky: true, stickyHeader: "X-Session", trackResponses: true}, sessions: make(map[string]tcpSession)}
+
+	session := func(id, value string) []byte {
+		return []byte("1 " + id + " 1\nGET / HTTP/1.1\r\nX-Session: " + value + "\r\n\r\n")
+	}
+
+	first := tcpOutput.getBufferIndex(session("a1", "alice"))
+	for i := 0; i < 100; i++ {
+		if index := tcpOutput.getBufferIndex(session(string(uuid()), "alice")); index != first {
+			t.Fatal("Requests of the same session should go to the same buffer:", index, first)
+		}
+	}
+
+	// ID hashes to other buffer than session
+	id := "b0"
+	for i := 0; tcpOutput.bufferHash([]byte(id)) == first; i++ {
+		id = "b" + strconv.Itoa(i)
+	}
+
+	tcpOutput.getBufferIndex(session(id, "alice"))
+	if index := tcpOutput.getBufferIndex([]byte("2 " + id + " 1 1\nHTTP/1.1 200 OK\r\n\r\n")); index != first {
+		t.Error("Response should follow its request:", index, first)
+	}
+	if _, ok := tcpOutput.sessions[id]; ok {
+		t.Error("Request should be forgotten after its response")
+	}
+
+	// Requests without responses expire
+	tcpOutput.sessions["old"] = tcpSession{first, time.Now().Add(-2 * tcpSessionTimeout)}
+	tcpOutput.sessionsLastClean = time.Time{}
+	tcpOutput.getBufferIndex(session("c1", "alice"))
+	if _, ok := tcpOutput.sessions["old"]; ok {
+		t.Error("Expired request should be forgotten")
+	}
+
+	tcpOutput.config.trackResponses = false
+	tcpOutput.getBufferIndex(session("d1", "alice"))
+	if _, ok := tcpOutput.sessions["d1"]; ok {
+		t.Error("Requests should not be remembered if responses are not tracked")
+	}
+
+	if index := tcpOutput.getBufferIndex([]byte("1 " + id + " 1\nGET / HTTP/1.1\r\n\r\n")); index != tcpOutput.bufferHash([]byte(id)) {
+		t.Error("Request without session should be hashed by ID:", index)
+	}
+}
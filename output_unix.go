@@ -0,0 +1,16 @@
+package main
+
+import (
+	"io"
+)
+
+// NewUnixOutput constructor for TCPOutput writing to Unix domain socket, e.g. of co-located aggregator.
+// Payloads are framed, routed and reconnected the same way as by TCP output, with the same options.
+func NewUnixOutput(path string, config *TCPOutputConfig) io.Writer {
+	// Options are shared with TCP outputs, so they are copied. Local socket is not encrypted.
+	unixConfig := *config
+	unixConfig.network = "unix"
+	unixConfig.secure = false
+
+	return NewTCPOutput(path, &unixConfig)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+// Actions for input payloads, which are not in gor format, set by --input-format-mismatch
+const (
+	formatMismatchConvert = "convert"
+	formatMismatchSkip    = "skip"
+	formatMismatchError   = "error"
+)
+
+// convertPayloadFormat handles payload of input, which is not in gor format, according to --input-format-mismatch.
+// Payloads of known formats are converted, others are skipped: result is nil.
+// Known format is JSON of --output-kafka-json-format, e.g. when such topic is read without --input-kafka-json-format.
+func convertPayloadFormat(payload []byte, src io.Reader, action string, warned *bool) []byte {
+	preview := payload
+	if len(preview) > 100 {
+		preview = preview[:100]
+	}
+
+	if action == formatMismatchError {
+		log.Fatalf("input-format-mismatch: %v returned payload which is not in gor format: %q", src, preview)
+	}
+
+	if action == formatMismatchConvert {
+		if converted, ok := convertKafkaJSON(payload); ok {
+			return converted
+		}
+	}
+
+	// Logged once per input, to not flood the log
+	if !*warned {
+		*warned = true
+		log.Printf("[EMITTER] %v returned payload which is not in gor format, such payloads are skipped: %q", src, preview)
+	}
+
+	return nil
+}
+
+// convertKafkaJSON converts message written by --output-kafka-json-format to gor payload
+func convertKafkaJSON(payload []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		return nil, false
+	}
+
+	var message KafkaMessage
+	if err := json.Unmarshal(payload, &message); err != nil || message.ReqType == "" || message.ReqMethod == "" {
+		return nil, false
+	}
+
+	converted, err := message.Dump()
+	if err != nil || !isGorPayload(converted) {
+		return nil, false
+	}
+
+	return converted, true
+}
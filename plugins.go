@@ -1,10 +1,18 @@
 package main
 
 import (
+	"errors"
 	"io"
+	"log"
+	"net"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/buger/goreplay/metrics"
+	raw "github.com/buger/goreplay/raw_socket_listener"
 )
 
 // InOutPlugins struct for holding references to plugins
@@ -31,11 +39,102 @@ func extractLimitOptions(options string) (string, string) {
 	return split[0], ""
 }
 
+// extractOutputName detects if plugin get called with explicit name: `name=staging,http://staging.example`
+// Returns name and options without it
+func extractOutputName(options string) (string, string) {
+	if !strings.HasPrefix(options, "name=") {
+		return "", options
+	}
+
+	split := strings.SplitN(strings.TrimPrefix(options, "name="), ",", 2)
+	if len(split) == 1 {
+		return split[0], ""
+	}
+
+	return split[0], split[1]
+}
+
+// outputFlags are flags creating outputs, in order InitPlugins registers them
+var outputFlags = []string{
+	"output-dummy",
+	"output-stdout",
+	"output-null",
+	"output-tcp",
+	"output-unix",
+	"output-file",
+	"output-http",
+	"output-kafka-host",
+	"output-redis-host",
+	"output-nats-url",
+	"output-mqtt",
+}
+
+// registrationOrder reorders weights given in command line order of output flags
+// to order outputs are registered in: grouped by type, in order of outputFlags
+func registrationOrder(weights []int, order []string) []int {
+	rank := make(map[string]int)
+	for i, name := range outputFlags {
+		rank[name] = i
+	}
+
+	positions := make([]int, len(order))
+	for i := range positions {
+		positions[i] = i
+	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		return rank[order[positions[i]]] < rank[order[positions[j]]]
+	})
+
+	result := make([]int, len(positions))
+	for i, pos := range positions {
+		result[i] = weights[pos]
+	}
+	return result
+}
+
 // Automatically detects type of plugin and initialize it
 //
 // See this article if curious about relfect stuff below: http://blog.burntsushi.net/type-parametric-functions-golang
+// checkRAWInterfaces validates interfaces part of --input-raw address: comma separated
+// interface names or IPs, or 'any'. Supported forms depend on engine.
+func checkRAWInterfaces(options string, engine int) error {
+	if engine == EnginePcapFile {
+		return nil
+	}
+
+	address, _ := extractLimitOptions(options)
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		// Address errors are reported by input itself
+		return nil
+	}
+
+	interfaces := strings.Split(host, ",")
+	for _, iface := range interfaces {
+		if iface == "" {
+			return errors.New("empty interface in list: " + host)
+		}
+		if iface == "any" && len(interfaces) > 1 {
+			return errors.New("'any' can't be combined with other interfaces: " + host)
+		}
+	}
+
+	switch engine {
+	case EngineEBPF:
+		if len(interfaces) > 1 {
+			return errors.New("eBPF engine captures single interface, or all of them with 'any': " + host)
+		}
+	case EngineRawSocket:
+		if len(interfaces) > 1 || net.ParseIP(host) == nil {
+			return errors.New("raw_socket engine captures single interface by IP, or all of them with empty host: " + host)
+		}
+	}
+
+	return nil
+}
+
 func registerPlugin(constructor interface{}, options ...interface{}) {
-	var path, limit string
+	var path, limit, name string
 	vc := reflect.ValueOf(constructor)
 
 	// Pre-processing options to make it work with reflect
@@ -45,8 +144,9 @@ func registerPlugin(constructor interface{}, options ...interface{}) {
 	}
 
 	if len(vo) > 0 {
-		// Removing limit options from path
-		path, limit = extractLimitOptions(vo[0].String())
+		// Removing name and limit options from path
+		name, path = extractOutputName(vo[0].String())
+		path, limit = extractLimitOptions(path)
 
 		// Writing value back without limiter "|" options
 		vo[0] = reflect.ValueOf(path)
@@ -65,6 +165,14 @@ func registerPlugin(constructor interface{}, options ...interface{}) {
 	_, isR := plugin.(io.Reader)
 	_, isW := plugin.(io.Writer)
 
+	// Outputs can be paused using status server API, by name or by index if name is not set
+	if isW && Settings.statusAddr != "" {
+		if name == "" {
+			name = strconv.Itoa(len(plugins.Outputs))
+		}
+		pluginWrapper = NewPausableOutput(pluginWrapper.(io.Writer), name, Settings.outputPauseBuffer)
+	}
+
 	// Some of the output can be Readers as well because return responses
 	if isR && !isW {
 		plugins.Inputs = append(plugins.Inputs, pluginWrapper.(io.Reader))
@@ -82,16 +190,66 @@ func InitPlugins() *InOutPlugins {
 	pluginMu.Lock()
 	defer pluginMu.Unlock()
 
+	switch Settings.inputFormatMismatch {
+	case formatMismatchConvert, formatMismatchSkip, formatMismatchError:
+	default:
+		log.Fatal("input-format-mismatch: should be convert, skip or error")
+	}
+
+	if Settings.sampleRate < 0 || Settings.sampleRate > 1 {
+		log.Fatal("sample-rate: should be between 0 and 1")
+	}
+
+	if Settings.dedupHeader != "" && Settings.dedupWindow <= 0 {
+		log.Fatal("http-dedup-window: should be positive")
+	}
+
+	if Settings.metricsLatencyBuckets != "" {
+		buckets, err := latencyBucketsParser(Settings.metricsLatencyBuckets)
+		if err != nil {
+			log.Fatal("metrics-latency-buckets: ", err)
+		}
+		metrics.SetLatencyBuckets(buckets)
+	}
+
 	for _, options := range Settings.inputDummy {
 		registerPlugin(NewDummyInput, options)
 	}
 
+	if Settings.inputStdin {
+		registerPlugin(NewStdinInput)
+	}
+
+	if Settings.dryRun {
+		log.Println("Dry run: outputs are not started, requests are counted instead")
+		Settings.outputDummy = nil
+		Settings.outputStdout = false
+		Settings.outputNull = false
+		Settings.outputTCP = nil
+		Settings.outputUnix = nil
+		Settings.outputFile = nil
+		Settings.ringBuffer = ""
+		Settings.outputHTTP = nil
+		Settings.outputHTTPCompare = ""
+		Settings.outputKafkaConfig.host = ""
+		Settings.outputRedisConfig.host = ""
+		Settings.outputNATSConfig.url = ""
+		Settings.outputMQTT = nil
+		Settings.splitOutputWeights = ""
+	}
+
 	for range Settings.outputDummy {
-		registerPlugin(NewDummyOutput)
+		registerPlugin(NewDummyOutput, stdoutFormatRaw)
 	}
 
 	if Settings.outputStdout {
-		registerPlugin(NewDummyOutput)
+		switch Settings.outputStdoutFormat {
+		case stdoutFormatRaw, stdoutFormatJSON, stdoutFormatCurl:
+		default:
+			log.Fatal("output-stdout-format: should be raw, json or curl")
+		}
+
+		registerPlugin(NewDummyOutput, Settings.outputStdoutFormat)
 	}
 
 	if Settings.outputNull {
@@ -103,30 +261,151 @@ func InitPlugins() *InOutPlugins {
 		engine = EngineRawSocket
 	} else if Settings.inputRAWEngine == "pcap_file" {
 		engine = EnginePcapFile
+	} else if Settings.inputRAWEngine == "ebpf" {
+		engine = EngineEBPF
 	}
 
+	switch Settings.inputRAWProtocol {
+	case raw.ProtocolAuto, raw.ProtocolHTTP1, raw.ProtocolHTTP2:
+	case raw.ProtocolUDP:
+		if engine == EngineEBPF {
+			log.Fatal("input-raw-protocol: udp is not supported by eBPF engine")
+		}
+	default:
+		log.Fatal("input-raw-protocol: should be auto, http1, http2 or udp")
+	}
+
+	if Settings.inputRAWSnapLen < 0 {
+		log.Fatal("input-raw-snaplen: should be positive")
+	}
+	if Settings.inputRAWOverrideSnapLen && Settings.inputRAWSnapLen == 0 {
+		Settings.inputRAWSnapLen = 65536
+	}
+
+	// Port is needed to filter requests by it
+	recordPort := Settings.inputRAWRecordPort || len(Settings.modifierConfig.dstPorts) > 0
+
 	for _, options := range Settings.inputRAW {
-		registerPlugin(NewRAWInput, options, engine, Settings.inputRAWTrackResponse, Settings.inputRAWExpire, Settings.inputRAWRealIPHeader, Settings.inputRAWBpfFilter, Settings.inputRAWTimestampType, Settings.inputRawBufferSize)
+		if err := checkRAWInterfaces(options, engine); err != nil {
+			log.Fatal("input-raw: ", err)
+		}
+
+		registerPlugin(NewRAWInput, options, engine, Settings.inputRAWTrackResponse, Settings.inputRAWExpire, Settings.inputRAWRealIPHeader, Settings.inputRAWBpfFilter, Settings.inputRAWTimestampType, Settings.inputRawBufferSize, recordPort)
 	}
 
 	for _, options := range Settings.inputTCP {
 		registerPlugin(NewTCPInput, options, &Settings.inputTCPConfig)
 	}
 
+	for _, options := range Settings.inputUnix {
+		registerPlugin(NewUnixInput, options, &Settings.inputTCPConfig)
+	}
+
+	if Settings.outputTCPConfig.workers <= 0 {
+		log.Fatal("output-tcp-workers: should be positive")
+	}
+
+	// Original responses come from raw input, or from other Gor instances and files
+	Settings.outputTCPConfig.trackResponses = Settings.inputRAWTrackResponse || len(Settings.inputTCP) > 0 || len(Settings.inputUnix) > 0 || len(Settings.inputFile) > 0
+
 	for _, options := range Settings.outputTCP {
 		registerPlugin(NewTCPOutput, options, &Settings.outputTCPConfig)
 	}
 
-	for _, options := range Settings.inputFile {
-		registerPlugin(NewFileInput, options, Settings.inputFileLoop)
+	for _, options := range Settings.outputUnix {
+		registerPlugin(NewUnixOutput, options, &Settings.outputTCPConfig)
 	}
 
-	for _, options := range Settings.outputFile {
-		registerPlugin(NewFileOutput, options, &Settings.outputFileConfig)
+	fileConfig := Settings.inputFileConfig
+	if fileConfig.replaySpeed <= 0 {
+		log.Fatal("input-file-replay-speed: should be positive")
+	}
+
+	if fileConfig.replaySpeed != 1 {
+		if fileConfig.fitLoops {
+			log.Fatal("input-file-replay-speed: can't be combined with --input-file-loop-fit")
+		}
+
+		for _, options := range Settings.inputFile {
+			if _, limit := extractLimitOptions(options); strings.Contains(limit, "%") {
+				log.Fatal("input-file-replay-speed: can't be combined with percentage limit: ", options)
+			}
+		}
+	}
+
+	if fileConfig.fitLoops {
+		if !fileConfig.loop || Settings.exitAfter == 0 {
+			log.Fatal("input-file-loop-fit: requires --input-file-loop and --exit-after")
+		}
+
+		// Percentage limit changes replay speed too
+		for _, options := range Settings.inputFile {
+			if _, limit := extractLimitOptions(options); strings.Contains(limit, "%") {
+				log.Fatal("input-file-loop-fit: can't be combined with percentage limit: ", options)
+			}
+		}
+
+		fileConfig.exitAfter = Settings.exitAfter
+	}
+
+	if len(Settings.inputFileWeight) > 0 {
+		weights, err := parseFileWeights(Settings.inputFile, Settings.inputFileWeight)
+		if err != nil {
+			log.Fatal("input-file-weight: ", err)
+		}
+
+		registerPlugin(func() *FileInput {
+			return NewWeightedFileInput(Settings.inputFile, weights, &fileConfig)
+		})
+	} else {
+		for _, options := range Settings.inputFile {
+			registerPlugin(NewFileInput, options, &fileConfig)
+		}
+	}
+
+	for _, options := range Settings.inputALBLog {
+		registerPlugin(NewALBLogInput, options)
+	}
+
+	for _, options := range Settings.inputSQL {
+		registerPlugin(NewSQLInput, options, &Settings.inputSQLConfig)
+	}
+
+	if Settings.throttleBandwidth != "" {
+		rate, err := bufferParser(Settings.throttleBandwidth, "0")
+		if err != nil || rate <= 0 {
+			log.Fatal("throttle-bandwidth: invalid rate ", Settings.throttleBandwidth)
+		}
+		outputBandwidth = newBandwidthLimiter(rate)
+	}
+
+	if Settings.ringBuffer != "" {
+		size, err := bufferParser(Settings.ringBuffer, "0")
+		if err != nil || size <= 0 {
+			log.Fatal("ring-buffer: invalid size ", Settings.ringBuffer)
+		}
+
+		if len(Settings.outputFile) == 0 {
+			log.Fatal("ring-buffer: requires --output-file")
+		}
+
+		for _, options := range Settings.outputFile {
+			registerPlugin(func(path string) *RingBufferOutput {
+				return NewRingBufferOutput(NewFileOutput(path, &Settings.outputFileConfig), size, Settings.ringBufferDuration)
+			}, options)
+		}
+	} else {
+		for _, options := range Settings.outputFile {
+			registerPlugin(NewFileOutput, options, &Settings.outputFileConfig)
+		}
 	}
 
 	for _, options := range Settings.inputHTTP {
-		registerPlugin(NewHTTPInput, options)
+		registerPlugin(NewHTTPInput, options, &Settings.inputHTTPConfig)
+	}
+
+	for _, options := range Settings.inputProxy {
+		registerPlugin(NewProxyInput, options, &Settings.inputProxyConfig)
 	}
 
 	// If we explicitly set Host header http output should not rewrite it
@@ -138,10 +417,38 @@ func InitPlugins() *InOutPlugins {
 		}
 	}
 
-	for _, options := range Settings.outputHTTP {
-		registerPlugin(NewHTTPOutput, options, &Settings.outputHTTPConfig)
+	if Settings.outputHTTPCompare != "" {
+		if len(Settings.outputHTTP) != 2 {
+			log.Fatal("output-http-compare: exactly 2 --output-http are required")
+		}
+		if Settings.splitOutput {
+			log.Fatal("output-http-compare: can't be used with --split-output, both targets should get each request")
+		}
+		if Settings.outputHTTPConfig.lb {
+			log.Fatal("output-http-compare: can't be used with --output-http-lb, both targets should get each request")
+		}
+
+		comparator, err := newResponseComparator(Settings.outputHTTPCompare)
+		if err != nil {
+			log.Fatal("output-http-compare: ", err)
+		}
+		Settings.outputHTTPConfig.comparator = comparator
+	}
+
+	if Settings.outputHTTPConfig.lb && len(Settings.outputHTTP) > 0 {
+		// Single output balances requests across all targets
+		Settings.outputHTTPConfig.lbTargets = Settings.outputHTTP
+		registerPlugin(NewHTTPOutput, Settings.outputHTTP[0], &Settings.outputHTTPConfig)
+	} else {
+		for _, options := range Settings.outputHTTP {
+			registerPlugin(NewHTTPOutput, options, &Settings.outputHTTPConfig)
+		}
 	}
 
+	Settings.outputKafkaConfig.auth = &Settings.kafkaAuthConfig
+	Settings.inputKafkaConfig.auth = &Settings.kafkaAuthConfig
+	Settings.outputKafkaConfig.trackResponses = Settings.inputRAWTrackResponse || Settings.outputHTTPConfig.TrackResponses
+
 	if Settings.outputKafkaConfig.host != "" && Settings.outputKafkaConfig.topic != "" {
 		registerPlugin(NewKafkaOutput, "", &Settings.outputKafkaConfig)
 	}
@@ -150,5 +457,48 @@ func InitPlugins() *InOutPlugins {
 		registerPlugin(NewKafkaInput, "", &Settings.inputKafkaConfig)
 	}
 
+	if Settings.outputRedisConfig.host != "" {
+		registerPlugin(NewRedisOutput, "", &Settings.outputRedisConfig)
+	}
+
+	if Settings.outputNATSConfig.url != "" {
+		registerPlugin(NewNATSOutput, "", &Settings.outputNATSConfig)
+	}
+
+	if Settings.inputNATSConfig.url != "" {
+		registerPlugin(NewNATSInput, "", &Settings.inputNATSConfig)
+	}
+
+	for _, options := range Settings.inputMQTT {
+		registerPlugin(NewMQTTInput, options, &Settings.inputMQTTConfig)
+	}
+
+	for _, options := range Settings.outputMQTT {
+		registerPlugin(NewMQTTOutput, options, &Settings.outputMQTTConfig)
+	}
+
+	// Added as is, so emitter can find it among outputs to count dropped requests
+	if Settings.dryRun {
+		dryRun := NewDryRunOutput()
+		plugins.Outputs = append(plugins.Outputs, dryRun)
+		plugins.All = append(plugins.All, dryRun)
+	}
+
+	if Settings.splitOutputWeights != "" {
+		if !Settings.splitOutput {
+			log.Fatal("split-output-weights: requires --split-output")
+		}
+
+		// Weights are given in command line order of output flags
+		weights, err := parseSplitWeights(Settings.splitOutputWeights, len(Settings.outputOrder))
+		if err != nil {
+			log.Fatal("split-output-weights: ", err)
+		}
+		if len(weights) != len(plugins.Outputs) {
+			log.Fatal("split-output-weights: each output flag should create exactly one output, e.g. --output-http-lb is not supported")
+		}
+		Settings.splitWeights = registrationOrder(weights, Settings.outputOrder)
+	}
+
 	return plugins
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"testing"
 )
 
@@ -41,3 +43,81 @@ func TestPluginsRegistration(t *testing.T) {
 	}
 
 }
+
+func TestLatencyBucketsParser(t *testing.T) {
+	buckets, err := latencyBucketsParser("0.005, 50ms,1s,2.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 4 || buckets[0] != 0.005 || buckets[1] != 0.05 || buckets[2] != 1 || buckets[3] != 2.5 {
+		t.Errorf("Wrong buckets: %v", buckets)
+	}
+
+	for _, value := range []string{"1,abc", "1s,500ms", ""} {
+		if _, err := latencyBucketsParser(value); err == nil {
+			t.Errorf("Should fail to parse %q", value)
+		}
+	}
+}
+
+func TestSplitWeightsOrder(t *testing.T) {
+	Settings.outputOrder = nil
+	defer func() { Settings.outputOrder = nil }()
+
+	var http, tcp MultiOption
+	var stdout, null bool
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&http, "output-http", "")
+	fs.Var(&tcp, "output-tcp", "")
+	fs.BoolVar(&stdout, "output-stdout", false, "")
+	fs.BoolVar(&null, "output-null", false, "")
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Value = &outputFlag{f.Value, f.Name}
+	})
+
+	args := []string{"--output-http", "a", "--output-null", "--output-stdout", "--output-tcp", "b", "--output-http", "c", "--output-null=false"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if !stdout || null || len(http) != 2 {
+		t.Fatal("Flags should be parsed as usual")
+	}
+	if fmt.Sprint(Settings.outputOrder) != "[output-http output-stdout output-tcp output-http]" {
+		t.Fatalf("Wrong order of outputs: %v", Settings.outputOrder)
+	}
+
+	// Outputs are registered as: stdout, tcp b, http a, http c
+	weights := registrationOrder([]int{1, 2, 3, 4}, Settings.outputOrder)
+	if fmt.Sprint(weights) != "[2 3 1 4]" {
+		t.Errorf("Weights should follow registration order: %v", weights)
+	}
+}
+
+func TestCheckRAWInterfaces(t *testing.T) {
+	cases := []struct {
+		options string
+		engine  int
+		valid   bool
+	}{
+		{":80", EnginePcap, true},
+		{"eth0,eth1:80", EnginePcap, true},
+		{"any:80|10%", EnginePcap, true},
+		{"eth0,,eth1:80", EnginePcap, false},
+		{"any,eth0:80", EnginePcap, false},
+		{"eth0:80", EngineEBPF, true},
+		{"any:80", EngineEBPF, true},
+		{"eth0,eth1:80", EngineEBPF, false},
+		{":80", EngineRawSocket, true},
+		{"127.0.0.1:80", EngineRawSocket, true},
+		{"any:80", EngineRawSocket, false},
+		{"eth0:80", EngineRawSocket, false},
+		{"127.0.0.1,127.0.0.2:80", EngineRawSocket, false},
+		{"dump,1.pcap:80", EnginePcapFile, true},
+	}
+
+	for _, c := range cases {
+		if err := checkRAWInterfaces(c.options, c.engine); (err == nil) != c.valid {
+			t.Error("Wrong validation of", c.options, "engine", c.engine, "error:", err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package proto
+
+import (
+	"bytes"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// HTTP2Header is a single field of decoded HTTP/2 header block, in order it was received
+type HTTP2Header struct {
+	Name  string
+	Value string
+}
+
+// Flags of HTTP/2 HEADERS frame
+const (
+	HTTP2FlagEndStream  = 0x1
+	HTTP2FlagEndHeaders = 0x4
+	HTTP2FlagPadded     = 0x8
+	HTTP2FlagPriority   = 0x20
+)
+
+var http2FlagNames = []struct {
+	flag uint8
+	name string
+}{
+	{HTTP2FlagEndStream, "END_STREAM"},
+	{HTTP2FlagEndHeaders, "END_HEADERS"},
+	{HTTP2FlagPadded, "PADDED"},
+	{HTTP2FlagPriority, "PRIORITY"},
+}
+
+// Headers which carry HTTP/2 stream properties in converted payload, so they can be used by filters
+const (
+	HTTP2StreamIDHeader = "X-Http2-Stream-Id"
+	HTTP2PriorityHeader = "X-Http2-Priority"
+	HTTP2FlagsHeader    = "X-Http2-Flags"
+)
+
+// DeleteHTTP2StreamHeaders removes headers added by FromHTTP2, so they are used only by filters, and are not sent to replay target
+func DeleteHTTP2StreamHeaders(payload []byte) []byte {
+	for _, h := range []string{HTTP2StreamIDHeader, HTTP2PriorityHeader, HTTP2FlagsHeader} {
+		payload = DeleteHeader(payload, []byte(h))
+	}
+
+	return payload
+}
+
+// HTTP2Priority is stream priority, set by HEADERS or PRIORITY frame
+type HTTP2Priority struct {
+	StreamDependency uint32
+	Exclusive        bool
+	// In 1-256 range, frames carry it decremented by one
+	Weight int
+}
+
+// HTTP2DefaultPriority is priority of streams which do not set it explicitly
+var HTTP2DefaultPriority = HTTP2Priority{Weight: 16}
+
+// HTTP2Stream describes stream which message is converted
+type HTTP2Stream struct {
+	ID       uint32
+	Priority HTTP2Priority
+	// Flags of HEADERS frame which started the message. END_HEADERS is set also if header block is ended by CONTINUATION frame.
+	Flags uint8
+}
+
+// HTTP2FlagsString returns names of HEADERS frame flags, separated by comma
+func HTTP2FlagsString(flags uint8) string {
+	var names []string
+	for _, f := range http2FlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// FromHTTP2 converts decoded HTTP/2 header block and message body into HTTP/1.1 payload,
+// so HTTP/2 traffic can be filtered and rewritten same way as HTTP/1.x.
+//
+// Pseudo-headers are moved into the first line: `:method` and `:path` for requests, `:status` for responses.
+// `:authority` becomes Host header, unless the block already has one. `:scheme` is dropped.
+// Header names are canonicalized, since HTTP/2 requires them to be lowercase.
+// Content-Length is added if body is present and length is not specified, as HTTP/2 messages are framed without it.
+//
+// If stream is set, its id, priority and flags are added as X-Http2-Stream-Id, X-Http2-Priority and X-Http2-Flags headers,
+// for example `X-Http2-Priority: weight=16; depends-on=0; exclusive=0` and `X-Http2-Flags: END_STREAM,END_HEADERS`.
+// They are removed by DeleteHTTP2StreamHeaders before request is replayed.
+func FromHTTP2(headers []HTTP2Header, body []byte, stream *HTTP2Stream) []byte {
+	var method, path, authority, status string
+	hasHost, hasLength := false, false
+
+	for _, h := range headers {
+		switch h.Name {
+		case ":method":
+			method = h.Value
+		case ":path":
+			path = h.Value
+		case ":authority":
+			authority = h.Value
+		case ":status":
+			status = h.Value
+		case "host":
+			hasHost = true
+		case "content-length":
+			hasLength = true
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if status != "" {
+		code, _ := strconv.Atoi(status)
+		buf.WriteString("HTTP/1.1 " + status + " " + http.StatusText(code) + "\r\n")
+	} else {
+		if path == "" {
+			// CONNECT requests have only authority
+			path = authority
+		}
+		buf.WriteString(method + " " + path + " HTTP/1.1\r\n")
+	}
+
+	if !hasHost && authority != "" {
+		buf.WriteString("Host: " + authority + "\r\n")
+	}
+
+	for _, h := range headers {
+		if len(h.Name) == 0 || h.Name[0] == ':' {
+			continue
+		}
+
+		buf.WriteString(textproto.CanonicalMIMEHeaderKey(h.Name) + ": " + h.Value + "\r\n")
+	}
+
+	if stream != nil {
+		exclusive := "0"
+		if stream.Priority.Exclusive {
+			exclusive = "1"
+		}
+
+		buf.WriteString(HTTP2StreamIDHeader + ": " + strconv.FormatUint(uint64(stream.ID), 10) + "\r\n")
+		buf.WriteString(HTTP2PriorityHeader + ": weight=" + strconv.Itoa(stream.Priority.Weight) +
+			"; depends-on=" + strconv.FormatUint(uint64(stream.Priority.StreamDependency), 10) + "; exclusive=" + exclusive + "\r\n")
+		buf.WriteString(HTTP2FlagsHeader + ": " + HTTP2FlagsString(stream.Flags) + "\r\n")
+	}
+
+	if !hasLength && len(body) > 0 {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	}
+
+	buf.Write(CLRF)
+	buf.Write(body)
+
+	return buf.Bytes()
+}
@@ -0,0 +1,58 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFromHTTP2(t *testing.T) {
+	payload := FromHTTP2([]HTTP2Header{
+		{":method", "POST"},
+		{":scheme", "https"},
+		{":authority", "www.w3.org"},
+		{":path", "/post?a=1"},
+		{"content-type", "application/grpc"},
+		{"x-request-id", "1"},
+	}, []byte("a=1&b=2"), nil)
+
+	expected := "POST /post?a=1 HTTP/1.1\r\nHost: www.w3.org\r\nContent-Type: application/grpc\r\nX-Request-Id: 1\r\nContent-Length: 7\r\n\r\na=1&b=2"
+	if string(payload) != expected {
+		t.Errorf("Expected %q, got %q", expected, payload)
+	}
+
+	if !bytes.Equal(Method(payload), []byte("POST")) || !bytes.Equal(Path(payload), []byte("/post?a=1")) || !bytes.Equal(Header(payload, []byte("Host")), []byte("www.w3.org")) {
+		t.Error("Converted payload should be parsed as HTTP/1.1")
+	}
+
+	payload = FromHTTP2([]HTTP2Header{{":status", "404"}, {"content-length", "0"}}, nil, nil)
+
+	if expected = "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"; string(payload) != expected {
+		t.Errorf("Expected %q, got %q", expected, payload)
+	}
+}
+
+func TestFromHTTP2Stream(t *testing.T) {
+	stream := &HTTP2Stream{
+		ID:       3,
+		Priority: HTTP2Priority{StreamDependency: 1, Exclusive: true, Weight: 256},
+		Flags:    HTTP2FlagEndStream | HTTP2FlagEndHeaders | HTTP2FlagPriority,
+	}
+
+	payload := FromHTTP2([]HTTP2Header{{":method", "GET"}, {":path", "/"}, {":authority", "www.w3.org"}}, nil, stream)
+
+	expected := "GET / HTTP/1.1\r\nHost: www.w3.org\r\nX-Http2-Stream-Id: 3\r\nX-Http2-Priority: weight=256; depends-on=1; exclusive=1\r\nX-Http2-Flags: END_STREAM,END_HEADERS,PRIORITY\r\n\r\n"
+	if string(payload) != expected {
+		t.Errorf("Expected %q, got %q", expected, payload)
+	}
+}
+
+func TestDeleteHTTP2StreamHeaders(t *testing.T) {
+	stream := &HTTP2Stream{ID: 3, Priority: HTTP2DefaultPriority, Flags: HTTP2FlagEndStream}
+
+	payload := FromHTTP2([]HTTP2Header{{":method", "GET"}, {":path", "/"}, {":authority", "www.w3.org"}, {"accept", "*/*"}}, nil, stream)
+
+	expected := "GET / HTTP/1.1\r\nHost: www.w3.org\r\nAccept: */*\r\n\r\n"
+	if p := DeleteHTTP2StreamHeaders(payload); string(p) != expected {
+		t.Errorf("Expected %q, got %q", expected, p)
+	}
+}
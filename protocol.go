@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"io"
 	"strconv"
 )
 
@@ -27,13 +31,162 @@ func uuid() []byte {
 var payloadSeparator = "\n🐵🙈🙉\n"
 
 func payloadScanner(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return payloadFraming{}.Split(data, atEOF)
+}
+
+// Framing modes of files with payloads
+const (
+	framingSeparator = "separator"
+	framingLength    = "length"
+)
+
+// payloadFraming tells how payloads are delimited in files and streams.
+// Zero value is the default framing: each payload is followed by payloadSeparator.
+type payloadFraming struct {
+	// Used instead of payloadSeparator if set
+	separator []byte
+	// Each payload is preceded by its length as 4 byte big endian number, so it can contain any bytes
+	lengthPrefixed bool
+	// Each line is JSON object with request, converted to payload when read, see readJSONRequest.
+	// Only reading is supported.
+	jsonLines bool
+}
+
+// newPayloadFraming parses framing mode and separator. Separator can contain Go escape sequences like `\n`,
+// empty separator means payloadSeparator.
+func newPayloadFraming(mode, separator string) (f payloadFraming, err error) {
+	switch mode {
+	case "", framingSeparator:
+	case framingLength:
+		if separator != "" {
+			return f, errors.New("separator can't be used with length framing")
+		}
+		f.lengthPrefixed = true
+		return f, nil
+	default:
+		return f, errors.New("framing should be separator or length: " + mode)
+	}
+
+	if separator != "" {
+		unquoted, err := strconv.Unquote(`"` + separator + `"`)
+		if err != nil || unquoted == "" {
+			return f, errors.New("invalid separator: " + separator)
+		}
+		f.separator = []byte(unquoted)
+	}
+
+	return f, nil
+}
+
+// errPayloadTooLarge means length prefix is over --copy-buffer-size: data is corrupted or has another framing
+var errPayloadTooLarge = errors.New("payload length is over --copy-buffer-size, data is corrupted or is not length framed")
+
+func (f payloadFraming) sep() []byte {
+	if f.separator != nil {
+		return f.separator
+	}
+
+	return []byte(payloadSeparator)
+}
+
+// Write writes payload with framing, and returns number of written bytes
+func (f payloadFraming) Write(w io.Writer, data []byte) (int, error) {
+	if f.lengthPrefixed {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+		if _, err := w.Write(size[:]); err != nil {
+			return 0, err
+		}
+		n, err := w.Write(data)
+		return len(size) + n, err
+	}
+
+	n, err := w.Write(data)
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(f.sep())
+
+	return n + m, err
+}
+
+// Read reads next payload. Incomplete payload at the end is not returned, io.EOF is returned instead.
+func (f payloadFraming) Read(r *bufio.Reader) ([]byte, error) {
+	if f.jsonLines {
+		return readJSONRequest(r)
+	}
+
+	if f.lengthPrefixed {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		length := binary.BigEndian.Uint32(size[:])
+		if int64(length) > Settings.copyBufferSize {
+			return nil, errPayloadTooLarge
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		return data, nil
+	}
+
+	sep := f.sep()
+	var buffer bytes.Buffer
+
+	for {
+		chunk, err := r.ReadBytes(sep[len(sep)-1])
+		buffer.Write(chunk)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.HasSuffix(buffer.Bytes(), sep) {
+			return buffer.Bytes()[:buffer.Len()-len(sep)], nil
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+
+	return err
+}
+
+// Split is bufio.SplitFunc for payloads with this framing
+func (f payloadFraming) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if atEOF && len(data) == 0 {
 		return 0, nil, nil
 	}
 
-	if i := bytes.Index(data, []byte(payloadSeparator)); i >= 0 {
-		// We have a full newline-terminated line.
-		return i + len([]byte(payloadSeparator)), data[0:i], nil
+	if f.lengthPrefixed {
+		if len(data) >= 4 {
+			size := int(binary.BigEndian.Uint32(data))
+			if int64(size) > Settings.copyBufferSize {
+				return 0, nil, errPayloadTooLarge
+			}
+			if len(data) >= 4+size {
+				return 4 + size, data[4 : 4+size], nil
+			}
+		}
+
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+
+	sep := f.sep()
+	if i := bytes.Index(data, sep); i >= 0 {
+		// We have a full payload followed by separator
+		return i + len(sep), data[0:i], nil
 	}
 
 	if atEOF {
@@ -77,6 +230,34 @@ func payloadHeader(payloadType byte, uuid []byte, timing int64, latency int64) (
 	return header
 }
 
+// payloadHeaderWithPort adds port of the captured service after latency, which is -1 for requests:
+//
+//	1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1231 -1 443\n
+func payloadHeaderWithPort(payloadType byte, uuid []byte, timing int64, latency int64, port uint16) []byte {
+	header := payloadHeader(payloadType, uuid, timing, latency)
+	header = header[:len(header)-1]
+
+	if latency == -1 {
+		header = append(header, " -1"...)
+	}
+
+	header = append(header, ' ')
+	header = strconv.AppendUint(header, uint64(port), 10)
+
+	return append(header, '\n')
+}
+
+// payloadPort returns port of the captured service, or 0 if payload has no such information
+func payloadPort(meta [][]byte) uint16 {
+	if len(meta) < 5 {
+		return 0
+	}
+
+	port, _ := strconv.ParseUint(string(meta[4]), 10, 16)
+
+	return uint16(port)
+}
+
 func payloadBody(payload []byte) []byte {
 	headerSize := bytes.IndexByte(payload, '\n')
 	return payload[headerSize+1:]
@@ -0,0 +1,562 @@
+// +build linux
+
+package rawSocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// bpf(2) syscall numbers, not exported by syscall package
+var sysBPF = map[string]uintptr{
+	"386":     357,
+	"amd64":   321,
+	"arm":     386,
+	"arm64":   280,
+	"ppc64le": 361,
+	"s390x":   351,
+}
+
+const (
+	bpfProgLoad             = 5
+	bpfProgTypeSocketFilter = 1
+	soAttachBPF             = 50
+	ethPAll                 = 0x0003
+)
+
+// PACKET_MMAP ring, see linux/if_packet.h
+const (
+	packetRXRing   = 5
+	packetVersion  = 10
+	tpacketV2      = 1
+	tpStatusKernel = 0
+	tpStatusUser   = 1
+
+	// Size of tpacket2_hdr, sockaddr_ll follows it
+	tpacket2HdrLen = 32
+
+	// Frame should fit packets merged by GRO, which can be larger than MTU
+	ebpfFrameSize = 1<<16 + 1<<12
+	// Used if --input-raw-buffer-size is not set
+	ebpfDefaultRingSize = 64 << 20
+	// Packets are copied out of the ring into chunks of this size, instead of allocating memory for each
+	ebpfCopyChunkSize = 1 << 20
+)
+
+// tpacket2Hdr is header of each ring frame, fields are in host byte order
+type tpacket2Hdr struct {
+	status   uint32
+	len      uint32
+	snaplen  uint32
+	mac      uint16
+	net      uint16
+	sec      uint32
+	nsec     uint32
+	vlanTCI  uint16
+	vlanTPID uint16
+	padding  [4]uint8
+}
+
+type tpacketReq struct {
+	blockSize uint32
+	blockNr   uint32
+	frameSize uint32
+	frameNr   uint32
+}
+
+// eBPF instruction encoding, see linux/bpf.h
+const (
+	bpfLD    = 0x00
+	bpfALU   = 0x04
+	bpfJMP   = 0x05
+	bpfALU64 = 0x07
+
+	bpfW = 0x00
+	bpfH = 0x08
+	bpfB = 0x10
+
+	bpfABS = 0x20
+	bpfIND = 0x40
+
+	bpfK = 0x00
+	bpfX = 0x08
+
+	bpfAND = 0x50
+	bpfLSH = 0x60
+	bpfRSH = 0x70
+	bpfMOV = 0xb0
+
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJSET = 0x40
+	bpfJNE  = 0x50
+	bpfEXIT = 0x90
+)
+
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst in lower 4 bits, src in upper
+	off  int16
+	imm  int32
+}
+
+// bpfProgram is tiny assembler, which resolves jumps to labels
+type bpfProgram struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (p *bpfProgram) emit(code uint8, dst, src uint8, imm int32) {
+	p.insns = append(p.insns, bpfInsn{code: code, regs: dst | src<<4, imm: imm})
+}
+
+func (p *bpfProgram) jump(code uint8, dst uint8, imm int32, label string) {
+	p.jumps[len(p.insns)] = label
+	p.emit(bpfJMP|code|bpfK, dst, 0, imm)
+}
+
+func (p *bpfProgram) jumpX(code uint8, dst, src uint8, label string) {
+	p.jumps[len(p.insns)] = label
+	p.emit(bpfJMP|code|bpfX, dst, src, 0)
+}
+
+// checkAddr jumps to label if address at offset of packet is not equal to ip
+func (p *bpfProgram) checkAddr(offset int32, ip net.IP, label string) {
+	const r0, r2 = 0, 2
+
+	for i := 0; i < len(ip); i += 4 {
+		// Loaded word is converted to host byte order and zero-extended,
+		// 32 bit move also zero-extends, unlike immediate operand of jump
+		p.emit(bpfLD|bpfABS|bpfW, 0, 0, offset+int32(i))
+		p.emit(bpfALU|bpfMOV|bpfK, r2, 0, int32(binary.BigEndian.Uint32(ip[i:i+4])))
+		p.jumpX(bpfJNE, r0, r2, label)
+	}
+}
+
+func (p *bpfProgram) label(name string) {
+	p.labels[name] = len(p.insns)
+}
+
+func (p *bpfProgram) assemble() ([]byte, error) {
+	buf := make([]byte, 8*len(p.insns))
+
+	for i, insn := range p.insns {
+		if label, ok := p.jumps[i]; ok {
+			target, found := p.labels[label]
+			if !found {
+				return nil, errors.New("unknown label: " + label)
+			}
+			insn.off = int16(target - i - 1)
+		}
+
+		b := buf[i*8:]
+		b[0] = insn.code
+		b[1] = insn.regs
+		binary.LittleEndian.PutUint16(b[2:4], uint16(insn.off))
+		binary.LittleEndian.PutUint32(b[4:8], uint32(insn.imm))
+	}
+
+	return buf, nil
+}
+
+// ebpfPortFilter generates socket filter, which accepts only TCP packets to given port,
+// and from it if responses are captured. Packets start with IP header (SOCK_DGRAM).
+// If host is set, port should be of this address.
+func ebpfPortFilter(host net.IP, port uint16, responses bool) ([]byte, error) {
+	p := &bpfProgram{labels: make(map[string]int), jumps: make(map[int]string)}
+	const r0, r1, r6 = 0, 1, 6
+
+	var host4, host6 net.IP
+	if host != nil {
+		if host4 = host.To4(); host4 == nil {
+			host6 = host.To16()
+		}
+	}
+
+	// Packet access instructions expect context in r6, loaded value is in r0
+	p.emit(bpfALU64|bpfMOV|bpfX, r6, r1, 0)
+	p.emit(bpfLD|bpfABS|bpfB, 0, 0, 0)
+	p.emit(bpfALU|bpfRSH|bpfK, r0, 0, 4)
+	p.jump(bpfJNE, r0, 4, "ipv6")
+
+	// Packets of other IP version can't match host address
+	if host6 == nil {
+		p.ipv4Ports(host4, port, responses)
+	}
+
+	p.label("ipv6")
+	p.jump(bpfJNE, r0, 6, "drop")
+	if host4 == nil {
+		p.ipv6Ports(host6, port, responses)
+	}
+
+	p.label("drop")
+	p.emit(bpfALU64|bpfMOV|bpfK, r0, 0, 0)
+	p.emit(bpfJMP|bpfEXIT, 0, 0, 0)
+
+	// Returned value is number of bytes to keep
+	p.label("accept")
+	p.emit(bpfALU64|bpfMOV|bpfK, r0, 0, math.MaxInt32)
+	p.emit(bpfJMP|bpfEXIT, 0, 0, 0)
+
+	return p.assemble()
+}
+
+// ipv4Ports checks protocol, fragment offset, and ports after variable length header
+func (p *bpfProgram) ipv4Ports(host net.IP, port uint16, responses bool) {
+	const r0, r7 = 0, 7
+
+	p.emit(bpfLD|bpfABS|bpfB, 0, 0, 9)
+	p.jump(bpfJNE, r0, syscall.IPPROTO_TCP, "drop")
+	p.emit(bpfLD|bpfABS|bpfH, 0, 0, 6)
+	p.jump(bpfJSET, r0, 0x1fff, "drop")
+	p.emit(bpfLD|bpfABS|bpfB, 0, 0, 0)
+	p.emit(bpfALU|bpfAND|bpfK, r0, 0, 0x0f)
+	p.emit(bpfALU|bpfLSH|bpfK, r0, 0, 2)
+	p.emit(bpfALU64|bpfMOV|bpfX, r7, r0, 0)
+	if responses {
+		p.emit(bpfLD|bpfIND|bpfH, 0, r7, 0)
+		p.jump(bpfJNE, r0, int32(port), "ipv4_dst")
+		if host != nil {
+			p.checkAddr(12, host, "ipv4_dst")
+		}
+		p.jump(bpfJA, 0, 0, "accept")
+	}
+	p.label("ipv4_dst")
+	p.emit(bpfLD|bpfIND|bpfH, 0, r7, 2)
+	p.jump(bpfJNE, r0, int32(port), "drop")
+	if host != nil {
+		p.checkAddr(16, host, "drop")
+	}
+	p.jump(bpfJA, 0, 0, "accept")
+}
+
+// ipv6Ports checks protocol and ports, extension headers are not supported
+func (p *bpfProgram) ipv6Ports(host net.IP, port uint16, responses bool) {
+	const r0 = 0
+
+	p.emit(bpfLD|bpfABS|bpfB, 0, 0, 6)
+	p.jump(bpfJNE, r0, syscall.IPPROTO_TCP, "drop")
+	if responses {
+		p.emit(bpfLD|bpfABS|bpfH, 0, 0, 40)
+		p.jump(bpfJNE, r0, int32(port), "ipv6_dst")
+		if host != nil {
+			p.checkAddr(8, host, "ipv6_dst")
+		}
+		p.jump(bpfJA, 0, 0, "accept")
+	}
+	p.label("ipv6_dst")
+	p.emit(bpfLD|bpfABS|bpfH, 0, 0, 42)
+	p.jump(bpfJNE, r0, int32(port), "drop")
+	if host != nil {
+		p.checkAddr(24, host, "drop")
+	}
+	p.jump(bpfJA, 0, 0, "accept")
+}
+
+// loadEBPFProgram loads socket filter program into the kernel, and returns its file descriptor
+func loadEBPFProgram(insns []byte) (int, error) {
+	sys, ok := sysBPF[runtime.GOARCH]
+	if !ok {
+		return -1, errors.New("eBPF is not supported on " + runtime.GOARCH)
+	}
+
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 64*1024)
+
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType: bpfProgTypeSocketFilter,
+		insnCnt:  uint32(len(insns) / 8),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+
+	fd, _, errno := syscall.Syscall(sys, bpfProgLoad, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+
+	if errno != 0 {
+		if n := clen(logBuf); n > 0 {
+			return -1, fmt.Errorf("%v: %s", errno, logBuf[:n])
+		}
+		return -1, errno
+	}
+
+	return int(fd), nil
+}
+
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// openEBPFSocket opens packet socket with attached eBPF filter. If ifindex is 0, all interfaces are captured.
+// Packets are received through memory mapped ring, which is returned together with number of its frames.
+func openEBPFSocket(prog []byte, ifindex int, bufferSize int64) (fd int, ring []byte, frames int, err error) {
+	progFD, err := loadEBPFProgram(prog)
+	if err != nil {
+		return -1, nil, 0, err
+	}
+	// Socket keeps reference to the program
+	defer syscall.Close(progFD)
+
+	// Protocol is set on bind, so no packets are queued before filter is attached
+	fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return -1, nil, 0, err
+	}
+
+	if ring, frames, err = setupEBPFSocket(fd, progFD, ifindex, bufferSize); err != nil {
+		if ring != nil {
+			syscall.Munmap(ring)
+		}
+		syscall.Close(fd)
+		return -1, nil, 0, err
+	}
+
+	return fd, ring, frames, nil
+}
+
+func setupEBPFSocket(fd, progFD, ifindex int, bufferSize int64) (ring []byte, frames int, err error) {
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soAttachBPF, progFD); err != nil {
+		return
+	}
+
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetVersion, tpacketV2); err != nil {
+		return
+	}
+
+	size := int64(ebpfDefaultRingSize)
+	if bufferSize > 0 {
+		size = bufferSize
+	}
+
+	// Each block holds single frame, so size of block stays multiple of page size
+	frames = int(size / ebpfFrameSize)
+	if frames < 1 {
+		frames = 1
+	}
+	req := tpacketReq{blockSize: ebpfFrameSize, blockNr: uint32(frames), frameSize: ebpfFrameSize, frameNr: uint32(frames)}
+	reqBytes := (*[unsafe.Sizeof(req)]byte)(unsafe.Pointer(&req))[:]
+
+	if err = syscall.SetsockoptString(fd, syscall.SOL_PACKET, packetRXRing, string(reqBytes)); err != nil {
+		return
+	}
+
+	if ring, err = syscall.Mmap(fd, 0, frames*ebpfFrameSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED); err != nil {
+		return
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPAll), Ifindex: ifindex})
+
+	return
+}
+
+// findEBPFInterface returns index of interface by name or IP, or 0 to capture all interfaces
+func findEBPFInterface(addr string) (int, error) {
+	if listenAllInterfaces(addr) {
+		return 0, nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, iface := range ifaces {
+		if iface.Name == addr {
+			return iface.Index, nil
+		}
+
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.String() == addr {
+				return iface.Index, nil
+			}
+		}
+	}
+
+	return 0, &DeviceNotFoundError{addr}
+}
+
+// readEBPF captures traffic using AF_PACKET socket, with packets filtered in kernel by eBPF program,
+// and received through memory mapped ring without system call for each packet.
+// Unlike libpcap, custom BPF filter is not supported.
+func (t *Listener) readEBPF() {
+	if t.bpfFilter != "" {
+		log.Println("Custom BPF filter is ignored by eBPF engine")
+	}
+
+	ifindex, err := findEBPFInterface(t.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Address can be also interface name, then all its addresses are captured
+	var host net.IP
+	if !listenAllInterfaces(t.addr) {
+		host = net.ParseIP(t.addr)
+	}
+
+	prog, err := ebpfPortFilter(host, t.port, t.captureResponses())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fd, ring, frames, err := openEBPFSocket(prog, ifindex, t.bufferSize)
+	if err != nil {
+		log.Fatal("eBPF engine error: ", err)
+	}
+	defer syscall.Close(fd)
+	defer syscall.Munmap(ring)
+
+	epfd, err := syscall.EpollCreate1(0)
+	if err != nil {
+		log.Fatal("eBPF engine error: ", err)
+	}
+	defer syscall.Close(epfd)
+
+	if err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}); err != nil {
+		log.Fatal("eBPF engine error: ", err)
+	}
+	events := make([]syscall.EpollEvent, 1)
+
+	// On loopback each packet is seen twice: as outgoing and as incoming
+	loopbacks := make(map[int]bool)
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				loopbacks[iface.Index] = true
+			}
+		}
+	}
+
+	var chunk []byte
+
+	t.readyCh <- true
+
+	for frame := 0; ; {
+		select {
+		case <-t.quit:
+			return
+		default:
+		}
+
+		buf := ring[frame*ebpfFrameSize : (frame+1)*ebpfFrameSize]
+		hdr := (*tpacket2Hdr)(unsafe.Pointer(&buf[0]))
+
+		if atomic.LoadUint32(&hdr.status)&tpStatusUser == 0 {
+			// Wake up periodically to check if listener is closed
+			if _, err := syscall.EpollWait(epfd, events, 500); err != nil && err != syscall.EINTR {
+				log.Println("eBPF engine error:", err)
+				return
+			}
+			continue
+		}
+
+		ll := (*syscall.RawSockaddrLinklayer)(unsafe.Pointer(&buf[tpacket2HdrLen]))
+		skip := ll.Pkttype == syscall.PACKET_OUTGOING && loopbacks[int(ll.Ifindex)]
+
+		var srcIP, dstIP, data []byte
+		if !skip && int(hdr.net)+int(hdr.snaplen) <= len(buf) {
+			srcIP, dstIP, data = parseIPPacket(buf[hdr.net : int(hdr.net)+int(hdr.snaplen)])
+		}
+
+		// We need only packets with data inside, or FIN and RST, which close connection
+		if data != nil {
+			dataOffset := (data[12] & 0xF0) >> 4
+			isClosing := data[13]&0x05 != 0
+			if len(data) <= int(dataOffset*4) && !isClosing {
+				data = nil
+			}
+		}
+
+		if data != nil {
+			// Frame is returned to kernel, so packet should have own copy
+			ipLen := len(srcIP)
+			size := 2*ipLen + len(data)
+			if len(chunk) < size {
+				chunk = make([]byte, ebpfCopyChunkSize+size)
+			}
+			packetData := chunk[:size:size]
+			chunk = chunk[size:]
+
+			copy(packetData, srcIP)
+			copy(packetData[ipLen:], dstIP)
+			copy(packetData[2*ipLen:], data)
+
+			timestamp := time.Unix(int64(hdr.sec), int64(hdr.nsec))
+			t.packetsChan <- t.buildPacket(packetData[:ipLen], packetData[ipLen:2*ipLen], packetData[2*ipLen:], timestamp)
+		}
+
+		atomic.StoreUint32(&hdr.status, tpStatusKernel)
+		frame = (frame + 1) % frames
+	}
+}
+
+// parseIPPacket returns source and destination IP and TCP segment, or nil if packet is malformed
+func parseIPPacket(data []byte) (srcIP, dstIP []byte, tcp []byte) {
+	if len(data) < 20 {
+		return nil, nil, nil
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		ihl := int(data[0]&0x0F) * 4
+		ipLength := int(binary.BigEndian.Uint16(data[2:4]))
+
+		if ihl < 20 || ipLength < ihl || len(data) < ipLength {
+			return nil, nil, nil
+		}
+
+		srcIP, dstIP, tcp = data[12:16], data[16:20], data[ihl:ipLength]
+	case 6:
+		payloadLength := int(binary.BigEndian.Uint16(data[4:6]))
+
+		if len(data) < 40+payloadLength {
+			return nil, nil, nil
+		}
+
+		srcIP, dstIP, tcp = data[8:24], data[24:40], data[40:40+payloadLength]
+	default:
+		return nil, nil, nil
+	}
+
+	// Truncated TCP header
+	if len(tcp) <= 13 {
+		return nil, nil, nil
+	}
+
+	return srcIP, dstIP, tcp
+}
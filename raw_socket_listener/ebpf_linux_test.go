@@ -0,0 +1,104 @@
+// +build linux
+
+package rawSocket
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEBPFListener(t *testing.T) {
+	prog, err := ebpfPortFilter(net.ParseIP("127.0.0.1"), 80, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, ring, _, err := openEBPFSocket(prog, 0, 1<<20)
+	if err != nil {
+		t.Skip("eBPF is not available:", err)
+	}
+	syscall.Munmap(ring)
+	syscall.Close(fd)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	listener := NewListener("127.0.0.1", port, ListenerConfig{Engine: EngineEBPF, TrackResponse: true, Expire: 10 * time.Millisecond})
+	defer listener.Close()
+
+	if !listener.IsReady() {
+		t.Fatal("Listener should be ready")
+	}
+
+	// Unrelated traffic should be filtered out in kernel
+	other, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer other.Close()
+	go http.Serve(other, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	http.Get("http://" + other.Addr().String() + "/other")
+
+	// Same port on other address of loopback interface
+	if otherHost, err := net.Listen("tcp", "127.0.0.2:"+port); err == nil {
+		defer otherHost.Close()
+		go http.Serve(otherHost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		http.Get("http://127.0.0.2:" + port + "/other-host")
+	}
+
+	http.Get("http://127.0.0.1:" + port + "/ebpf")
+
+	var req, resp *TCPMessage
+	for req == nil || resp == nil {
+		select {
+		case m := <-listener.Receiver():
+			if m.IsIncoming {
+				if req != nil {
+					t.Fatal("Should capture single request:", string(m.Bytes()))
+				}
+				req = m
+			} else {
+				resp = m
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Should capture request and response")
+		}
+	}
+
+	if string(req.Bytes()[:10]) != "GET /ebpf " {
+		t.Error("Wrong request:", string(req.Bytes()))
+	}
+
+	if string(resp.Bytes()[:15]) != "HTTP/1.1 200 OK" {
+		t.Error("Wrong response:", string(resp.Bytes()))
+	}
+}
+
+func TestParseIPPacket(t *testing.T) {
+	packet := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now())
+	tcp := packet.dump().data
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	ip[2], ip[3] = 0, byte(20+len(tcp))
+	copy(ip[12:16], []byte{10, 0, 0, 1})
+	copy(ip[16:20], []byte{10, 0, 0, 2})
+	ip = append(ip, tcp...)
+
+	srcIP, dstIP, data := parseIPPacket(append(ip, 0, 0))
+	if net.IP(srcIP).String() != "10.0.0.1" || net.IP(dstIP).String() != "10.0.0.2" || len(data) != len(tcp) {
+		t.Error("Wrong packet:", srcIP, dstIP, len(data))
+	}
+
+	if srcIP, _, _ = parseIPPacket(ip[:30]); srcIP != nil {
+		t.Error("Should skip truncated packet")
+	}
+}
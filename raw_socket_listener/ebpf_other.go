@@ -0,0 +1,9 @@
+// +build !linux
+
+package rawSocket
+
+import "log"
+
+func (t *Listener) readEBPF() {
+	log.Fatal("eBPF engine is supported only on Linux")
+}
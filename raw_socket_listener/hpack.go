@@ -0,0 +1,369 @@
+package rawSocket
+
+import (
+	"errors"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Decoder of HTTP/2 header blocks, compressed with HPACK https://tools.ietf.org/html/rfc7541
+
+const (
+	hpackDefaultTableSize = 4096
+	// Size of each dynamic table entry includes overhead of 32 bytes
+	hpackEntryOverhead = 32
+	// Protection from corrupted integers
+	hpackMaxInt = 1 << 24
+)
+
+var (
+	errHPACKTruncated    = errors.New("hpack: truncated header block")
+	errHPACKInvalidIndex = errors.New("hpack: invalid index")
+	errHPACKInvalidInt   = errors.New("hpack: integer overflow")
+	errHPACKHuffman      = errors.New("hpack: invalid huffman code")
+)
+
+var hpackStaticTable = []proto.HTTP2Header{
+	{Name: ":authority", Value: ""},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset", Value: ""},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language", Value: ""},
+	{Name: "accept-ranges", Value: ""},
+	{Name: "accept", Value: ""},
+	{Name: "access-control-allow-origin", Value: ""},
+	{Name: "age", Value: ""},
+	{Name: "allow", Value: ""},
+	{Name: "authorization", Value: ""},
+	{Name: "cache-control", Value: ""},
+	{Name: "content-disposition", Value: ""},
+	{Name: "content-encoding", Value: ""},
+	{Name: "content-language", Value: ""},
+	{Name: "content-length", Value: ""},
+	{Name: "content-location", Value: ""},
+	{Name: "content-range", Value: ""},
+	{Name: "content-type", Value: ""},
+	{Name: "cookie", Value: ""},
+	{Name: "date", Value: ""},
+	{Name: "etag", Value: ""},
+	{Name: "expect", Value: ""},
+	{Name: "expires", Value: ""},
+	{Name: "from", Value: ""},
+	{Name: "host", Value: ""},
+	{Name: "if-match", Value: ""},
+	{Name: "if-modified-since", Value: ""},
+	{Name: "if-none-match", Value: ""},
+	{Name: "if-range", Value: ""},
+	{Name: "if-unmodified-since", Value: ""},
+	{Name: "last-modified", Value: ""},
+	{Name: "link", Value: ""},
+	{Name: "location", Value: ""},
+	{Name: "max-forwards", Value: ""},
+	{Name: "proxy-authenticate", Value: ""},
+	{Name: "proxy-authorization", Value: ""},
+	{Name: "range", Value: ""},
+	{Name: "referer", Value: ""},
+	{Name: "refresh", Value: ""},
+	{Name: "retry-after", Value: ""},
+	{Name: "server", Value: ""},
+	{Name: "set-cookie", Value: ""},
+	{Name: "strict-transport-security", Value: ""},
+	{Name: "transfer-encoding", Value: ""},
+	{Name: "user-agent", Value: ""},
+	{Name: "vary", Value: ""},
+	{Name: "via", Value: ""},
+	{Name: "www-authenticate", Value: ""},
+}
+
+// hpackDecoder keeps dynamic table of one direction of connection, so blocks should be decoded in order they were sent
+type hpackDecoder struct {
+	// Newest entry is the last one
+	dynamic []proto.HTTP2Header
+	size    int
+	maxSize int
+}
+
+func newHPACKDecoder() *hpackDecoder {
+	return &hpackDecoder{maxSize: hpackDefaultTableSize}
+}
+
+// Decode returns header fields of complete header block
+func (d *hpackDecoder) Decode(block []byte) (headers []proto.HTTP2Header, err error) {
+	for len(block) > 0 {
+		b := block[0]
+
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field
+			var idx uint64
+			if idx, block, err = hpackReadInt(block, 7); err != nil {
+				return nil, err
+			}
+
+			field, ok := d.field(idx)
+			if !ok {
+				return nil, errHPACKInvalidIndex
+			}
+			headers = append(headers, field)
+		case b&0xe0 == 0x20:
+			// Dynamic table size update
+			var size uint64
+			if size, block, err = hpackReadInt(block, 5); err != nil {
+				return nil, err
+			}
+			d.maxSize = int(size)
+			d.evict()
+		default:
+			// Literal header field: with incremental indexing, without indexing, or never indexed
+			indexed := b&0xc0 == 0x40
+			prefix := uint8(4)
+			if indexed {
+				prefix = 6
+			}
+
+			var field proto.HTTP2Header
+			if field, block, err = d.readLiteral(block, prefix); err != nil {
+				return nil, err
+			}
+			headers = append(headers, field)
+
+			if indexed {
+				d.add(field)
+			}
+		}
+	}
+
+	return headers, nil
+}
+
+func (d *hpackDecoder) readLiteral(block []byte, prefix uint8) (field proto.HTTP2Header, rest []byte, err error) {
+	idx, rest, err := hpackReadInt(block, prefix)
+	if err != nil {
+		return
+	}
+
+	if idx > 0 {
+		name, ok := d.field(idx)
+		if !ok {
+			return field, nil, errHPACKInvalidIndex
+		}
+		field.Name = name.Name
+	} else if field.Name, rest, err = hpackReadString(rest); err != nil {
+		return
+	}
+
+	field.Value, rest, err = hpackReadString(rest)
+
+	return
+}
+
+// field returns entry by index, which addresses static table first, and then dynamic table starting from the newest entry
+func (d *hpackDecoder) field(idx uint64) (proto.HTTP2Header, bool) {
+	if idx == 0 {
+		return proto.HTTP2Header{}, false
+	}
+
+	if idx <= uint64(len(hpackStaticTable)) {
+		return hpackStaticTable[idx-1], true
+	}
+
+	idx -= uint64(len(hpackStaticTable))
+	if idx > uint64(len(d.dynamic)) {
+		return proto.HTTP2Header{}, false
+	}
+
+	return d.dynamic[uint64(len(d.dynamic))-idx], true
+}
+
+func (d *hpackDecoder) add(field proto.HTTP2Header) {
+	d.dynamic = append(d.dynamic, field)
+	d.size += len(field.Name) + len(field.Value) + hpackEntryOverhead
+	d.evict()
+}
+
+func (d *hpackDecoder) evict() {
+	n := 0
+	for d.size > d.maxSize && n < len(d.dynamic) {
+		d.size -= len(d.dynamic[n].Name) + len(d.dynamic[n].Value) + hpackEntryOverhead
+		n++
+	}
+
+	if n > 0 {
+		d.dynamic = append(d.dynamic[:0:0], d.dynamic[n:]...)
+	}
+}
+
+// hpackReadInt decodes integer, which starts in the lowest `prefix` bits of the first byte
+func hpackReadInt(block []byte, prefix uint8) (value uint64, rest []byte, err error) {
+	if len(block) == 0 {
+		return 0, nil, errHPACKTruncated
+	}
+
+	mask := uint64(1)<<prefix - 1
+	value = uint64(block[0]) & mask
+	rest = block[1:]
+
+	if value < mask {
+		return
+	}
+
+	for shift := uint(0); ; shift += 7 {
+		if len(rest) == 0 {
+			return 0, nil, errHPACKTruncated
+		}
+
+		b := rest[0]
+		rest = rest[1:]
+		value += uint64(b&0x7f) << shift
+
+		if value > hpackMaxInt {
+			return 0, nil, errHPACKInvalidInt
+		}
+
+		if b&0x80 == 0 {
+			return
+		}
+	}
+}
+
+func hpackReadString(block []byte) (value string, rest []byte, err error) {
+	if len(block) == 0 {
+		return "", nil, errHPACKTruncated
+	}
+	huffman := block[0]&0x80 != 0
+
+	length, rest, err := hpackReadInt(block, 7)
+	if err != nil {
+		return
+	}
+
+	if uint64(len(rest)) < length {
+		return "", nil, errHPACKTruncated
+	}
+
+	data := rest[:length]
+	rest = rest[length:]
+
+	if !huffman {
+		return string(data), rest, nil
+	}
+
+	decoded, err := hpackHuffmanDecode(data)
+
+	return string(decoded), rest, err
+}
+
+// Nodes of Huffman code tree. Children are indexes of nodes, leaf has no children and holds symbol.
+type hpackHuffmanNode struct {
+	children [2]uint16
+	sym      byte
+	leaf     bool
+}
+
+var hpackHuffmanTree = buildHPACKHuffmanTree()
+
+func buildHPACKHuffmanTree() []hpackHuffmanNode {
+	tree := []hpackHuffmanNode{{}}
+
+	for sym, code := range hpackHuffmanCodes {
+		node := 0
+		for i := int(code.len) - 1; i >= 0; i-- {
+			bit := (code.code >> uint(i)) & 1
+
+			if tree[node].children[bit] == 0 {
+				tree = append(tree, hpackHuffmanNode{})
+				tree[node].children[bit] = uint16(len(tree) - 1)
+			}
+			node = int(tree[node].children[bit])
+		}
+
+		tree[node].sym = byte(sym)
+		tree[node].leaf = true
+	}
+
+	return tree
+}
+
+func hpackHuffmanDecode(data []byte) ([]byte, error) {
+	decoded := make([]byte, 0, len(data)*8/5)
+
+	node, depth := 0, 0
+	// Bits of unfinished symbol are all ones, so they can be padding
+	ones := true
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			node = int(hpackHuffmanTree[node].children[bit])
+			depth++
+			ones = ones && bit == 1
+
+			// Only EOS symbol, which is not in the tree, can be longer than 30 bits
+			if node == 0 || depth > 30 {
+				return nil, errHPACKHuffman
+			}
+
+			if hpackHuffmanTree[node].leaf {
+				decoded = append(decoded, hpackHuffmanTree[node].sym)
+				node, depth, ones = 0, 0, true
+			}
+		}
+	}
+
+	// Padding is the most significant bits of EOS symbol, which are all ones, and should be shorter than byte
+	if depth > 7 || !ones {
+		return nil, errHPACKHuffman
+	}
+
+	return decoded, nil
+}
+
+// Huffman code of each byte, from Appendix B of RFC 7541
+var hpackHuffmanCodes = [256]struct {
+	code uint32
+	len  uint8
+}{
+	{0x1ff8, 13}, {0x7fffd8, 23}, {0xfffffe2, 28}, {0xfffffe3, 28}, {0xfffffe4, 28}, {0xfffffe5, 28}, {0xfffffe6, 28}, {0xfffffe7, 28},
+	{0xfffffe8, 28}, {0xffffea, 24}, {0x3ffffffc, 30}, {0xfffffe9, 28}, {0xfffffea, 28}, {0x3ffffffd, 30}, {0xfffffeb, 28}, {0xfffffec, 28},
+	{0xfffffed, 28}, {0xfffffee, 28}, {0xfffffef, 28}, {0xffffff0, 28}, {0xffffff1, 28}, {0xffffff2, 28}, {0x3ffffffe, 30}, {0xffffff3, 28},
+	{0xffffff4, 28}, {0xffffff5, 28}, {0xffffff6, 28}, {0xffffff7, 28}, {0xffffff8, 28}, {0xffffff9, 28}, {0xffffffa, 28}, {0xffffffb, 28},
+	{0x14, 6}, {0x3f8, 10}, {0x3f9, 10}, {0xffa, 12}, {0x1ff9, 13}, {0x15, 6}, {0xf8, 8}, {0x7fa, 11},
+	{0x3fa, 10}, {0x3fb, 10}, {0xf9, 8}, {0x7fb, 11}, {0xfa, 8}, {0x16, 6}, {0x17, 6}, {0x18, 6},
+	{0x0, 5}, {0x1, 5}, {0x2, 5}, {0x19, 6}, {0x1a, 6}, {0x1b, 6}, {0x1c, 6}, {0x1d, 6},
+	{0x1e, 6}, {0x1f, 6}, {0x5c, 7}, {0xfb, 8}, {0x7ffc, 15}, {0x20, 6}, {0xffb, 12}, {0x3fc, 10},
+	{0x1ffa, 13}, {0x21, 6}, {0x5d, 7}, {0x5e, 7}, {0x5f, 7}, {0x60, 7}, {0x61, 7}, {0x62, 7},
+	{0x63, 7}, {0x64, 7}, {0x65, 7}, {0x66, 7}, {0x67, 7}, {0x68, 7}, {0x69, 7}, {0x6a, 7},
+	{0x6b, 7}, {0x6c, 7}, {0x6d, 7}, {0x6e, 7}, {0x6f, 7}, {0x70, 7}, {0x71, 7}, {0x72, 7},
+	{0xfc, 8}, {0x73, 7}, {0xfd, 8}, {0x1ffb, 13}, {0x7fff0, 19}, {0x1ffc, 13}, {0x3ffc, 14}, {0x22, 6},
+	{0x7ffd, 15}, {0x3, 5}, {0x23, 6}, {0x4, 5}, {0x24, 6}, {0x5, 5}, {0x25, 6}, {0x26, 6},
+	{0x27, 6}, {0x6, 5}, {0x74, 7}, {0x75, 7}, {0x28, 6}, {0x29, 6}, {0x2a, 6}, {0x7, 5},
+	{0x2b, 6}, {0x76, 7}, {0x2c, 6}, {0x8, 5}, {0x9, 5}, {0x2d, 6}, {0x77, 7}, {0x78, 7},
+	{0x79, 7}, {0x7a, 7}, {0x7b, 7}, {0x7ffe, 15}, {0x7fc, 11}, {0x3ffd, 14}, {0x1ffd, 13}, {0xffffffc, 28},
+	{0xfffe6, 20}, {0x3fffd2, 22}, {0xfffe7, 20}, {0xfffe8, 20}, {0x3fffd3, 22}, {0x3fffd4, 22}, {0x3fffd5, 22}, {0x7fffd9, 23},
+	{0x3fffd6, 22}, {0x7fffda, 23}, {0x7fffdb, 23}, {0x7fffdc, 23}, {0x7fffdd, 23}, {0x7fffde, 23}, {0xffffeb, 24}, {0x7fffdf, 23},
+	{0xffffec, 24}, {0xffffed, 24}, {0x3fffd7, 22}, {0x7fffe0, 23}, {0xffffee, 24}, {0x7fffe1, 23}, {0x7fffe2, 23}, {0x7fffe3, 23},
+	{0x7fffe4, 23}, {0x1fffdc, 21}, {0x3fffd8, 22}, {0x7fffe5, 23}, {0x3fffd9, 22}, {0x7fffe6, 23}, {0x7fffe7, 23}, {0xffffef, 24},
+	{0x3fffda, 22}, {0x1fffdd, 21}, {0xfffe9, 20}, {0x3fffdb, 22}, {0x3fffdc, 22}, {0x7fffe8, 23}, {0x7fffe9, 23}, {0x1fffde, 21},
+	{0x7fffea, 23}, {0x3fffdd, 22}, {0x3fffde, 22}, {0xfffff0, 24}, {0x1fffdf, 21}, {0x3fffdf, 22}, {0x7fffeb, 23}, {0x7fffec, 23},
+	{0x1fffe0, 21}, {0x1fffe1, 21}, {0x3fffe0, 22}, {0x1fffe2, 21}, {0x7fffed, 23}, {0x3fffe1, 22}, {0x7fffee, 23}, {0x7fffef, 23},
+	{0xfffea, 20}, {0x3fffe2, 22}, {0x3fffe3, 22}, {0x3fffe4, 22}, {0x7ffff0, 23}, {0x3fffe5, 22}, {0x3fffe6, 22}, {0x7ffff1, 23},
+	{0x3ffffe0, 26}, {0x3ffffe1, 26}, {0xfffeb, 20}, {0x7fff1, 19}, {0x3fffe7, 22}, {0x7ffff2, 23}, {0x3fffe8, 22}, {0x1ffffec, 25},
+	{0x3ffffe2, 26}, {0x3ffffe3, 26}, {0x3ffffe4, 26}, {0x7ffffde, 27}, {0x7ffffdf, 27}, {0x3ffffe5, 26}, {0xfffff1, 24}, {0x1ffffed, 25},
+	{0x7fff2, 19}, {0x1fffe3, 21}, {0x3ffffe6, 26}, {0x7ffffe0, 27}, {0x7ffffe1, 27}, {0x3ffffe7, 26}, {0x7ffffe2, 27}, {0xfffff2, 24},
+	{0x1fffe4, 21}, {0x1fffe5, 21}, {0x3ffffe8, 26}, {0x3ffffe9, 26}, {0xffffffd, 28}, {0x7ffffe3, 27}, {0x7ffffe4, 27}, {0x7ffffe5, 27},
+	{0xfffec, 20}, {0xfffff3, 24}, {0xfffed, 20}, {0x1fffe6, 21}, {0x3fffe9, 22}, {0x1fffe7, 21}, {0x1fffe8, 21}, {0x7ffff3, 23},
+	{0x3fffea, 22}, {0x3fffeb, 22}, {0x1ffffee, 25}, {0x1ffffef, 25}, {0xfffff4, 24}, {0xfffff5, 24}, {0x3ffffea, 26}, {0x7ffff4, 23},
+	{0x3ffffeb, 26}, {0x7ffffe6, 27}, {0x3ffffec, 26}, {0x3ffffed, 26}, {0x7ffffe7, 27}, {0x7ffffe8, 27}, {0x7ffffe9, 27}, {0x7ffffea, 27},
+	{0x7ffffeb, 27}, {0xffffffe, 28}, {0x7ffffec, 27}, {0x7ffffed, 27}, {0x7ffffee, 27}, {0x7ffffef, 27}, {0x7fffff0, 27}, {0x3ffffee, 26},
+}
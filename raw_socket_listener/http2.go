@@ -0,0 +1,425 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Client starts HTTP/2 connection with this preface, when it knows that server supports HTTP/2 over cleartext TCP
+var http2ClientPreface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// HTTP/2 frame types
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FramePriority     = 0x2
+	http2FrameRSTStream    = 0x3
+	http2FramePushPromise  = 0x5
+	http2FrameContinuation = 0x9
+)
+
+const (
+	http2FrameHeaderLen = 9
+
+	http2SessionIdleTimeout = 5 * time.Minute
+	// Limit for streams of one connection which are waiting for request or response end
+	http2MaxStreams = 1000
+)
+
+var (
+	errHTTP2Padding        = errors.New("http2: invalid padding")
+	errHTTP2FrameSize      = errors.New("http2: invalid frame size")
+	errHTTP2Continuation   = errors.New("http2: unexpected CONTINUATION frame")
+	errHTTP2TooManyStreams = errors.New("http2: too many open streams")
+)
+
+// http2Message is request or response part of the stream
+type http2Message struct {
+	started bool
+	flags   uint8
+	headers []proto.HTTP2Header
+	body    []byte
+}
+
+type http2Stream struct {
+	id       uint32
+	priority proto.HTTP2Priority
+
+	request  http2Message
+	response http2Message
+
+	requestSent bool
+	// Acknowledgment number of response packet, which links it with converted request
+	responseAck uint32
+}
+
+// http2Direction holds frame decoding state of one side of connection
+type http2Direction struct {
+	tcpStream
+
+	// Client preface is not a frame, and should be skipped
+	skip int
+	// Incomplete frame
+	buf   []byte
+	hpack *hpackDecoder
+
+	// Header block split into several frames, it is decoded when the last CONTINUATION frame arrives
+	block       []byte
+	blockStream uint32
+	blockFlags  uint8
+	blockPushed bool
+
+	// Converted messages have own sequence numbers
+	seq uint32
+	fin bool
+}
+
+type http2Session struct {
+	key        tcpConnKey
+	initialSeq uint32
+	broken     bool
+	lastSeen   time.Time
+
+	client  http2Direction
+	server  http2Direction
+	streams map[uint32]*http2Stream
+
+	// Each converted request gets own acknowledgment number, so multiplexed requests are not merged into one message
+	nextAck uint32
+}
+
+// HTTP2Decoder turns HTTP/2 cleartext connections, started with client preface, into HTTP/1.1 messages converted by proto.FromHTTP2.
+// Stream id, priority and flags are kept in the message as X-Http2-* headers.
+//
+// Each message gets single packet, and response packet acknowledges its request, so following HTTP reassembly works unchanged.
+// Packets of other connections are returned as is.
+type HTTP2Decoder struct {
+	port     uint16
+	sessions map[tcpConnKey]*http2Session
+}
+
+// NewHTTP2Decoder creates decoder for traffic on given server port
+func NewHTTP2Decoder(port uint16) *HTTP2Decoder {
+	return &HTTP2Decoder{
+		port:     port,
+		sessions: make(map[tcpConnKey]*http2Session),
+	}
+}
+
+// Decode returns packets with converted messages, which are ended by the packet.
+// If packet does not belong to HTTP/2 connection, `ok` is false and packet should be used as is.
+func (d *HTTP2Decoder) Decode(packet *TCPPacket) (packets []*TCPPacket, ok bool) {
+	isClient := packet.DestPort == d.port
+	key := newTCPConnKey(packet, isClient)
+
+	session, ok := d.sessions[key]
+
+	if isClient && bytes.HasPrefix(packet.Data, http2ClientPreface) && (!ok || session.initialSeq != packet.Seq) {
+		session = &http2Session{
+			key:        key,
+			initialSeq: packet.Seq,
+			streams:    make(map[uint32]*http2Stream),
+			nextAck:    packet.Ack,
+		}
+		session.client.skip = len(http2ClientPreface)
+		session.client.hpack = newHPACKDecoder()
+		session.server.hpack = newHPACKDecoder()
+		d.sessions[key] = session
+		ok = true
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	if session.broken {
+		return nil, true
+	}
+
+	session.lastSeen = time.Now()
+
+	dir := &session.server
+	if isClient {
+		dir = &session.client
+	}
+
+	if !dir.started {
+		dir.seq = packet.Seq
+	}
+
+	data, last, fin, err := dir.push(packet)
+	if err == nil && last != nil {
+		packets, err = d.process(session, dir, isClient, last, data)
+	}
+
+	if err != nil {
+		log.Println("[HTTP2] Can't decode connection from port", session.key.clientPort(), err)
+		session.broken = true
+		return nil, true
+	}
+
+	if fin {
+		dir.fin = true
+		if session.client.fin && session.server.fin {
+			delete(d.sessions, session.key)
+		}
+	}
+
+	return packets, true
+}
+
+// process reads all complete frames, and returns packets with messages which were ended by them
+func (d *HTTP2Decoder) process(session *http2Session, dir *http2Direction, isClient bool, orig *TCPPacket, data []byte) (packets []*TCPPacket, err error) {
+	if dir.skip > 0 {
+		n := dir.skip
+		if n > len(data) {
+			n = len(data)
+		}
+		data, dir.skip = data[n:], dir.skip-n
+	}
+
+	dir.buf = append(dir.buf, data...)
+
+	for len(dir.buf) >= http2FrameHeaderLen {
+		length := int(dir.buf[0])<<16 | int(dir.buf[1])<<8 | int(dir.buf[2])
+		if len(dir.buf) < http2FrameHeaderLen+length {
+			break
+		}
+
+		typ, flags := dir.buf[3], dir.buf[4]
+		streamID := binary.BigEndian.Uint32(dir.buf[5:9]) & 0x7fffffff
+		payload := dir.buf[http2FrameHeaderLen : http2FrameHeaderLen+length]
+		dir.buf = dir.buf[http2FrameHeaderLen+length:]
+
+		var p *TCPPacket
+		if p, err = session.readFrame(dir, isClient, orig, typ, flags, streamID, payload); err != nil {
+			return nil, err
+		}
+
+		if p != nil {
+			packets = append(packets, p)
+		}
+	}
+
+	// Do not keep reference to processed data
+	dir.buf = append(dir.buf[:0:0], dir.buf...)
+
+	return
+}
+
+func (s *http2Session) readFrame(dir *http2Direction, isClient bool, orig *TCPPacket, typ, flags uint8, streamID uint32, payload []byte) (p *TCPPacket, err error) {
+	if dir.block != nil && typ != http2FrameContinuation {
+		return nil, errHTTP2Continuation
+	}
+
+	switch typ {
+	case http2FrameData:
+		if payload, err = http2StripPadding(flags, payload); err != nil {
+			return
+		}
+
+		stream, ok := s.streams[streamID]
+		if !ok {
+			return
+		}
+
+		msg := stream.message(isClient)
+		msg.body = append(msg.body, payload...)
+
+		if flags&proto.HTTP2FlagEndStream != 0 {
+			return s.finish(dir, isClient, stream, orig), nil
+		}
+	case http2FrameHeaders:
+		if payload, err = http2StripPadding(flags, payload); err != nil {
+			return
+		}
+
+		priority := proto.HTTP2DefaultPriority
+		if flags&proto.HTTP2FlagPriority != 0 {
+			if len(payload) < 5 {
+				return nil, errHTTP2FrameSize
+			}
+			priority = http2ReadPriority(payload)
+			payload = payload[5:]
+		}
+
+		stream, ok := s.streams[streamID]
+		if !ok {
+			if stream, err = s.newStream(streamID, priority); err != nil {
+				return
+			}
+		} else if flags&proto.HTTP2FlagPriority != 0 {
+			stream.priority = priority
+		}
+
+		return s.readBlock(dir, isClient, orig, streamID, flags, false, payload)
+	case http2FramePushPromise:
+		if payload, err = http2StripPadding(flags, payload); err != nil {
+			return
+		}
+
+		if len(payload) < 4 {
+			return nil, errHTTP2FrameSize
+		}
+
+		// Promised requests are not sent by client, but their header block still changes HPACK state
+		return s.readBlock(dir, isClient, orig, streamID, flags, true, payload[4:])
+	case http2FrameContinuation:
+		if dir.block == nil || streamID != dir.blockStream {
+			return nil, errHTTP2Continuation
+		}
+
+		return s.readBlock(dir, isClient, orig, streamID, dir.blockFlags|flags&proto.HTTP2FlagEndHeaders, dir.blockPushed, payload)
+	case http2FramePriority:
+		if len(payload) != 5 {
+			return nil, errHTTP2FrameSize
+		}
+
+		if stream, ok := s.streams[streamID]; ok {
+			stream.priority = http2ReadPriority(payload)
+		}
+	case http2FrameRSTStream:
+		delete(s.streams, streamID)
+	}
+
+	return
+}
+
+// readBlock collects header block fragments, and decodes complete block
+func (s *http2Session) readBlock(dir *http2Direction, isClient bool, orig *TCPPacket, streamID uint32, flags uint8, pushed bool, fragment []byte) (*TCPPacket, error) {
+	if flags&proto.HTTP2FlagEndHeaders == 0 {
+		if dir.block == nil {
+			dir.block = []byte{}
+		}
+		dir.block = append(dir.block, fragment...)
+		dir.blockStream, dir.blockFlags, dir.blockPushed = streamID, flags, pushed
+		return nil, nil
+	}
+
+	block := fragment
+	if dir.block != nil {
+		block = append(dir.block, fragment...)
+		dir.block = nil
+	}
+
+	headers, err := dir.hpack.Decode(block)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, ok := s.streams[streamID]
+	if pushed || !ok {
+		return nil, nil
+	}
+
+	msg := stream.message(isClient)
+
+	// Informational responses precede the final one
+	if !isClient && !msg.started && len(headers) > 0 && headers[0].Name == ":status" && strings.HasPrefix(headers[0].Value, "1") {
+		return nil, nil
+	}
+
+	if !msg.started {
+		msg.started = true
+		msg.flags = flags
+	}
+	// Block after the body contains trailers
+	msg.headers = append(msg.headers, headers...)
+
+	if flags&proto.HTTP2FlagEndStream != 0 {
+		return s.finish(dir, isClient, stream, orig), nil
+	}
+
+	return nil, nil
+}
+
+func (s *http2Session) newStream(id uint32, priority proto.HTTP2Priority) (*http2Stream, error) {
+	if len(s.streams) >= http2MaxStreams {
+		// Responses may be not captured, so streams which are waiting only for them are removed first
+		for streamID, stream := range s.streams {
+			if stream.requestSent {
+				delete(s.streams, streamID)
+			}
+		}
+
+		if len(s.streams) >= http2MaxStreams {
+			return nil, errHTTP2TooManyStreams
+		}
+	}
+
+	stream := &http2Stream{id: id, priority: priority}
+	s.streams[id] = stream
+
+	return stream, nil
+}
+
+func (st *http2Stream) message(isClient bool) *http2Message {
+	if isClient {
+		return &st.request
+	}
+
+	return &st.response
+}
+
+// finish converts ended message into packet
+func (s *http2Session) finish(dir *http2Direction, isClient bool, stream *http2Stream, orig *TCPPacket) *TCPPacket {
+	msg := stream.message(isClient)
+
+	payload := proto.FromHTTP2(msg.headers, msg.body, &proto.HTTP2Stream{ID: stream.id, Priority: stream.priority, Flags: msg.flags})
+	*msg = http2Message{}
+
+	seq := dir.seq
+	dir.seq += uint32(len(payload))
+
+	var ack uint32
+	if isClient {
+		s.nextAck++
+		ack = s.nextAck
+
+		stream.requestSent = true
+		stream.responseAck = dir.seq
+	} else {
+		ack = stream.responseAck
+		delete(s.streams, stream.id)
+	}
+
+	return buildTCPPacket(orig, seq, ack, false, payload)
+}
+
+func http2StripPadding(flags uint8, payload []byte) ([]byte, error) {
+	if flags&proto.HTTP2FlagPadded == 0 {
+		return payload, nil
+	}
+
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, errHTTP2Padding
+	}
+
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+func http2ReadPriority(payload []byte) proto.HTTP2Priority {
+	dependency := binary.BigEndian.Uint32(payload[0:4])
+
+	return proto.HTTP2Priority{
+		StreamDependency: dependency & 0x7fffffff,
+		Exclusive:        dependency&0x80000000 != 0,
+		Weight:           int(payload[4]) + 1,
+	}
+}
+
+// GC removes sessions without any activity
+func (d *HTTP2Decoder) GC() {
+	now := time.Now()
+	for key, s := range d.sessions {
+		if now.Sub(s.lastSeen) > http2SessionIdleTimeout {
+			delete(d.sessions, key)
+		}
+	}
+}
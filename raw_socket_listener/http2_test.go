@@ -0,0 +1,293 @@
+package rawSocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"golang.org/x/net/http2/hpack"
+)
+
+func http2Frame(typ, flags uint8, streamID uint32, payload []byte) []byte {
+	frame := make([]byte, http2FrameHeaderLen, http2FrameHeaderLen+len(payload))
+	frame[0], frame[1], frame[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	frame[3], frame[4] = typ, flags
+	binary.BigEndian.PutUint32(frame[5:9], streamID)
+
+	return append(frame, payload...)
+}
+
+// Encodes headers as literals without indexing, short names and values only
+func hpackLiterals(headers ...string) (block []byte) {
+	for i := 0; i < len(headers); i += 2 {
+		block = append(block, 0, byte(len(headers[i])))
+		block = append(block, headers[i]...)
+		block = append(block, byte(len(headers[i+1])))
+		block = append(block, headers[i+1]...)
+	}
+
+	return
+}
+
+func TestHPACKDecode(t *testing.T) {
+	// Requests with Huffman coding, from Appendix C.4 of RFC 7541, share dynamic table
+	blocks := []string{
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828684be5886a8eb10649cbf",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	}
+
+	expected := [][]proto.HTTP2Header{
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":authority", Value: "www.example.com"}},
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":authority", Value: "www.example.com"}, {Name: "cache-control", Value: "no-cache"}},
+		{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "https"}, {Name: ":path", Value: "/index.html"}, {Name: ":authority", Value: "www.example.com"}, {Name: "custom-key", Value: "custom-value"}},
+	}
+
+	decoder := newHPACKDecoder()
+
+	for i, b := range blocks {
+		block, _ := hex.DecodeString(b)
+
+		headers, err := decoder.Decode(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(headers, expected[i]) {
+			t.Errorf("Block %d: expected %v, got %v", i, expected[i], headers)
+		}
+	}
+
+	if decoder.size != 164 {
+		t.Error("Dynamic table size should be 164, got", decoder.size)
+	}
+
+	if _, err := decoder.Decode([]byte{0xff}); err != errHPACKTruncated {
+		t.Error("Should fail on truncated block", err)
+	}
+}
+
+func TestHPACKHuffmanLiterals(t *testing.T) {
+	var all []byte
+	for b := 0; b < 256; b++ {
+		all = append(all, byte(b))
+	}
+
+	// Reference encoder uses Huffman coding whenever it is shorter
+	var buf bytes.Buffer
+	encoder := hpack.NewEncoder(&buf)
+	fields := []hpack.HeaderField{
+		{Name: "user-agent", Value: "Mozilla/5.0 (X11; Linux x86_64)"},
+		{Name: "x-binary", Value: string(all)},
+		{Name: "x-token", Value: "Bearer eyJhbGciOiJIUzI1NiJ9", Sensitive: true},
+	}
+	for _, f := range fields {
+		encoder.WriteField(f)
+	}
+
+	headers, err := newHPACKDecoder().Decode(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range fields {
+		if i >= len(headers) || headers[i].Name != f.Name || headers[i].Value != f.Value {
+			t.Fatalf("Field %d: expected %s: %q, got %v", i, f.Name, f.Value, headers)
+		}
+	}
+
+	for _, s := range []string{
+		// Padding is not made of ones
+		"0081" + "00",
+		// EOS symbol
+		"0084" + "ffffffff",
+		// Padding longer than 7 bits
+		"0082" + "1fff",
+	} {
+		block, _ := hex.DecodeString(s)
+		if _, err := newHPACKDecoder().Decode(block); err != errHPACKHuffman {
+			t.Errorf("%s: expected Huffman error, got %v", s, err)
+		}
+	}
+}
+
+func TestHPACKDynamicTableEviction(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := hpack.NewEncoder(&buf)
+	encoder.SetMaxDynamicTableSize(256)
+
+	decoder := newHPACKDecoder()
+
+	// Fields do not fit into the table together, so older ones are evicted and encoded as literals again
+	for i := 0; i < 20; i++ {
+		buf.Reset()
+
+		var fields []hpack.HeaderField
+		for j := 0; j < 3; j++ {
+			n := (i + j) % 7
+			fields = append(fields, hpack.HeaderField{Name: "x-header-" + strconv.Itoa(n), Value: strings.Repeat("v", 20+n*5)})
+		}
+		for _, f := range fields {
+			encoder.WriteField(f)
+		}
+
+		headers, err := decoder.Decode(buf.Bytes())
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		for j, f := range fields {
+			if j >= len(headers) || headers[j].Name != f.Name || headers[j].Value != f.Value {
+				t.Fatalf("Block %d field %d: expected %s: %q, got %v", i, j, f.Name, f.Value, headers)
+			}
+		}
+
+		if decoder.size > 256 {
+			t.Fatal("Dynamic table should be evicted to 256 bytes, got", decoder.size)
+		}
+	}
+
+	// Size update evicts all entries, so the first dynamic index is not valid anymore
+	if _, err := decoder.Decode([]byte{0x20, 0x80 | byte(len(hpackStaticTable)+1)}); err != errHPACKInvalidIndex {
+		t.Error("Expected invalid index after table is emptied, got", err)
+	}
+	if decoder.size != 0 || len(decoder.dynamic) != 0 {
+		t.Error("Dynamic table should be empty:", decoder.size, len(decoder.dynamic))
+	}
+}
+
+func TestHTTP2Listener(t *testing.T) {
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
+	defer listener.Close()
+
+	var preface []byte
+	preface = append(preface, http2ClientPreface...)
+	preface = append(preface, http2Frame(0x4, 0, 0, nil)...)
+
+	// Stream 1: exclusive dependency on stream 0 with weight 32, header block continues in next frame, and body follows
+	var client []byte
+	priority := []byte{0x80, 0, 0, 0, 31}
+	client = append(client, http2Frame(http2FrameHeaders, proto.HTTP2FlagPriority, 1, append(priority, hpackLiterals(":method", "POST", ":path", "/upload")...))...)
+	client = append(client, http2Frame(http2FrameContinuation, proto.HTTP2FlagEndHeaders, 1, hpackLiterals(":authority", "www.w3.org"))...)
+
+	// Stream 3 is multiplexed and ends first
+	client = append(client, http2Frame(http2FrameHeaders, proto.HTTP2FlagEndHeaders|proto.HTTP2FlagEndStream, 3, hpackLiterals(":method", "GET", ":path", "/", ":authority", "www.w3.org"))...)
+
+	// Padded body of stream 1 comes in the next packet
+	body := http2Frame(http2FrameData, proto.HTTP2FlagEndStream|proto.HTTP2FlagPadded, 1, []byte{2, 'a', '=', '1', 0, 0})
+
+	var server []byte
+	server = append(server, http2Frame(0x4, 0, 0, nil)...)
+	server = append(server, http2Frame(http2FrameHeaders, proto.HTTP2FlagEndHeaders, 3, hpackLiterals(":status", "200"))...)
+	server = append(server, http2Frame(http2FrameData, proto.HTTP2FlagEndStream, 3, []byte("ok"))...)
+	server = append(server, http2Frame(http2FrameHeaders, proto.HTTP2FlagEndHeaders|proto.HTTP2FlagEndStream, 1, hpackLiterals(":status", "404"))...)
+
+	prefacePacket := buildPacket(true, 1, 1, preface, time.Now())
+	reqPacket := nextPacket(prefacePacket, client)
+	bodyPacket := nextPacket(reqPacket, body)
+	respPacket := responsePacket(bodyPacket, server)
+
+	clientAddr, serverAddr := []byte{127, 0, 0, 1}, []byte{127, 0, 0, 2}
+	for _, p := range []*TCPPacket{prefacePacket, reqPacket, bodyPacket} {
+		p.Addr, p.DstAddr = clientAddr, serverAddr
+	}
+	respPacket.Addr, respPacket.DstAddr = serverAddr, clientAddr
+
+	listener.packetsChan <- prefacePacket.dump()
+	// Body segment comes first, and should wait for preceding one
+	listener.packetsChan <- bodyPacket.dump()
+	listener.packetsChan <- reqPacket.dump()
+	listener.packetsChan <- respPacket.dump()
+
+	requests := make(map[string]*TCPMessage)
+	responses := make(map[string]*TCPMessage)
+
+	for i := 0; i < 4; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			id := string(proto.Header(m.Bytes(), []byte(proto.HTTP2StreamIDHeader)))
+			if m.IsIncoming {
+				requests[id] = m
+			} else {
+				responses[id] = m
+			}
+		case <-time.After(50 * time.Millisecond):
+			t.Fatal("Should return requests and responses of both streams, got", len(requests), len(responses))
+		}
+	}
+
+	expected := "POST /upload HTTP/1.1\r\nHost: www.w3.org\r\nX-Http2-Stream-Id: 1\r\nX-Http2-Priority: weight=32; depends-on=0; exclusive=1\r\nX-Http2-Flags: END_HEADERS,PRIORITY\r\nContent-Length: 3\r\n\r\na=1"
+	if req, ok := requests["1"]; !ok || string(req.Bytes()) != expected {
+		t.Errorf("Expected %q, got %v", expected, requests)
+	}
+
+	expected = "GET / HTTP/1.1\r\nHost: www.w3.org\r\nX-Http2-Stream-Id: 3\r\nX-Http2-Priority: weight=16; depends-on=0; exclusive=0\r\nX-Http2-Flags: END_STREAM,END_HEADERS\r\n\r\n"
+	if req, ok := requests["3"]; !ok || string(req.Bytes()) != expected {
+		t.Errorf("Expected %q, got %v", expected, requests)
+	}
+
+	for id, resp := range responses {
+		if resp.AssocMessage != requests[id] || !bytes.Equal(resp.UUID(), requests[id].UUID()) {
+			t.Error("Response should be paired with request of the same stream", id)
+		}
+	}
+
+	if !bytes.HasPrefix(responses["3"].Bytes(), []byte("HTTP/1.1 200 OK\r\n")) || !bytes.HasSuffix(responses["3"].Bytes(), []byte("\r\n\r\nok")) {
+		t.Errorf("Wrong response: %q", responses["3"].Bytes())
+	}
+
+	if !bytes.HasPrefix(responses["1"].Bytes(), []byte("HTTP/1.1 404 Not Found\r\n")) {
+		t.Errorf("Wrong response: %q", responses["1"].Bytes())
+	}
+}
+
+func TestHTTP2ListenerPassHTTP1(t *testing.T) {
+	decoder := NewHTTP2Decoder(0)
+
+	if _, ok := decoder.Decode(buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now())); ok {
+		t.Error("HTTP/1.1 packets should be passed as is")
+	}
+}
+
+func TestHTTP2ListenerProtocol(t *testing.T) {
+	var h2 []byte
+	h2 = append(h2, http2ClientPreface...)
+	h2 = append(h2, http2Frame(http2FrameHeaders, proto.HTTP2FlagEndHeaders|proto.HTTP2FlagEndStream, 1, hpackLiterals(":method", "GET", ":path", "/h2", ":authority", "www.w3.org"))...)
+
+	// Returns first line of each captured message
+	capture := func(protocol string) (lines []string) {
+		listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, Expire: 10 * time.Millisecond, Protocol: protocol})
+		defer listener.Close()
+
+		listener.packetsChan <- buildPacket(true, 1, 1, []byte("GET /h1 HTTP/1.1\r\n\r\n"), time.Now()).dump()
+		listener.packetsChan <- buildPacket(true, 2, 100, h2, time.Now()).dump()
+
+		for {
+			select {
+			case m := <-listener.messagesChan:
+				lines = append(lines, string(bytes.SplitN(m.Bytes(), []byte("\r\n"), 2)[0]))
+			case <-time.After(100 * time.Millisecond):
+				sort.Strings(lines)
+				return
+			}
+		}
+	}
+
+	if lines := capture(ProtocolAuto); len(lines) != 2 || lines[0] != "GET /h1 HTTP/1.1" || lines[1] != "GET /h2 HTTP/1.1" {
+		t.Errorf("Both protocols should be captured: %q", lines)
+	}
+
+	if lines := capture(ProtocolHTTP2); len(lines) != 1 || lines[0] != "GET /h2 HTTP/1.1" {
+		t.Errorf("Only HTTP/2 should be captured: %q", lines)
+	}
+
+	// HTTP/2 connection is passed as is
+	if lines := capture(ProtocolHTTP1); len(lines) != 2 || lines[0] != "GET /h1 HTTP/1.1" || lines[1] != "PRI * HTTP/2.0" {
+		t.Errorf("HTTP/2 should not be decoded: %q", lines)
+	}
+}
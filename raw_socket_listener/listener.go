@@ -16,6 +16,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"net"
@@ -24,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buger/goreplay/proto"
@@ -37,12 +39,18 @@ var _ = fmt.Println
 
 type packet struct {
 	srcIP     []byte
+	dstIP     []byte
 	data      []byte
 	timestamp time.Time
 }
 
 // Listener handle traffic capture
 type Listener struct {
+	// Keep counters first in the struct, to guarantee 64bit alignment for atomic operations on 32bit machines
+	messagesEmitted uint64
+	messagesExpired uint64
+	streamsNonHTTP  uint64
+
 	mu sync.Mutex
 	// buffer of TCPMessages waiting to be send
 	// ID -> TCPMessage
@@ -72,13 +80,28 @@ type Listener struct {
 	trackResponse bool
 	messageExpire time.Duration
 
-	bpfFilter       string
-	timestampType   string
-	overrideSnapLen bool
-	immediateMode   bool
+	bpfFilter     string
+	timestampType string
+	snapLen       int
+	immediateMode bool
 
 	bufferSize int64
 
+	// Decrypts TLS traffic if key log file is set
+	tlsDecryptor *TLSDecryptor
+	// Converts HTTP/2 connections to HTTP/1.1 messages
+	http2Decoder *HTTP2Decoder
+	// One of Protocol* constants
+	protocol string
+	// One of Detect* constants, if connections should be classified before reassembly
+	protocolDetect   string
+	protocolDetector *protocolDetector
+	// Number of captured UDP datagrams, shared with workers
+	udpCounter *uint32
+
+	// If set, packets are reassembled by workers, each of them handles own part of connections
+	workers []*Listener
+
 	conn        net.PacketConn
 	pcapHandles []*pcap.Handle
 
@@ -97,56 +120,191 @@ const (
 	EngineRawSocket = 1 << iota
 	EnginePcap
 	EnginePcapFile
+	EngineEBPF
+)
+
+// Application protocols which listener reassembles
+const (
+	// HTTP/1.x, and HTTP/2 connections which are started with client preface
+	ProtocolAuto = "auto"
+	// Only HTTP/1.x, HTTP/2 connections are not recognized
+	ProtocolHTTP1 = "http1"
+	// Only HTTP/2 cleartext connections, other traffic is ignored
+	ProtocolHTTP2 = "http2"
+	// UDP datagrams, each datagram is emitted as separate message
+	ProtocolUDP = "udp"
 )
 
+// ListenerConfig holds options of Listener
+type ListenerConfig struct {
+	// One of Engine* constants
+	Engine        int
+	TrackResponse bool
+	// How long to wait for the last packet of message, 2s by default
+	Expire        time.Duration
+	BPFFilter     string
+	TimestampType string
+	BufferSize    int64
+	SnapLen       int
+	ImmediateMode bool
+	// Key log file in NSS format, used to decrypt TLS traffic
+	TLSKeyLog string
+	// Number of goroutines doing TCP reassembly
+	Workers int
+	// One of Protocol* constants, ProtocolAuto by default
+	Protocol string
+	// One of Detect* constants, connections are not classified by default
+	ProtocolDetect string
+}
+
 // NewListener creates and initializes new Listener object
-func NewListener(addr string, port string, engine int, trackResponse bool, expire time.Duration, bpfFilter string, timestampType string, bufferSize int64, overrideSnapLen bool, immediateMode bool) (l *Listener) {
+//
+// If config.Workers is more than 1, TCP reassembly is done in parallel, by given number of goroutines.
+// Packets of one connection are always handled by the same worker, so its messages keep order,
+// but messages of different connections can be received in different order than they were captured.
+func NewListener(addr string, port string, config ListenerConfig) (l *Listener) {
 	l = &Listener{}
 
+	switch config.Protocol {
+	case "":
+		config.Protocol = ProtocolAuto
+	case ProtocolAuto, ProtocolHTTP1, ProtocolHTTP2:
+	case ProtocolUDP:
+		if config.Engine == EngineEBPF {
+			log.Fatal("UDP capture is not supported by eBPF engine")
+		}
+		if config.TrackResponse {
+			log.Println("Responses are not tracked for UDP, only datagrams sent to the port are captured")
+			config.TrackResponse = false
+		}
+	default:
+		log.Fatal("Unknown protocol: ", config.Protocol)
+	}
+	l.protocol = config.Protocol
+
+	switch config.ProtocolDetect {
+	case "", DetectDrop, DetectRaw:
+	default:
+		log.Fatal("Unknown protocol detection mode: ", config.ProtocolDetect)
+	}
+	if config.ProtocolDetect != "" && config.Protocol == ProtocolUDP {
+		log.Fatal("Protocol detection is not supported for UDP")
+	}
+	l.protocolDetect = config.ProtocolDetect
+	l.udpCounter = new(uint32)
+
 	l.packetsChan = make(chan *packet, 10000)
 	l.messagesChan = make(chan *TCPMessage, 10000)
 	l.quit = make(chan bool)
 	l.readyCh = make(chan bool, 1)
 
-	l.messages = make(map[tcpID]*TCPMessage)
-	l.ackAliases = make(map[uint32]uint32)
-	l.seqWithData = make(map[uint32]uint32)
-	l.respAliases = make(map[uint32]*TCPMessage)
-	l.respWithoutReq = make(map[uint32]tcpID)
-	l.trackResponse = trackResponse
-	l.bpfFilter = bpfFilter
-	l.timestampType = timestampType
-	l.immediateMode = immediateMode
-	l.bufferSize = bufferSize
-	l.overrideSnapLen = overrideSnapLen
+	l.trackResponse = config.TrackResponse
+	l.bpfFilter = config.BPFFilter
+	l.timestampType = config.TimestampType
+	l.immediateMode = config.ImmediateMode
+	l.bufferSize = config.BufferSize
+	l.snapLen = config.SnapLen
 
 	l.addr = addr
 	_port, _ := strconv.Atoi(port)
 	l.port = uint16(_port)
 
-	if expire.Nanoseconds() == 0 {
-		expire = 2000 * time.Millisecond
+	if config.TLSKeyLog != "" {
+		l.tlsDecryptor = NewTLSDecryptor(config.TLSKeyLog, l.port)
+	}
+	l.initReassembly()
+
+	if config.Expire.Nanoseconds() == 0 {
+		config.Expire = 2000 * time.Millisecond
 	}
 
-	l.messageExpire = expire
+	l.messageExpire = config.Expire
+
+	if config.Workers > 1 {
+		l.workers = make([]*Listener, config.Workers)
+		for i := range l.workers {
+			l.workers[i] = l.newWorker()
+			go l.workers[i].listen()
+		}
+	}
 
 	go l.listen()
 
 	// Special case for testing
 	if l.port != 0 {
-		switch engine {
+		switch config.Engine {
 		case EnginePcap:
 			go l.readPcap()
 		case EnginePcapFile:
 			go l.readPcapFile()
+		case EngineEBPF:
+			go l.readEBPF()
 		default:
-			log.Fatal("Unknown traffic interception engine:", engine)
+			log.Fatal("Unknown traffic interception engine:", config.Engine)
 		}
 	}
 
 	return
 }
 
+func (t *Listener) initReassembly() {
+	t.messages = make(map[tcpID]*TCPMessage)
+	t.ackAliases = make(map[uint32]uint32)
+	t.seqWithData = make(map[uint32]uint32)
+	t.respAliases = make(map[uint32]*TCPMessage)
+	t.respWithoutReq = make(map[uint32]tcpID)
+	t.http2Decoder = NewHTTP2Decoder(t.port)
+	if t.protocolDetect != "" {
+		t.protocolDetector = newProtocolDetector(t.port)
+	}
+}
+
+// newWorker creates listener with own reassembly state, which sends messages to the same channel
+func (t *Listener) newWorker() *Listener {
+	w := &Listener{
+		addr:           t.addr,
+		port:           t.port,
+		trackResponse:  t.trackResponse,
+		messageExpire:  t.messageExpire,
+		protocol:       t.protocol,
+		protocolDetect: t.protocolDetect,
+		udpCounter:     t.udpCounter,
+		packetsChan:    make(chan *packet, cap(t.packetsChan)),
+		messagesChan:   t.messagesChan,
+		quit:           t.quit,
+	}
+	w.initReassembly()
+
+	if t.tlsDecryptor != nil {
+		w.tlsDecryptor = t.tlsDecryptor.Fork()
+	}
+
+	return w
+}
+
+// workerIndex returns worker for connection of the packet, both directions of connection get the same one
+func (t *Listener) workerIndex(p *packet) int {
+	srcPort, dstPort := p.data[0:2], p.data[2:4]
+	clientIP, serverIP := p.srcIP, p.dstIP
+	if binary.BigEndian.Uint16(dstPort) != t.port {
+		srcPort, dstPort = dstPort, srcPort
+		clientIP, serverIP = serverIP, clientIP
+	}
+
+	h := fnv.New32a()
+	// Raw socket engine does not provide destination address
+	if len(p.dstIP) > 0 {
+		h.Write(clientIP)
+		h.Write(serverIP)
+	}
+	h.Write(srcPort)
+	h.Write(dstPort)
+
+	// Low bits of FNV hash depend only on low bits of input, so high ones are mixed in
+	sum := h.Sum32()
+	return int((sum ^ sum>>16) % uint32(len(t.workers)))
+}
+
 func (t *Listener) listen() {
 	gcTicker := time.Tick(t.messageExpire / 2)
 
@@ -156,13 +314,54 @@ func (t *Listener) listen() {
 			if t.conn != nil {
 				t.conn.Close()
 			}
+			if t.tlsDecryptor != nil {
+				t.tlsDecryptor.Close()
+			}
 			return
 		case packet := <-t.packetsChan:
+			if t.workers != nil {
+				t.workers[t.workerIndex(packet)].packetsChan <- packet
+				continue
+			}
+
+			if t.protocol == ProtocolUDP {
+				t.processUDPPacket(packet)
+				continue
+			}
+
 			tcpPacket := ParseTCPPacket(packet.srcIP, packet.data, packet.timestamp)
-			t.processTCPPacket(tcpPacket)
+			tcpPacket.DstAddr = packet.dstIP
+
+			// Reset is captured only to forget connection
+			if tcpPacket.IsRST && len(tcpPacket.Data) == 0 {
+				if t.protocolDetector != nil {
+					t.protocolDetector.IsHTTP(tcpPacket)
+				}
+				continue
+			}
+
+			if t.tlsDecryptor != nil {
+				for _, p := range t.tlsDecryptor.Decrypt(tcpPacket) {
+					// Responses are captured only for decryption
+					if t.trackResponse || p.DestPort == t.port {
+						t.decodeTCPPacket(p)
+					}
+				}
+				continue
+			}
+
+			t.decodeTCPPacket(tcpPacket)
 		case <-gcTicker:
 			now := time.Now()
 
+			if t.tlsDecryptor != nil {
+				t.tlsDecryptor.GC()
+			}
+			t.http2Decoder.GC()
+			if t.protocolDetector != nil {
+				t.protocolDetector.GC()
+			}
+
 			// Dispatch requests before responses
 			for _, message := range t.messages {
 				if now.Sub(message.End) >= t.messageExpire {
@@ -199,6 +398,7 @@ func (t *Listener) dispatchMessage(message *TCPMessage) {
 			delete(t.respAliases, message.Ack)
 			delete(t.respWithoutReq, message.Ack)
 		}
+		atomic.AddUint64(&t.messagesExpired, 1)
 
 		return
 	}
@@ -243,6 +443,7 @@ func (t *Listener) dispatchMessage(message *TCPMessage) {
 		}
 	}
 
+	atomic.AddUint64(&t.messagesEmitted, 1)
 	t.messagesChan <- message
 }
 
@@ -288,40 +489,73 @@ func isLoopback(device pcap.Interface) bool {
 
 func listenAllInterfaces(addr string) bool {
 	switch addr {
-	case "", "0.0.0.0", "[::]", "::":
+	case "", "0.0.0.0", "[::]", "::", "any":
 		return true
 	default:
 		return false
 	}
 }
 
+// findPcapDevices returns interfaces matching comma separated list of interface names or IPs,
+// or all interfaces with address assigned. Loopback interface is always included.
 func findPcapDevices(addr string) (interfaces []pcap.Interface, err error) {
 	devices, err := pcap.FindAllDevs()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	wanted := strings.Split(addr, ",")
+	found := make(map[string]bool)
+
 	for _, device := range devices {
 		if listenAllInterfaces(addr) && len(device.Addresses) > 0 || isLoopback(device) {
 			interfaces = append(interfaces, device)
 			continue
 		}
 
-		for _, address := range device.Addresses {
-			if device.Name == addr || address.IP.String() == addr {
+		for _, w := range wanted {
+			if deviceMatches(device, w) {
 				interfaces = append(interfaces, device)
-				return interfaces, nil
+				found[w] = true
+				break
 			}
 		}
 	}
 
-	if len(interfaces) == 0 {
-		return nil, &DeviceNotFoundError{addr}
+	if listenAllInterfaces(addr) {
+		if len(interfaces) == 0 {
+			return nil, &DeviceNotFoundError{addr}
+		}
+		return interfaces, nil
+	}
+
+	for _, w := range wanted {
+		if !found[w] {
+			return nil, &DeviceNotFoundError{w}
+		}
 	}
 
 	return interfaces, nil
 }
 
+// deviceMatches tells if addr is name or one of IPs of the device
+func deviceMatches(device pcap.Interface, addr string) bool {
+	if device.Name == addr {
+		return true
+	}
+
+	// IPv6 address can be written in different forms
+	ip := net.ParseIP(addr)
+
+	for _, address := range device.Addresses {
+		if address.IP.String() == addr || ip != nil && address.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (t *Listener) readPcap() {
 	devices, err := findPcapDevices(t.addr)
 	if err != nil {
@@ -353,7 +587,9 @@ func (t *Listener) readPcap() {
 				}
 			}
 
-			if it, err := net.InterfaceByName(device.Name); err == nil && !t.overrideSnapLen {
+			if t.snapLen > 0 {
+				inactive.SetSnapLen(t.snapLen)
+			} else if it, err := net.InterfaceByName(device.Name); err == nil {
 				// Auto-guess max length of packet to capture
 				inactive.SetSnapLen(it.MTU + 68*2)
 			} else {
@@ -377,7 +613,7 @@ func (t *Listener) readPcap() {
 				return
 			}
 
-			defer handle.Close()
+			defer t.closePcapHandle(handle)
 
 			t.mu.Lock()
 			t.pcapHandles = append(t.pcapHandles, handle)
@@ -409,10 +645,15 @@ func (t *Listener) readPcap() {
 			if bpfSupported {
 				var bpf string
 
-				if t.trackResponse {
-					bpf = "(tcp dst port " + strconv.Itoa(int(t.port)) + " and (" + bpfDstHost + ")) or (" + "tcp src port " + strconv.Itoa(int(t.port)) + " and (" + bpfSrcHost + "))"
+				transport := "tcp"
+				if t.protocol == ProtocolUDP {
+					transport = "udp"
+				}
+
+				if t.captureResponses() {
+					bpf = "(" + transport + " dst port " + strconv.Itoa(int(t.port)) + " and (" + bpfDstHost + ")) or (" + transport + " src port " + strconv.Itoa(int(t.port)) + " and (" + bpfSrcHost + "))"
 				} else {
-					bpf = "tcp dst port " + strconv.Itoa(int(t.port)) + " and (" + bpfDstHost + ")"
+					bpf = transport + " dst port " + strconv.Itoa(int(t.port)) + " and (" + bpfDstHost + ")"
 				}
 
 				if t.bpfFilter != "" {
@@ -421,6 +662,7 @@ func (t *Listener) readPcap() {
 
 				if err := handle.SetBPFFilter(bpf); err != nil {
 					log.Println("BPF filter error:", err, "Device:", device.Name, bpf)
+					t.mu.Unlock()
 					wg.Done()
 					return
 				}
@@ -477,61 +719,32 @@ func (t *Listener) readPcap() {
 
 				data = packet.Data()[of:]
 
-				version := uint8(data[0]) >> 4
-				ipLength := int(binary.BigEndian.Uint16(data[2:4]))
-
-				if version == 4 {
-					ihl := uint8(data[0]) & 0x0F
-
-					// Truncated IP info
-					if len(data) < int(ihl*4) {
-						continue
-					}
-
-					srcIP = data[12:16]
-					dstIP = data[16:20]
-
-					// Too small IP packet
-					if ipLength < 20 {
-						continue
-					}
+				var ok bool
+				if data, srcIP, dstIP, ok = stripIPHeader(data); !ok {
+					continue
+				}
 
-					// Invalid length
-					if int(ihl*4) > ipLength {
-						continue
-					}
+				var hasData bool
 
-					if cmp := len(data) - ipLength; cmp > 0 {
-						data = data[:ipLength]
-					} else if cmp < 0 {
-						// Truncated packet
-						continue
-					}
-
-					data = data[ihl*4:]
+				if t.protocol == ProtocolUDP {
+					// UDP header is always 8 bytes, empty datagrams are skipped
+					hasData = len(data) > 8
 				} else {
-					// Truncated IP info
-					if len(data) < 40 {
+					// Truncated TCP info
+					if len(data) <= 13 {
 						continue
 					}
 
-					srcIP = data[8:24]
-					dstIP = data[24:40]
+					dataOffset := (data[12] & 0xF0) >> 4
+					// FIN and RST close connection
+					isClosing := data[13]&0x05 != 0
 
-					data = data[40:]
-				}
-
-				// Truncated TCP info
-				if len(data) <= 13 {
-					continue
+					// We need only packets with data inside
+					// Check that the buffer is larger than the size of the TCP header
+					hasData = len(data) > int(dataOffset*4) || isClosing
 				}
 
-				dataOffset := (data[12] & 0xF0) >> 4
-				isFIN := data[13]&0x01 != 0
-
-				// We need only packets with data inside
-				// Check that the buffer is larger than the size of the TCP header
-				if len(data) > int(dataOffset*4) || isFIN {
+				if hasData {
 					if !bpfSupported {
 						destPort := binary.BigEndian.Uint16(data[2:4])
 						srcPort := binary.BigEndian.Uint16(data[0:2])
@@ -542,7 +755,7 @@ func (t *Listener) readPcap() {
 							addrCheck = dstIP
 						}
 
-						if t.trackResponse && srcPort == t.port {
+						if t.captureResponses() && srcPort == t.port {
 							addrCheck = srcIP
 						}
 
@@ -579,7 +792,7 @@ func (t *Listener) readPcap() {
 						}
 					}
 
-					t.packetsChan <- t.buildPacket(srcIP, data, packet.Metadata().Timestamp)
+					t.packetsChan <- t.buildPacket(srcIP, dstIP, data, packet.Metadata().Timestamp)
 				}
 			}
 		}(d)
@@ -612,9 +825,20 @@ func (t *Listener) readPcapFile() {
 				continue
 			}
 
-			var addr, data []byte
+			var addr, dstAddr, data []byte
+
+			if t.protocol == ProtocolUDP {
+				udpLayer := packet.Layer(layers.LayerTypeUDP)
+				if udpLayer == nil {
+					continue
+				}
 
-			if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+				udp, _ := udpLayer.(*layers.UDP)
+				if uint16(udp.DstPort) != t.port || len(udp.LayerPayload()) == 0 {
+					continue
+				}
+				data = append(udp.LayerContents(), udp.LayerPayload()...)
+			} else if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
 				tcp, _ := tcpLayer.(*layers.TCP)
 				data = append(tcp.LayerContents(), tcp.LayerPayload()...)
 
@@ -631,31 +855,39 @@ func (t *Listener) readPcapFile() {
 
 			if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
 				ip, _ := ipLayer.(*layers.IPv4)
-				addr = ip.SrcIP
+				addr, dstAddr = ip.SrcIP, ip.DstIP
 			} else if ipLayer = packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
 				ip, _ := ipLayer.(*layers.IPv6)
-				addr = ip.SrcIP
+				addr, dstAddr = ip.SrcIP, ip.DstIP
 			} else {
 				// log.Println("Can't find IP layer", packet)
 				continue
 			}
 
-			dataOffset := (data[12] & 0xF0) >> 4
-			isFIN := data[13]&0x01 != 0
+			if t.protocol != ProtocolUDP {
+				dataOffset := (data[12] & 0xF0) >> 4
+				// FIN and RST close connection
+				isClosing := data[13]&0x05 != 0
 
-			// We need only packets with data inside
-			// Check that the buffer is larger than the size of the TCP header
-			if len(data) <= int(dataOffset*4) && !isFIN {
-				continue
+				// We need only packets with data inside
+				// Check that the buffer is larger than the size of the TCP header
+				if len(data) <= int(dataOffset*4) && !isClosing {
+					continue
+				}
 			}
 
-			t.packetsChan <- t.buildPacket(addr, data, packet.Metadata().Timestamp)
+			t.packetsChan <- t.buildPacket(addr, dstAddr, data, packet.Metadata().Timestamp)
 		}
 	}
 }
 
 func (t *Listener) readRAWSocket() {
-	conn, e := net.ListenPacket("ip:tcp", t.addr)
+	network := "ip:tcp"
+	if t.protocol == ProtocolUDP {
+		network = "ip:udp"
+	}
+
+	conn, e := net.ListenPacket(network, t.addr)
 	t.conn = conn
 
 	if e != nil {
@@ -682,28 +914,124 @@ func (t *Listener) readRAWSocket() {
 
 		if n > 0 {
 			if t.isValidPacket(buf[:n]) {
-				t.packetsChan <- t.buildPacket([]byte(addr.(*net.IPAddr).IP), buf[:n], time.Now())
+				t.packetsChan <- t.buildPacket([]byte(addr.(*net.IPAddr).IP), nil, buf[:n], time.Now())
 			}
 		}
 	}
 }
 
-func (t *Listener) buildPacket(packetSrcIP []byte, packetData []byte, timestamp time.Time) *packet {
+// IPv6 extension headers which can precede TCP or UDP header
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6AuthHeader  = 51
+	ipv6DestOptions = 60
+)
+
+// stripIPHeader returns transport layer data of IPv4 or IPv6 packet, and its addresses.
+// Truncated packets and fragments, except the first one, are not valid.
+func stripIPHeader(data []byte) (payload, srcIP, dstIP []byte, ok bool) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		// Truncated IP info
+		if len(data) < 20 {
+			return
+		}
+
+		ihl := int(data[0]&0x0F) * 4
+		ipLength := int(binary.BigEndian.Uint16(data[2:4]))
+
+		// Invalid length, or truncated packet
+		if ihl < 20 || ipLength < ihl || len(data) < ipLength {
+			return
+		}
+
+		return data[ihl:ipLength], data[12:16], data[16:20], true
+	case 6:
+		// Truncated IP info
+		if len(data) < 40 {
+			return
+		}
+
+		// Zero payload length is used by jumbograms, which are not supported
+		payloadLength := int(binary.BigEndian.Uint16(data[4:6]))
+		if payloadLength == 0 || len(data) < 40+payloadLength {
+			return
+		}
+
+		srcIP, dstIP = data[8:24], data[24:40]
+		next := data[6]
+		payload = data[40 : 40+payloadLength]
+
+		// Skip extension headers until TCP or UDP header
+		for {
+			var size int
+
+			switch next {
+			case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+				if len(payload) < 8 {
+					return
+				}
+				size = (int(payload[1]) + 1) * 8
+			case ipv6AuthHeader:
+				if len(payload) < 8 {
+					return
+				}
+				size = (int(payload[1]) + 2) * 4
+			case ipv6Fragment:
+				// Only the first fragment has transport header
+				if len(payload) < 8 || binary.BigEndian.Uint16(payload[2:4])&0xFFF8 != 0 {
+					return
+				}
+				size = 8
+			default:
+				return payload, srcIP, dstIP, true
+			}
+
+			if len(payload) < size {
+				return
+			}
+
+			next = payload[0]
+			payload = payload[size:]
+		}
+	}
+
+	return
+}
+
+func (t *Listener) buildPacket(packetSrcIP, packetDstIP []byte, packetData []byte, timestamp time.Time) *packet {
 	return &packet{
 		srcIP:     packetSrcIP,
+		dstIP:     packetDstIP,
 		data:      packetData,
 		timestamp: timestamp,
 	}
 }
 
+// TLS decryption needs both sides of connection, even if responses are not tracked
+func (t *Listener) captureResponses() bool {
+	return t.trackResponse || t.tlsDecryptor != nil
+}
+
 func (t *Listener) isValidPacket(buf []byte) bool {
 	// To avoid full packet parsing every time, we manually parsing values needed for packet filtering
 	// http://en.wikipedia.org/wiki/Transmission_Control_Protocol
 	destPort := binary.BigEndian.Uint16(buf[2:4])
 	srcPort := binary.BigEndian.Uint16(buf[0:2])
 
+	// UDP header has fixed size, and only datagrams sent to the port are captured
+	if t.protocol == ProtocolUDP {
+		return destPort == t.port && len(buf) > 8
+	}
+
 	// Because RAW_SOCKET can't be bound to port, we have to control it by ourself
-	if destPort == t.port || (t.trackResponse && srcPort == t.port) {
+	if destPort == t.port || (t.captureResponses() && srcPort == t.port) {
 		// Get the 'data offset' (size of the TCP header in 32-bit words)
 		dataOffset := (buf[12] & 0xF0) >> 4
 
@@ -718,6 +1046,79 @@ func (t *Listener) isValidPacket(buf []byte) bool {
 	return false
 }
 
+// processUDPPacket emits datagram as complete message. Datagrams have no sequence numbers,
+// so Ack is replaced with counter, to make request IDs unique.
+func (t *Listener) processUDPPacket(packet *packet) {
+	data := packet.data
+	if len(data) <= 8 {
+		return
+	}
+
+	udpPacket := &TCPPacket{
+		SrcPort:   binary.BigEndian.Uint16(data[0:2]),
+		DestPort:  binary.BigEndian.Uint16(data[2:4]),
+		Ack:       atomic.AddUint32(t.udpCounter, 1),
+		Raw:       data,
+		Data:      data[8:],
+		Addr:      packet.srcIP,
+		DstAddr:   packet.dstIP,
+		timestamp: packet.timestamp,
+	}
+
+	message := NewTCPMessage(0, udpPacket.Ack, true, packet.timestamp)
+	message.End = packet.timestamp
+	message.packets = []*TCPPacket{udpPacket}
+	message.complete = true
+
+	atomic.AddUint64(&t.messagesEmitted, 1)
+	t.messagesChan <- message
+}
+
+// processRawPacket emits data of non-HTTP connection without reassembly
+func (t *Listener) processRawPacket(packet *TCPPacket) {
+	message := NewTCPMessage(packet.Seq, packet.Ack, true, packet.timestamp)
+	message.End = packet.timestamp
+	message.packets = []*TCPPacket{packet}
+	message.complete = true
+
+	atomic.AddUint64(&t.messagesEmitted, 1)
+	t.messagesChan <- message
+}
+
+// decodeTCPPacket passes messages of HTTP/2 connections to reassembly as HTTP/1.1, and other packets as is
+func (t *Listener) decodeTCPPacket(packet *TCPPacket) {
+	if t.protocolDetector != nil {
+		isHTTP, detected := t.protocolDetector.IsHTTP(packet)
+		if !isHTTP {
+			if detected {
+				atomic.AddUint64(&t.streamsNonHTTP, 1)
+			}
+			if t.protocolDetect == DetectRaw && packet.DestPort == t.port && len(packet.Data) > 0 {
+				t.processRawPacket(packet)
+			}
+			return
+		}
+	}
+
+	if t.protocol == ProtocolHTTP1 {
+		t.processTCPPacket(packet)
+		return
+	}
+
+	packets, ok := t.http2Decoder.Decode(packet)
+	if !ok {
+		// Connections which were not started with HTTP/2 preface are not decoded: header compression state is unknown
+		if t.protocol != ProtocolHTTP2 {
+			t.processTCPPacket(packet)
+		}
+		return
+	}
+
+	for _, p := range packets {
+		t.processTCPPacket(p)
+	}
+}
+
 // Trying to add packet to existing message or creating new message
 //
 // For TCP message unique id is Acknowledgment number (see tcp_packet.go)
@@ -901,9 +1302,26 @@ func (t *Listener) Close() {
 		t.conn.Close()
 	}
 
+	t.mu.Lock()
 	for _, h := range t.pcapHandles {
 		h.Close()
 	}
+	t.pcapHandles = nil
+	t.mu.Unlock()
 
 	return
 }
+
+// closePcapHandle forgets handle before closing it, so Stats does not query freed handle
+func (t *Listener) closePcapHandle(handle *pcap.Handle) {
+	t.mu.Lock()
+	for i, h := range t.pcapHandles {
+		if h == handle {
+			t.pcapHandles = append(t.pcapHandles[:i], t.pcapHandles[i+1:]...)
+			break
+		}
+	}
+	t.mu.Unlock()
+
+	handle.Close()
+}
@@ -4,15 +4,58 @@ import (
 	"bytes"
 	"log"
 	"math/rand"
+	"net"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/google/gopacket/pcap"
 )
 
+func TestStripIPHeader(t *testing.T) {
+	tcp := []byte("tcp header and data")
+
+	ipv4 := append([]byte{0x45, 0, 0, byte(20 + len(tcp)), 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}, tcp...)
+	// Ethernet frame can be padded
+	payload, src, dst, ok := stripIPHeader(append(ipv4, 0, 0))
+	if !ok || !bytes.Equal(payload, tcp) || !net.IP(src).Equal(net.ParseIP("10.0.0.1")) || !net.IP(dst).Equal(net.ParseIP("10.0.0.2")) {
+		t.Error("Wrong IPv4 packet:", ok, payload, src, dst)
+	}
+
+	srcIP, dstIP := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	ipv6 := func(next byte, payload []byte) []byte {
+		header := []byte{0x60, 0, 0, 0, 0, byte(len(payload)), next, 64}
+		header = append(header, srcIP...)
+		header = append(header, dstIP...)
+		return append(header, payload...)
+	}
+
+	payload, src, dst, ok = stripIPHeader(ipv6(6, tcp))
+	if !ok || !bytes.Equal(payload, tcp) || !net.IP(src).Equal(srcIP) || !net.IP(dst).Equal(dstIP) {
+		t.Error("Wrong IPv6 packet:", ok, payload, src, dst)
+	}
+
+	// Hop-by-hop options followed by the first fragment
+	extensions := []byte{ipv6Fragment, 0, 1, 4, 0, 0, 0, 0, 6, 0, 0, 1, 0, 0, 0, 1}
+	if payload, _, _, ok = stripIPHeader(ipv6(ipv6HopByHop, append(extensions, tcp...))); !ok || !bytes.Equal(payload, tcp) {
+		t.Error("Extension headers should be skipped:", ok, payload)
+	}
+
+	// Next fragments have no TCP header
+	extensions[10] = 0x10
+	if _, _, _, ok = stripIPHeader(ipv6(ipv6HopByHop, append(extensions, tcp...))); ok {
+		t.Error("Fragment should be skipped")
+	}
+
+	if _, _, _, ok = stripIPHeader(ipv6(6, tcp)[:50]); ok {
+		t.Error("Truncated packet should be skipped")
+	}
+}
+
 func TestRawListenerInput(t *testing.T) {
 	var req, resp *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now())
@@ -77,7 +120,7 @@ func responsePacket(prev *TCPPacket, payload []byte) *TCPPacket {
 }
 
 func TestHEADRequestNoBody(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	reqPacket := firstPacket([]byte("HEAD / HTTP/1.1\r\nContent-Length: 0\r\n\r\n"))
@@ -111,7 +154,7 @@ func TestHEADRequestNoBody(t *testing.T) {
 }
 
 func TestSingleAck100Continue(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	reqPacket1 := firstPacket([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"))
@@ -130,7 +173,7 @@ func TestSingleAck100Continue(t *testing.T) {
 }
 
 func Test100ContinueWithoutWaiting(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	req1 := firstPacket([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"))
@@ -146,7 +189,7 @@ func Test100ContinueWithoutWaiting(t *testing.T) {
 
 // Client first sends data without waiting 100-continue, but once response received, generate packets based on Ack payload
 func Test100ContinueMixed(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	req1 := firstPacket([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 12\r\n\r\n"))
@@ -164,7 +207,7 @@ func Test100ContinueMixed(t *testing.T) {
 }
 
 func TestDoubleAck100Continue(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	reqPacket1 := firstPacket([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"))
@@ -187,7 +230,7 @@ func TestDoubleAck100Continue(t *testing.T) {
 func TestRawListenerInputResponseByClose(t *testing.T) {
 	var req, resp *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now())
@@ -227,7 +270,7 @@ func TestRawListenerInputResponseByClose(t *testing.T) {
 func TestRawListenerInputWithoutResponse(t *testing.T) {
 	var req *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, false, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	reqPacket := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now())
@@ -249,7 +292,7 @@ func TestRawListenerInputWithoutResponse(t *testing.T) {
 func TestRawListenerResponse(t *testing.T) {
 	var req, resp *TCPMessage
 
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	reqPacket := firstPacket([]byte("GET / HTTP/1.1\r\n\r\n"))
@@ -297,7 +340,7 @@ func get100ContinuePackets() (req []*TCPPacket, resp []*TCPPacket) {
 }
 
 func TestShort100Continue(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	req, resp := get100ContinuePackets()
@@ -309,7 +352,7 @@ func TestShort100Continue(t *testing.T) {
 
 // Response comes before Request
 func Test100ContinueWrongOrder(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	req, resp := get100ContinuePackets()
@@ -462,7 +505,7 @@ func permutation(n int, list []*TCPPacket) []*TCPPacket {
 
 // Response comes before Request
 func TestRawListenerChunkedWrongOrder(t *testing.T) {
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	reqPacket1 := firstPacket([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nExpect: 100-continue\r\n\r\n"))
@@ -532,7 +575,7 @@ func getMessage() []*TCPPacket {
 
 // Response comes before Request
 func TestRawListenerBench(t *testing.T) {
-	l := NewListener("", "0", EnginePcap, true, 200*time.Millisecond, "", "", 0, false, false)
+	l := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 200 * time.Millisecond})
 	defer l.Close()
 
 	// Should re-construct message from all possible combinations
@@ -583,7 +626,7 @@ func TestRawListenerBench(t *testing.T) {
 
 func TestResponseZeroContentLength(t *testing.T) {
 	var req, resp *TCPMessage
-	listener := NewListener("", "0", EnginePcap, true, 10*time.Millisecond, "", "", 0, false, false)
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond})
 	defer listener.Close()
 
 	reqPacket := firstPacket([]byte("POST /api/setup/install HTTP/1.1\r\nHost: localhost:22936\r\nUser-Agent: curl/7.57.0\r\nAccept: */*\r\nContent-Length: 0\r\nContent-Type: application/x-www-form-urlencoded\r\n\r\n"))
@@ -621,3 +664,198 @@ func TestResponseZeroContentLength(t *testing.T) {
 		t.Error("Resp and Req UUID should be equal")
 	}
 }
+
+func TestRawListenerWorkers(t *testing.T) {
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond, Workers: 4})
+	defer listener.Close()
+
+	connections := 200
+	used := make(map[int]bool)
+
+	for i := 0; i < connections; i++ {
+		packets := getMessage()
+
+		clientAddr, serverAddr := []byte{10, 0, byte(i >> 8), byte(i)}, []byte{10, 1, 0, 1}
+		req, resp := packets[0], packets[1]
+		req.SrcPort, req.Addr, req.DstAddr = uint16(1000+i), clientAddr, serverAddr
+		resp.DestPort, resp.Addr, resp.DstAddr = uint16(1000+i), serverAddr, clientAddr
+
+		reqDump, respDump := req.dump(), resp.dump()
+		if listener.workerIndex(reqDump) != listener.workerIndex(respDump) {
+			t.Fatal("Request and response should be handled by the same worker")
+		}
+		used[listener.workerIndex(reqDump)] = true
+
+		listener.packetsChan <- reqDump
+		listener.packetsChan <- respDump
+	}
+
+	if len(used) != 4 {
+		t.Error("Connections should be spread across all workers:", used)
+	}
+
+	requests := make(map[*TCPMessage]bool)
+	for i := 0; i < connections*2; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if m.IsIncoming {
+				requests[m] = true
+			} else if m.AssocMessage == nil || !bytes.Equal(m.UUID(), m.AssocMessage.UUID()) {
+				t.Error("Response should be paired with request")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Should return all messages, got", i)
+		}
+	}
+
+	if len(requests) != connections {
+		t.Error("Should return all requests:", len(requests))
+	}
+}
+
+func TestRawListenerStats(t *testing.T) {
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond, Workers: 2})
+	defer listener.Close()
+
+	packets := getMessage()
+	listener.packetsChan <- packets[0].dump()
+	listener.packetsChan <- packets[1].dump()
+
+	// Body never arrives
+	incomplete := buildPacket(true, 100, 100, []byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\na"), time.Now())
+	incomplete.SrcPort = 2
+	listener.packetsChan <- incomplete.dump()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-listener.messagesChan:
+		case <-time.After(time.Second):
+			t.Fatal("Should return request and response")
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if s := listener.Stats(); s.MessagesEmitted != 2 || s.MessagesExpired != 1 || s.PacketsQueued != 0 {
+		t.Errorf("Wrong stats: %+v", s)
+	}
+}
+
+func TestRawListenerUDP(t *testing.T) {
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond, Workers: 2, Protocol: ProtocolUDP})
+	defer listener.Close()
+
+	datagram := func(srcPort uint16, payload string) *packet {
+		data := []byte{byte(srcPort >> 8), byte(srcPort), 0, 53, 0, byte(8 + len(payload)), 0, 0}
+		return &packet{srcIP: []byte{127, 0, 0, 1}, data: append(data, payload...), timestamp: time.Now()}
+	}
+
+	listener.packetsChan <- datagram(1000, "foo:1|c")
+	listener.packetsChan <- datagram(1001, "bar:2|c")
+	listener.packetsChan <- datagram(1002, "")
+
+	uuids := make(map[string]bool)
+	payloads := make(map[string]bool)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if !m.IsIncoming || m.ServicePort() != 53 || !m.IP().Equal([]byte{127, 0, 0, 1}) {
+				t.Errorf("Wrong message: %s", m)
+			}
+			uuids[string(m.UUID())] = true
+			payloads[string(m.Bytes())] = true
+		case <-time.After(time.Second):
+			t.Fatal("Each datagram should be emitted")
+		}
+	}
+
+	if !payloads["foo:1|c"] || !payloads["bar:2|c"] || len(uuids) != 2 {
+		t.Errorf("Wrong payloads %v, or not unique IDs %v", payloads, uuids)
+	}
+
+	select {
+	case m := <-listener.messagesChan:
+		t.Errorf("Empty datagram should be skipped: %q", m.Bytes())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRawListenerUDPValidPacket(t *testing.T) {
+	listener := &Listener{port: 53, protocol: ProtocolUDP}
+
+	for _, c := range []struct {
+		data  []byte
+		valid bool
+	}{
+		{[]byte{0x03, 0xe8, 0, 53, 0, 11, 0, 0, 'f', 'o', 'o'}, true},
+		// Empty datagram
+		{[]byte{0x03, 0xe8, 0, 53, 0, 8, 0, 0}, false},
+		// Response
+		{[]byte{0, 53, 0x03, 0xe8, 0, 11, 0, 0, 'f', 'o', 'o'}, false},
+	} {
+		if valid := listener.isValidPacket(c.data); valid != c.valid {
+			t.Errorf("Datagram %v: expected valid %v", c.data, c.valid)
+		}
+	}
+}
+
+func TestRawListenerProtocolDetect(t *testing.T) {
+	listener := NewListener("", "0", ListenerConfig{Engine: EnginePcap, TrackResponse: true, Expire: 10 * time.Millisecond, ProtocolDetect: DetectRaw})
+	defer listener.Close()
+
+	binary := buildPacket(true, 1, 1, []byte("\x00\x00\x00\x0abinary"), time.Now())
+	binary.Addr, binary.DstAddr = []byte{10, 0, 0, 1}, []byte{10, 0, 0, 100}
+	reply := buildPacket(false, 11, 1, []byte("\x00\x00\x00\x02ok"), time.Now())
+	reply.Addr, reply.DstAddr = binary.DstAddr, binary.Addr
+
+	request := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now())
+	request.Addr, request.DstAddr = []byte{10, 0, 0, 2}, []byte{10, 0, 0, 100}
+
+	listener.packetsChan <- binary.dump()
+	listener.packetsChan <- reply.dump()
+	listener.packetsChan <- request.dump()
+
+	payloads := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-listener.messagesChan:
+			if !m.IsIncoming {
+				t.Errorf("Only client data should be emitted: %q", m.Bytes())
+			}
+			payloads[string(m.Bytes())] = true
+		case <-time.After(time.Second):
+			t.Fatal("Both connections should be emitted")
+		}
+	}
+
+	if !payloads["\x00\x00\x00\x0abinary"] || !payloads["GET / HTTP/1.1\r\n\r\n"] {
+		t.Errorf("Wrong payloads: %v", payloads)
+	}
+
+	if s := listener.Stats(); s.StreamsNonHTTP != 1 {
+		t.Error("Non-HTTP connection should be counted:", s.StreamsNonHTTP)
+	}
+}
+
+func TestDeviceMatches(t *testing.T) {
+	device := pcap.Interface{Name: "eth1", Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("fe80::1")}}}
+
+	for addr, expected := range map[string]bool{
+		"eth1":     true,
+		"10.0.0.2": true,
+		"fe80::1":  true,
+		"eth0":     false,
+		"10.0.0.3": false,
+	} {
+		if deviceMatches(device, addr) != expected {
+			t.Errorf("Wrong match of %q: expected %v", addr, expected)
+		}
+	}
+
+	for _, addr := range []string{"", "0.0.0.0", "any"} {
+		if !listenAllInterfaces(addr) {
+			t.Errorf("%q should capture all interfaces", addr)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package rawSocket
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// What to do with connections which do not look like HTTP, when protocol detection is enabled
+const (
+	// Non-HTTP connections are ignored, and only counted
+	DetectDrop = "drop"
+	// Data sent by client over non-HTTP connection is emitted as is, each packet as separate message
+	DetectRaw = "raw"
+)
+
+const (
+	detectIdleTimeout = 5 * time.Minute
+	detectMaxConns    = 10000
+)
+
+type detectedConn struct {
+	http     bool
+	lastSeen time.Time
+}
+
+// protocolDetector classifies connections by the first data packet. Connection is HTTP if client speaks first,
+// and starts with HTTP method or HTTP/2 preface. Protocols where server speaks first, like MySQL or SMTP, are not HTTP,
+// unless server sends HTTP response, e.g. on keep-alive connection opened before capture started.
+type protocolDetector struct {
+	port     uint16
+	conns    map[tcpConnKey]*detectedConn
+	maxConns int
+}
+
+func newProtocolDetector(port uint16) *protocolDetector {
+	return &protocolDetector{
+		port:     port,
+		conns:    make(map[tcpConnKey]*detectedConn),
+		maxConns: detectMaxConns,
+	}
+}
+
+// IsHTTP returns whether packet belongs to HTTP connection, and whether connection was classified by this packet.
+// Packets without data of unknown connections are treated as HTTP, since they do not affect reassembly.
+func (d *protocolDetector) IsHTTP(packet *TCPPacket) (isHTTP bool, detected bool) {
+	isClient := packet.DestPort == d.port
+	key := newTCPConnKey(packet, isClient)
+
+	c, ok := d.conns[key]
+	if !ok {
+		if len(packet.Data) == 0 {
+			return true, false
+		}
+
+		if len(d.conns) >= d.maxConns {
+			d.evict()
+		}
+
+		var isHTTP bool
+		if isClient {
+			isHTTP = proto.IsHTTPPayload(packet.Data) || bytes.HasPrefix(packet.Data, http2ClientPreface)
+		} else {
+			isHTTP = bytes.HasPrefix(packet.Data, []byte("HTTP/1."))
+		}
+
+		c = &detectedConn{http: isHTTP}
+		d.conns[key] = c
+		detected = true
+	}
+
+	c.lastSeen = time.Now()
+
+	// Connection with the same address can be opened again, and should be classified again
+	if packet.IsFIN || packet.IsRST {
+		delete(d.conns, key)
+	}
+
+	return c.http, detected
+}
+
+// evict makes room for new connections. Idle connections are removed first, then least recently seen ones,
+// non-HTTP before HTTP, so live HTTP connections are not classified again by packet in the middle of the stream.
+// Tenth of the table is freed at once, to not sort it for each new connection.
+func (d *protocolDetector) evict() {
+	d.GC()
+	if len(d.conns) < d.maxConns {
+		return
+	}
+
+	keys := make([]tcpConnKey, 0, len(d.conns))
+	for key := range d.conns {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := d.conns[keys[i]], d.conns[keys[j]]
+		if a.http != b.http {
+			return !a.http
+		}
+		return a.lastSeen.Before(b.lastSeen)
+	})
+
+	n := len(keys) - d.maxConns*9/10
+	for _, key := range keys[:n] {
+		delete(d.conns, key)
+	}
+}
+
+// GC removes connections without any activity
+func (d *protocolDetector) GC() {
+	now := time.Now()
+	for key, c := range d.conns {
+		if now.Sub(c.lastSeen) > detectIdleTimeout {
+			delete(d.conns, key)
+		}
+	}
+}
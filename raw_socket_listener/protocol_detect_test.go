@@ -0,0 +1,90 @@
+package rawSocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProtocolDetector(t *testing.T) {
+	d := newProtocolDetector(0)
+
+	conn := func(client byte, isIncoming bool, data string) *TCPPacket {
+		p := buildPacket(isIncoming, 1, 1, []byte(data), time.Now())
+		p.Addr, p.DstAddr = []byte{10, 0, 0, client}, []byte{10, 0, 0, 100}
+		if !isIncoming {
+			p.Addr, p.DstAddr = p.DstAddr, p.Addr
+		}
+		return p
+	}
+
+	for i, c := range []struct {
+		packet   *TCPPacket
+		isHTTP   bool
+		detected bool
+	}{
+		{conn(1, true, ""), true, false},
+		{conn(1, true, "GET / HTTP/1.1\r\n\r\n"), true, true},
+		{conn(1, false, "\x00\x01binary"), true, false},
+		{conn(2, true, "\x16\x03\x01binary"), false, true},
+		{conn(2, true, "GET / HTTP/1.1\r\n\r\n"), false, false},
+		{conn(3, true, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), true, true},
+		// Server speaks first
+		{conn(4, false, "220 smtp.example.org ESMTP\r\n"), false, true},
+		{conn(4, true, "GET / HTTP/1.1\r\n\r\n"), false, false},
+	} {
+		isHTTP, detected := d.IsHTTP(c.packet)
+		if isHTTP != c.isHTTP || detected != c.detected {
+			t.Errorf("%d: expected HTTP %v, detected %v, got %v, %v", i, c.isHTTP, c.detected, isHTTP, detected)
+		}
+	}
+
+	// Connection is classified again after it was closed
+	fin := conn(2, true, "")
+	fin.IsFIN = true
+	d.IsHTTP(fin)
+	if isHTTP, _ := d.IsHTTP(conn(2, true, "GET / HTTP/1.1\r\n\r\n")); !isHTTP {
+		t.Error("Reopened connection should be classified again")
+	}
+
+	// Reset closes connection too
+	rst := conn(4, true, "")
+	rst.IsRST = true
+	d.IsHTTP(rst)
+	if isHTTP, _ := d.IsHTTP(conn(4, true, "GET / HTTP/1.1\r\n\r\n")); !isHTTP {
+		t.Error("Connection should be classified again after reset")
+	}
+
+	// Keep-alive connection seen for the first time in the middle, with response
+	if isHTTP, _ := d.IsHTTP(conn(5, false, "HTTP/1.1 200 OK\r\n\r\n")); !isHTTP {
+		t.Error("Connection with HTTP response should be HTTP")
+	}
+}
+
+func TestProtocolDetectorEviction(t *testing.T) {
+	d := newProtocolDetector(0)
+	d.maxConns = 10
+
+	conn := func(client byte, data string) *TCPPacket {
+		p := buildPacket(true, 1, 1, []byte(data), time.Now())
+		p.Addr, p.DstAddr = []byte{10, 0, 0, client}, []byte{10, 0, 0, 100}
+		return p
+	}
+
+	for i := byte(0); i < 5; i++ {
+		d.IsHTTP(conn(i, "GET / HTTP/1.1\r\n\r\n"))
+	}
+	for i := byte(5); i < 20; i++ {
+		d.IsHTTP(conn(i, "\x16\x03\x01binary"))
+	}
+
+	if len(d.conns) > d.maxConns {
+		t.Error("Table should not grow over limit:", len(d.conns))
+	}
+
+	// HTTP connections are kept, so body in the middle of the stream does not make them non-HTTP
+	for i := byte(0); i < 5; i++ {
+		if isHTTP, detected := d.IsHTTP(conn(i, "body")); !isHTTP || detected {
+			t.Errorf("Connection %d should stay HTTP", i)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package rawSocket
+
+import "sync/atomic"
+
+// ListenerStats shows how much traffic was lost during capture
+type ListenerStats struct {
+	// Totals of all pcap handles, dropped packets mean that capture buffer should be increased
+	PacketsReceived  int
+	PacketsDropped   int
+	PacketsIfDropped int
+
+	// Messages sent to receiver, and incomplete ones which expired without all their packets
+	MessagesEmitted uint64
+	MessagesExpired uint64
+
+	// Connections which were not recognized as HTTP, when protocol detection is enabled
+	StreamsNonHTTP uint64
+
+	// Captured packets waiting for reassembly
+	PacketsQueued int
+}
+
+// Stats returns capture statistics, including ones of reassembly workers
+func (t *Listener) Stats() (stats ListenerStats) {
+	t.mu.Lock()
+	for _, h := range t.pcapHandles {
+		if s, err := h.Stats(); err == nil && s != nil {
+			stats.PacketsReceived += s.PacketsReceived
+			stats.PacketsDropped += s.PacketsDropped
+			stats.PacketsIfDropped += s.PacketsIfDropped
+		}
+	}
+	t.mu.Unlock()
+
+	for _, l := range append([]*Listener{t}, t.workers...) {
+		stats.MessagesEmitted += atomic.LoadUint64(&l.messagesEmitted)
+		stats.MessagesExpired += atomic.LoadUint64(&l.messagesExpired)
+		stats.StreamsNonHTTP += atomic.LoadUint64(&l.streamsNonHTTP)
+		stats.PacketsQueued += len(l.packetsChan)
+	}
+
+	return
+}
@@ -505,6 +505,15 @@ func (t *TCPMessage) IP() net.IP {
 	return net.IP(t.packets[0].Addr)
 }
 
+// ServicePort returns port of the server side of connection: destination port for requests, and source port for responses
+func (t *TCPMessage) ServicePort() uint16 {
+	if t.IsIncoming {
+		return t.packets[0].DestPort
+	}
+
+	return t.packets[0].SrcPort
+}
+
 func (t *TCPMessage) String() string {
 	return strings.Join([]string{
 		"Len packets: " + strconv.Itoa(len(t.packets)),
@@ -35,10 +35,12 @@ type TCPPacket struct {
 	OrigAck    uint32
 	DataOffset uint8
 	IsFIN      bool
+	IsRST      bool
 
 	Raw       []byte
 	Data      []byte
 	Addr      []byte
+	DstAddr   []byte
 	timestamp time.Time
 	ID        tcpID
 }
@@ -76,6 +78,7 @@ func (t *TCPPacket) ParseBasic() {
 	t.Ack = binary.BigEndian.Uint32(t.Raw[8:12])
 	t.DataOffset = (t.Raw[12] & 0xF0) >> 4
 	t.IsFIN = t.Raw[13]&0x01 != 0
+	t.IsRST = t.Raw[13]&0x04 != 0
 
 	if len(t.Raw) >= int(t.DataOffset*4) {
 		t.Data = t.Raw[t.DataOffset*4:]
@@ -85,9 +88,11 @@ func (t *TCPPacket) ParseBasic() {
 func (t *TCPPacket) dump() *packet {
 
 	packetSrcIP := make([]byte, 16)
+	packetDstIP := make([]byte, 16)
 	packetData := make([]byte, len(t.Data)+16)
 
 	copy(packetSrcIP, t.Addr)
+	copy(packetDstIP, t.DstAddr)
 
 	binary.BigEndian.PutUint16(packetData[0:2], t.SrcPort)
 	binary.BigEndian.PutUint16(packetData[2:4], t.DestPort)
@@ -101,10 +106,15 @@ func (t *TCPPacket) dump() *packet {
 		packetData[13] = packetData[13] | 0x01
 	}
 
+	if t.IsRST {
+		packetData[13] = packetData[13] | 0x04
+	}
+
 	copy(packetData[16:], t.Data)
 
 	return &packet{
 		srcIP:     packetSrcIP,
+		dstIP:     packetDstIP,
 		data:      packetData,
 		timestamp: t.timestamp,
 	}
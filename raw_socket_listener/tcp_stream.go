@@ -0,0 +1,121 @@
+package rawSocket
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Limit for segments kept while waiting for missing one
+const tcpMaxPendingSegments = 256
+
+var errTCPMissingSegment = errors.New("missing TCP segment")
+
+// tcpStream puts segments of one side of TCP connection in order, for decoders which need continuous data
+type tcpStream struct {
+	started bool
+	nextSeq uint32
+
+	// Segments received ahead of nextSeq, by sequence number
+	pending map[uint32]*TCPPacket
+}
+
+// push returns data continuing the stream, including segments which were waiting for this one,
+// together with the last of used packets, and FIN flag.
+// Packet is nil if nothing can be processed yet: segment is retransmission, or came before preceding ones.
+func (s *tcpStream) push(packet *TCPPacket) (data []byte, last *TCPPacket, fin bool, err error) {
+	if !s.started {
+		s.started = true
+		s.nextSeq = packet.Seq
+	}
+
+	// Retransmission
+	if int32(packet.Seq-s.nextSeq) < 0 {
+		return
+	}
+
+	if packet.Seq != s.nextSeq {
+		// Segment came before preceding ones, keep it until the gap is filled
+		if len(s.pending) >= tcpMaxPendingSegments {
+			return nil, nil, false, errTCPMissingSegment
+		}
+
+		if s.pending == nil {
+			s.pending = make(map[uint32]*TCPPacket)
+		}
+		s.pending[packet.Seq] = packet
+
+		return
+	}
+
+	data, last, fin = packet.Data, packet, packet.IsFIN
+	s.nextSeq += uint32(len(packet.Data))
+
+	for len(s.pending) > 0 {
+		next, ok := s.pending[s.nextSeq]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.nextSeq)
+
+		data = append(data[:len(data):len(data)], next.Data...)
+		last, fin = next, fin || next.IsFIN
+		s.nextSeq += uint32(len(next.Data))
+	}
+
+	// Segments fully covered by already processed data
+	for seq := range s.pending {
+		if int32(seq-s.nextSeq) < 0 {
+			delete(s.pending, seq)
+		}
+	}
+
+	return
+}
+
+// Client address, server address, client port and server port
+type tcpConnKey [36]byte
+
+// newTCPConnKey returns key which is same for both directions of connection.
+// If capture method does not provide destination address, connections are distinguished only by ports.
+func newTCPConnKey(packet *TCPPacket, isClient bool) (key tcpConnKey) {
+	clientAddr, serverAddr := packet.Addr, packet.DstAddr
+	clientPort, serverPort := packet.SrcPort, packet.DestPort
+	if !isClient {
+		clientAddr, serverAddr = serverAddr, clientAddr
+		clientPort, serverPort = serverPort, clientPort
+	}
+
+	if len(packet.DstAddr) > 0 {
+		copy(key[0:16], clientAddr)
+		copy(key[16:32], serverAddr)
+	}
+	binary.BigEndian.PutUint16(key[32:34], clientPort)
+	binary.BigEndian.PutUint16(key[34:36], serverPort)
+
+	return
+}
+
+func (k tcpConnKey) clientPort() uint16 {
+	return binary.BigEndian.Uint16(k[32:34])
+}
+
+// buildTCPPacket returns packet of the same connection as original, with replaced payload and sequence numbers.
+// Used by decoders, output of which goes to HTTP reassembly.
+func buildTCPPacket(orig *TCPPacket, seq, ack uint32, fin bool, data []byte) *TCPPacket {
+	raw := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint16(raw[0:2], orig.SrcPort)
+	binary.BigEndian.PutUint16(raw[2:4], orig.DestPort)
+	binary.BigEndian.PutUint32(raw[4:8], seq)
+	binary.BigEndian.PutUint32(raw[8:12], ack)
+	// Data offset: 4 words
+	raw[12] = 64
+	if fin {
+		raw[13] |= 0x01
+	}
+	copy(raw[16:], data)
+
+	packet := ParseTCPPacket(orig.Addr, raw, orig.timestamp)
+	packet.DstAddr = orig.DstAddr
+
+	return packet
+}
@@ -0,0 +1,782 @@
+package rawSocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS record content types
+const (
+	tlsRecordChangeCipherSpec = 20
+	tlsRecordAlert            = 21
+	tlsRecordHandshake        = 22
+	tlsRecordApplicationData  = 23
+)
+
+// TLS handshake message types
+const (
+	tlsHandshakeClientHello = 1
+	tlsHandshakeServerHello = 2
+	tlsHandshakeFinished    = 20
+	tlsHandshakeKeyUpdate   = 24
+)
+
+const (
+	tlsRecordHeaderLen = 5
+	// 2^14 bytes of payload plus maximum allowed expansion
+	tlsMaxRecordLen = 16384 + 2048
+
+	gcmExplicitNonceLen = 8
+	gcmTagLen           = 16
+	tls13IVLen          = 12
+
+	tlsSessionIdleTimeout = 5 * time.Minute
+
+	tlsKeyLogReloadInterval = time.Second
+	// Limit for data kept while waiting for master secret to appear in key log
+	tlsMaxWaitingLen = 1 << 20
+)
+
+var errTLSSecretNotFound = errors.New("master secret not found in key log")
+
+type tlsCipherSuite struct {
+	keyLen int
+	hash   func() hash.Hash
+}
+
+// Only AEAD AES-GCM TLS 1.2 suites are supported
+var tlsCipherSuites = map[uint16]tlsCipherSuite{
+	0x009c: {16, sha256.New},    // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: {32, sha512.New384}, // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0x009e: {16, sha256.New},    // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	0x009f: {32, sha512.New384}, // TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+	0xc02b: {16, sha256.New},    // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02c: {32, sha512.New384}, // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xc02f: {16, sha256.New},    // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc030: {32, sha512.New384}, // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+}
+
+// TLS 1.3 AES-GCM suites
+var tls13CipherSuites = map[uint16]tlsCipherSuite{
+	0x1301: {16, sha256.New},    // TLS_AES_128_GCM_SHA256
+	0x1302: {32, sha512.New384}, // TLS_AES_256_GCM_SHA384
+}
+
+// ServerHello with this random is HelloRetryRequest, RFC 8446 section 4.1.3
+var tlsHelloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// tlsKeyLog reads master secrets from NSS key log file, the format used by SSLKEYLOGFILE
+// https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format
+//
+// Applications append new secrets while running, so file is read from the last position in background:
+// periodically, and as soon as unknown secret is requested. Packet processing never waits for the file.
+type tlsKeyLog struct {
+	mu      sync.RWMutex
+	secrets map[string][]byte
+
+	// Used only by loading goroutine
+	path   string
+	offset int64
+
+	reload chan struct{}
+	quit   chan struct{}
+}
+
+func newTLSKeyLog(path string) *tlsKeyLog {
+	k := &tlsKeyLog{
+		path:    path,
+		secrets: make(map[string][]byte),
+		reload:  make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+
+	if err := k.load(); err != nil {
+		log.Println("Can't open TLS key log file:", err)
+	}
+
+	go k.watch()
+
+	return k
+}
+
+func (k *tlsKeyLog) watch() {
+	ticker := time.NewTicker(tlsKeyLogReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.quit:
+			return
+		case <-ticker.C:
+		case <-k.reload:
+		}
+
+		k.load()
+	}
+}
+
+func (k *tlsKeyLog) close() {
+	close(k.quit)
+}
+
+func (k *tlsKeyLog) load() error {
+	file, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// File was truncated or replaced
+	if stat, err := file.Stat(); err == nil && stat.Size() < k.offset {
+		k.offset = 0
+	}
+
+	if _, err = file.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		// Line can be partially written, read it next time
+		if err != nil {
+			return nil
+		}
+		k.offset += int64(len(line))
+
+		// TLS 1.2 master secret is logged with CLIENT_RANDOM label, TLS 1.3 secrets have label of each traffic secret
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+
+		if secret, err := hex.DecodeString(fields[2]); err == nil {
+			k.mu.Lock()
+			k.secrets[fields[0]+" "+strings.ToLower(fields[1])] = secret
+			k.mu.Unlock()
+		}
+	}
+}
+
+// masterSecret returns TLS 1.2 master secret for given client random, or nil if it is not loaded yet
+func (k *tlsKeyLog) masterSecret(clientRandom []byte) []byte {
+	return k.secret("CLIENT_RANDOM", clientRandom)
+}
+
+// secret returns secret with given label for given client random, or nil if it is not loaded yet
+func (k *tlsKeyLog) secret(label string, clientRandom []byte) []byte {
+	k.mu.RLock()
+	secret := k.secrets[label+" "+hex.EncodeToString(clientRandom)]
+	k.mu.RUnlock()
+
+	if secret == nil {
+		select {
+		case k.reload <- struct{}{}:
+		default:
+		}
+	}
+
+	return secret
+}
+
+// Maps position in original TCP stream to position in decrypted stream
+type tlsSeqCheckpoint struct {
+	tcpSeq   uint32
+	plainSeq uint32
+}
+
+// tlsDirection holds decryption state of one side of TLS connection
+type tlsDirection struct {
+	tcpStream
+
+	// Decrypted stream does not have TLS framing, so it needs own sequence numbers
+	plainSeq    uint32
+	checkpoints []tlsSeqCheckpoint
+	fin         bool
+
+	// Last processed packet, used as template for packets decrypted later
+	last *TCPPacket
+
+	// Incomplete TLS record, or records waiting for master secret
+	buf        []byte
+	waitingKey bool
+
+	encrypted bool
+	recordSeq uint64
+	aead      cipher.AEAD
+	fixedIV   []byte
+
+	// TLS 1.3 switches from handshake to application traffic keys after Finished, and on KeyUpdate
+	suite         tlsCipherSuite
+	trafficSecret []byte
+	handshakeDone bool
+	// Incomplete encrypted handshake message
+	handshake []byte
+}
+
+// Translates acknowledgment number from TCP stream to decrypted stream
+func (d *tlsDirection) plainAck(ack uint32) uint32 {
+	for i := len(d.checkpoints) - 1; i >= 0; i-- {
+		if int32(ack-d.checkpoints[i].tcpSeq) >= 0 {
+			return d.checkpoints[i].plainSeq
+		}
+	}
+
+	return ack
+}
+
+func (d *tlsDirection) addCheckpoint() {
+	d.checkpoints = append(d.checkpoints, tlsSeqCheckpoint{d.nextSeq, d.plainSeq})
+
+	// Only recent positions can be acknowledged
+	if len(d.checkpoints) > 64 {
+		d.checkpoints = d.checkpoints[len(d.checkpoints)-64:]
+	}
+}
+
+type tlsSession struct {
+	key          tcpConnKey
+	clientRandom []byte
+	serverRandom []byte
+	suite        uint16
+	tls13        bool
+	initialSeq   uint32
+	broken       bool
+	lastSeen     time.Time
+
+	client tlsDirection
+	server tlsDirection
+}
+
+// TLSDecryptor turns TLS 1.2 and 1.3 traffic into plain TCP stream using secrets from key log file.
+// Decrypted packets get own sequence and acknowledgment numbers, so following HTTP reassembly works unchanged.
+type TLSDecryptor struct {
+	port     uint16
+	keyLog   *tlsKeyLog
+	sessions map[tcpConnKey]*tlsSession
+	// Key log is owned by decryptor this one was forked from
+	forked bool
+}
+
+// NewTLSDecryptor creates decryptor for traffic on given server port
+func NewTLSDecryptor(keyLogPath string, port uint16) *TLSDecryptor {
+	return &TLSDecryptor{
+		port:     port,
+		keyLog:   newTLSKeyLog(keyLogPath),
+		sessions: make(map[tcpConnKey]*tlsSession),
+	}
+}
+
+// Fork creates decryptor with own sessions, which shares key log with this one
+func (d *TLSDecryptor) Fork() *TLSDecryptor {
+	return &TLSDecryptor{
+		port:     d.port,
+		keyLog:   d.keyLog,
+		sessions: make(map[tcpConnKey]*tlsSession),
+		forked:   true,
+	}
+}
+
+// Close stops reading of key log file
+func (d *TLSDecryptor) Close() {
+	if !d.forked {
+		d.keyLog.close()
+	}
+}
+
+func isClientHello(data []byte) bool {
+	return len(data) > tlsRecordHeaderLen && data[0] == tlsRecordHandshake && data[tlsRecordHeaderLen] == tlsHandshakeClientHello
+}
+
+// Decrypt returns packets with decrypted payload, or original packet if it does not belong to TLS session.
+// Result is empty if packet has only TLS handshake data, can't be decrypted yet or at all.
+// It can contain packets of both directions, when data was waiting for master secret.
+func (d *TLSDecryptor) Decrypt(packet *TCPPacket) (packets []*TCPPacket) {
+	isClient := packet.DestPort == d.port
+	key := newTCPConnKey(packet, isClient)
+
+	session, ok := d.sessions[key]
+
+	if isClient && isClientHello(packet.Data) && (!ok || session.initialSeq != packet.Seq) {
+		session = &tlsSession{key: key, initialSeq: packet.Seq}
+		d.sessions[key] = session
+		ok = true
+	}
+
+	if !ok {
+		return []*TCPPacket{packet}
+	}
+
+	if session.broken {
+		return nil
+	}
+
+	session.lastSeen = time.Now()
+
+	dir, other := &session.server, &session.client
+	if isClient {
+		dir, other = &session.client, &session.server
+	}
+
+	if !dir.started {
+		dir.plainSeq = packet.Seq
+	}
+
+	data, last, fin, err := dir.push(packet)
+	if err != nil {
+		log.Println("[TLS] Can't decrypt connection from port", session.key.clientPort(), err)
+		session.broken = true
+		return nil
+	}
+
+	if last == nil {
+		return nil
+	}
+
+	// Secret requested by other side could be loaded meanwhile, its data was sent earlier
+	if other.waitingKey {
+		if p := d.process(session, other, dir, !isClient, other.last, nil, false); p != nil {
+			packets = append(packets, p)
+		}
+	}
+
+	if session.broken {
+		return nil
+	}
+
+	if p := d.process(session, dir, other, isClient, last, data, fin); p != nil {
+		packets = append(packets, p)
+	}
+
+	return
+}
+
+// process decrypts new data of one direction, and returns packet with decrypted part, if there is any
+func (d *TLSDecryptor) process(session *tlsSession, dir, other *tlsDirection, isClient bool, orig *TCPPacket, data []byte, fin bool) *TCPPacket {
+	plain, err := session.readRecords(dir, data, d.keyLog, isClient)
+	if err != nil {
+		log.Println("[TLS] Can't decrypt connection from port", session.key.clientPort(), err)
+		session.broken = true
+		return nil
+	}
+
+	seq := dir.plainSeq
+	dir.plainSeq += uint32(len(plain))
+	dir.addCheckpoint()
+	dir.last = orig
+
+	ack := orig.Ack
+	if other.started {
+		ack = other.plainAck(orig.Ack)
+	}
+
+	if fin {
+		dir.fin = true
+		if other.fin {
+			delete(d.sessions, session.key)
+		}
+	}
+
+	if len(plain) == 0 && !fin {
+		return nil
+	}
+
+	return buildTCPPacket(orig, seq, ack, fin, plain)
+}
+
+// GC removes sessions without any activity
+func (d *TLSDecryptor) GC() {
+	now := time.Now()
+	for key, s := range d.sessions {
+		if now.Sub(s.lastSeen) > tlsSessionIdleTimeout {
+			delete(d.sessions, key)
+		}
+	}
+}
+
+// readRecords appends data to pending buffer and processes all complete TLS records.
+// Returns decrypted application data.
+//
+// If master secret is not loaded yet, records after ChangeCipherSpec are kept in buffer, and next call tries again.
+func (s *tlsSession) readRecords(dir *tlsDirection, data []byte, keyLog *tlsKeyLog, isClient bool) (plain []byte, err error) {
+	dir.buf = append(dir.buf, data...)
+
+records:
+	for len(dir.buf) >= tlsRecordHeaderLen {
+		length := int(binary.BigEndian.Uint16(dir.buf[3:5]))
+		if length > tlsMaxRecordLen {
+			return nil, errors.New("record is too large")
+		}
+
+		if len(dir.buf) < tlsRecordHeaderLen+length {
+			break
+		}
+
+		header := dir.buf[:tlsRecordHeaderLen]
+		payload := dir.buf[tlsRecordHeaderLen : tlsRecordHeaderLen+length]
+
+		// TLS 1.3 encrypts everything after ServerHello, and records look like application data
+		if s.tls13 && !dir.encrypted && header[0] == tlsRecordApplicationData {
+			err = s.initTLS13Cipher(dir, keyLog, isClient)
+			if err == errTLSSecretNotFound && len(dir.buf) <= tlsMaxWaitingLen {
+				dir.waitingKey, err = true, nil
+				break records
+			}
+			if err != nil {
+				return nil, err
+			}
+			dir.waitingKey = false
+		}
+
+		if dir.encrypted && s.tls13 {
+			typ, decrypted, err := dir.decryptTLS13(header, payload)
+			if err != nil {
+				return nil, err
+			}
+
+			switch typ {
+			case tlsRecordApplicationData:
+				plain = append(plain, decrypted...)
+			case tlsRecordHandshake:
+				if err = dir.readTLS13Handshake(decrypted); err != nil {
+					return nil, err
+				}
+			}
+		} else if dir.encrypted {
+			decrypted, err := dir.decrypt(header, payload)
+			if err != nil {
+				return nil, err
+			}
+
+			if header[0] == tlsRecordApplicationData {
+				plain = append(plain, decrypted...)
+			}
+		} else {
+			switch header[0] {
+			case tlsRecordHandshake:
+				if err = s.readHandshake(payload); err != nil {
+					return nil, err
+				}
+			case tlsRecordChangeCipherSpec:
+				// Sent in TLS 1.3 only for compatibility with middleboxes
+				if s.tls13 {
+					break
+				}
+
+				err = s.initCipher(dir, keyLog, isClient)
+				if err == errTLSSecretNotFound && len(dir.buf) <= tlsMaxWaitingLen {
+					dir.waitingKey, err = true, nil
+					break records
+				}
+				if err != nil {
+					return nil, err
+				}
+				dir.waitingKey = false
+			case tlsRecordAlert:
+			default:
+				return nil, errors.New("unexpected record before handshake finished")
+			}
+		}
+
+		dir.buf = dir.buf[tlsRecordHeaderLen+length:]
+	}
+
+	// Do not keep reference to large packet data
+	if len(dir.buf) == 0 {
+		dir.buf = nil
+	} else {
+		dir.buf = append([]byte(nil), dir.buf...)
+	}
+
+	return
+}
+
+func (s *tlsSession) readHandshake(msg []byte) error {
+	if len(msg) < 4 {
+		return nil
+	}
+
+	body := msg[4:]
+
+	switch msg[0] {
+	case tlsHandshakeClientHello:
+		if len(body) < 34 {
+			return errors.New("malformed ClientHello")
+		}
+		s.clientRandom = append([]byte(nil), body[2:34]...)
+	case tlsHandshakeServerHello:
+		if len(body) < 35 {
+			return errors.New("malformed ServerHello")
+		}
+		s.serverRandom = append([]byte(nil), body[2:34]...)
+
+		pos := 35 + int(body[34])
+		if len(body) < pos+3 {
+			return errors.New("malformed ServerHello")
+		}
+		s.suite = binary.BigEndian.Uint16(body[pos : pos+2])
+		s.tls13 = isTLS13(body[pos+3:])
+
+		if s.tls13 && bytes.Equal(s.serverRandom, tlsHelloRetryRequestRandom) {
+			return errors.New("TLS 1.3 HelloRetryRequest is not supported")
+		}
+	}
+
+	return nil
+}
+
+// isTLS13 checks ServerHello extensions for supported_versions set to TLS 1.3
+func isTLS13(ext []byte) bool {
+	if len(ext) < 2 {
+		return false
+	}
+	ext = ext[2:]
+
+	for len(ext) >= 4 {
+		typ := binary.BigEndian.Uint16(ext[0:2])
+		length := int(binary.BigEndian.Uint16(ext[2:4]))
+		if len(ext) < 4+length {
+			return false
+		}
+
+		if typ == 43 && length == 2 {
+			return binary.BigEndian.Uint16(ext[4:6]) == 0x0304
+		}
+
+		ext = ext[4+length:]
+	}
+
+	return false
+}
+
+func (s *tlsSession) initCipher(dir *tlsDirection, keyLog *tlsKeyLog, isClient bool) error {
+	suite, ok := tlsCipherSuites[s.suite]
+	if !ok {
+		return errors.New("unsupported cipher suite")
+	}
+
+	if s.clientRandom == nil || s.serverRandom == nil {
+		return errors.New("handshake not captured")
+	}
+
+	master := keyLog.masterSecret(s.clientRandom)
+	if master == nil {
+		return errTLSSecretNotFound
+	}
+
+	keys := tlsPRF(suite.hash, master, []byte("key expansion"), append(append([]byte{}, s.serverRandom...), s.clientRandom...), 2*suite.keyLen+8)
+
+	key, iv := keys[suite.keyLen:2*suite.keyLen], keys[2*suite.keyLen+4:]
+	if isClient {
+		key, iv = keys[:suite.keyLen], keys[2*suite.keyLen:2*suite.keyLen+4]
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	if dir.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+
+	dir.fixedIV = iv
+	dir.encrypted = true
+	dir.recordSeq = 0
+
+	return nil
+}
+
+// initTLS13Cipher sets handshake traffic keys for the first encrypted record, and application traffic keys after Finished
+func (s *tlsSession) initTLS13Cipher(dir *tlsDirection, keyLog *tlsKeyLog, isClient bool) error {
+	suite, ok := tls13CipherSuites[s.suite]
+	if !ok {
+		return errors.New("unsupported cipher suite")
+	}
+
+	if s.clientRandom == nil {
+		return errors.New("handshake not captured")
+	}
+
+	label := "SERVER_"
+	if isClient {
+		label = "CLIENT_"
+	}
+	if dir.handshakeDone {
+		label += "TRAFFIC_SECRET_0"
+	} else {
+		label += "HANDSHAKE_TRAFFIC_SECRET"
+	}
+
+	secret := keyLog.secret(label, s.clientRandom)
+	if secret == nil {
+		return errTLSSecretNotFound
+	}
+
+	return dir.setTrafficSecret(suite, secret)
+}
+
+// setTrafficSecret derives TLS 1.3 record protection keys, RFC 8446 section 7.3
+func (d *tlsDirection) setTrafficSecret(suite tlsCipherSuite, secret []byte) error {
+	block, err := aes.NewCipher(hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen))
+	if err != nil {
+		return err
+	}
+
+	if d.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+
+	d.suite = suite
+	d.trafficSecret = secret
+	d.fixedIV = hkdfExpandLabel(suite.hash, secret, "iv", tls13IVLen)
+	d.encrypted = true
+	d.recordSeq = 0
+
+	return nil
+}
+
+// readTLS13Handshake looks for handshake messages which change keys of this direction
+func (d *tlsDirection) readTLS13Handshake(data []byte) error {
+	d.handshake = append(d.handshake, data...)
+
+	for len(d.handshake) >= 4 {
+		length := int(d.handshake[1])<<16 | int(d.handshake[2])<<8 | int(d.handshake[3])
+		if len(d.handshake) < 4+length {
+			break
+		}
+
+		typ := d.handshake[0]
+		d.handshake = d.handshake[4+length:]
+
+		switch typ {
+		case tlsHandshakeFinished:
+			if !d.handshakeDone {
+				// Next record is encrypted with application traffic keys
+				d.handshakeDone = true
+				d.encrypted = false
+			}
+		case tlsHandshakeKeyUpdate:
+			next := hkdfExpandLabel(d.suite.hash, d.trafficSecret, "traffic upd", d.suite.hash().Size())
+			if err := d.setTrafficSecret(d.suite, next); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(d.handshake) > tlsMaxWaitingLen {
+		return errors.New("handshake message is too large")
+	}
+
+	if len(d.handshake) == 0 {
+		d.handshake = nil
+	}
+
+	return nil
+}
+
+// decryptTLS13 returns real content type of record, and its decrypted data
+func (d *tlsDirection) decryptTLS13(header, payload []byte) (byte, []byte, error) {
+	nonce := append([]byte(nil), d.fixedIV...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(d.recordSeq >> (8 * uint(i)))
+	}
+
+	d.recordSeq++
+
+	inner, err := d.aead.Open(nil, nonce, payload, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Content type follows data, and can be padded with zeros
+	i := len(inner) - 1
+	for i >= 0 && inner[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, errors.New("encrypted record has no content type")
+	}
+
+	return inner[i], inner[:i], nil
+}
+
+func (d *tlsDirection) decrypt(header, payload []byte) ([]byte, error) {
+	if len(payload) < gcmExplicitNonceLen+gcmTagLen {
+		return nil, errors.New("encrypted record is too short")
+	}
+
+	nonce := append(append([]byte{}, d.fixedIV...), payload[:gcmExplicitNonceLen]...)
+
+	additionalData := make([]byte, 13)
+	binary.BigEndian.PutUint64(additionalData, d.recordSeq)
+	copy(additionalData[8:11], header[:3])
+	binary.BigEndian.PutUint16(additionalData[11:], uint16(len(payload)-gcmExplicitNonceLen-gcmTagLen))
+
+	d.recordSeq++
+
+	return d.aead.Open(nil, nonce, payload[gcmExplicitNonceLen:], additionalData)
+}
+
+// tlsPRF is TLS 1.2 pseudorandom function, RFC 5246 section 5
+func tlsPRF(h func() hash.Hash, secret, label, seed []byte, length int) []byte {
+	seed = append(append([]byte{}, label...), seed...)
+
+	mac := hmac.New(h, secret)
+	a := seed
+	var out bytes.Buffer
+
+	for out.Len() < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out.Write(mac.Sum(nil))
+	}
+
+	return out.Bytes()[:length]
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3, RFC 8446 section 7.1, with empty context
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+
+	mac := hmac.New(h, secret)
+	var out, t []byte
+
+	for i := byte(1); len(out) < length; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+
+	return out[:length]
+}
@@ -0,0 +1,390 @@
+package rawSocket
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type tlsChunk struct {
+	isIncoming bool
+	data       []byte
+}
+
+// Records bytes written by both sides of connection, in order they were sent
+type tlsRecorder struct {
+	mu     sync.Mutex
+	chunks []tlsChunk
+}
+
+type recordedConn struct {
+	net.Conn
+	isIncoming bool
+	recorder   *tlsRecorder
+}
+
+func (c *recordedConn) Write(p []byte) (int, error) {
+	c.recorder.mu.Lock()
+	c.recorder.chunks = append(c.recorder.chunks, tlsChunk{c.isIncoming, append([]byte(nil), p...)})
+	c.recorder.mu.Unlock()
+
+	return c.Conn.Write(p)
+}
+
+func testTLSCertificate(t *testing.T) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Runs TLS 1.2 request/response exchange and returns captured traffic with key log.
+// TLS 1.3 is used for TLS 1.3 suite, test is skipped if other suite was negotiated.
+func recordTLSExchange(t *testing.T, suite uint16, request, response []byte) ([]tlsChunk, []byte) {
+	recorder := &tlsRecorder{}
+	keyLog := &bytes.Buffer{}
+
+	clientConn, serverConn := net.Pipe()
+
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{suite},
+		KeyLogWriter:       keyLog,
+	}
+	if _, ok := tls13CipherSuites[suite]; ok {
+		config.MinVersion, config.MaxVersion, config.CipherSuites = tls.VersionTLS13, tls.VersionTLS13, nil
+	}
+
+	server := tls.Server(&recordedConn{serverConn, false, recorder}, &tls.Config{
+		Certificates: []tls.Certificate{testTLSCertificate(t)},
+	})
+	client := tls.Client(&recordedConn{clientConn, true, recorder}, config)
+
+	done := make(chan bool)
+	go func() {
+		buf := make([]byte, len(request))
+		io.ReadFull(server, buf)
+		server.Write(response)
+		close(done)
+	}()
+
+	client.Write(request)
+	buf := make([]byte, len(response))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if negotiated := client.ConnectionState().CipherSuite; negotiated != suite {
+		t.Skip("Cipher suite can't be forced:", tls.CipherSuiteName(negotiated))
+	}
+
+	// Closing TLS connection blocks on close_notify, which nobody reads
+	clientConn.Close()
+	serverConn.Close()
+
+	return recorder.chunks, keyLog.Bytes()
+}
+
+// Assigns sequence numbers to captured chunks
+func tlsPackets(chunks []tlsChunk) (packets []*TCPPacket) {
+	var clientSeq, serverSeq uint32 = 1000, 5000
+
+	for _, c := range chunks {
+		if c.isIncoming {
+			packets = append(packets, buildPacket(true, serverSeq, clientSeq, c.data, time.Now()))
+			clientSeq += uint32(len(c.data))
+		} else {
+			packets = append(packets, buildPacket(false, clientSeq, serverSeq, c.data, time.Now()))
+			serverSeq += uint32(len(c.data))
+		}
+	}
+
+	return
+}
+
+// Collects decrypted data of both directions, checking that responses acknowledge requests
+func decryptTLSPackets(t *testing.T, decryptor *TLSDecryptor, packets []*TCPPacket) (request, response []byte) {
+	var lastPacket *TCPPacket
+
+	for _, packet := range packets {
+		for _, p := range decryptor.Decrypt(packet) {
+			if p.SrcPort == 1 {
+				request = append(request, p.Data...)
+			} else {
+				response = append(response, p.Data...)
+
+				if lastPacket == nil || p.Ack != lastPacket.Seq+uint32(len(lastPacket.Data)) {
+					t.Error("Response should acknowledge decrypted request", p.Ack)
+				}
+			}
+			lastPacket = p
+		}
+	}
+
+	return
+}
+
+func writeTLSKeyLog(t *testing.T, keys []byte) string {
+	keyLogFile, err := ioutil.TempFile("", "keylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyLogFile.Write(keys)
+	keyLogFile.Close()
+
+	return keyLogFile.Name()
+}
+
+func TestTLSDecrypt(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.org\r\n\r\n")
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+
+	for _, suite := range []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384} {
+		chunks, keys := recordTLSExchange(t, suite, request, response)
+
+		keyLogPath := writeTLSKeyLog(t, keys)
+		defer os.Remove(keyLogPath)
+
+		decryptor := NewTLSDecryptor(keyLogPath, 0)
+		defer decryptor.Close()
+
+		packets := tlsPackets(chunks)
+
+		// Retransmissions should be ignored
+		for _, packet := range packets {
+			decryptor.Decrypt(packet)
+			if len(decryptor.Decrypt(packet)) != 0 {
+				t.Error("Retransmitted packet should be dropped")
+			}
+		}
+
+		decryptor = NewTLSDecryptor(keyLogPath, 0)
+		defer decryptor.Close()
+
+		decryptedRequest, decryptedResponse := decryptTLSPackets(t, decryptor, packets)
+
+		if !bytes.Equal(decryptedRequest, request) {
+			t.Errorf("Wrong request: %q", decryptedRequest)
+		}
+
+		if !bytes.Equal(decryptedResponse, response) {
+			t.Errorf("Wrong response: %q", decryptedResponse)
+		}
+	}
+}
+
+func TestTLSDecryptTLS13(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.org\r\n\r\n")
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+
+	chunks, keys := recordTLSExchange(t, tls.TLS_AES_128_GCM_SHA256, request, response)
+
+	keyLogPath := writeTLSKeyLog(t, keys)
+	defer os.Remove(keyLogPath)
+
+	decryptor := NewTLSDecryptor(keyLogPath, 0)
+	defer decryptor.Close()
+
+	decryptedRequest, decryptedResponse := decryptTLSPackets(t, decryptor, tlsPackets(chunks))
+
+	if !bytes.Equal(decryptedRequest, request) {
+		t.Errorf("Wrong request: %q", decryptedRequest)
+	}
+
+	if !bytes.Equal(decryptedResponse, response) {
+		t.Errorf("Wrong response: %q", decryptedResponse)
+	}
+}
+
+func TestHKDFExpandLabel(t *testing.T) {
+	// RFC 8448 section 3, server handshake traffic key
+	secret, _ := hex.DecodeString("b67b7d690cc16c4e75e54213cb2d37b4e9c912bcded9105d42befd59d391ad38")
+	key := hkdfExpandLabel(sha256.New, secret, "key", 16)
+
+	if hex.EncodeToString(key) != "3fce516009c21727d0f2e4e86ee403bc" {
+		t.Errorf("Wrong key: %x", key)
+	}
+}
+
+func TestTLSDecryptOutOfOrder(t *testing.T) {
+	request := []byte("POST / HTTP/1.1\r\nHost: example.org\r\nContent-Length: 3\r\n\r\nabc")
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+
+	chunks, keys := recordTLSExchange(t, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, request, response)
+
+	keyLogPath := writeTLSKeyLog(t, keys)
+	defer os.Remove(keyLogPath)
+
+	decryptor := NewTLSDecryptor(keyLogPath, 0)
+	defer decryptor.Close()
+
+	var packets []*TCPPacket
+	for _, p := range tlsPackets(chunks) {
+		// Split encrypted request in 3 segments, and deliver them in reverse order
+		if p.SrcPort == 1 && p.Data[0] == tlsRecordApplicationData {
+			third := len(p.Data) / 3
+			packets = append(packets,
+				buildPacket(true, p.Ack, p.Seq+uint32(2*third), p.Data[2*third:], time.Now()),
+				buildPacket(true, p.Ack, p.Seq+uint32(third), p.Data[third:2*third], time.Now()),
+				buildPacket(true, p.Ack, p.Seq, p.Data[:third], time.Now()),
+			)
+			continue
+		}
+		packets = append(packets, p)
+	}
+
+	decryptedRequest, decryptedResponse := decryptTLSPackets(t, decryptor, packets)
+
+	if !bytes.Equal(decryptedRequest, request) {
+		t.Errorf("Wrong request: %q", decryptedRequest)
+	}
+
+	if !bytes.Equal(decryptedResponse, response) {
+		t.Errorf("Wrong response: %q", decryptedResponse)
+	}
+}
+
+func TestTLSDecryptSamePortDifferentClients(t *testing.T) {
+	requests := [][]byte{[]byte("GET /first HTTP/1.1\r\n\r\n"), []byte("GET /second HTTP/1.1\r\n\r\n")}
+	response := []byte("HTTP/1.1 204 No Content\r\n\r\n")
+
+	var keys []byte
+	var connections [][]*TCPPacket
+
+	for i, request := range requests {
+		chunks, connKeys := recordTLSExchange(t, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, request, response)
+		keys = append(keys, connKeys...)
+
+		clientAddr := []byte{10, 0, 0, byte(i + 1)}
+		serverAddr := []byte{10, 0, 0, 100}
+
+		packets := tlsPackets(chunks)
+		for _, p := range packets {
+			if p.SrcPort == 1 {
+				p.Addr, p.DstAddr = clientAddr, serverAddr
+			} else {
+				p.Addr, p.DstAddr = serverAddr, clientAddr
+			}
+		}
+		connections = append(connections, packets)
+	}
+
+	keyLogPath := writeTLSKeyLog(t, keys)
+	defer os.Remove(keyLogPath)
+
+	decryptor := NewTLSDecryptor(keyLogPath, 0)
+	defer decryptor.Close()
+
+	// Both connections use same client port and sequence numbers, and their packets are interleaved
+	decrypted := make(map[byte][]byte)
+	for i := 0; i < len(connections[0]) || i < len(connections[1]); i++ {
+		for _, packets := range connections {
+			if i >= len(packets) {
+				continue
+			}
+
+			for _, p := range decryptor.Decrypt(packets[i]) {
+				if p.SrcPort == 1 {
+					decrypted[p.Addr[3]] = append(decrypted[p.Addr[3]], p.Data...)
+				}
+			}
+		}
+	}
+
+	for i, request := range requests {
+		if !bytes.Equal(decrypted[byte(i+1)], request) {
+			t.Errorf("Wrong request of client %d: %q", i+1, decrypted[byte(i+1)])
+		}
+	}
+}
+
+func TestTLSDecryptKeyLoggedLater(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.org\r\n\r\n")
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+
+	chunks, keys := recordTLSExchange(t, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, request, response)
+
+	keyLogPath := writeTLSKeyLog(t, nil)
+	defer os.Remove(keyLogPath)
+
+	decryptor := NewTLSDecryptor(keyLogPath, 0)
+	defer decryptor.Close()
+
+	packets := tlsPackets(chunks)
+	last := packets[len(packets)-1]
+
+	// Secret is not known yet, so encrypted data should wait for it
+	for _, p := range packets[:len(packets)-1] {
+		if len(decryptor.Decrypt(p)) != 0 {
+			t.Fatal("Nothing can be decrypted without secret")
+		}
+	}
+
+	ioutil.WriteFile(keyLogPath, keys, 0600)
+
+	for i := 0; decryptor.keyLog.masterSecret(decryptor.sessions[newTCPConnKey(last, false)].clientRandom) == nil; i++ {
+		if i == 100 {
+			t.Fatal("Key log should be reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	decryptedRequest, decryptedResponse := decryptTLSPackets(t, decryptor, []*TCPPacket{last})
+
+	if !bytes.Equal(decryptedRequest, request) {
+		t.Errorf("Wrong request: %q", decryptedRequest)
+	}
+
+	if !bytes.Equal(decryptedResponse, response) {
+		t.Errorf("Wrong response: %q", decryptedResponse)
+	}
+}
+
+func TestTLSDecryptUnknownTraffic(t *testing.T) {
+	decryptor := NewTLSDecryptor("/not/exists", 0)
+	defer decryptor.Close()
+
+	packet := buildPacket(true, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n"), time.Now())
+	if packets := decryptor.Decrypt(packet); len(packets) != 1 || packets[0] != packet {
+		t.Error("Plain traffic should pass as is")
+	}
+}
+
+func TestTLSPRF(t *testing.T) {
+	// Commonly used TLS 1.2 PRF (SHA-256) test vector
+	secret := []byte{0x9b, 0xbe, 0x43, 0x6b, 0xa9, 0x40, 0xf0, 0x17, 0xb1, 0x76, 0x52, 0x84, 0x9a, 0x71, 0xdb, 0x35}
+	seed := []byte{0xa0, 0xba, 0x9f, 0x93, 0x6c, 0xda, 0x31, 0x18, 0x27, 0xa6, 0xf7, 0x96, 0xff, 0xd5, 0x19, 0x8c}
+	expected := []byte{0xe3, 0xf2, 0x29, 0xba, 0x72, 0x7b, 0xe1, 0x7b, 0x8d, 0x12, 0x26, 0x20, 0x55, 0x7c, 0xd4, 0x53}
+
+	out := tlsPRF(sha256.New, secret, []byte("test label"), seed, 100)
+
+	if len(out) != 100 || !bytes.Equal(out[:16], expected) {
+		t.Errorf("Wrong PRF output: %x", out[:16])
+	}
+}
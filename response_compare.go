@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Requests which got response only from one target are forgotten after this limit
+const compareMaxPending = 10000
+
+// Length of body fragments around first difference, included into the report
+const compareDiffContext = 64
+
+// responseComparator pairs responses of the same request from two HTTP outputs by request ID,
+// and writes report of each pair which differs by status, length or body, one JSON object per line.
+type responseComparator struct {
+	mu      sync.Mutex
+	out     io.Writer
+	targets []string
+	// Request ID -> response of one of targets
+	pending map[string]*comparedResponse
+}
+
+type comparedResponse struct {
+	target int
+	status string
+	body   []byte
+}
+
+type compareSide struct {
+	Target string `json:"target"`
+	Status string `json:"status"`
+	Length int    `json:"length"`
+	Body   string `json:"body,omitempty"`
+}
+
+type compareRecord struct {
+	UUID       string      `json:"uuid"`
+	Request    string      `json:"request"`
+	Mismatch   []string    `json:"mismatch"`
+	DiffOffset int         `json:"diff_offset,omitempty"`
+	A          compareSide `json:"a"`
+	B          compareSide `json:"b"`
+}
+
+// newResponseComparator writes report to file at path, or to stdout if path is `stdout`
+func newResponseComparator(path string) (*responseComparator, error) {
+	out := io.Writer(os.Stdout)
+
+	if path != "stdout" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+
+	return &responseComparator{out: out, pending: make(map[string]*comparedResponse)}, nil
+}
+
+// register adds target, and returns its index
+func (c *responseComparator) register(target string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.targets) == 2 {
+		return 0, errors.New("exactly 2 HTTP outputs are compared")
+	}
+	c.targets = append(c.targets, target)
+
+	return len(c.targets) - 1, nil
+}
+
+// Add takes response of target to request, and reports difference once both responses are received
+func (c *responseComparator) Add(target int, id []byte, request, response []byte) {
+	resp := &comparedResponse{target: target, status: string(proto.Status(response)), body: proto.Body(response)}
+
+	c.mu.Lock()
+	other, ok := c.pending[string(id)]
+	if !ok {
+		if len(c.pending) >= compareMaxPending {
+			c.pending = make(map[string]*comparedResponse)
+		}
+		// Response buffer is reused by client, so body is copied
+		resp.body = append([]byte(nil), resp.body...)
+		c.pending[string(id)] = resp
+		c.mu.Unlock()
+		return
+	}
+	delete(c.pending, string(id))
+	c.mu.Unlock()
+
+	a, b := other, resp
+	if a.target > b.target {
+		a, b = b, a
+	}
+
+	record := compareRecord{
+		UUID:    string(id),
+		Request: string(proto.Method(request)) + " " + string(proto.Path(request)),
+		A:       compareSide{Target: c.targets[a.target], Status: a.status, Length: len(a.body)},
+		B:       compareSide{Target: c.targets[b.target], Status: b.status, Length: len(b.body)},
+	}
+
+	if a.status != b.status {
+		record.Mismatch = append(record.Mismatch, "status")
+	}
+	if len(a.body) != len(b.body) {
+		record.Mismatch = append(record.Mismatch, "length")
+	}
+	if !bytes.Equal(a.body, b.body) {
+		record.Mismatch = append(record.Mismatch, "body")
+
+		offset := 0
+		for offset < len(a.body) && offset < len(b.body) && a.body[offset] == b.body[offset] {
+			offset++
+		}
+		record.DiffOffset = offset
+		record.A.Body = diffFragment(a.body, offset)
+		record.B.Body = diffFragment(b.body, offset)
+	}
+
+	if len(record.Mismatch) == 0 {
+		return
+	}
+
+	Debug("[COMPARE] Responses differ:", record.UUID, record.Mismatch)
+
+	line, _ := json.Marshal(&record)
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.out.Write(line); err != nil {
+		log.Println("output-http-compare: " + err.Error())
+	}
+}
+
+// diffFragment returns part of body starting a bit before offset
+func diffFragment(body []byte, offset int) string {
+	start := offset - compareDiffContext/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + compareDiffContext
+	if end > len(body) {
+		end = len(body)
+	}
+	if start >= end {
+		return ""
+	}
+
+	return string(body[start:end])
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseComparator(t *testing.T) {
+	var out bytes.Buffer
+	c := &responseComparator{out: &out, pending: make(map[string]*comparedResponse)}
+	c.register("http://a")
+	c.register("http://b")
+
+	if _, err := c.register("http://c"); err == nil {
+		t.Error("Only 2 targets should be compared")
+	}
+
+	req := []byte("GET /users HTTP/1.1\r\n\r\n")
+
+	c.Add(0, []byte("1"), req, []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	c.Add(1, []byte("1"), req, []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	if out.Len() != 0 {
+		t.Error("Equal responses should not be reported:", out.String())
+	}
+
+	c.Add(1, []byte("2"), req, []byte("HTTP/1.1 500 Internal Server Error\r\n\r\n{\"error\":1}"))
+	c.Add(0, []byte("2"), req, []byte("HTTP/1.1 200 OK\r\n\r\n{\"id\":1}"))
+
+	var record compareRecord
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if record.UUID != "2" || record.Request != "GET /users" || len(record.Mismatch) != 3 || record.DiffOffset != 2 {
+		t.Errorf("Wrong record: %+v", record)
+	}
+	if record.A.Target != "http://a" || record.A.Status != "200" || record.A.Body != `{"id":1}` || record.B.Status != "500" || record.B.Length != 11 {
+		t.Errorf("Wrong responses: %+v %+v", record.A, record.B)
+	}
+}
+
+func TestHTTPOutputCompare(t *testing.T) {
+	handler := func(status int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+	}
+	a := httptest.NewServer(handler(200))
+	defer a.Close()
+	b := httptest.NewServer(handler(404))
+	defer b.Close()
+
+	var out bytes.Buffer
+	c := &responseComparator{out: &out, pending: make(map[string]*comparedResponse)}
+	config := &HTTPOutputConfig{workersMin: 1, workersMax: 1, comparator: c}
+
+	outputA := NewHTTPOutput(a.URL, config)
+	outputB := NewHTTPOutput(b.URL, config)
+
+	payload := []byte("1 abc 1\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	outputA.Write(payload)
+	outputB.Write(payload)
+
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		report := out.String()
+		c.mu.Unlock()
+
+		if report != "" {
+			var record compareRecord
+			json.Unmarshal([]byte(report), &record)
+			if record.UUID != "abc" || record.A.Status != "200" || record.B.Status != "404" {
+				t.Errorf("Wrong report: %s", report)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Error("Responses should be compared")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// Requests which responses were not seen are forgotten after this limit
+const maxPendingStatusRequests = 10000
+
+// HTTPStatusRegexp holds regexps of --http-allow-response-status and --http-disallow-response-status
+type HTTPStatusRegexp []*regexp.Regexp
+
+func (r *HTTPStatusRegexp) String() string {
+	return fmt.Sprint(*r)
+}
+
+func (r *HTTPStatusRegexp) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+
+	*r = append(*r, re)
+
+	return nil
+}
+
+// responseStatusFilter holds requests until their original responses arrive, so request and response
+// are forwarded or dropped together, depending on response status.
+type responseStatusFilter struct {
+	allow    HTTPStatusRegexp
+	disallow HTTPStatusRegexp
+
+	// Request ID -> request waiting for its response
+	pending map[string]pendingRequest
+}
+
+type pendingRequest struct {
+	payload []byte
+	seen    time.Time
+}
+
+// newResponseStatusFilter returns nil if there are no filters
+func newResponseStatusFilter(allow, disallow HTTPStatusRegexp) *responseStatusFilter {
+	if len(allow) == 0 && len(disallow) == 0 {
+		return nil
+	}
+
+	return &responseStatusFilter{allow: allow, disallow: disallow, pending: make(map[string]pendingRequest)}
+}
+
+// Hold keeps copy of request until its response
+func (f *responseStatusFilter) Hold(id string, payload []byte, now time.Time) {
+	if len(f.pending) >= maxPendingStatusRequests {
+		Debug("[EMITTER] Too many requests wait for responses, forgetting them")
+		f.pending = make(map[string]pendingRequest)
+	}
+
+	f.pending[id] = pendingRequest{append([]byte(nil), payload...), now}
+}
+
+// Release returns held request if status of its response passes filters. Otherwise request is nil,
+// and reason is name of the option which dropped it, or empty if request was not seen.
+func (f *responseStatusFilter) Release(id string, response []byte) (request []byte, reason string) {
+	held, ok := f.pending[id]
+	if !ok {
+		return nil, ""
+	}
+	delete(f.pending, id)
+
+	status := proto.Status(payloadBody(response))
+
+	if len(f.allow) > 0 {
+		matched := false
+		for _, re := range f.allow {
+			if re.Match(status) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return nil, "http-allow-response-status"
+		}
+	}
+
+	for _, re := range f.disallow {
+		if re.Match(status) {
+			return nil, "http-disallow-response-status"
+		}
+	}
+
+	return held.payload, ""
+}
+
+// Expire forgets requests held longer than ttl
+func (f *responseStatusFilter) Expire(now time.Time, ttl time.Duration) {
+	for id, held := range f.pending {
+		if now.Sub(held.seen) > ttl {
+			delete(f.pending, id)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyRingBufferDump dumps ring buffers when gor receives SIGUSR1: kill -USR1 <pid>
+func notifyRingBufferDump() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+
+	go func() {
+		for range c {
+			dumpRingBuffers()
+		}
+	}()
+}
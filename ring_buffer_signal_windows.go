@@ -0,0 +1,4 @@
+package main
+
+// There is no SIGUSR1 on Windows, ring buffers can be dumped only using status server API
+func notifyRingBufferDump() {}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+)
+
+// SocketOptions holds TCP tunables for connections to replay targets
+type SocketOptions struct {
+	// Disable Nagle's algorithm, so small writes are sent immediately
+	NoDelay bool
+	// SO_SNDBUF and SO_RCVBUF, 0 keeps system defaults
+	SendBuffer int
+	RecvBuffer int
+}
+
+// apply sets options on dialed connection. Must be called before wrapping connection in TLS.
+func (o *SocketOptions) apply(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tcpConn.SetNoDelay(o.NoDelay); err != nil {
+		return err
+	}
+
+	if o.SendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(o.SendBuffer); err != nil {
+			return err
+		}
+	}
+
+	if o.RecvBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(o.RecvBuffer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
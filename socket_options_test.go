@@ -0,0 +1,50 @@
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSocketOptions(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	options := &SocketOptions{NoDelay: false, SendBuffer: 64 * 1024, RecvBuffer: 128 * 1024}
+	if err := options.apply(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := conn.(*net.TCPConn).SyscallConn()
+	raw.Control(func(fd uintptr) {
+		if v, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+			t.Error("TCP_NODELAY should be disabled")
+		}
+
+		// Linux doubles requested value
+		if v, _ := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF); v < 64*1024 {
+			t.Error("Wrong send buffer:", v)
+		}
+
+		if v, _ := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); v < 128*1024 {
+			t.Error("Wrong receive buffer:", v)
+		}
+	})
+
+	options.NoDelay = true
+	options.apply(conn)
+
+	raw.Control(func(fd uintptr) {
+		if v, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v == 0 {
+			t.Error("TCP_NODELAY should be enabled")
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoMethod = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+var socks5Errors = []string{
+	"",
+	"general failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func isSOCKS5(proxy *url.URL) bool {
+	return proxy.Scheme == "socks5" || proxy.Scheme == "socks5h"
+}
+
+// socks5Connect asks SOCKS5 proxy, connected with `conn`, to open connection to `addr`.
+// Username and password authentication is used if `user` is set.
+func socks5Connect(conn net.Conn, addr string, user *url.Userinfo) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return errors.New("socks5: wrong port " + portStr)
+	}
+
+	greeting := []byte{socks5Version, 1, socks5AuthNone}
+	if user != nil {
+		greeting = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err = conn.Write(greeting); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected protocol version %d", buf[0])
+	}
+
+	switch buf[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if user == nil {
+			return errors.New("socks5: proxy requires authentication")
+		}
+		if err = socks5Authenticate(conn, user); err != nil {
+			return err
+		}
+	case socks5AuthNoMethod:
+		return errors.New("socks5: no acceptable authentication methods")
+	default:
+		return fmt.Errorf("socks5: unsupported authentication method %d", buf[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long")
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	// Version, reply, reserved and type of bound address
+	buf = make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected protocol version %d", buf[0])
+	}
+	if buf[1] != 0 {
+		if int(buf[1]) < len(socks5Errors) {
+			return errors.New("socks5: " + socks5Errors[buf[1]])
+		}
+		return fmt.Errorf("socks5: unknown error %d", buf[1])
+	}
+
+	// Bound address is not used, but should be read before data
+	var size int
+	switch buf[3] {
+	case socks5AddrIPv4:
+		size = net.IPv4len
+	case socks5AddrIPv6:
+		size = net.IPv6len
+	case socks5AddrDomain:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		size = int(buf[0])
+	default:
+		return fmt.Errorf("socks5: unknown address type %d", buf[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
+
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+
+	req := []byte{1, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return errors.New("socks5: authentication failed")
+	}
+
+	return nil
+}
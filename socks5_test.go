@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// startSOCKS5 starts SOCKS5 proxy accepting only given credentials, connection target is sent to `targets`
+func startSOCKS5(t *testing.T, username, password string, targets chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, username, password, targets)
+		}
+	}()
+
+	return ln
+}
+
+func serveSOCKS5(conn net.Conn, username, password string, targets chan<- string) {
+	defer conn.Close()
+
+	buf := make([]byte, 256)
+	io.ReadFull(conn, buf[:2])
+	methods := make([]byte, buf[1])
+	io.ReadFull(conn, methods)
+	if !bytes.Contains(methods, []byte{socks5AuthPassword}) {
+		conn.Write([]byte{socks5Version, socks5AuthNoMethod})
+		return
+	}
+	conn.Write([]byte{socks5Version, socks5AuthPassword})
+
+	io.ReadFull(conn, buf[:2])
+	user := make([]byte, buf[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, buf[:1])
+	pass := make([]byte, buf[0])
+	io.ReadFull(conn, pass)
+	if string(user) != username || string(pass) != password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	io.ReadFull(conn, buf[:5])
+	host := make([]byte, buf[4])
+	io.ReadFull(conn, host)
+	io.ReadFull(conn, buf[:2])
+	addr := net.JoinHostPort(string(host), strconv.Itoa(int(buf[0])<<8|int(buf[1])))
+	targets <- addr
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{socks5Version, 5, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func TestHTTPClientSOCKS5(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	targets := make(chan string, 10)
+	proxy := startSOCKS5(t, "user", "secret", targets)
+	defer proxy.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	target := "http://localhost:" + port
+
+	client := NewHTTPClient(target, &HTTPClientConfig{})
+	client.proxy = &url.URL{Scheme: "socks5", Host: proxy.Addr().String(), User: url.UserPassword("user", "secret")}
+
+	resp, err := client.Send([]byte("GET /socks HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(resp, []byte("\r\n\r\n/socks")) {
+		t.Errorf("Request should be sent as is through the tunnel: %q", resp)
+	}
+	if addr := <-targets; addr != "localhost:"+port {
+		t.Errorf("Proxy should connect to target host, got %s", addr)
+	}
+
+	client = NewHTTPClient(target, &HTTPClientConfig{})
+	client.proxy = &url.URL{Scheme: "socks5", Host: proxy.Addr().String(), User: url.UserPassword("user", "wrong")}
+
+	resp, _ = client.Send([]byte("GET /socks HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if !bytes.Equal(resp, errorPayload(HTTP_CONNECTION_ERROR)) {
+		t.Errorf("Should fail with connection error: %q", resp)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+const (
+	otlpBatchSize     = 512
+	otlpFlushInterval = time.Second
+
+	// https://opentelemetry.io/docs/specs/otel/trace/api/#spankind
+	otlpSpanKindClient = 3
+	// https://opentelemetry.io/docs/specs/otel/trace/api/#set-status
+	otlpStatusError = 2
+)
+
+// traceSpan holds data of single replayed request
+type traceSpan struct {
+	traceID  []byte
+	spanID   []byte
+	parentID []byte
+	start    time.Time
+	method   string
+	url      string
+}
+
+// traceparent returns value of W3C Trace Context header
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func (s *traceSpan) traceparent() []byte {
+	return []byte("00-" + hex.EncodeToString(s.traceID) + "-" + hex.EncodeToString(s.spanID) + "-01")
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int64) otlpAttribute {
+	v := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &v}}
+}
+
+// OTLPTracer creates OpenTelemetry spans for replayed requests, and exports them
+// to the collector using OTLP/HTTP protocol with JSON encoding.
+type OTLPTracer struct {
+	endpoint    string
+	serviceName string
+	target      string
+
+	spans  chan otlpSpan
+	client *http.Client
+}
+
+// NewOTLPTracer constructor for OTLPTracer. If endpoint has no path, default `/v1/traces` is used.
+func NewOTLPTracer(endpoint, serviceName, target string) *OTLPTracer {
+	if u, err := url.Parse(endpoint); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = "/v1/traces"
+		endpoint = u.String()
+	}
+
+	t := &OTLPTracer{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		target:      target,
+		spans:       make(chan otlpSpan, 10000),
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}
+
+	go t.export()
+
+	return t
+}
+
+func randomID(size int) []byte {
+	id := make([]byte, size)
+	rand.Read(id)
+	return id
+}
+
+// parseTraceparent extracts trace and span ids from W3C traceparent header
+func parseTraceparent(value []byte) (traceID, spanID []byte, ok bool) {
+	parts := bytes.Split(value, []byte("-"))
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil, nil, false
+	}
+
+	traceID = make([]byte, 16)
+	spanID = make([]byte, 8)
+
+	if _, err := hex.Decode(traceID, parts[1]); err != nil {
+		return nil, nil, false
+	}
+	if _, err := hex.Decode(spanID, parts[2]); err != nil {
+		return nil, nil, false
+	}
+
+	return traceID, spanID, true
+}
+
+// StartSpan creates span for the request, and injects `traceparent` header into it.
+// If request already has `traceparent`, replayed request becomes child of the original span.
+func (t *OTLPTracer) StartSpan(payload []byte) (*traceSpan, []byte) {
+	span := &traceSpan{
+		spanID: randomID(8),
+		start:  time.Now(),
+		method: string(proto.Method(payload)),
+		url:    t.target + string(proto.Path(payload)),
+	}
+
+	if traceID, parentID, ok := parseTraceparent(proto.Header(payload, []byte("traceparent"))); ok {
+		span.traceID = traceID
+		span.parentID = parentID
+	} else {
+		span.traceID = randomID(16)
+	}
+
+	return span, proto.SetHeader(payload, []byte("traceparent"), span.traceparent())
+}
+
+// EndSpan records response status and latency, and queues span for export
+func (t *OTLPTracer) EndSpan(span *traceSpan, resp []byte, err error) {
+	end := time.Now()
+
+	s := otlpSpan{
+		TraceID:           hex.EncodeToString(span.traceID),
+		SpanID:            hex.EncodeToString(span.spanID),
+		Name:              "HTTP " + span.method,
+		Kind:              otlpSpanKindClient,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			otlpString("http.method", span.method),
+			otlpString("http.url", span.url),
+			otlpInt("gor.latency_ms", int64(end.Sub(span.start)/time.Millisecond)),
+		},
+	}
+
+	if span.parentID != nil {
+		s.ParentSpanID = hex.EncodeToString(span.parentID)
+	}
+
+	status, _ := strconv.Atoi(string(proto.Status(resp)))
+	if status > 0 {
+		s.Attributes = append(s.Attributes, otlpInt("http.status_code", int64(status)))
+	}
+
+	if err != nil {
+		s.Status = otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	} else if status >= 500 {
+		s.Status = otlpStatus{Code: otlpStatusError}
+	}
+
+	select {
+	case t.spans <- s:
+	default:
+		Debug("[OTLP] Queue is full, dropping span")
+	}
+}
+
+func (t *OTLPTracer) export() {
+	var batch []otlpSpan
+	ticker := time.NewTicker(otlpFlushInterval)
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		t.send(batch)
+		batch = nil
+	}
+}
+
+func (t *OTLPTracer) send(spans []otlpSpan) {
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{otlpString("service.name", t.serviceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "goreplay", "version": VERSION},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		log.Println("[OTLP] Can't encode spans:", err)
+		return
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		Debug("[OTLP] Export error:", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		Debug("[OTLP] Export error, collector responded with:", resp.Status)
+	}
+}
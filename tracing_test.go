@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestOTLPTracer(t *testing.T) {
+	exported := make(chan map[string]interface{}, 1)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Error("Wrong path:", r.URL.Path)
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		var data map[string]interface{}
+		if err := json.Unmarshal(body, &data); err != nil {
+			t.Error(err)
+		}
+		exported <- data
+	}))
+	defer collector.Close()
+
+	tracer := NewOTLPTracer(collector.URL, "gor-test", "http://staging.com")
+
+	payload := []byte("GET /path HTTP/1.1\r\ntraceparent: 00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01\r\n\r\n")
+	span, payload := tracer.StartSpan(payload)
+
+	traceparent := string(proto.Header(payload, []byte("traceparent")))
+	if !strings.HasPrefix(traceparent, "00-0af7651916cd43dd8448eb211c80319c-") || strings.Contains(traceparent, "b7ad6b7169203331") {
+		t.Error("Should continue original trace with new span:", traceparent)
+	}
+
+	tracer.EndSpan(span, []byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"), nil)
+
+	var data map[string]interface{}
+	select {
+	case data = <-exported:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Spans should be exported")
+	}
+
+	spans := data["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	s := spans[0].(map[string]interface{})
+
+	if s["parentSpanId"] != "b7ad6b7169203331" || s["traceId"] != "0af7651916cd43dd8448eb211c80319c" {
+		t.Error("Wrong span ids:", s)
+	}
+
+	if s["name"] != "HTTP GET" || s["status"].(map[string]interface{})["code"] != float64(otlpStatusError) {
+		t.Error("Wrong span:", s)
+	}
+
+	attrs := map[string]interface{}{}
+	for _, a := range s["attributes"].([]interface{}) {
+		attr := a.(map[string]interface{})
+		for _, v := range attr["value"].(map[string]interface{}) {
+			attrs[attr["key"].(string)] = v
+		}
+	}
+
+	if attrs["http.url"] != "http://staging.com/path" || attrs["http.status_code"] != "503" || attrs["http.method"] != "GET" {
+		t.Error("Wrong attributes:", attrs)
+	}
+}